@@ -0,0 +1,158 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+const (
+	backupPrefix = "meta/dump-"
+	backupSuffix = ".json.gz"
+	backupTime   = "2006-01-02-150405"
+)
+
+// backupMeta dumps the metadata into the object storage periodically. All the
+// sessions check it regularly, but only the one claimed the job will do it.
+func backupMeta(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
+	if interval < time.Minute*5 {
+		logger.Warnf("backup interval %s is too short, use 5m instead", interval)
+		interval = time.Minute * 5
+	}
+	for {
+		time.Sleep(interval/10 + time.Duration(rand.Int63n(int64(interval/10))))
+		ok, err := m.ClaimJob("BackupMeta", interval)
+		if err != nil {
+			logger.Warnf("claim the job to backup metadata: %s", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		if err = backup(m, blob, now); err != nil {
+			logger.Errorf("backup metadata: %s", err)
+		} else {
+			logger.Infof("backup metadata into %s%s succeed, used %s", blob, backupKey(now), time.Since(now))
+		}
+		cleanupBackups(blob, now)
+	}
+}
+
+func backupKey(t time.Time) string {
+	return backupPrefix + t.UTC().Format(backupTime) + backupSuffix
+}
+
+// backup writes a compressed dump into a temporary file first, so it can be uploaded in one piece.
+func backup(m meta.Meta, blob object.ObjectStorage, now time.Time) error {
+	fp, err := ioutil.TempFile("", "juicefs-meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	zw := gzip.NewWriter(fp)
+	if err = m.DumpMeta(zw); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return blob.Put(backupKey(now), fp)
+}
+
+func cleanupBackups(blob object.ObjectStorage, now time.Time) {
+	objs, err := blob.ListAll(backupPrefix, "")
+	if err != nil {
+		logger.Warnf("list backups: %s", err)
+		return
+	}
+	var keys []string
+	for o := range objs {
+		if o == nil {
+			logger.Warnf("list backups: failed")
+			return
+		}
+		keys = append(keys, o.Key)
+	}
+	for _, key := range expiredBackups(keys, now) {
+		if err := blob.Delete(key); err != nil {
+			logger.Warnf("delete backup %s: %s", key, err)
+		} else {
+			logger.Debugf("backup %s is deleted", key)
+		}
+	}
+}
+
+// expiredBackups returns the backups out of retention:
+// 1. all the backups within 2 days are kept
+// 2. one backup each day is kept within 2 weeks
+// 3. one backup each week is kept within 2 months
+// 4. one backup each month is kept within a year
+func expiredBackups(keys []string, now time.Time) []string {
+	backups := make(map[string]time.Time)
+	for _, key := range keys {
+		ts := strings.TrimSuffix(strings.TrimPrefix(key, backupPrefix), backupSuffix)
+		t, err := time.Parse(backupTime, ts)
+		if err != nil || !strings.HasPrefix(key, backupPrefix) {
+			continue
+		}
+		backups[key] = t
+	}
+	sort.Slice(keys, func(i, j int) bool { return backups[keys[i]].After(backups[keys[j]]) })
+
+	var expired []string
+	kept := make(map[string]bool)
+	day := time.Hour * 24
+	for _, key := range keys {
+		t, ok := backups[key]
+		if !ok {
+			continue
+		}
+		var bucket string
+		switch age := now.Sub(t); {
+		case age < day*2:
+			continue
+		case age < day*14:
+			bucket = t.Format("day 2006-01-02")
+		case age < day*60:
+			y, w := t.ISOWeek()
+			bucket = fmt.Sprintf("week %d-%d", y, w)
+		case age < day*365:
+			bucket = t.Format("month 2006-01")
+		}
+		if bucket == "" || kept[bucket] {
+			expired = append(expired, key)
+		} else {
+			kept[bucket] = true
+		}
+	}
+	return expired
+}
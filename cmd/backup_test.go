@@ -0,0 +1,86 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	var keys []string
+	for i := 0; i < 24*400; i++ {
+		keys = append(keys, backupKey(now.Add(-time.Hour*time.Duration(i))))
+	}
+	expired := make(map[string]bool)
+	for _, key := range expiredBackups(keys, now) {
+		expired[key] = true
+	}
+	var kept []string
+	for _, key := range keys {
+		if !expired[key] {
+			kept = append(kept, key)
+		}
+	}
+	sort.Strings(kept)
+	// 48 hourly, 12 daily, about 7 weekly and 10 monthly ones
+	if len(kept) < 70 || len(kept) > 80 {
+		t.Fatalf("kept %d backups: %v", len(kept), kept)
+	}
+	if kept[len(kept)-1] != backupKey(now) || expired[backupKey(now.Add(-time.Hour*47))] {
+		t.Fatalf("recent backups should be kept")
+	}
+	if !expired[keys[len(keys)-1]] {
+		t.Fatalf("backups older than a year should be expired")
+	}
+	if len(expiredBackups([]string{"meta/other", backupKey(now.Add(-time.Hour * 24 * 500))}, now)) != 1 {
+		t.Fatalf("unknown keys should be ignored")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", SecretKey: "secret"}, true); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	now := time.Now()
+	if err := backup(m, blob, now); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+	r, err := blob.Get(backupKey(now), 0, -1)
+	if err != nil {
+		t.Fatalf("get backup: %s", err)
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("open backup: %s", err)
+	}
+	m2 := meta.NewClient("memkv://", &meta.Config{})
+	if err = m2.LoadMeta(zr); err != nil {
+		t.Fatalf("load backup: %s", err)
+	}
+	if format, err := m2.Load(); err != nil || format.Name != "test" {
+		t.Fatalf("load format: %+v %s", format, err)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cloneFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "clone",
+		Usage:     "clone a file or directory without copying the data",
+		ArgsUsage: "SRC DST",
+		Action:    clone,
+	}
+}
+
+func clone(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("SRC and DST are needed")
+	}
+	src, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	dst, err := filepath.Abs(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(1), err)
+	}
+	srcIno, err := utils.GetFileInode(src)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", src, err)
+	}
+	d := filepath.Dir(dst)
+	name := filepath.Base(dst)
+	parent, err := utils.GetFileInode(d)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", d, err)
+	}
+	f := openControler(d)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", dst)
+	}
+	defer f.Close()
+	if sf := openControler(src); sf == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", src)
+	} else {
+		_ = sf.Close()
+		if sf.Name() != f.Name() {
+			return fmt.Errorf("%s and %s are not in the same volume", src, dst)
+		}
+	}
+
+	wb := utils.NewBuffer(8 + 8 + 8 + 1 + uint32(len(name)))
+	wb.Put32(meta.Clone)
+	wb.Put32(8 + 8 + 1 + uint32(len(name)))
+	wb.Put64(srcIno)
+	wb.Put64(parent)
+	wb.Put8(uint8(len(name)))
+	wb.Put([]byte(name))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	var errs = make([]byte, 1)
+	n, err := f.Read(errs)
+	if err != nil || n != 1 {
+		logger.Fatalf("read message: %d %s", n, err)
+	}
+	if errs[0] != 0 {
+		logger.Fatalf("clone %s to %s: %s", src, dst, syscall.Errno(errs[0]))
+	}
+	return nil
+}
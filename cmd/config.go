@@ -0,0 +1,184 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/compress"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/urfave/cli/v2"
+)
+
+func configFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "config",
+		Usage:     "show or change the setting of a volume",
+		ArgsUsage: "META-URL",
+		Action:    config,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "bucket",
+				Usage: "A bucket URL to store data",
+			},
+			&cli.StringFlag{
+				Name:  "access-key",
+				Usage: "Access key for object storage",
+			},
+			&cli.StringFlag{
+				Name:  "secret-key",
+				Usage: "Secret key for object storage",
+			},
+			&cli.Uint64Flag{
+				Name:  "capacity",
+				Usage: "the limit for space in GiB (0 means unlimited)",
+			},
+			&cli.Uint64Flag{
+				Name:  "inodes",
+				Usage: "the limit for number of inodes (0 means unlimited)",
+			},
+			&cli.IntFlag{
+				Name:  "trash-days",
+				Usage: "number of days after which removed files will be permanently deleted (0 means no trash)",
+			},
+			&cli.IntFlag{
+				Name:  "event-days",
+				Usage: "number of days to keep the changes in the change log for `juicefs watch` (0 means no change log)",
+			},
+			&cli.IntFlag{
+				Name:  "retention-days",
+				Usage: "number of days to retain the files written under the directories with a retention (0 means no default retention)",
+			},
+			&cli.StringFlag{
+				Name:  "compress",
+				Usage: "compression algorithm for new data (lz4, zstd, none), which can't be disabled once enabled",
+			},
+		},
+	}
+}
+
+func config(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	changed := *format
+	if ctx.IsSet("bucket") {
+		changed.Bucket = ctx.String("bucket")
+		if changed.Storage == "file" && !strings.HasSuffix(changed.Bucket, "/") {
+			changed.Bucket += "/"
+		}
+	}
+	if ctx.IsSet("access-key") {
+		changed.AccessKey = ctx.String("access-key")
+	}
+	if ctx.IsSet("secret-key") {
+		changed.SecretKey = ctx.String("secret-key")
+	}
+	if ctx.IsSet("capacity") {
+		changed.Capacity = ctx.Uint64("capacity") << 30
+	}
+	if ctx.IsSet("inodes") {
+		changed.Inodes = ctx.Uint64("inodes")
+	}
+	if ctx.IsSet("trash-days") {
+		changed.TrashDays = ctx.Int("trash-days")
+		if changed.TrashDays < 0 {
+			logger.Fatalf("invalid trash days: %d", changed.TrashDays)
+		}
+	}
+	if ctx.IsSet("event-days") {
+		changed.EventDays = ctx.Int("event-days")
+		if changed.EventDays < 0 {
+			logger.Fatalf("invalid event days: %d", changed.EventDays)
+		}
+	}
+	if ctx.IsSet("retention-days") {
+		changed.RetentionDays = ctx.Int("retention-days")
+		if changed.RetentionDays < 0 {
+			logger.Fatalf("invalid retention days: %d", changed.RetentionDays)
+		}
+	}
+	if ctx.IsSet("compress") {
+		changed.Compression = ctx.String("compress")
+		if compress.NewCompressor(changed.Compression) == nil {
+			logger.Fatalf("Unsupported compress algorithm: %s", changed.Compression)
+		}
+	}
+
+	if changed != *format {
+		blob, err := createStorage(&changed)
+		if err != nil {
+			logger.Fatalf("object storage: %s", err)
+		}
+		logger.Infof("Data uses %s", blob)
+		if err = test(blob); err != nil {
+			logger.Fatalf("Storage %s is not configured correctly: %s", blob, err)
+		}
+		if err = m.UpdateFormat(&changed); err != nil {
+			logger.Fatalf("update setting: %s", err)
+		}
+		logger.Infof("Setting is updated, the running clients will reload it in a minute")
+		format = &changed
+	}
+
+	if format.SecretKey != "" {
+		format.SecretKey = "removed"
+	}
+	if format.EncryptKey != "" {
+		format.EncryptKey = "removed"
+	}
+	data, err := json.MarshalIndent(format, "", "  ")
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// reloadSetting applies the changes made by `juicefs config` to a running client, the requests
+// to the object storage are switched to a new one once the bucket or the credentials are changed.
+func reloadSetting(m meta.Meta, format *meta.Format, blob *object.Switchable, store chunk.ChunkStore) {
+	current := *format
+	m.OnReload(func(new *meta.Format) {
+		if new.Bucket != current.Bucket || new.AccessKey != current.AccessKey || new.SecretKey != current.SecretKey {
+			s, err := createStorage(new)
+			if err != nil {
+				logger.Errorf("object storage: %s", err)
+				return
+			}
+			blob.Switch(s)
+			logger.Infof("Data use %s", s)
+		}
+		if new.Compression != current.Compression {
+			if err := store.SetCompression(new.Compression); err != nil {
+				logger.Errorf("change compression: %s", err)
+				return
+			}
+			logger.Infof("Compress new data with %s", new.Compression)
+		}
+		current = *new
+	})
+}
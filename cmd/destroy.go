@@ -0,0 +1,125 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/urfave/cli/v2"
+)
+
+func destroyFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "destroy",
+		Usage:     "destroy a volume, removing all its data and metadata",
+		ArgsUsage: "META-URL UUID",
+		Action:    destroy,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 50,
+				Usage: "number threads to delete objects",
+			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "destroy the volume even if some clients are still active",
+			},
+		},
+	}
+}
+
+func destroy(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and UUID are needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	// the UUID is asked to make sure the right volume is destroyed
+	if uuid := ctx.Args().Get(1); uuid != format.UUID {
+		logger.Fatalf("UUID of volume %s is %s, not %s", format.Name, format.UUID, uuid)
+	}
+	sessions, err := m.ListSessions()
+	if err != nil {
+		logger.Fatalf("list sessions: %s", err)
+	}
+	var active int
+	for _, s := range sessions {
+		if !s.Stale {
+			logger.Warnf("Session %d of %s (%s) is active, last heartbeat at %s", s.Sid, s.Hostname, s.MountPoint, s.Heartbeat)
+			active++
+		}
+	}
+	if active > 0 && !ctx.Bool("force") {
+		logger.Fatalf("%d clients are still using volume %s, umount them or use --force to destroy it anyway", active, format.Name)
+	}
+
+	blob, err := createStorage(format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	objs, err := osync.ListAll(blob, "", "")
+	if err != nil {
+		logger.Fatalf("list all objects: %s", err)
+	}
+	var deleted, failed int64
+	var keys = make(chan string, 10240)
+	var wg sync.WaitGroup
+	for i := 0; i < ctx.Int("threads"); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if err := blob.Delete(key); err != nil {
+					logger.Warnf("delete %s: %s", key, err)
+					atomic.AddInt64(&failed, 1)
+				} else {
+					atomic.AddInt64(&deleted, 1)
+				}
+			}
+		}()
+	}
+	var listed = true
+	for obj := range objs {
+		if obj == nil {
+			listed = false // failed listing
+			break
+		}
+		if !obj.IsDir {
+			keys <- obj.Key
+		}
+	}
+	close(keys)
+	wg.Wait()
+	logger.Infof("deleted %d objects", deleted)
+	if !listed || failed > 0 {
+		logger.Fatalf("some objects are not deleted, the metadata is kept to try again")
+	}
+
+	// only the metadata of this volume is removed, others sharing the same engine are kept
+	if err = m.Reset(); err != nil {
+		logger.Fatalf("remove metadata: %s", err)
+	}
+	logger.Infof("volume %s is destroyed", format.Name)
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func dumpFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "dump",
+		Usage:     "dump metadata into a JSON file",
+		ArgsUsage: "META-URL [FILE]",
+		Action:    dump,
+	}
+}
+
+func dump(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		logger.Fatalf("META-URL is needed")
+	}
+	var w io.WriteCloser = os.Stdout
+	if ctx.Args().Len() > 1 {
+		fp, err := os.OpenFile(ctx.Args().Get(1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		w = fp
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	if err := m.DumpMeta(w); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	logger.Infof("Dump metadata into %s succeed", w.(*os.File).Name())
+	return nil
+}
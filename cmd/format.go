@@ -135,18 +135,9 @@ func test(store object.ObjectStorage) error {
 func format(c *cli.Context) error {
 	setLoggerLevel(c)
 	if c.Args().Len() < 1 {
-		logger.Fatalf("Redis URL and name are required")
-	}
-	addr := c.Args().Get(0)
-	if !strings.Contains(addr, "://") {
-		addr = "redis://" + addr
-	}
-	logger.Infof("Meta address: %s", addr)
-	var rc = meta.RedisConfig{Retries: 2}
-	m, err := meta.NewRedisMeta(addr, &rc)
-	if err != nil {
-		logger.Fatalf("Meta is not available: %s", err)
+		logger.Fatalf("Meta URL and name are required")
 	}
+	m := meta.NewClient(c.Args().Get(0), &meta.Config{Retries: 2})
 
 	if c.Args().Len() < 2 {
 		logger.Fatalf("Please give it a name")
@@ -170,6 +161,28 @@ func format(c *cli.Context) error {
 		SecretKey:   c.String("secret-key"),
 		BlockSize:   fixObjectSize(c.Int("block-size")),
 		Compression: c.String("compress"),
+		Capacity:    c.Uint64("capacity") << 30,
+		Inodes:      c.Uint64("inodes"),
+		TrashDays:   c.Int("trash-days"),
+		EnableACL:   c.Bool("enable-acl"),
+	}
+	if old, err := m.Load(); err == nil {
+		// keep the limits and the trash of an existing volume if they are not specified
+		if !c.IsSet("capacity") {
+			format.Capacity = old.Capacity
+		}
+		if !c.IsSet("inodes") {
+			format.Inodes = old.Inodes
+		}
+		if !c.IsSet("trash-days") {
+			format.TrashDays = old.TrashDays
+		}
+		if !c.IsSet("enable-acl") {
+			format.EnableACL = old.EnableACL
+		}
+	}
+	if format.TrashDays < 0 {
+		logger.Fatalf("invalid trash days: %d", format.TrashDays)
 	}
 	if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 		format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -233,13 +246,29 @@ func formatFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "format",
 		Usage:     "format a volume",
-		ArgsUsage: "REDIS-URL NAME",
+		ArgsUsage: "META-URL NAME",
 		Flags: []cli.Flag{
 			&cli.IntFlag{
 				Name:  "block-size",
 				Value: 4096,
 				Usage: "size of block in KiB",
 			},
+			&cli.Uint64Flag{
+				Name:  "capacity",
+				Usage: "the limit for space in GiB (0 means unlimited)",
+			},
+			&cli.Uint64Flag{
+				Name:  "inodes",
+				Usage: "the limit for number of inodes (0 means unlimited)",
+			},
+			&cli.IntFlag{
+				Name:  "trash-days",
+				Usage: "number of days after which removed files will be permanently deleted (0 means no trash)",
+			},
+			&cli.BoolFlag{
+				Name:  "enable-acl",
+				Usage: "enable POSIX ACLs, which can't be disabled once enabled",
+			},
 			&cli.StringFlag{
 				Name:  "compress",
 				Value: "lz4",
@@ -31,27 +31,23 @@ func checkFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "fsck",
 		Usage:     "Check consistency of file system",
-		ArgsUsage: "REDIS-URL",
+		ArgsUsage: "META-URL",
 		Action:    fsck,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "fix the inconsistent metadata",
+			},
+		},
 	}
 }
 
 func fsck(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
 	if ctx.Args().Len() < 1 {
-		return fmt.Errorf("REDIS-URL is needed")
-	}
-	addr := ctx.Args().Get(0)
-	if !strings.Contains(addr, "://") {
-		addr = "redis://" + addr
-	}
-
-	logger.Infof("Meta address: %s", addr)
-	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(addr, &rc)
-	if err != nil {
-		logger.Fatalf("Meta: %s", err)
+		return fmt.Errorf("META-URL is needed")
 	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
@@ -76,6 +72,29 @@ func fsck(ctx *cli.Context) error {
 	}
 	logger.Infof("Data use %s", blob)
 
+	logger.Infof("Checking metadata ...")
+	var c = meta.NewContext(0, 0, []uint32{0})
+	broken, err := m.CheckMeta(c, ctx.Bool("repair"))
+	if err != nil {
+		logger.Fatalf("check metadata: %s", err)
+	}
+	if broken > 0 && ctx.Bool("repair") {
+		logger.Infof("%d problems of metadata are fixed", broken)
+	} else if broken > 0 {
+		logger.Warnf("Found %d problems of metadata, run with --repair to fix them", broken)
+	}
+
+	logger.Infof("Checking stats of directories ...")
+	broken, err = m.CheckDirStats(c, ctx.Bool("repair"))
+	if err != nil {
+		logger.Fatalf("check stats of directories: %s", err)
+	}
+	if broken > 0 && ctx.Bool("repair") {
+		logger.Infof("Stats of %d directories are fixed", broken)
+	} else if broken > 0 {
+		logger.Warnf("Stats of %d directories are inconsistent, run with --repair to fix them", broken)
+	}
+
 	logger.Infof("Listing all blocks ...")
 	blob = object.WithPrefix(blob, "chunks/")
 	objs, err := osync.ListAll(blob, "", "")
@@ -104,7 +123,6 @@ func fsck(ctx *cli.Context) error {
 	logger.Infof("Found %d blocks (%d bytes)", len(blocks), totalBlockBytes)
 
 	logger.Infof("Listing all slices ...")
-	var c = meta.NewContext(0, 0, []uint32{0})
 	var slices []meta.Slice
 	r := m.ListSlices(c, &slices)
 	if r != 0 {
@@ -71,7 +71,7 @@ func gatewayFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "gateway",
 		Usage:     "S3-compatible gateway",
-		ArgsUsage: "REDIS-URL ADDRESS",
+		ArgsUsage: "META-URL ADDRESS",
 		Flags:     flags,
 		Action:    gateway,
 	}
@@ -87,7 +87,7 @@ func gateway(c *cli.Context) error {
 	}()
 
 	if c.Args().Len() < 2 {
-		logger.Fatalf("Redis URL and listen address are required")
+		logger.Fatalf("Meta URL and listen address are required")
 	}
 	address := c.Args().Get(1)
 	gw = &GateWay{c}
@@ -144,16 +144,8 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	mctx = meta.NewContext(uint32(os.Getpid()), uint32(os.Getuid()), []uint32{uint32(os.Getgid())})
 
 	c := g.ctx
-	redisAddr := c.Args().Get(0)
-	if !strings.Contains(redisAddr, "://") {
-		redisAddr = "redis://" + redisAddr
-	}
-	logger.Infof("Meta address: %s", redisAddr)
-	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(redisAddr, &rc)
-	if err != nil {
-		logger.Fatalf("Meta: %s", err)
-	}
+	metaConf := &meta.Config{Retries: 10, Strict: true, IORetries: c.Int("io-retries"), CacheTTL: c.Duration("meta-cache"), CacheLimit: c.Int("meta-cache-limit")}
+	m := meta.NewClient(c.Args().Get(0), metaConf)
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
@@ -189,7 +181,8 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
-	blob = object.WithMetrics(blob)
+	switchable := object.NewSwitchable(blob)
+	blob = object.WithMetrics(switchable)
 
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, meta.MsgCallback(func(args ...interface{}) error {
@@ -202,15 +195,14 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		chunkid := args[1].(uint64)
 		return vfs.Compact(chunkConf, store, slices, chunkid)
 	}))
+	reloadSetting(m, format, switchable, store)
 	err = m.NewSession()
 	if err != nil {
 		logger.Fatalf("new session: %s", err)
 	}
 
 	conf := &vfs.Config{
-		Meta: &meta.Config{
-			IORetries: 10,
-		},
+		Meta:      metaConf,
 		Format:    format,
 		Version:   version.Version(),
 		AccessLog: c.String("access-log"),
@@ -306,6 +298,9 @@ func jfsToObjectErr(ctx context.Context, err error, params ...string) error {
 			return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
 		}
 		return minio.BucketNotEmpty{Bucket: bucket}
+	case err == syscall.EPERM && object != "":
+		// the object is retained
+		return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
 	default:
 		logger.Errorf("other error: %s bucket: %s, object: %s, uploadID: %s", err, bucket, object, uploadID)
 		return err
@@ -406,12 +401,13 @@ func (n *jfsObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInf
 	if eno != 0 {
 		return nil, jfsToObjectErr(ctx, eno)
 	}
-	entries, eno := f.Readdir(mctx, 10000)
+	defer f.Close(mctx)
+	entries, eno := f.Readdir(mctx, 0)
 	if eno != 0 {
 		return nil, jfsToObjectErr(ctx, eno)
 	}
 
-	for _, entry := range entries[2:] {
+	for _, entry := range entries {
 		// Ignore all reserved bucket names and invalid bucket names.
 		if isReservedOrInvalidBucket(entry.Name(), false) || !n.isValidBucketName(entry.Name()) {
 			continue
@@ -437,6 +433,9 @@ func (n *jfsObjects) isLeaf(bucket, leafPath string) bool {
 	return !strings.HasSuffix(leafPath, "/")
 }
 
+// listPageSize is the number of entries read at a time when listing a directory.
+const listPageSize = 10000
+
 func (n *jfsObjects) listDirFactory() minio.ListDirFunc {
 	return func(bucket, prefixDir, prefixEntry string) (emptyDir bool, entries []string, delayIsLeaf bool) {
 		f, eno := n.fs.Open(mctx, n.path(bucket, prefixDir), 0)
@@ -444,29 +443,52 @@ func (n *jfsObjects) listDirFactory() minio.ListDirFunc {
 			return fs.IsNotExist(eno), nil, false
 		}
 		defer f.Close(mctx)
-		fis, eno := f.Readdir(mctx, 0)
-		if eno != 0 {
-			return
-		}
-		if len(fis) == 2 {
-			return true, nil, false
-		}
 		root := n.path(bucket, prefixDir) == "/"
-		for _, fi := range fis[2:] {
-			if root && len(fi.Name()) == len(metaBucket) && string(fi.Name()) == metaBucket {
-				continue
+		var empty = true
+		// read the directory page by page, only the names matching prefixEntry are kept
+		for {
+			fis, eno := f.Readdir(mctx, listPageSize)
+			if eno != 0 {
+				return
 			}
-			if fi.IsDir() {
-				entries = append(entries, fi.Name()+sep)
-			} else {
-				entries = append(entries, fi.Name())
+			if len(fis) == 0 {
+				break
+			}
+			empty = false
+			for _, fi := range fis {
+				if root && len(fi.Name()) == len(metaBucket) && string(fi.Name()) == metaBucket {
+					continue
+				}
+				if !strings.HasPrefix(fi.Name(), prefixEntry) {
+					continue
+				}
+				if fi.IsDir() {
+					entries = append(entries, fi.Name()+sep)
+				} else {
+					entries = append(entries, fi.Name())
+				}
 			}
 		}
+		if empty {
+			return true, nil, false
+		}
 		entries, delayIsLeaf = minio.FilterListEntries(bucket, prefixDir, entries, prefixEntry, n.isLeaf)
 		return false, entries, delayIsLeaf
 	}
 }
 
+// readdirPlus returns all the entries of a directory with their attributes.
+func readdirPlus(f *fs.File) ([]*meta.Entry, syscall.Errno) {
+	var entries []*meta.Entry
+	for {
+		es, eno := f.ReaddirPlus(mctx, len(entries))
+		if eno != 0 || len(es) == 0 {
+			return entries, eno
+		}
+		entries = append(entries, es...)
+	}
+}
+
 func (n *jfsObjects) checkBucket(ctx context.Context, bucket string) error {
 	if !n.isValidBucketName(bucket) {
 		return minio.BucketNameInvalid{Bucket: bucket}
@@ -617,6 +639,10 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 		logger.Errorf("rename %s to %s: %s", tmp, dst, err)
 		return
 	}
+	if eno = n.retain(dst, objectLockUntil(dstOpts)); eno != 0 {
+		err = jfsToObjectErr(ctx, eno, dstBucket, dstObject)
+		return
+	}
 	fi, eno := n.fs.Stat(mctx, dst)
 	if eno != 0 {
 		err = jfsToObjectErr(ctx, eno, dstBucket, dstObject)
@@ -696,12 +722,13 @@ func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, o
 		return
 	}
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		UserDefined: n.objectLock(n.path(bucket, object), fi),
 	}, nil
 }
 
@@ -774,9 +801,48 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 		err = jfsToObjectErr(ctx, eno, bucket, object)
 		return
 	}
+	if eno := n.retain(object, objectLockUntil(opts)); eno != 0 {
+		err = jfsToObjectErr(ctx, eno, bucket, object)
+	}
 	return
 }
 
+// the metadata of S3 object lock, which is mapped to the retention of files
+const (
+	objectLockMode        = "x-amz-object-lock-mode"
+	objectLockRetainUntil = "x-amz-object-lock-retain-until-date"
+	uploadRetention       = "s3-retention"
+)
+
+func objectLockUntil(opts minio.ObjectOptions) string {
+	for k, v := range opts.UserDefined {
+		if strings.EqualFold(k, objectLockRetainUntil) {
+			return v
+		}
+	}
+	return ""
+}
+
+// retain sets the retention of a file until the time in RFC3339, nothing is changed if it's empty.
+func (n *jfsObjects) retain(p string, until string) syscall.Errno {
+	if until == "" {
+		return 0
+	}
+	return n.fs.SetXattr(mctx, p, meta.RetentionXattr, []byte(until), 0)
+}
+
+// objectLock returns the object lock of a retained file as the metadata of the object.
+func (n *jfsObjects) objectLock(p string, fi *fs.FileStat) map[string]string {
+	if fi.Sys().(*meta.Attr).Flags&meta.FlagRetention == 0 {
+		return nil
+	}
+	until, eno := n.fs.GetXattr(mctx, p, meta.RetentionXattr)
+	if eno != 0 {
+		return nil
+	}
+	return map[string]string{objectLockMode: "COMPLIANCE", objectLockRetainUntil: string(until)}
+}
+
 func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string, r *minio.PutObjReader, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
 	if err = n.checkBucket(ctx, bucket); err != nil {
 		return
@@ -818,6 +884,11 @@ func (n *jfsObjects) NewMultipartUpload(ctx context.Context, bucket string, obje
 		if eno != 0 {
 			logger.Warnf("set object %s on upload %s: %s", object, uploadID, eno)
 		}
+		if until := objectLockUntil(opts); until != "" {
+			if eno = n.fs.SetXattr(mctx, p, uploadRetention, []byte(until), 0); eno != 0 {
+				logger.Warnf("set retention %s on upload %s: %s", until, uploadID, eno)
+			}
+		}
 	}
 	return
 }
@@ -834,7 +905,7 @@ func (n *jfsObjects) ListMultipartUploads(ctx context.Context, bucket string, pr
 		return // no found
 	}
 	defer f.Close(mctx)
-	entries, eno := f.ReaddirPlus(mctx, 0)
+	entries, eno := readdirPlus(f)
 	if eno != 0 {
 		err = jfsToObjectErr(ctx, eno, bucket)
 		return
@@ -890,7 +961,7 @@ func (n *jfsObjects) ListObjectParts(ctx context.Context, bucket, object, upload
 		return
 	}
 	defer func() { _ = f.Close(mctx) }()
-	entries, e := f.ReaddirPlus(mctx, 0)
+	entries, e := readdirPlus(f)
 	if e != 0 {
 		err = jfsToObjectErr(ctx, e, bucket, object, uploadID)
 		return
@@ -995,6 +1066,13 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 		return
 	}
 
+	if until, eno := n.fs.GetXattr(mctx, n.upath(bucket, uploadID), uploadRetention); eno == 0 {
+		if eno = n.retain(name, string(until)); eno != 0 {
+			err = jfsToObjectErr(ctx, eno, bucket, object, uploadID)
+			return
+		}
+	}
+
 	fi, eno := n.fs.Stat(mctx, name)
 	if eno != 0 {
 		_ = n.fs.Delete(mctx, name)
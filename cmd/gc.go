@@ -35,7 +35,7 @@ func gcFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "gc",
 		Usage:     "collect any leaked objects",
-		ArgsUsage: "REDIS-URL",
+		ArgsUsage: "META-URL",
 		Action:    gc,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
@@ -99,19 +99,9 @@ func showProgress(p *gcProgress) {
 func gc(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
 	if ctx.Args().Len() < 1 {
-		return fmt.Errorf("REDIS-URL is needed")
-	}
-	addr := ctx.Args().Get(0)
-	if !strings.Contains(addr, "://") {
-		addr = "redis://" + addr
-	}
-
-	logger.Infof("Meta address: %s", addr)
-	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(addr, &rc)
-	if err != nil {
-		logger.Fatalf("Meta: %s", err)
+		return fmt.Errorf("META-URL is needed")
 	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
@@ -0,0 +1,109 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func infoFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "info",
+		Usage:     "show the paths and the layout of data of a file or directory",
+		ArgsUsage: "PATH|INODE ...",
+		Action:    info,
+	}
+}
+
+func info(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("PATH or INODE is needed")
+	}
+	for i := 0; i < ctx.Args().Len(); i++ {
+		arg := ctx.Args().Get(i)
+		p, err := filepath.Abs(arg)
+		if err != nil {
+			return fmt.Errorf("abs of %s: %s", arg, err)
+		}
+		var inode uint64
+		if _, err = os.Lstat(p); err == nil {
+			if inode, err = utils.GetFileInode(p); err != nil {
+				return fmt.Errorf("lookup inode for %s: %s", p, err)
+			}
+		} else if inode, err = strconv.ParseUint(arg, 10, 64); err == nil {
+			// the inode is looked up in the volume of the current directory
+			if p, err = os.Getwd(); err != nil {
+				return fmt.Errorf("current directory: %s", err)
+			}
+		} else {
+			return fmt.Errorf("%s is neither a path nor an inode", arg)
+		}
+		f := openControler(p)
+		if f == nil {
+			return fmt.Errorf("%s is not inside JuiceFS", p)
+		}
+
+		wb := utils.NewBuffer(8 + 8)
+		wb.Put32(meta.Info)
+		wb.Put32(8)
+		wb.Put64(inode)
+		if _, err = f.Write(wb.Bytes()); err != nil {
+			logger.Fatalf("write message: %s", err)
+		}
+		var errs = make([]byte, 1)
+		n, err := f.Read(errs)
+		if err != nil || n != 1 {
+			logger.Fatalf("read message: %d %s", n, err)
+		}
+		if errs[0] != 0 {
+			logger.Fatalf("info of %s: %s", arg, syscall.Errno(errs[0]))
+		}
+		size := make([]byte, 4)
+		if _, err = io.ReadFull(f, size); err != nil {
+			logger.Fatalf("read message: %s", err)
+		}
+		data := make([]byte, utils.ReadBuffer(size).Get32())
+		if _, err = io.ReadFull(f, data); err != nil {
+			logger.Fatalf("read message: %s", err)
+		}
+		_ = f.Close()
+
+		var result vfs.InodeInfo
+		if err = json.Unmarshal(data, &result); err != nil {
+			logger.Fatalf("json: %s", err)
+		}
+		if data, err = json.MarshalIndent(&result, "", "  "); err != nil {
+			logger.Fatalf("json: %s", err)
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func loadFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "load",
+		Usage:     "load metadata from a JSON file into an empty meta engine",
+		ArgsUsage: "META-URL [FILE]",
+		Action:    load,
+	}
+}
+
+func load(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		logger.Fatalf("META-URL is needed")
+	}
+	var r io.ReadCloser = os.Stdin
+	if ctx.Args().Len() > 1 {
+		fp, err := os.Open(ctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		r = fp
+	}
+	defer r.Close()
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if err := m.LoadMeta(r); err != nil {
+		return err
+	}
+	logger.Infof("Load metadata from %s succeed", r.(*os.File).Name())
+	return nil
+}
@@ -59,14 +59,24 @@ func main() {
 		},
 		Commands: []*cli.Command{
 			formatFlags(),
+			destroyFlags(),
+			statusFlags(),
+			configFlags(),
+			watchFlags(),
 			mountFlags(),
 			umountFlags(),
 			gatewayFlags(),
 			syncFlags(),
 			rmrFlags(),
+			cloneFlags(),
+			infoFlags(),
 			benchmarkFlags(),
 			gcFlags(),
 			checkFlags(),
+			dumpFlags(),
+			loadFlags(),
+			quotaFlags(),
+			snapshotFlags(),
 		},
 	}
 
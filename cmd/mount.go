@@ -82,7 +82,7 @@ func updateMetrics(m meta.Meta) {
 		_, rss := utils.MemoryUsage()
 		memory.Set(float64(rss))
 		var totalSpace, availSpace, iused, iavail uint64
-		err := m.StatFS(ctx, &totalSpace, &availSpace, &iused, &iavail)
+		err := m.StatFS(ctx, 1, &totalSpace, &availSpace, &iused, &iavail)
 		if err == 0 {
 			usedSpace.Set(float64(totalSpace - availSpace))
 			usedInodes.Set(float64(iused))
@@ -121,12 +121,9 @@ func installHandler(mp string) {
 func mount(c *cli.Context) error {
 	setLoggerLevel(c)
 	if c.Args().Len() < 1 {
-		logger.Fatalf("Redis URL and mountpoint are required")
+		logger.Fatalf("Meta URL and mountpoint are required")
 	}
 	addr := c.Args().Get(0)
-	if !strings.Contains(addr, "://") {
-		addr = "redis://" + addr
-	}
 	if c.Args().Len() < 2 {
 		logger.Fatalf("MOUNTPOINT is required")
 	}
@@ -137,12 +134,25 @@ func mount(c *cli.Context) error {
 		}
 	}
 
-	logger.Infof("Meta address: %s", addr)
-	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(addr, &rc)
-	if err != nil {
-		logger.Fatalf("Meta: %s", err)
+	metaConf := &meta.Config{
+		Retries:    10,
+		Strict:     true,
+		ReadOnly:   c.Bool("read-only"),
+		IORetries:  c.Int("io-retries"),
+		CacheTTL:   c.Duration("meta-cache"),
+		CacheLimit: c.Int("meta-cache-limit"),
+		MountPoint: mp,
+		AtimeMode:  c.String("atime-mode"),
+	}
+	switch metaConf.AtimeMode {
+	case meta.NoAtime, meta.RelAtime, meta.StrictAtime:
+	default:
+		logger.Fatalf("invalid atime mode: %s", metaConf.AtimeMode)
+	}
+	if p, err := filepath.Abs(mp); err == nil {
+		metaConf.MountPoint = p
 	}
+	m := meta.NewClient(addr, metaConf)
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
@@ -186,7 +196,8 @@ func mount(c *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
-	blob = object.WithMetrics(blob)
+	switchable := object.NewSwitchable(blob)
+	blob = object.WithMetrics(switchable)
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, meta.MsgCallback(func(args ...interface{}) error {
 		chunkid := args[0].(uint64)
@@ -198,15 +209,17 @@ func mount(c *cli.Context) error {
 		chunkid := args[1].(uint64)
 		return vfs.Compact(chunkConf, store, slices, chunkid)
 	}))
+	reloadSetting(m, format, switchable, store)
 	err = m.NewSession()
 	if err != nil {
 		logger.Fatalf("new session: %s", err)
 	}
+	if d := c.Duration("backup-meta"); d > 0 && !metaConf.ReadOnly {
+		go backupMeta(m, blob, d)
+	}
 
 	conf := &vfs.Config{
-		Meta: &meta.Config{
-			IORetries: 10,
-		},
+		Meta:       metaConf,
 		Format:     format,
 		Version:    version.Version(),
 		Mountpoint: mp,
@@ -343,6 +356,15 @@ func clientFlags() []cli.Flag {
 			Name:  "cache-partial-only",
 			Usage: "cache only random/small read",
 		},
+		&cli.DurationFlag{
+			Name:  "meta-cache",
+			Usage: "how long to cache the metadata in memory, it's invalidated when changed by any client (only Redis is supported, 0 means disabled)",
+		},
+		&cli.IntFlag{
+			Name:  "meta-cache-limit",
+			Value: 500000,
+			Usage: "max number of items in the cache of metadata",
+		},
 	}
 }
 
@@ -350,7 +372,7 @@ func mountFlags() *cli.Command {
 	cmd := &cli.Command{
 		Name:      "mount",
 		Usage:     "mount a volume",
-		ArgsUsage: "REDIS-URL MOUNTPOINT",
+		ArgsUsage: "META-URL MOUNTPOINT",
 		Action:    mount,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -362,6 +384,19 @@ func mountFlags() *cli.Command {
 				Name:  "no-usage-report",
 				Usage: "do not send usage report",
 			},
+			&cli.BoolFlag{
+				Name:  "read-only",
+				Usage: "allow lookup/read operations only",
+			},
+			&cli.StringFlag{
+				Name:  "atime-mode",
+				Value: meta.NoAtime,
+				Usage: "when to update the access time of files: noatime, relatime or strictatime",
+			},
+			&cli.DurationFlag{
+				Name:  "backup-meta",
+				Usage: "interval to backup metadata into the object storage automatically (0 means disabled)",
+			},
 		},
 	}
 	cmd.Flags = append(cmd.Flags, mount_flags()...)
@@ -0,0 +1,141 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func quotaFlags() *cli.Command {
+	pathFlag := &cli.StringFlag{
+		Name:  "path",
+		Usage: "full path of the directory within the volume",
+	}
+	return &cli.Command{
+		Name:  "quota",
+		Usage: "manage quotas of directories",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "set",
+				Usage:     "set quota of a directory",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags: []cli.Flag{
+					pathFlag,
+					&cli.Uint64Flag{
+						Name:  "capacity",
+						Usage: "the limit for space in GiB (0 means unlimited)",
+					},
+					&cli.Uint64Flag{
+						Name:  "inodes",
+						Usage: "the limit for number of inodes (0 means unlimited)",
+					},
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "show quota of a directory",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags:     []cli.Flag{pathFlag},
+			},
+			{
+				Name:      "delete",
+				Aliases:   []string{"del"},
+				Usage:     "delete quota of a directory",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags:     []cli.Flag{pathFlag},
+			},
+			{
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "list all quotas",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+			},
+			{
+				Name:      "check",
+				Usage:     "re-count the usage of quotas (all of them if no path is given)",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags: []cli.Flag{
+					pathFlag,
+					&cli.BoolFlag{
+						Name:  "repair",
+						Usage: "fix the usage if it's inconsistent",
+					},
+				},
+			},
+		},
+	}
+}
+
+func quota(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 1 {
+		logger.Fatalf("META-URL is needed")
+	}
+	var cmd uint8
+	switch c.Command.Name {
+	case "set":
+		cmd = meta.QuotaSet
+	case "get":
+		cmd = meta.QuotaGet
+	case "delete":
+		cmd = meta.QuotaDel
+	case "list":
+		cmd = meta.QuotaList
+	case "check":
+		cmd = meta.QuotaCheck
+	}
+	dpath := c.String("path")
+	if dpath == "" && cmd != meta.QuotaList && cmd != meta.QuotaCheck {
+		logger.Fatalf("--path is needed")
+	}
+	quotas := make(map[string]*meta.Quota)
+	if cmd == meta.QuotaSet {
+		if !c.IsSet("capacity") && !c.IsSet("inodes") {
+			logger.Fatalf("--capacity or --inodes is needed")
+		}
+		quotas[dpath] = &meta.Quota{
+			MaxSpace:  int64(c.Uint64("capacity") << 30),
+			MaxInodes: int64(c.Uint64("inodes")),
+		}
+	}
+
+	m := meta.NewClient(c.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if err := m.HandleQuota(meta.Background, cmd, dpath, quotas, c.Bool("repair")); err != nil {
+		return err
+	}
+	if cmd == meta.QuotaSet || cmd == meta.QuotaDel {
+		return nil
+	}
+	var paths []string
+	for p := range quotas {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	fmt.Printf("%-40s %16s %16s %12s %12s\n", "Path", "Capacity", "Used", "Inodes", "IUsed")
+	for _, p := range paths {
+		q := quotas[p]
+		fmt.Printf("%-40s %16d %16d %12d %12d\n", p, q.MaxSpace, q.UsedSpace, q.MaxInodes, q.UsedInodes)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func snapshotFlags() *cli.Command {
+	nameFlag := &cli.StringFlag{
+		Name:  "name",
+		Usage: "name of the snapshot",
+	}
+	return &cli.Command{
+		Name:  "snapshot",
+		Usage: "manage read-only snapshots of directories",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "take a snapshot of a directory",
+				ArgsUsage: "META-URL",
+				Action:    snapshot,
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringFlag{
+						Name:  "path",
+						Usage: "full path of the directory within the volume",
+					},
+				},
+			},
+			{
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "list all snapshots",
+				ArgsUsage: "META-URL",
+				Action:    snapshot,
+			},
+			{
+				Name:      "delete",
+				Aliases:   []string{"del"},
+				Usage:     "delete a snapshot",
+				ArgsUsage: "META-URL",
+				Action:    snapshot,
+				Flags:     []cli.Flag{nameFlag},
+			},
+		},
+	}
+}
+
+func snapshot(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 1 {
+		logger.Fatalf("META-URL is needed")
+	}
+	var cmd uint8
+	switch c.Command.Name {
+	case "create":
+		cmd = meta.SnapshotCreate
+	case "list":
+		cmd = meta.SnapshotList
+	case "delete":
+		cmd = meta.SnapshotDel
+	}
+	name := c.String("name")
+	if name == "" && cmd != meta.SnapshotList {
+		logger.Fatalf("--name is needed")
+	}
+	dpath := c.String("path")
+	if dpath == "" && cmd == meta.SnapshotCreate {
+		logger.Fatalf("--path is needed")
+	}
+
+	m := meta.NewClient(c.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	snapshots := make(map[string]*meta.Snapshot)
+	if err := m.HandleSnapshot(meta.Background, cmd, name, dpath, snapshots); err != nil {
+		return err
+	}
+	if cmd != meta.SnapshotList {
+		return nil
+	}
+	var names []string
+	for n := range snapshots {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-30s %-20s %16s %12s %12s\n", "Name", "Created", "Size", "Files", "Dirs")
+	for _, n := range names {
+		s := snapshots[n]
+		fmt.Printf("%-30s %-20s %16d %12d %12d\n", n, s.Created.Format("2006-01-02 15:04:05"), s.Summary.Size, s.Summary.Files, s.Summary.Dirs)
+	}
+	return nil
+}
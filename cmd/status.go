@@ -0,0 +1,94 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func statusFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "status",
+		Usage:     "show the setting and the client sessions of a volume",
+		ArgsUsage: "META-URL",
+		Action:    status,
+		Flags: []cli.Flag{
+			&cli.Uint64Flag{
+				Name:  "kill-session",
+				Usage: "clean up the open files and locks of a dead session immediately",
+			},
+		},
+	}
+}
+
+func status(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	if sid := ctx.Uint64("kill-session"); sid > 0 {
+		sessions, err := m.ListSessions()
+		if err != nil {
+			logger.Fatalf("list sessions: %s", err)
+		}
+		var found bool
+		for _, s := range sessions {
+			if s.Sid == sid {
+				found = true
+				if !s.Stale {
+					logger.Warnf("Session %d is still alive (last heartbeat at %s), the client may fail", sid, s.Heartbeat)
+				}
+			}
+		}
+		if !found {
+			logger.Fatalf("Session %d is not found", sid)
+		}
+		if err = m.CleanSession(sid); err != nil {
+			logger.Fatalf("clean session %d: %s", sid, err)
+		}
+		logger.Infof("Session %d is cleaned", sid)
+		return nil
+	}
+
+	sessions, err := m.ListSessions()
+	if err != nil {
+		logger.Fatalf("list sessions: %s", err)
+	}
+	if format.SecretKey != "" {
+		format.SecretKey = "removed"
+	}
+	if format.EncryptKey != "" {
+		format.EncryptKey = "removed"
+	}
+	data, err := json.MarshalIndent(&struct {
+		Setting  *meta.Format
+		Sessions []*meta.Session
+	}{format, sessions}, "", "  ")
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
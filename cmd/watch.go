@@ -0,0 +1,90 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func watchFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "print the changes of a volume from its change log",
+		ArgsUsage: "META-URL",
+		Action:    watch,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "offset",
+				Usage: "print the changes after the offset (the oldest one if it's empty)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "prefix",
+				Usage: "only print the changes under the directory of the prefix, e.g. /data matches /data/a but not /database (could be repeated)",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Value: time.Second,
+				Usage: "interval to check new changes",
+			},
+			&cli.BoolFlag{
+				Name:  "once",
+				Usage: "exit once the existing changes are printed",
+			},
+		},
+	}
+}
+
+func watch(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if format.EventDays == 0 {
+		logger.Warnf("The change log of volume %s is disabled, enable it with `juicefs config --event-days`", format.Name)
+	}
+
+	w := fs.NewWatcher(m, ctx.String("offset"), ctx.StringSlice("prefix"))
+	for {
+		offset := w.Offset()
+		changes, st := w.Next(meta.Background, 1000)
+		if st != 0 {
+			logger.Fatalf("read changes after %q: %s", offset, st)
+		}
+		for _, c := range changes {
+			data, err := json.Marshal(c)
+			if err != nil {
+				logger.Fatalf("json: %s", err)
+			}
+			fmt.Println(string(data))
+		}
+		if w.Offset() == offset {
+			if ctx.Bool("once") {
+				return nil
+			}
+			time.Sleep(ctx.Duration("interval"))
+		}
+	}
+}
@@ -140,7 +140,7 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		}
 	}
 
-	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 {
+	if c.store.seekable() && boff > 0 && len(p) <= blockSize/4 {
 		// partial read
 		st := time.Now()
 		in, err := c.store.storage.Get(key, int64(boff), int64(len(p)))
@@ -348,7 +348,8 @@ func (c *wChunk) put(key string, p *Page) error {
 
 func (c *wChunk) syncUpload(key string, block *Page) {
 	blen := len(block.Data)
-	bufSize := c.store.compressor.CompressBound(blen)
+	compressor := c.store.getCompressor()
+	bufSize := compressor.CompressBound(blen)
 	var buf *Page
 	if bufSize > blen {
 		buf = NewOffPage(bufSize)
@@ -356,7 +357,7 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 		buf = block
 		buf.Acquire()
 	}
-	n, err := c.store.compressor.Compress(buf.Data, block.Data)
+	n, err := compressor.Compress(buf.Data, block.Data)
 	if err != nil {
 		logger.Fatalf("compress chunk %v: %s", c.id, err)
 		return
@@ -434,7 +435,8 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 			return
 		}
 	}
-	bufSize := c.store.compressor.CompressBound(blockSize)
+	compressor := c.store.getCompressor()
+	bufSize := compressor.CompressBound(blockSize)
 	var buf *Page
 	if bufSize > blockSize {
 		buf = NewOffPage(bufSize)
@@ -442,7 +444,7 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 		buf = block
 		buf.Acquire()
 	}
-	n, err := c.store.compressor.Compress(buf.Data, block.Data)
+	n, err := compressor.Compress(buf.Data, block.Data)
 	if err != nil {
 		logger.Fatalf("compress chunk %v: %s", c.id, err)
 		return
@@ -587,8 +589,38 @@ type cachedStore struct {
 	currentUpload chan bool
 	pendingKeys   map[string]bool
 	pendingMutex  sync.Mutex
+	compressLock  sync.RWMutex
 	compressor    compress.Compressor
-	seekable      bool
+}
+
+// the algorithms used by the blocks written before the compression is changed
+var decompressors = []compress.Compressor{
+	compress.NewCompressor("zstd"),
+	compress.NewCompressor("lz4"),
+	compress.NewCompressor("none"),
+}
+
+func (store *cachedStore) getCompressor() compress.Compressor {
+	store.compressLock.RLock()
+	defer store.compressLock.RUnlock()
+	return store.compressor
+}
+
+// seekable returns whether the blocks can be read partially, the compression can't be disabled once
+// it's enabled, so all the blocks are not compressed if the current compressor does nothing.
+func (store *cachedStore) seekable() bool {
+	return store.getCompressor().CompressBound(0) == 0
+}
+
+func (store *cachedStore) SetCompression(algr string) error {
+	compressor := compress.NewCompressor(algr)
+	if compressor == nil {
+		return fmt.Errorf("unknown compress algorithm: %s", algr)
+	}
+	store.compressLock.Lock()
+	store.compressor = compressor
+	store.compressLock.Unlock()
+	return nil
 }
 
 func (store *cachedStore) load(key string, page *Page, cache bool) (err error) {
@@ -618,9 +650,15 @@ func (store *cachedStore) load(key string, page *Page, cache bool) (err error) {
 	if err != nil {
 		return fmt.Errorf("get %s: %s", key, err)
 	}
-	needed := store.compressor.CompressBound(len(page.Data))
+	compressor := store.getCompressor()
+	needed := compressor.CompressBound(len(page.Data))
 	var n int
 	if needed > len(page.Data) {
+		for _, d := range decompressors {
+			if b := d.CompressBound(len(page.Data)); b > needed {
+				needed = b
+			}
+		}
 		c := NewOffPage(needed)
 		defer c.Release()
 		var cn int
@@ -629,7 +667,19 @@ func (store *cachedStore) load(key string, page *Page, cache bool) (err error) {
 		if err != nil && (cn == 0 || err != io.ErrUnexpectedEOF) {
 			return err
 		}
-		n, err = store.compressor.Decompress(page.Data, c.Data[:cn])
+		n, err = compressor.Decompress(page.Data, c.Data[:cn])
+		if err != nil || n != len(page.Data) {
+			// the block could be written before the compression is changed
+			for _, d := range decompressors {
+				if d.Name() == compressor.Name() {
+					continue
+				}
+				if dn, e := d.Decompress(page.Data, c.Data[:cn]); e == nil && dn == len(page.Data) {
+					n, err = dn, nil
+					break
+				}
+			}
+		}
 	} else {
 		n, err = io.ReadFull(in, page.Data)
 	}
@@ -662,7 +712,6 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 		conf:          config,
 		currentUpload: make(chan bool, config.MaxUpload),
 		compressor:    compressor,
-		seekable:      compressor.CompressBound(0) == 0,
 		bcache:        newCacheManager(&config),
 		pendingKeys:   make(map[string]bool),
 		group:         &Controller{},
@@ -728,8 +777,9 @@ func (store *cachedStore) uploadStaging() {
 				logger.Errorf("open %s: %s", stagingPath, err)
 				return
 			}
-			buf := make([]byte, store.compressor.CompressBound(len(block)))
-			n, err := store.compressor.Compress(buf, block)
+			compressor := store.getCompressor()
+			buf := make([]byte, compressor.CompressBound(len(block)))
+			n, err := compressor.Compress(buf, block)
 			if err != nil {
 				logger.Errorf("compress chunk %s: %s", stagingPath, err)
 				return
@@ -769,4 +819,16 @@ func (store *cachedStore) Remove(chunkid uint64, length int) error {
 	return r.Remove()
 }
 
+func (store *cachedStore) BlockKeys(chunkid uint64, length, off, size int) []string {
+	if size <= 0 {
+		return nil
+	}
+	r := chunkForRead(chunkid, length, store)
+	var keys []string
+	for i := r.index(off); i <= r.index(off+size-1); i++ {
+		keys = append(keys, r.key(i))
+	}
+	return keys
+}
+
 var _ ChunkStore = &cachedStore{}
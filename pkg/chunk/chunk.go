@@ -37,4 +37,8 @@ type ChunkStore interface {
 	NewReader(chunkid uint64, length int) Reader
 	NewWriter(chunkid uint64) Writer
 	Remove(chunkid uint64, length int) error
+	// BlockKeys returns the keys of the blocks of a slice sized length, which hold the data between off and off+size.
+	BlockKeys(chunkid uint64, length, off, size int) []string
+	// SetCompression changes the algorithm to compress new blocks.
+	SetCompression(algr string) error
 }
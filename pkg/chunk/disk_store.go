@@ -108,4 +108,12 @@ func (s *diskStore) Remove(chunkid uint64, length int) error {
 	return os.Remove(s.chunkPath(chunkid))
 }
 
+func (s *diskStore) BlockKeys(chunkid uint64, length, off, size int) []string {
+	return []string{s.chunkPath(chunkid)}
+}
+
+func (s *diskStore) SetCompression(algr string) error {
+	return nil
+}
+
 var _ ChunkStore = &diskStore{}
@@ -83,6 +83,18 @@ func TestCachedStore(t *testing.T) {
 	testStore(t, store)
 }
 
+func TestBlockKeys(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	store := NewCachedStore(mem, defaultConf)
+	keys := store.BlockKeys(1234, 2500, 1000, 100)
+	if len(keys) != 2 || keys[0] != "chunks/0/1/1234_0_1024" || keys[1] != "chunks/0/1/1234_1_1024" {
+		t.Fatalf("keys of blocks: %v", keys)
+	}
+	if keys = store.BlockKeys(1234, 2500, 2048, 452); len(keys) != 1 || keys[0] != "chunks/0/1/1234_2_452" {
+		t.Fatalf("keys of the last block: %v", keys)
+	}
+}
+
 func TestUncompressedStore(t *testing.T) {
 	mem, _ := object.CreateStorage("mem", "", "", "")
 	conf := defaultConf
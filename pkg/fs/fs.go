@@ -16,7 +16,6 @@
 package fs
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -130,11 +129,15 @@ type File struct {
 	fs    *FileSystem
 
 	sync.Mutex
-	offset   int64
-	rdata    vfs.FileReader
-	wdata    vfs.FileWriter
-	dircache []os.FileInfo
-	entries  []*meta.Entry
+	offset int64
+	rdata  vfs.FileReader
+	wdata  vfs.FileWriter
+
+	// for directories, only the page being read is kept
+	entries    []*meta.Entry
+	entriesOff int    // offset of the first entry in entries
+	cursor     string // cursor of the next page
+	lastPage   bool
 }
 
 func NewFileSystem(conf *vfs.Config, m meta.Meta, d chunk.ChunkStore) (*FileSystem, error) {
@@ -237,7 +240,7 @@ func (fs *FileSystem) StatFS(ctx meta.Context) (totalspace uint64, availspace ui
 	l := vfs.NewLogContext(ctx)
 	defer func() { fs.log(l, "StatFS (): (%d,%d)", totalspace, availspace) }()
 	var iused, iavail uint64
-	_ = fs.m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail)
+	_ = fs.m.StatFS(ctx, 1, &totalspace, &availspace, &iused, &iavail)
 	return
 }
 
@@ -257,6 +260,9 @@ func (fs *FileSystem) Open(ctx meta.Context, path string, flags uint32) (f *File
 	}
 
 	if flags != 0 && !fi.IsDir() {
+		if flags&mMaskW != 0 && fi.attr.Flags&meta.FlagImmutable != 0 {
+			return nil, syscall.EPERM
+		}
 		if ctx.Uid() != 0 {
 			err = fs.m.Access(ctx, fi.inode, uint8(flags), nil)
 			if err != 0 {
@@ -709,6 +715,16 @@ func (f *File) Utime(ctx meta.Context, atime, mtime int64) (err syscall.Errno) {
 	return
 }
 
+// SetFlags sets the immutable and append-only flags (meta.FlagImmutable and meta.FlagAppend) of the file,
+// which can only be changed by root.
+func (f *File) SetFlags(ctx meta.Context, flags uint8) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.SetFlags").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { f.fs.log(l, "SetFlags (%s,%d): %s", f.path, flags, errstr(err)) }()
+	err = f.fs.m.SetFlags(ctx, f.inode, flags)
+	return
+}
+
 func (f *File) Seek(ctx meta.Context, offset int64, whence int) (int64, error) {
 	defer trace.StartRegion(context.TODO(), "fs.Seek").End()
 	l := vfs.NewLogContext(ctx)
@@ -768,6 +784,7 @@ func (f *File) pread(ctx meta.Context, b []byte, offset int64) (n int, err error
 	if got == 0 {
 		return 0, io.EOF
 	}
+	f.fs.m.TouchAtime(ctx, f.inode, nil)
 	return got, nil
 }
 
@@ -796,6 +813,9 @@ func (f *File) pwrite(ctx meta.Context, b []byte, offset int64) (n int, err sysc
 	if f.wdata == nil {
 		f.wdata = f.fs.writer.Open(f.inode, uint64(f.info.Size()))
 	}
+	if f.info.attr.Flags&meta.FlagAppend != 0 && uint64(offset) < f.wdata.GetLength() {
+		return 0, syscall.EPERM
+	}
 	err = f.wdata.Write(ctx, uint64(offset), b)
 	if err != 0 {
 		f.wdata.Close(meta.Background)
@@ -851,68 +871,75 @@ func (f *File) Close(ctx meta.Context) (err syscall.Errno) {
 	return
 }
 
-func (f *File) Readdir(ctx meta.Context, count int) (fi []os.FileInfo, err syscall.Errno) {
-	l := vfs.NewLogContext(ctx)
-	defer func() { f.fs.log(l, "Readdir (%s,%d): (%s,%d)", f.path, count, errstr(err), len(fi)) }()
-	f.Lock()
-	defer f.Unlock()
-	fi = f.dircache
-	if fi == nil {
-		err = f.fs.m.Access(ctx, f.inode, mMaskR, f.info.attr)
-		if err != 0 {
+// readdirAt returns the entries from offset to the end of the page containing it, the directory is read
+// from the beginning again if offset is before the current page. Nothing is returned after the last entry.
+func (f *File) readdirAt(ctx meta.Context, offset int) ([]*meta.Entry, syscall.Errno) {
+	if f.entries == nil || offset < f.entriesOff {
+		if err := f.fs.m.Access(ctx, f.inode, mMaskR, f.info.attr); err != 0 {
 			return nil, err
 		}
-		var inodes []*meta.Entry
-		err = f.fs.m.Readdir(ctx, f.inode, 1, &inodes)
-		if err != 0 {
-			return
+		f.entriesOff, f.cursor, f.lastPage = 0, "", false
+		if err := f.readdirPage(ctx); err != 0 {
+			return nil, err
 		}
-		for _, n := range inodes {
-			i := AttrToFileInfo(n.Inode, n.Attr)
-			i.name = string(n.Name)
-			fi = append(fi, i)
+	}
+	for offset >= f.entriesOff+len(f.entries) && !f.lastPage {
+		f.entriesOff += len(f.entries)
+		if err := f.readdirPage(ctx); err != 0 {
+			return nil, err
 		}
-		f.dircache = fi
 	}
-
-	if len(fi) < int(f.offset) {
+	if offset-f.entriesOff >= len(f.entries) {
 		return nil, 0
 	}
-	fi = fi[f.offset:]
-	if count > 0 && len(fi) > count {
-		fi = fi[:count]
+	return f.entries[offset-f.entriesOff:], 0
+}
+
+func (f *File) readdirPage(ctx meta.Context) syscall.Errno {
+	es := make([]*meta.Entry, 0)
+	cursor := f.cursor
+	if err := f.fs.m.ReaddirPage(ctx, f.inode, 1, &cursor, 0, &es); err != 0 {
+		f.entries = nil
+		return err
 	}
-	f.offset += int64(len(fi))
-	return
+	f.entries, f.cursor, f.lastPage = es, cursor, cursor == ""
+	return 0
 }
 
-func (f *File) ReaddirPlus(ctx meta.Context, offset int) (entries []*meta.Entry, err syscall.Errno) {
+// Readdir returns the next count entries (all the left ones if count <= 0) of the directory, "." and ".."
+// are not included.
+func (f *File) Readdir(ctx meta.Context, count int) (fi []os.FileInfo, err syscall.Errno) {
 	l := vfs.NewLogContext(ctx)
-	defer func() { f.fs.log(l, "ReaddirPlus (%s,%d): (%s,%d)", f.path, offset, errstr(err), len(entries)) }()
+	defer func() { f.fs.log(l, "Readdir (%s,%d): (%s,%d)", f.path, count, errstr(err), len(fi)) }()
 	f.Lock()
 	defer f.Unlock()
-	if f.entries == nil {
-		err = f.fs.m.Access(ctx, f.inode, mMaskR, f.info.attr)
-		if err != 0 {
-			return nil, err
-		}
+	for count <= 0 || len(fi) < count {
 		var es []*meta.Entry
-		err = f.fs.m.Readdir(ctx, f.inode, 1, &es)
-		if err != 0 {
+		es, err = f.readdirAt(ctx, int(f.offset))
+		if err != 0 || len(es) == 0 {
 			return
 		}
-		// filter out . and ..
-		f.entries = make([]*meta.Entry, 0, len(es))
+		if count > 0 && len(es) > count-len(fi) {
+			es = es[:count-len(fi)]
+		}
 		for _, e := range es {
-			if !bytes.Equal(e.Name, []byte{'.'}) && !bytes.Equal(e.Name, []byte("..")) {
-				f.entries = append(f.entries, e)
-			}
+			i := AttrToFileInfo(e.Inode, e.Attr)
+			i.name = string(e.Name)
+			fi = append(fi, i)
 		}
+		f.offset += int64(len(es))
 	}
-	if offset >= len(f.entries) {
-		offset = len(f.entries)
-	}
-	entries = f.entries[offset:]
+	return
+}
+
+// ReaddirPlus returns the entries with attributes from offset, which are in the same page. It returns
+// nothing after the last entry.
+func (f *File) ReaddirPlus(ctx meta.Context, offset int) (entries []*meta.Entry, err syscall.Errno) {
+	l := vfs.NewLogContext(ctx)
+	defer func() { f.fs.log(l, "ReaddirPlus (%s,%d): (%s,%d)", f.path, offset, errstr(err), len(entries)) }()
+	f.Lock()
+	defer f.Unlock()
+	entries, err = f.readdirAt(ctx, offset)
 	return
 }
 
@@ -16,6 +16,8 @@
 package fs
 
 import (
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
@@ -25,11 +27,7 @@ import (
 
 // nolint:errcheck
 func TestFileSystem(t *testing.T) {
-	m, err := meta.NewRedisMeta("redis://127.0.0.1:6379/10", &meta.RedisConfig{})
-	if err != nil {
-		t.Logf("redis is not available: %s", err)
-		t.Skip()
-	}
+	m := meta.NewClient("redis://127.0.0.1:6379/10", &meta.Config{})
 	format := meta.Format{
 		Name:      "test",
 		BlockSize: 4096,
@@ -55,3 +53,103 @@ func TestFileSystem(t *testing.T) {
 		t.Fatalf("delete /hello: %s", err)
 	}
 }
+
+// nolint:errcheck
+func TestWatcher(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	_ = m.Init(meta.Format{Name: "test", BlockSize: 4096}, true)
+	format, _ := m.Load()
+	format.EventDays = 1
+	if err := m.UpdateFormat(format); err != nil {
+		t.Fatalf("enable change log: %s", err)
+	}
+	var conf = vfs.Config{
+		Meta: &meta.Config{},
+		Chunk: &chunk.Config{
+			BlockSize: 4096,
+		},
+	}
+	fs, _ := NewFileSystem(&conf, m, chunk.NewDiskStore("/tmp"))
+	ctx := meta.Background
+	fs.Mkdir(ctx, "/a", 0755)
+	fs.Mkdir(ctx, "/b", 0755)
+	f, _ := fs.Create(ctx, "/a/f", 0644)
+	f.Close(ctx)
+	fs.Rename(ctx, "/a/f", "/b/f")
+
+	w := fs.Watch("", "/b/")
+	changes, st := w.Next(ctx, 100)
+	if st != 0 {
+		t.Fatalf("watch: %s", st)
+	}
+	if len(changes) != 1 || changes[0].Type != "rename" || changes[0].Path != "/a/f" || changes[0].DstPath != "/b/f" {
+		t.Fatalf("changes in /b/: %+v", changes)
+	}
+	offset := w.Offset()
+	fs.Delete(ctx, "/b/f")
+	changes, st = NewWatcher(m, offset, nil).Next(ctx, 100)
+	if st != 0 || len(changes) != 1 || changes[0].Type != "unlink" || changes[0].Path != "/b/f" {
+		t.Fatalf("changes after %s: %s %+v", offset, st, changes)
+	}
+
+	// the paths are the ones when the changes were made, even if the parents are removed
+	fs.Mkdir(ctx, "/data", 0755)
+	fs.Mkdir(ctx, "/database", 0755)
+	fs.Mkdir(ctx, "/data/d", 0755)
+	f, _ = fs.Create(ctx, "/data/d/g", 0644)
+	f.Close(ctx)
+	fs.Delete(ctx, "/data/d/g")
+	fs.Delete(ctx, "/data/d")
+	changes, st = NewWatcher(m, w.Offset(), []string{"/data"}).Next(ctx, 100)
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, c.Type+" "+c.Path)
+	}
+	expected := []string{"create /data", "create /data/d", "create /data/d/g", "unlink /data/d/g", "rmdir /data/d"}
+	if st != 0 || strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("changes in /data: %s %v", st, paths)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	_ = m.Init(meta.Format{Name: "test", BlockSize: 4096}, true)
+	var conf = vfs.Config{
+		Meta: &meta.Config{},
+		Chunk: &chunk.Config{
+			BlockSize: 4096,
+		},
+	}
+	fs, _ := NewFileSystem(&conf, m, chunk.NewDiskStore("/tmp"))
+	ctx := meta.Background
+	f, _ := fs.Create(ctx, "/log", 0644)
+	if _, st := f.Write(ctx, []byte("a")); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	f.Close(ctx)
+	if st := f.SetFlags(ctx, meta.FlagAppend); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+
+	f, st := fs.Open(ctx, "/log", mMaskW)
+	if st != 0 {
+		t.Fatalf("open: %s", st)
+	}
+	if _, st = f.Pwrite(ctx, []byte("b"), 0); st != syscall.EPERM {
+		t.Fatalf("overwrite append-only file: %s", st)
+	}
+	if _, st = f.Pwrite(ctx, []byte("b"), 1); st != 0 {
+		t.Fatalf("append to append-only file: %s", st)
+	}
+	f.Close(ctx)
+
+	if st = f.SetFlags(ctx, meta.FlagImmutable); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+	if _, st = fs.Open(ctx, "/log", mMaskW); st != syscall.EPERM {
+		t.Fatalf("open immutable file to write: %s", st)
+	}
+	if st = fs.Delete(ctx, "/log"); st != syscall.EPERM {
+		t.Fatalf("delete immutable file: %s", st)
+	}
+}
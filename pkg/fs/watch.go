@@ -0,0 +1,105 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// Change is an event in the change log of a volume with the paths resolved.
+type Change struct {
+	Offset  string // the offset to resume watching after this change
+	Time    time.Time
+	Type    string // create, link, write, rename, unlink, rmdir, setattr, setxattr or removexattr
+	Inode   Ino
+	Path    string // empty if the node is not in the tree, e.g. it's in the trash
+	DstPath string `json:",omitempty"` // the new path of a renamed entry
+	Xattr   string `json:",omitempty"` // the name of the extended attribute changed
+}
+
+// Watcher reads the changes of a volume from the change log, which should be enabled with
+// `juicefs config --event-days`. The paths are the ones when the changes were made.
+type Watcher struct {
+	m        meta.Meta
+	offset   string
+	prefixes []string
+}
+
+// NewWatcher returns a watcher of the changes after the offset (empty for the oldest one), only the
+// changes within one of the prefixes (all if there is none) are returned.
+func NewWatcher(m meta.Meta, offset string, prefixes []string) *Watcher {
+	return &Watcher{m: m, offset: offset, prefixes: prefixes}
+}
+
+// Watch returns a watcher of the changes of the file system, see NewWatcher.
+func (fs *FileSystem) Watch(offset string, prefixes ...string) *Watcher {
+	return NewWatcher(fs.m, offset, prefixes)
+}
+
+// Offset returns the offset of the last change read, which can be used to resume watching.
+func (w *Watcher) Offset() string {
+	return w.offset
+}
+
+// Next reads at most limit events from the change log, and returns the ones matching the prefixes.
+// The returned list could be empty even if there are more events after the offset.
+func (w *Watcher) Next(ctx meta.Context, limit int) ([]*Change, syscall.Errno) {
+	var events []*meta.Event
+	offset := w.offset
+	if st := w.m.ReadEvents(ctx, &offset, limit, &events); st != 0 {
+		return nil, st
+	}
+	var changes []*Change
+	for _, e := range events {
+		c := &Change{
+			Offset:  e.Offset,
+			Time:    time.Unix(0, e.Time),
+			Type:    e.TypeName(),
+			Inode:   e.Inode,
+			Path:    e.Path,
+			DstPath: e.DstPath,
+		}
+		if e.Type == meta.EventSetXattr || e.Type == meta.EventRemoveXattr {
+			c.Xattr = e.Name
+		}
+		if w.match(c.Path) || c.DstPath != "" && w.match(c.DstPath) {
+			changes = append(changes, c)
+		}
+	}
+	w.offset = offset
+	return changes, 0
+}
+
+func (w *Watcher) match(p string) bool {
+	if len(w.prefixes) == 0 {
+		return true
+	}
+	if p == "" {
+		return false
+	}
+	for _, prefix := range w.prefixes {
+		// a prefix is matched by the components of paths, e.g. /data matches /data and /data/a but not
+		// /database, and /data/ matches only the ones under it
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(p, prefix) || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
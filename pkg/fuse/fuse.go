@@ -431,7 +431,7 @@ func Serve(conf *vfs.Config, options string, attrCacheTo, entryCacheTo, dirEntry
 	opt.SingleThreaded = false
 	opt.MaxBackground = 50
 	opt.EnableLocks = true
-	opt.DisableXAttrs = !xattrs
+	opt.DisableXAttrs = !xattrs && !conf.Format.EnableACL
 	opt.IgnoreSecurityLabels = true
 	opt.MaxWrite = 1 << 20
 	opt.MaxReadAhead = 1 << 20
@@ -447,7 +447,10 @@ func Serve(conf *vfs.Config, options string, attrCacheTo, entryCacheTo, dirEntry
 			opt.Options = append(opt.Options, n)
 		}
 	}
-	opt.Options = append(opt.Options, "default_permissions")
+	if !conf.Format.EnableACL {
+		// the kernel only checks the permission bits, the ACLs are checked by vfs
+		opt.Options = append(opt.Options, "default_permissions")
+	}
 	if runtime.GOOS == "darwin" {
 		opt.Options = append(opt.Options, "fssubtype=juicefs")
 		opt.Options = append(opt.Options, "volname="+conf.Format.Name)
@@ -0,0 +1,272 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// The ACLs are stored as xattrs of the nodes, in the same format as the kernel passes them.
+const (
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+)
+
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclVersion   = 2
+	aclUndefined = 0xFFFFFFFF
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// acl is a list of entries ordered by tag and id.
+type acl []aclEntry
+
+func isACL(name string) bool {
+	return name == aclAccess || name == aclDefault
+}
+
+func parseACL(buf []byte) (acl, error) {
+	if len(buf) < 4 || (len(buf)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid size of ACL: %d", len(buf))
+	}
+	if v := binary.LittleEndian.Uint32(buf); v != aclVersion {
+		return nil, fmt.Errorf("unsupported version of ACL: %d", v)
+	}
+	a := make(acl, 0, (len(buf)-4)/8)
+	for off := 4; off < len(buf); off += 8 {
+		a = append(a, aclEntry{
+			tag:  binary.LittleEndian.Uint16(buf[off:]),
+			perm: binary.LittleEndian.Uint16(buf[off+2:]),
+			id:   binary.LittleEndian.Uint32(buf[off+4:]),
+		})
+	}
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// validate checks that the ACL has exactly one entry for the owner, the owning group and others,
+// and a mask if there is any named user or group, like the kernel does.
+func (a acl) validate() error {
+	var last aclEntry
+	var named bool
+	for i, e := range a {
+		if e.perm&^7 != 0 {
+			return fmt.Errorf("invalid permission of ACL entry: %o", e.perm)
+		}
+		if i > 0 && (e.tag < last.tag || e.tag == last.tag && (e.tag&(aclUser|aclGroup) == 0 || e.id <= last.id)) {
+			return fmt.Errorf("ACL entries are not sorted or duplicated")
+		}
+		switch e.tag {
+		case aclUser, aclGroup:
+			if e.id == aclUndefined {
+				return fmt.Errorf("undefined id in ACL entry")
+			}
+			named = true
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+		default:
+			return fmt.Errorf("invalid tag of ACL entry: %x", e.tag)
+		}
+		last = e
+	}
+	if a.entry(aclUserObj) == nil || a.entry(aclGroupObj) == nil || a.entry(aclOther) == nil {
+		return fmt.Errorf("ACL entries for owner, group or others are missing")
+	}
+	if named && a.entry(aclMask) == nil {
+		return fmt.Errorf("ACL mask is missing")
+	}
+	return nil
+}
+
+func (a acl) encode() []byte {
+	buf := make([]byte, 4+len(a)*8)
+	binary.LittleEndian.PutUint32(buf, aclVersion)
+	for i, e := range a {
+		off := 4 + i*8
+		binary.LittleEndian.PutUint16(buf[off:], e.tag)
+		binary.LittleEndian.PutUint16(buf[off+2:], e.perm)
+		binary.LittleEndian.PutUint32(buf[off+4:], e.id)
+	}
+	return buf
+}
+
+func (a acl) entry(tag uint16) *aclEntry {
+	for i := range a {
+		if a[i].tag == tag {
+			return &a[i]
+		}
+	}
+	return nil
+}
+
+// isMinimal tells whether the ACL is equivalent to the permission bits.
+func (a acl) isMinimal() bool {
+	return len(a) == 3
+}
+
+// groupClass returns the entry that is mapped to the permission bits of the group.
+func (a acl) groupClass() *aclEntry {
+	if e := a.entry(aclMask); e != nil {
+		return e
+	}
+	return a.entry(aclGroupObj)
+}
+
+// mode returns the permission bits of the ACL.
+func (a acl) mode() uint16 {
+	return a.entry(aclUserObj).perm<<6 | a.groupClass().perm<<3 | a.entry(aclOther).perm
+}
+
+// chmod updates the ACL with the permission bits in mode.
+func (a acl) chmod(mode uint16) {
+	a.entry(aclUserObj).perm = mode >> 6 & 7
+	a.groupClass().perm = mode >> 3 & 7
+	a.entry(aclOther).perm = mode & 7
+}
+
+// inherit returns the access ACL of a node created with mode in a directory with the default ACL a,
+// and the mode of the node.
+func (a acl) inherit(mode uint16) (acl, uint16) {
+	c := make(acl, len(a))
+	copy(c, a)
+	c.entry(aclUserObj).perm &= mode >> 6 & 7
+	c.groupClass().perm &= mode >> 3 & 7
+	c.entry(aclOther).perm &= mode & 7
+	return c, mode&^0777 | c.mode()
+}
+
+// check tells whether the ACL of a node grants the permissions in mmask to the user.
+func (a acl) check(attr *Attr, uid uint32, gids []uint32, mmask uint8) bool {
+	want := uint16(mmask)
+	if uid == attr.Uid {
+		return a.entry(aclUserObj).perm&want == want
+	}
+	var mask uint16 = 7
+	if e := a.entry(aclMask); e != nil {
+		mask = e.perm
+	}
+	for _, e := range a {
+		if e.tag == aclUser && e.id == uid {
+			return e.perm&mask&want == want
+		}
+	}
+	inGroup := func(gid uint32) bool {
+		for _, g := range gids {
+			if g == gid {
+				return true
+			}
+		}
+		return false
+	}
+	var matched bool
+	for _, e := range a {
+		if e.tag == aclGroupObj && inGroup(attr.Gid) || e.tag == aclGroup && inGroup(e.id) {
+			if e.perm&mask&want == want {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+	return a.entry(aclOther).perm&want == want
+}
+
+// getACL returns the ACL of a node, or nil if there is none.
+func (m *baseMeta) getACL(ctx Context, inode Ino, name string) (acl, syscall.Errno) {
+	var buf []byte
+	if st := m.en.GetXattr(ctx, inode, name, &buf); st == ENOATTR {
+		return nil, 0
+	} else if st != 0 {
+		return nil, st
+	}
+	a, err := parseACL(buf)
+	if err != nil {
+		logger.Warnf("%s of inode %d is broken: %s", name, inode, err)
+		return nil, 0
+	}
+	return a, 0
+}
+
+// setACL sets or removes (when value is nil) an ACL of a node. An access ACL is kept in sync with
+// the permission bits of the node, and it's not stored if it's minimal.
+func (m *baseMeta) setACL(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if !m.format.EnableACL {
+		return syscall.ENOTSUP
+	}
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if ctx.Uid() != 0 && ctx.Uid() != attr.Uid {
+		return syscall.EPERM
+	}
+	var a acl
+	if value != nil {
+		var err error
+		if a, err = parseACL(value); err != nil {
+			logger.Debugf("set %s of inode %d: %s", name, inode, err)
+			return syscall.EINVAL
+		}
+	}
+	if name == aclDefault {
+		if attr.Typ != TypeDirectory {
+			if a == nil {
+				return 0
+			}
+			return syscall.EACCES
+		}
+		if a == nil {
+			return m.en.doRemoveXattr(ctx, inode, name)
+		}
+		return m.en.doSetXattr(ctx, inode, name, a.encode())
+	}
+
+	// the event of the change is logged with the attributes, which are always updated
+	if a == nil || a.isMinimal() {
+		if st := m.en.doRemoveXattr(withoutEvent(ctx), inode, name); st != 0 && (st != ENOATTR || a == nil) {
+			return st
+		}
+		attr.Flags &^= FlagACL
+	} else {
+		if st := m.en.doSetXattr(withoutEvent(ctx), inode, name, a.encode()); st != 0 {
+			return st
+		}
+		attr.Flags |= FlagACL
+	}
+	var set uint16 = SetAttrFlag
+	if a != nil {
+		attr.Mode = attr.Mode&^0777 | a.mode()
+		set |= SetAttrMode
+	}
+	return m.en.doSetAttr(ctx, inode, set, 0, &attr)
+}
@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"time"
+)
+
+// The modes to update the access time of files.
+const (
+	NoAtime     = "noatime"     // never update atime
+	RelAtime    = "relatime"    // update atime if it's older than mtime or ctime, or older than a day
+	StrictAtime = "strictatime" // update atime on every access
+)
+
+// atimeNeedsUpdate tells whether the atime should be updated for an access at now.
+func (m *baseMeta) atimeNeedsUpdate(attr *Attr, now time.Time) bool {
+	switch m.conf.AtimeMode {
+	case StrictAtime:
+		return true
+	case RelAtime:
+		atime := time.Unix(attr.Atime, int64(attr.Atimensec))
+		mtime := time.Unix(attr.Mtime, int64(attr.Mtimensec))
+		ctime := time.Unix(attr.Ctime, int64(attr.Ctimensec))
+		return !atime.After(mtime) || !atime.After(ctime) || now.Sub(atime) > 24*time.Hour
+	default:
+		return false
+	}
+}
+
+func (m *baseMeta) TouchAtime(ctx Context, inode Ino, attr *Attr) {
+	if m.conf.ReadOnly || m.conf.AtimeMode == "" || m.conf.AtimeMode == NoAtime {
+		return
+	}
+	// a file is checked at most once before the pending atimes are flushed
+	m.atimeLock.Lock()
+	_, checked := m.atimes[inode]
+	if !checked {
+		m.atimes[inode] = time.Time{}
+	}
+	m.atimeLock.Unlock()
+	if checked {
+		return
+	}
+	if attr == nil {
+		attr = &Attr{}
+		if m.GetAttr(ctx, inode, attr) != 0 {
+			return
+		}
+	}
+	now := time.Now()
+	if attr.Flags&FlagSnapshot != 0 || !m.atimeNeedsUpdate(attr, now) {
+		return
+	}
+	m.atimeLock.Lock()
+	m.atimes[inode] = now
+	m.atimeLock.Unlock()
+	attr.Atime = now.Unix()
+	attr.Atimensec = uint32(now.Nanosecond())
+}
+
+// flushAtimes saves the atimes of the files accessed in batch every second, so that the reads of
+// a file are not turned into writes to the meta engine.
+func (m *baseMeta) flushAtimes() {
+	for {
+		time.Sleep(time.Second)
+		m.saveAtimes()
+	}
+}
+
+func (m *baseMeta) saveAtimes() {
+	m.atimeLock.Lock()
+	atimes := m.atimes
+	m.atimes = make(map[Ino]time.Time)
+	m.atimeLock.Unlock()
+	for inode, atime := range atimes {
+		if atime.IsZero() {
+			continue
+		}
+		if err := m.en.doTouchAtime(inode, atime); err != nil && err != syscall.ENOENT {
+			logger.Warnf("update atime of inode %d: %s", inode, err)
+		}
+	}
+}
@@ -0,0 +1,1161 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// engine is the storage specific part of a meta service, the common logic
+// shared by all the engines is implemented by baseMeta.
+type engine interface {
+	getCounter(name string) (int64, error)
+	incrCounter(name string, delta int64) (int64, error)
+	// setIfSmall sets the counter to value if its current value is not larger than value-diff,
+	// it returns whether the counter is updated.
+	setIfSmall(name string, value, diff int64) (bool, error)
+
+	doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
+	doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno
+	doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno
+	doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno
+	doUnlink(ctx Context, parent Ino, name string) syscall.Errno
+	doRmdir(ctx Context, parent Ino, name string) syscall.Errno
+	doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno
+	doReadlink(ctx Context, inode Ino) ([]byte, error)
+	doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno
+	// doReaddirPage appends at most about limit entries after the cursor, and updates the cursor to the
+	// position of the next page, or empty after the last page.
+	doReaddirPage(ctx Context, inode Ino, plus uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno
+	doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno
+	doSetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno
+	doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+
+	// serverVersion returns the version of the meta server, or an empty string if it's unknown.
+	serverVersion() string
+
+	Init(format Format, force bool) error
+	Load() (*Format, error)
+	GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno
+	ListXattr(ctx Context, inode Ino, dbuff *[]byte) syscall.Errno
+
+	// doReadChunk returns the slices of a chunk as they are stored, without building.
+	doReadChunk(inode Ino, indx uint32) ([]byte, error)
+	setCounter(name string, value int64) error
+	// doLoadNode saves a node restored from a dump or cloned from another one, with its symlink target,
+	// xattrs and chunks, the references of the slices in the chunks are increased. The chunks of a clone
+	// are read from the source in the same transaction.
+	doLoadNode(n *loadedNode) error
+	doLoadEdge(parent Ino, name string, _type uint8, inode Ino) error
+	// doGetParents returns the parents of a file with hardlinks, with the number of entries in each one.
+	doGetParents(ctx Context, inode Ino) (map[Ino]int, error)
+	// doSetParents overwrites the parents of a file with hardlinks, an empty map removes them all.
+	doSetParents(inode Ino, parents map[Ino]int) error
+
+	// doLoadQuotas returns all the quotas of directories.
+	doLoadQuotas() (map[Ino]*Quota, error)
+	// doGetQuota returns the quota of a directory, or nil if there is none.
+	doGetQuota(inode Ino) (*Quota, error)
+	doSetQuota(inode Ino, quota *Quota) error
+	doDelQuota(inode Ino) error
+	// doFlushQuotas adds the used space and inodes in the deltas into the usage of the quotas.
+	doFlushQuotas(deltas map[Ino]*Quota) error
+
+	// doGetDirStat returns the stats of a directory, or nil if there is none.
+	doGetDirStat(inode Ino) (*dirStat, error)
+	doSetDirStat(inode Ino, stat *dirStat) error
+	// doDelDirStat removes the stats and the delta of a directory.
+	doDelDirStat(inode Ino) error
+	// doGetDirDeltas returns the deltas of directories that are not rolled up yet.
+	doGetDirDeltas() (map[Ino]*dirStat, error)
+	// doFlushDirStat adds the delta of a directory into the stats of it and all its ancestors in one
+	// transaction, the ones without stats are skipped.
+	doFlushDirStat(inode Ino) error
+
+	// doDeleteSustainedInode deletes a file that was unlinked while it's still opened by the session.
+	doDeleteSustainedInode(sid int64, inode Ino) error
+
+	// The methods below are used by fsck to check the invariants of the metadata.
+	ListSessions() ([]*Session, error)
+	ListSlices(ctx Context, slices *[]Slice) syscall.Errno
+	// doScanNodes calls fn with the attributes of every node, until it returns an error.
+	doScanNodes(ctx Context, fn func(inode Ino, attr *Attr) error) error
+	// doScanEdges calls fn with every entry of all the directories, until it returns an error.
+	doScanEdges(ctx Context, fn func(parent Ino, name string, _type uint8, inode Ino) error) error
+	// doSaveAttr overwrites the attributes of a node as they are.
+	doSaveAttr(inode Ino, attr *Attr) error
+	// doDeleteEdge removes an entry without touching the node it points to.
+	doDeleteEdge(parent Ino, name string) error
+	// doRemoveNode removes a node that no entry points to, with its entries, symlink and xattrs. The chunks
+	// of a file are left to the cleanup of deleted files, and the counters are not updated.
+	doRemoveNode(inode Ino, attr *Attr) error
+	// doListSliceRefs returns the references of the slices (with Chunkid and Size only) that have a record,
+	// the slices without record are referenced once.
+	doListSliceRefs() (map[Slice]int64, error)
+	// doSetSliceRef saves the references of a slice, the one with no reference is deleted by the cleanup.
+	doSetSliceRef(chunkid uint64, size uint32, refs int64) error
+	// doListDelFiles returns the lengths of the deleted files whose chunks are not cleaned yet.
+	doListDelFiles() (map[Ino]uint64, error)
+	doRemoveDelFile(inode Ino, length uint64) error
+
+	// doSaveFormat overwrites the setting of the volume with the JSON of format, and creates the trash
+	// if it's enabled for the first time.
+	doSaveFormat(format *Format, data []byte) error
+
+	// doAppendEvent appends an event at the end of the change log.
+	doAppendEvent(e *Event) error
+	// doReadEvents returns at most limit events after the offset in order, with their offsets.
+	doReadEvents(offset string, limit int) ([]*Event, error)
+	// doTrimEvents removes the events older than the time (in nanoseconds).
+	doTrimEvents(before int64) error
+
+	// doTouchAtime sets the atime of a node if it's newer than the current one, the ctime is not changed.
+	doTouchAtime(inode Ino, atime time.Time) error
+}
+
+type baseMeta struct {
+	sync.Mutex
+	conf *Config
+	en   engine
+
+	format       Format
+	sid          int64
+	openFiles    map[Ino]int
+	removedFiles map[Ino]bool
+	writtenFiles map[Ino]bool
+	compacting   map[uint64]bool
+	symlinks     *sync.Map
+	entryNames   map[Ino]entryName // the entries of the nodes seen, to resolve their paths
+	msgCallbacks *msgCallbacks
+	reloadCbs    []func(*Format)
+	cache        *metaCache // nil if the engine can't invalidate it
+
+	quotaLock sync.RWMutex
+	dirQuotas map[Ino]*Quota
+
+	atimeLock sync.Mutex
+	atimes    map[Ino]time.Time // the files accessed since last flush, with the new atime (zero if not changed)
+
+	freeInodes freeID
+	freeChunks freeID
+
+	// the bucket in the trash for the current hour
+	trashBucketName  string
+	trashBucketInode Ino
+}
+
+type msgCallbacks struct {
+	sync.Mutex
+	callbacks map[uint32]MsgCallback
+}
+
+func newBaseMeta(conf *Config) *baseMeta {
+	return &baseMeta{
+		conf:         conf,
+		openFiles:    make(map[Ino]int),
+		removedFiles: make(map[Ino]bool),
+		writtenFiles: make(map[Ino]bool),
+		compacting:   make(map[uint64]bool),
+		symlinks:     &sync.Map{},
+		entryNames:   make(map[Ino]entryName),
+		dirQuotas:    make(map[Ino]*Quota),
+		atimes:       make(map[Ino]time.Time),
+		msgCallbacks: &msgCallbacks{
+			callbacks: make(map[uint32]MsgCallback),
+		},
+	}
+}
+
+func (m *baseMeta) OnMsg(mtype uint32, cb MsgCallback) {
+	m.msgCallbacks.Lock()
+	defer m.msgCallbacks.Unlock()
+	m.msgCallbacks.callbacks[mtype] = cb
+}
+
+func (m *baseMeta) newMsg(mid uint32, args ...interface{}) error {
+	m.msgCallbacks.Lock()
+	cb, ok := m.msgCallbacks.callbacks[mid]
+	m.msgCallbacks.Unlock()
+	if ok {
+		return cb(args...)
+	}
+	return fmt.Errorf("message %d is not supported", mid)
+}
+
+func (m *baseMeta) ClaimJob(name string, interval time.Duration) (bool, error) {
+	if m.conf.ReadOnly {
+		return false, nil
+	}
+	return m.en.setIfSmall("last"+name, time.Now().Unix(), int64(interval/time.Second))
+}
+
+const (
+	inodeBatch = 1000
+	chunkBatch = 1000
+)
+
+// freeID is a range of IDs [next, maxid) reserved by the client from a counter.
+type freeID struct {
+	sync.Mutex
+	next  uint64
+	maxid uint64
+}
+
+// allocID returns an ID from the range reserved by the client, and reserves another batch
+// from the counter once it's used up. The counter is only increased, so the IDs left in the
+// range when the client exits (or crashes) are never used by anyone, which is safe.
+func (m *baseMeta) allocID(free *freeID, counter string, batch int64) (uint64, error) {
+	free.Lock()
+	defer free.Unlock()
+	if free.next >= free.maxid {
+		v, err := m.en.incrCounter(counter, batch)
+		if err != nil {
+			return 0, err
+		}
+		free.next, free.maxid = uint64(v-batch)+1, uint64(v)+1
+	}
+	id := free.next
+	free.next++
+	return id, nil
+}
+
+func (m *baseMeta) nextInode() (Ino, error) {
+	ino, err := m.allocID(&m.freeInodes, "nextinode", inodeBatch)
+	if err == nil && ino == 1 { // the root
+		ino, err = m.allocID(&m.freeInodes, "nextinode", inodeBatch)
+	}
+	return Ino(ino), err
+}
+
+func (m *baseMeta) nextChunkID() (uint64, error) {
+	return m.allocID(&m.freeChunks, "nextchunk", chunkBatch)
+}
+
+func (m *baseMeta) NewChunk(ctx Context, inode Ino, indx uint32, offset uint32, chunkid *uint64) syscall.Errno {
+	cid, err := m.nextChunkID()
+	if err == nil {
+		*chunkid = cid
+	}
+	return errno(err)
+}
+
+func (m *baseMeta) packEntry(_type uint8, inode Ino) []byte {
+	wb := utils.NewBuffer(9)
+	wb.Put8(_type)
+	wb.Put64(uint64(inode))
+	return wb.Bytes()
+}
+
+func (m *baseMeta) parseEntry(buf []byte) (uint8, Ino) {
+	if len(buf) != 9 {
+		panic("invalid entry")
+	}
+	return buf[0], Ino(binary.BigEndian.Uint64(buf[1:]))
+}
+
+func (m *baseMeta) parseAttr(buf []byte, attr *Attr) {
+	if attr == nil {
+		return
+	}
+	rb := utils.FromBuffer(buf)
+	attr.Flags = rb.Get8()
+	attr.Mode = rb.Get16()
+	attr.Typ = uint8(attr.Mode >> 12)
+	attr.Mode &= 0xfff
+	attr.Uid = rb.Get32()
+	attr.Gid = rb.Get32()
+	attr.Atime = int64(rb.Get64())
+	attr.Atimensec = rb.Get32()
+	attr.Mtime = int64(rb.Get64())
+	attr.Mtimensec = rb.Get32()
+	attr.Ctime = int64(rb.Get64())
+	attr.Ctimensec = rb.Get32()
+	attr.Nlink = rb.Get32()
+	attr.Length = rb.Get64()
+	attr.Rdev = rb.Get32()
+	if rb.Left() >= 8 {
+		attr.Parent = Ino(rb.Get64())
+	}
+	attr.Full = true
+	logger.Tracef("attr: %+v -> %+v", buf, attr)
+}
+
+func (m *baseMeta) marshal(attr *Attr) []byte {
+	w := utils.NewBuffer(36 + 24 + 4 + 8)
+	w.Put8(attr.Flags)
+	w.Put16((uint16(attr.Typ) << 12) | (attr.Mode & 0xfff))
+	w.Put32(attr.Uid)
+	w.Put32(attr.Gid)
+	w.Put64(uint64(attr.Atime))
+	w.Put32(attr.Atimensec)
+	w.Put64(uint64(attr.Mtime))
+	w.Put32(attr.Mtimensec)
+	w.Put64(uint64(attr.Ctime))
+	w.Put32(attr.Ctimensec)
+	w.Put32(attr.Nlink)
+	w.Put64(attr.Length)
+	w.Put32(attr.Rdev)
+	w.Put64(uint64(attr.Parent))
+	logger.Tracef("attr: %+v -> %+v", attr, w.Bytes())
+	return w.Bytes()
+}
+
+func align4K(length uint64) int64 {
+	if length == 0 {
+		return 0
+	}
+	return int64((((length - 1) >> 12) + 1) << 12)
+}
+
+func (m *baseMeta) setFormat(format *Format) {
+	m.Lock()
+	m.format = *format
+	m.Unlock()
+}
+
+// UpdateFormat checks the changes of the setting before saving it. The compression can't be disabled once
+// it's enabled, because the blocks compressed by an algorithm (unlike the plain ones) can't be read partially.
+func (m *baseMeta) UpdateFormat(format *Format) error {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	old, err := m.en.Load()
+	if err != nil {
+		return err
+	}
+	changed := *old
+	changed.AccessKey = format.AccessKey
+	changed.SecretKey = format.SecretKey
+	changed.Bucket = format.Bucket
+	changed.Capacity = format.Capacity
+	changed.Inodes = format.Inodes
+	changed.TrashDays = format.TrashDays
+	changed.EventDays = format.EventDays
+	changed.RetentionDays = format.RetentionDays
+	changed.Compression = format.Compression
+	if changed != *format {
+		return fmt.Errorf("only the credentials, bucket, capacity, inodes, trash days, event days, retention days and compression can be changed")
+	}
+	if format.TrashDays < 0 {
+		return fmt.Errorf("invalid trash days: %d", format.TrashDays)
+	}
+	if format.EventDays < 0 {
+		return fmt.Errorf("invalid event days: %d", format.EventDays)
+	}
+	if format.RetentionDays < 0 {
+		return fmt.Errorf("invalid retention days: %d", format.RetentionDays)
+	}
+	plain := func(algr string) bool { return algr == "" || strings.ToLower(algr) == "none" }
+	if !plain(old.Compression) && plain(format.Compression) {
+		return fmt.Errorf("compression can't be disabled once it's enabled")
+	}
+	data, err := json.MarshalIndent(format, "", "")
+	if err != nil {
+		return fmt.Errorf("json: %s", err)
+	}
+	if err = m.en.doSaveFormat(format, data); err != nil {
+		return err
+	}
+	m.setFormat(format)
+	return nil
+}
+
+func (m *baseMeta) OnReload(cb func(format *Format)) {
+	m.Lock()
+	defer m.Unlock()
+	m.reloadCbs = append(m.reloadCbs, cb)
+}
+
+// refreshFormat reloads the setting regularly, so the changes made by `juicefs config` are applied without remounting.
+func (m *baseMeta) refreshFormat() {
+	for {
+		time.Sleep(time.Minute)
+		m.Lock()
+		old := m.format
+		m.Unlock()
+		format, err := m.en.Load()
+		if err != nil {
+			logger.Warnf("reload setting: %s", err)
+			continue
+		}
+		if *format == old {
+			continue
+		}
+		logger.Infof("Setting of volume %s is changed", format.Name)
+		m.Lock()
+		m.format = *format
+		cbs := m.reloadCbs
+		m.Unlock()
+		for _, cb := range cbs {
+			cb(format)
+		}
+	}
+}
+
+func (m *baseMeta) limits() (capacity, inodes uint64) {
+	m.Lock()
+	defer m.Unlock()
+	return m.format.Capacity, m.format.Inodes
+}
+
+// checkQuota returns ENOSPC if the volume would be beyond its capacity or inodes limit after
+// space bytes and inodes more are used. The usage is read by get only when there is a limit,
+// it should be read within the same transaction for the check to be atomic.
+func (m *baseMeta) checkQuota(space, inodes int64, get func(name string) (int64, error)) error {
+	capacity, maxInodes := m.limits()
+	if space > 0 && capacity > 0 {
+		used, err := get(usedSpace)
+		if err != nil {
+			return err
+		}
+		if used+space > int64(capacity) {
+			return syscall.ENOSPC
+		}
+	}
+	if inodes > 0 && maxInodes > 0 {
+		used, err := get(totalInodes)
+		if err != nil {
+			return err
+		}
+		if used+inodes > int64(maxInodes) {
+			return syscall.ENOSPC
+		}
+	}
+	return nil
+}
+
+func (m *baseMeta) StatFS(ctx Context, inode Ino, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
+	capacity, maxInodes := m.limits()
+	*totalspace = 1 << 50
+	if capacity > 0 {
+		*totalspace = capacity
+	}
+	used, _ := m.en.getCounter(usedSpace)
+	used = ((used >> 16) + 1) << 16 // aligned to 64K
+	*availspace = 0
+	if uint64(used) < *totalspace {
+		*availspace = *totalspace - uint64(used)
+	}
+	inodes, _ := m.en.getCounter(totalInodes)
+	*iused = uint64(inodes)
+	*iavail = 10 << 20
+	if maxInodes > 0 {
+		*iavail = 0
+		if *iused < maxInodes {
+			*iavail = maxInodes - *iused
+		}
+	}
+	// the nearest quota is reported as the size of the file system
+	for _, q := range m.dirQuotasOf(ctx, inode) {
+		maxSpace, maxInodes := atomic.LoadInt64(&q.MaxSpace), atomic.LoadInt64(&q.MaxInodes)
+		if maxSpace <= 0 && maxInodes <= 0 {
+			continue
+		}
+		if maxSpace > 0 {
+			used := atomic.LoadInt64(&q.UsedSpace) + atomic.LoadInt64(&q.newSpace)
+			*totalspace = uint64(maxSpace)
+			*availspace = 0
+			if used < maxSpace {
+				*availspace = uint64(maxSpace - used)
+			}
+		}
+		if maxInodes > 0 {
+			used := atomic.LoadInt64(&q.UsedInodes) + atomic.LoadInt64(&q.newInodes)
+			*iused = uint64(used)
+			*iavail = 0
+			if used < maxInodes {
+				*iavail = uint64(maxInodes - used)
+			}
+		}
+		break
+	}
+	return 0
+}
+
+func (m *baseMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	st := m.lookup(ctx, parent, name, inode, attr)
+	if st == 0 {
+		m.rememberName(*inode, parent, name)
+	}
+	return st
+}
+
+func (m *baseMeta) lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	if parent == 1 {
+		if root := specialRoot(name); root > 0 {
+			if st := m.en.doGetAttr(ctx, root, attr); st != 0 {
+				return st
+			}
+			*inode = root
+			return 0
+		}
+	}
+	if m.cache == nil {
+		return m.en.doLookup(ctx, parent, name, inode, attr)
+	}
+	if ino, ok := m.cache.getEntry(parent, name); ok && m.cache.getAttr(ino, attr) {
+		*inode = ino
+		return 0
+	}
+	gen := m.cache.generation()
+	st := m.en.doLookup(ctx, parent, name, inode, attr)
+	if st == 0 {
+		m.cache.putEntry(gen, parent, name, *inode)
+		m.cache.putAttr(gen, *inode, attr)
+	}
+	return st
+}
+
+func accessMode(attr *Attr, uid uint32, gid uint32) uint8 {
+	if uid == 0 {
+		return 0x7
+	}
+	mode := attr.Mode
+	if uid == attr.Uid {
+		return uint8(mode>>6) & 7
+	}
+	if gid == attr.Gid {
+		return uint8(mode>>3) & 7
+	}
+	return uint8(mode & 7)
+}
+
+func (m *baseMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) syscall.Errno {
+	if ctx.Uid() == 0 {
+		return 0
+	}
+
+	if attr == nil || !attr.Full {
+		if attr == nil {
+			attr = &Attr{}
+		}
+		err := m.GetAttr(ctx, inode, attr)
+		if err != 0 {
+			return err
+		}
+	}
+
+	if attr.Flags&FlagACL != 0 {
+		a, st := m.getACL(ctx, inode, aclAccess)
+		if st != 0 {
+			return st
+		}
+		if a != nil {
+			if !a.check(attr, ctx.Uid(), ctx.Gids(), mmask) {
+				logger.Debugf("Access inode %d denied by ACL, request mode %o", inode, mmask)
+				return syscall.EACCES
+			}
+			return 0
+		}
+	}
+	mode := accessMode(attr, ctx.Uid(), ctx.Gid())
+	if mode&mmask != mmask {
+		logger.Debugf("Access inode %d %o, mode %o, request mode %o", inode, attr.Mode, mode, mmask)
+		return syscall.EACCES
+	}
+	return 0
+}
+
+func (m *baseMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	var err syscall.Errno
+	if m.cache == nil {
+		err = m.en.doGetAttr(ctx, inode, attr)
+	} else if !m.cache.getAttr(inode, attr) {
+		gen := m.cache.generation()
+		if err = m.en.doGetAttr(ctx, inode, attr); err == 0 {
+			m.cache.putAttr(gen, inode, attr)
+		}
+	}
+	if err != 0 && inode == 1 {
+		err = 0
+		attr.Typ = TypeDirectory
+		attr.Mode = 0777
+		attr.Nlink = 2
+		attr.Length = 4 << 10
+	}
+	return err
+}
+
+func (m *baseMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	set &^= SetAttrFlag
+	st := m.en.doSetAttr(withEvent(ctx, m.nodeEvent(ctx, EventSetAttr, inode, ""), nil), inode, set, sugidclearmode, attr)
+	if st == 0 && set&SetAttrMode != 0 && attr.Flags&FlagACL != 0 {
+		// the owner, mask and others in the access ACL follow the permission bits
+		var a acl
+		if a, st = m.getACL(ctx, inode, aclAccess); st == 0 && a != nil {
+			a.chmod(attr.Mode)
+			st = m.en.doSetXattr(ctx, inode, aclAccess, a.encode())
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if st := m.checkFlags(ctx, inode, FlagImmutable|FlagAppend); st != 0 {
+		return st
+	}
+	ectx := withEvent(ctx, m.nodeEvent(ctx, EventSetXattr, inode, name), nil)
+	if isACL(name) {
+		return m.setACL(ectx, inode, name, value)
+	} else if name == RetentionXattr {
+		return m.setRetention(ectx, inode, value)
+	}
+	return m.en.doSetXattr(ectx, inode, name, value)
+}
+
+func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if st := m.checkFlags(ctx, inode, FlagImmutable|FlagAppend); st != 0 {
+		return st
+	}
+	if name == RetentionXattr {
+		return syscall.EPERM
+	}
+	ectx := withEvent(ctx, m.nodeEvent(ctx, EventRemoveXattr, inode, name), nil)
+	if isACL(name) {
+		return m.setACL(ectx, inode, name, nil)
+	}
+	return m.en.doRemoveXattr(ectx, inode, name)
+}
+
+func (m *baseMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
+	if target, ok := m.symlinks.Load(inode); ok {
+		*path = target.([]byte)
+		return 0
+	}
+	target, err := m.en.doReadlink(ctx, inode)
+	if err == nil {
+		*path = target
+		m.symlinks.Store(inode, target)
+	}
+	return errno(err)
+}
+
+func (m *baseMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	return m.mknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
+}
+
+func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	return m.mknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+}
+
+func (m *baseMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	if isReserved(parent, name) {
+		return syscall.EPERM
+	}
+	if inode == nil {
+		inode = new(Ino)
+	}
+	if attr == nil {
+		attr = &Attr{}
+	}
+	qs := m.dirQuotasOf(ctx, parent)
+	if err := m.checkDirQuotas(qs, 0, 1); err != nil {
+		return errno(err)
+	}
+	var dacl, a acl
+	if m.format.EnableACL && _type != TypeSymlink {
+		var st syscall.Errno
+		if dacl, st = m.getACL(ctx, parent, aclDefault); st != 0 {
+			return st
+		}
+		if dacl != nil {
+			// the default ACL of the parent takes the place of umask
+			a, mode = dacl.inherit(mode)
+			cumask = 0
+		}
+	}
+	ectx := withEvent(ctx, m.entryEvent(ctx, EventCreate, 0, parent, name), inode)
+	st := m.en.doMknod(ectx, parent, name, _type, mode, cumask, rdev, path, inode, attr)
+	if st == 0 {
+		m.updateDirQuotas(qs, 0, 1)
+		m.rememberName(*inode, parent, name)
+		if dacl != nil {
+			st = m.inheritACL(ctx, *inode, dacl, a, attr)
+		}
+	}
+	return st
+}
+
+// inheritACL sets the ACLs of a new node inherited from the default ACL of its parent.
+func (m *baseMeta) inheritACL(ctx Context, inode Ino, dacl, a acl, attr *Attr) syscall.Errno {
+	if attr.Typ == TypeDirectory {
+		if st := m.en.doSetXattr(ctx, inode, aclDefault, dacl.encode()); st != 0 {
+			return st
+		}
+	}
+	if a.isMinimal() {
+		return 0
+	}
+	if st := m.en.doSetXattr(ctx, inode, aclAccess, a.encode()); st != 0 {
+		return st
+	}
+	attr.Flags |= FlagACL
+	return m.en.doSetAttr(ctx, inode, SetAttrFlag, 0, attr)
+}
+
+func (m *baseMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
+	return m.Mknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, inode, attr)
+}
+
+func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
+	err := m.Mknod(ctx, parent, name, TypeFile, mode, cumask, 0, inode, attr)
+	if err == 0 && inode != nil {
+		m.Lock()
+		m.openFiles[*inode] = 1
+		m.Unlock()
+	}
+	return err
+}
+
+func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if isReserved(parent, name) {
+		return syscall.EPERM
+	}
+	if st := m.checkFlags(ctx, inode, FlagImmutable|FlagAppend); st != 0 {
+		return st
+	}
+	if st := m.checkFlags(ctx, parent, FlagImmutable); st != 0 {
+		return st
+	}
+	if attr == nil {
+		attr = &Attr{}
+	}
+	return m.en.doLink(withEvent(ctx, m.entryEvent(ctx, EventLink, inode, parent, name), nil), inode, parent, name, attr)
+}
+
+func (m *baseMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		return syscall.EPERM
+	}
+	if attr.Flags&FlagSnapshot != 0 {
+		return syscall.EROFS
+	}
+	if attr.Flags&(FlagImmutable|FlagAppend) != 0 {
+		return syscall.EPERM
+	}
+	if st := m.checkFlags(ctx, parent, FlagImmutable|FlagAppend); st != 0 {
+		return st
+	}
+	if st := m.checkRetention(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	ectx := withEvent(ctx, m.entryEvent(ctx, EventUnlink, inode, parent, name), nil)
+	if m.trashDays() > 0 && attr.Nlink <= 1 && !m.inTrash(ctx, parent) {
+		return m.moveToTrash(ectx, parent, name, inode)
+	}
+	qs := m.dirQuotasOf(ctx, parent)
+	st := m.en.doUnlink(ectx, parent, name)
+	if st == 0 && attr.Nlink <= 1 {
+		m.updateDirQuotas(qs, -align4K(attr.Length), -1)
+	}
+	return st
+}
+
+func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if name == "." {
+		return syscall.EINVAL
+	}
+	if name == ".." {
+		return syscall.ENOTEMPTY
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	if attr.Flags&FlagSnapshot != 0 {
+		return syscall.EROFS
+	}
+	if attr.Flags&(FlagImmutable|FlagAppend) != 0 {
+		return syscall.EPERM
+	}
+	if st := m.checkFlags(ctx, parent, FlagImmutable|FlagAppend); st != 0 {
+		return st
+	}
+	if st := m.checkRetention(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	ectx := withEvent(ctx, m.entryEvent(ctx, EventRmdir, inode, parent, name), nil)
+	if m.trashDays() > 0 && !m.inTrash(ctx, parent) {
+		// the engine refuses to move a directory that is not empty into the trash
+		return m.moveToTrash(ectx, parent, name, inode)
+	}
+	qs := m.dirQuotasOf(ctx, parent)
+	st := m.en.doRmdir(ectx, parent, name)
+	if st == 0 {
+		m.updateDirQuotas(qs, 0, -1)
+		if m.getQuota(inode) != nil {
+			if err := m.en.doDelQuota(inode); err != nil {
+				logger.Warnf("remove quota of directory %d: %s", inode, err)
+			}
+			m.loadQuotas()
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if isReserved(parentDst, nameDst) {
+		return syscall.EPERM
+	}
+	if parentDst != parentSrc {
+		if st := m.checkWritable(ctx, parentDst); st != 0 {
+			return st
+		}
+	}
+	if inode == nil {
+		inode = new(Ino)
+	}
+	e := m.entryEvent(ctx, EventRename, 0, parentSrc, nameSrc)
+	if e != nil {
+		e.DstParent, e.DstName, e.DstPath = parentDst, nameDst, m.entryPath(ctx, parentDst, nameDst)
+	}
+	trash := m.trashDays() > 0 && !m.inTrash(ctx, parentDst)
+	st := m.rename(withEvent(ctx, e, inode), parentSrc, nameSrc, parentDst, nameDst, inode, attr, trash)
+	if st == 0 {
+		m.rememberName(*inode, parentDst, nameDst)
+	}
+	return st
+}
+
+// rename moves the entry after the checks of it, the file overwritten is moved into the trash first if trash is true.
+func (m *baseMeta) rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr, trash bool) syscall.Errno {
+	var sinode, dinode Ino
+	var sattr, dattr Attr
+	if st := m.Lookup(ctx, parentSrc, nameSrc, &sinode, &sattr); st != 0 {
+		return st
+	}
+	if st := m.Lookup(ctx, parentDst, nameDst, &dinode, &dattr); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	if (sattr.Flags|dattr.Flags)&FlagSnapshot != 0 {
+		return syscall.EROFS
+	}
+	if (sattr.Flags|dattr.Flags)&(FlagImmutable|FlagAppend) != 0 {
+		return syscall.EPERM
+	}
+	if dinode != 0 {
+		if st := m.checkRetention(ctx, dinode, &dattr); st != 0 {
+			return st
+		}
+	}
+	if st := m.checkFlags(ctx, parentSrc, FlagImmutable|FlagAppend); st != 0 {
+		return st
+	}
+	if parentDst != parentSrc {
+		// an entry can be added into an append-only directory, but not replaced
+		flags := FlagImmutable
+		if dinode != 0 {
+			flags |= FlagAppend
+		}
+		if st := m.checkFlags(ctx, parentDst, flags); st != 0 {
+			return st
+		}
+	}
+	srcQs, dstQs := m.dirQuotasOf(ctx, parentSrc), m.dirQuotasOf(ctx, parentDst)
+	// the usage is moved between the quotas that contain only one of the parents
+	srcOnly, dstOnly := quotaDiff(srcQs, dstQs), quotaDiff(dstQs, srcQs)
+	var moved Summary
+	if parentSrc != parentDst {
+		if st := m.summary(ctx, sinode, &moved, false); st != 0 {
+			return st
+		}
+	}
+	space, inodes := int64(moved.Size-moved.Dirs*4096), int64(moved.Files+moved.Dirs)
+	if err := m.checkDirQuotas(dstOnly, space, inodes); err != nil {
+		return errno(err)
+	}
+	if trash && dinode > 0 && dinode != sinode && sattr.Typ != TypeDirectory && dattr.Typ != TypeDirectory && dattr.Nlink <= 1 {
+		// the rename is allowed, so the file overwritten can be moved away
+		if st := m.moveToTrash(withoutEvent(ctx), parentDst, nameDst, dinode); st != 0 {
+			return st
+		}
+		dinode = 0
+	}
+	st := m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, inode, attr)
+	if st == 0 {
+		m.updateDirQuotas(srcOnly, -space, -inodes)
+		m.updateDirQuotas(dstOnly, space, inodes)
+		if dinode > 0 && dinode != sinode {
+			if dattr.Typ == TypeDirectory || dattr.Nlink <= 1 {
+				var dspace int64
+				if dattr.Typ != TypeDirectory {
+					dspace = align4K(dattr.Length)
+				}
+				m.updateDirQuotas(dstQs, -dspace, -1)
+			}
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
+	var attr Attr
+	if err := m.GetAttr(ctx, inode, &attr); err != 0 {
+		return err
+	}
+	*entries = []*Entry{
+		{
+			Inode: inode,
+			Name:  []byte("."),
+			Attr:  &Attr{Typ: TypeDirectory},
+		},
+	}
+	if attr.Parent > 0 {
+		*entries = append(*entries, &Entry{
+			Inode: attr.Parent,
+			Name:  []byte(".."),
+			Attr:  &Attr{Typ: TypeDirectory},
+		})
+	}
+	if m.cache == nil || plus == 0 {
+		return m.en.doReaddir(ctx, inode, plus, entries)
+	}
+	gen := m.cache.generation()
+	n := len(*entries)
+	st := m.en.doReaddir(ctx, inode, plus, entries)
+	if st == 0 {
+		for _, e := range (*entries)[n:] {
+			m.cache.putEntry(gen, inode, string(e.Name), e.Inode)
+			m.cache.putAttr(gen, e.Inode, e.Attr)
+		}
+	}
+	return st
+}
+
+// readdirPageSize is the size of a page used when limit is not given.
+const readdirPageSize = 4096
+
+func (m *baseMeta) ReaddirPage(ctx Context, inode Ino, plus uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno {
+	if *cursor == "" {
+		var attr Attr
+		if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+			return st
+		}
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+	}
+	if limit <= 0 {
+		limit = readdirPageSize
+	}
+	if m.cache == nil || plus == 0 {
+		return m.en.doReaddirPage(ctx, inode, plus, cursor, limit, entries)
+	}
+	gen := m.cache.generation()
+	n := len(*entries)
+	st := m.en.doReaddirPage(ctx, inode, plus, cursor, limit, entries)
+	if st == 0 {
+		for _, e := range (*entries)[n:] {
+			m.cache.putEntry(gen, inode, string(e.Name), e.Inode)
+			m.cache.putAttr(gen, e.Inode, e.Attr)
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) emptyDir(ctx Context, inode Ino, concurrent chan int) syscall.Errno {
+	if st := m.Access(ctx, inode, 3, nil); st != 0 {
+		return st
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, inode, 0, &entries); st != 0 {
+		return st
+	}
+	var wg sync.WaitGroup
+	var status syscall.Errno
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
+			continue
+		}
+		if e.Attr.Typ == TypeDirectory {
+			select {
+			case concurrent <- 1:
+				wg.Add(1)
+				go func(child Ino, name string) {
+					defer wg.Done()
+					e := m.emptyEntry(ctx, inode, name, child, concurrent)
+					if e != 0 {
+						status = e
+					}
+					<-concurrent
+				}(e.Inode, string(e.Name))
+			default:
+				if st := m.emptyEntry(ctx, inode, string(e.Name), e.Inode, concurrent); st != 0 {
+					return st
+				}
+			}
+		} else {
+			if st := m.Unlink(ctx, inode, string(e.Name)); st != 0 {
+				return st
+			}
+		}
+	}
+	wg.Wait()
+	return status
+}
+
+func (m *baseMeta) emptyEntry(ctx Context, parent Ino, name string, inode Ino, concurrent chan int) syscall.Errno {
+	st := m.emptyDir(ctx, inode, concurrent)
+	if st == 0 {
+		st = m.Rmdir(ctx, parent, name)
+		if st == syscall.ENOTEMPTY {
+			st = m.emptyEntry(ctx, parent, name, inode, concurrent)
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) Rmr(ctx Context, parent Ino, name string) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if st := m.Access(ctx, parent, 3, nil); st != 0 {
+		return st
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return m.Unlink(ctx, parent, name)
+	}
+	concurrent := make(chan int, 50)
+	return m.emptyEntry(ctx, parent, name, inode, concurrent)
+}
+
+func (m *baseMeta) Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscall.Errno {
+	var err syscall.Errno
+	if attr != nil {
+		err = m.GetAttr(ctx, inode, attr)
+	}
+	if err == 0 {
+		m.Lock()
+		m.openFiles[inode] = m.openFiles[inode] + 1
+		m.Unlock()
+		if flags&syscall.O_WRONLY == 0 {
+			m.TouchAtime(ctx, inode, attr)
+		}
+	}
+	return 0
+}
+
+func (m *baseMeta) Close(ctx Context, inode Ino) syscall.Errno {
+	m.Lock()
+	m.close(inode)
+	// the file is done with once the last reference is closed
+	written := m.writtenFiles[inode] && !m.isOpen(inode)
+	if written {
+		delete(m.writtenFiles, inode)
+	}
+	m.Unlock()
+	if written {
+		m.logEvent(m.nodeEvent(ctx, EventWrite, inode, ""))
+		m.retainWritten(ctx, inode)
+	}
+	return 0
+}
+
+// close drops a reference of the opened file, the caller should hold the lock.
+func (m *baseMeta) close(inode Ino) {
+	refs := m.openFiles[inode]
+	if refs <= 1 {
+		delete(m.openFiles, inode)
+		if m.removedFiles[inode] {
+			delete(m.removedFiles, inode)
+			go func() {
+				if err := m.en.doDeleteSustainedInode(m.sid, inode); err != nil {
+					logger.Errorf("delete sustained inode %d: %s", inode, err)
+				}
+			}()
+		}
+	} else {
+		m.openFiles[inode] = refs - 1
+	}
+}
+
+// isOpen returns whether the inode is opened by this session, the caller should hold the lock.
+func (m *baseMeta) isOpen(inode Ino) bool {
+	return m.openFiles[inode] > 0
+}
+
+func buildSlice(ss []*slice) []Slice {
+	var root *slice
+	for _, s := range ss {
+		if root != nil {
+			var right *slice
+			s.left, right = root.cut(s.pos)
+			_, s.right = right.cut(s.pos + s.len)
+		}
+		root = s
+	}
+	var pos uint32
+	var chunks []Slice
+	root.visit(func(s *slice) {
+		if s.pos > pos {
+			chunks = append(chunks, Slice{Size: s.pos - pos, Len: s.pos - pos})
+			pos = s.pos
+		}
+		chunks = append(chunks, Slice{Chunkid: s.chunkid, Size: s.size, Off: s.off, Len: s.len})
+		pos += s.len
+	})
+	return chunks
+}
@@ -0,0 +1,1846 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// nolint:errcheck
+func testMetaClient(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var parent, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "d", 0640, 022, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "d")
+	if st := m.Lookup(ctx, 1, "d", &parent, attr); st != 0 {
+		t.Fatalf("lookup dir: %s", st)
+	}
+	if st := m.Access(ctx, parent, 4, attr); st != 0 {
+		t.Fatalf("access dir: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0650, 022, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, parent, "f")
+	if st := m.Lookup(ctx, parent, "f", &inode, attr); st != 0 {
+		t.Fatalf("lookup file: %s", st)
+	}
+	attr.Mtime = 2
+	attr.Uid = 1
+	if st := m.SetAttr(ctx, inode, SetAttrMtime|SetAttrUID, 0, attr); st != 0 {
+		t.Fatalf("setattr file %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 {
+		t.Fatalf("getattr file %s", st)
+	}
+	if attr.Mtime != 2 || attr.Uid != 1 {
+		t.Fatalf("mtime:%d uid:%d", attr.Mtime, attr.Uid)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, parent, 0, &entries); st != 0 {
+		t.Fatalf("readdir: %s", st)
+	} else if len(entries) != 3 {
+		t.Fatalf("entries: %d", len(entries))
+	} else if string(entries[0].Name) != "." || string(entries[1].Name) != ".." || string(entries[2].Name) != "f" {
+		t.Fatalf("entries: %+v", entries)
+	}
+	if st := m.Rename(ctx, parent, "f", 1, "f2", &inode, attr); st != 0 {
+		t.Fatalf("rename f %s", st)
+	}
+	defer func() {
+		_ = m.Unlink(ctx, 1, "f2")
+	}()
+	if st := m.Lookup(ctx, 1, "f2", &inode, attr); st != 0 {
+		t.Fatalf("lookup f2: %s", st)
+	}
+
+	// data
+	var chunkid uint64
+	if st := m.Open(ctx, inode, 2, attr); st != 0 {
+		t.Fatalf("open f2: %s", st)
+	}
+	if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
+		t.Fatalf("write chunk: %s", st)
+	}
+	var s = Slice{Chunkid: chunkid, Size: 100, Len: 100}
+	if st := m.Write(ctx, inode, 0, 100, s); st != 0 {
+		t.Fatalf("write end: %s", st)
+	}
+	var chunks []Slice
+	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
+		t.Fatalf("read chunk: %s", st)
+	}
+	if len(chunks) != 2 || chunks[0].Chunkid != 0 || chunks[0].Size != 100 || chunks[1].Chunkid != chunkid || chunks[1].Size != 100 {
+		t.Fatalf("chunks: %v", chunks)
+	}
+	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 100, 50); st != 0 {
+		t.Fatalf("fallocate: %s", st)
+	}
+	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
+		t.Fatalf("read chunk: %s", st)
+	}
+	if len(chunks) != 3 || chunks[1].Chunkid != 0 || chunks[1].Len != 50 || chunks[2].Chunkid != chunkid || chunks[2].Len != 50 {
+		t.Fatalf("chunks: %v", chunks)
+	}
+
+	// xattr
+	if st := m.SetXattr(ctx, inode, "a", []byte("v")); st != 0 {
+		t.Fatalf("setxattr: %s", st)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, inode, "a", &value); st != 0 || string(value) != "v" {
+		t.Fatalf("getxattr: %s %v", st, value)
+	}
+	if st := m.ListXattr(ctx, inode, &value); st != 0 || string(value) != "a\000" {
+		t.Fatalf("listxattr: %s %v", st, value)
+	}
+	if st := m.RemoveXattr(ctx, inode, "a"); st != 0 {
+		t.Fatalf("setxattr: %s", st)
+	}
+
+	// flock
+	if st := m.Flock(ctx, inode, 1, syscall.F_RDLCK, false); st != 0 {
+		t.Fatalf("flock rlock: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 2, syscall.F_RDLCK, false); st != 0 {
+		t.Fatalf("flock rlock: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != syscall.EAGAIN {
+		t.Fatalf("flock wlock: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 2, syscall.F_UNLCK, false); st != 0 {
+		t.Fatalf("flock unlock: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != 0 {
+		t.Fatalf("flock wlock again: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 2, syscall.F_WRLCK, false); st != syscall.EAGAIN {
+		t.Fatalf("flock wlock: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 2, syscall.F_RDLCK, false); st != syscall.EAGAIN {
+		t.Fatalf("flock rlock: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 1, syscall.F_UNLCK, false); st != 0 {
+		t.Fatalf("flock unlock: %s", st)
+	}
+
+	// POSIX locks
+	if st := m.Setlk(ctx, inode, 1, false, syscall.F_RDLCK, 0, 0xFFFF, 1); st != 0 {
+		t.Fatalf("plock rlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 2, false, syscall.F_RDLCK, 0, 0x2FFFF, 1); st != 0 {
+		t.Fatalf("plock rlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 2, false, syscall.F_WRLCK, 0, 0xFFFF, 1); st != syscall.EAGAIN {
+		t.Fatalf("plock wlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 2, false, syscall.F_WRLCK, 0x10000, 0x20000, 1); st != 0 {
+		t.Fatalf("plock wlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 1, false, syscall.F_UNLCK, 0, 0x20000, 1); st != 0 {
+		t.Fatalf("plock unlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 2, false, syscall.F_WRLCK, 0, 0xFFFF, 10); st != 0 {
+		t.Fatalf("plock wlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 1, false, syscall.F_WRLCK, 0, 0xFFFF, 1); st != syscall.EAGAIN {
+		t.Fatalf("plock rlock: %s", st)
+	}
+	var ltype, pid uint32 = syscall.F_WRLCK, 1
+	var start, end uint64 = 0, 0xFFFF
+	if st := m.Getlk(ctx, inode, 1, &ltype, &start, &end, &pid); st != 0 || ltype != syscall.F_WRLCK || pid != 10 || start != 0 || end != 0xFFFF {
+		t.Fatalf("plock get rlock: %s, %d %d %x %x", st, ltype, pid, start, end)
+	}
+	if st := m.Setlk(ctx, inode, 2, false, syscall.F_UNLCK, 0, 0x2FFFF, 1); st != 0 {
+		t.Fatalf("plock unlock: %s", st)
+	}
+	ltype = syscall.F_WRLCK
+	start, end = 0, 0xFFFFFF
+	if st := m.Getlk(ctx, inode, 1, &ltype, &start, &end, &pid); st != 0 || ltype != syscall.F_UNLCK || pid != 0 || start != 0 || end != 0 {
+		t.Fatalf("plock get rlock: %s, %d %d %x %x", st, ltype, pid, start, end)
+	}
+
+	// concurrent locks
+	var g sync.WaitGroup
+	var count int
+	for i := 0; i < 100; i++ {
+		g.Add(1)
+		go func(i int) {
+			defer g.Done()
+			if st := m.Setlk(ctx, inode, uint64(i), true, syscall.F_WRLCK, 0, 0xFFFF, uint32(i)); st != 0 {
+				t.Errorf("plock lock: %s", st)
+			}
+			count++
+			time.Sleep(time.Millisecond)
+			count--
+			if count > 0 {
+				logger.Errorf("count should be be zero but got %d", count)
+			}
+			if st := m.Setlk(ctx, inode, uint64(i), false, syscall.F_UNLCK, 0, 0xFFFF, uint32(i)); st != 0 {
+				t.Errorf("plock unlock: %s", st)
+			}
+		}(i)
+	}
+	g.Wait()
+
+	if st := m.Unlink(ctx, 1, "f2"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+
+	// only one of the sessions can run the job within the interval
+	job := fmt.Sprintf("Test%d", time.Now().UnixNano())
+	var claimed int32
+	for i := 0; i < 10; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			ok, err := m.ClaimJob(job, time.Hour)
+			if err != nil {
+				t.Errorf("claim job: %s", err)
+			}
+			if ok {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	g.Wait()
+	if claimed != 1 {
+		t.Fatalf("job should be claimed once, but got %d", claimed)
+	}
+	if ok, err := m.ClaimJob(job, 0); err != nil || !ok {
+		t.Fatalf("claim job without interval: %v %s", ok, err)
+	}
+}
+
+func testCompaction(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	done := make(chan bool, 1)
+	var l sync.Mutex
+	deleted := make(map[uint64]int)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		l.Lock()
+		chunkid := args[0].(uint64)
+		deleted[chunkid] = 1
+		l.Unlock()
+		return nil
+	})
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		select {
+		case done <- true:
+		default:
+		}
+		return nil
+	})
+	_ = m.NewSession()
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "f", 0650, 022, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer func() {
+		_ = m.Unlink(ctx, 1, "f")
+	}()
+	for i := 0; i < 50; i++ {
+		if st := m.Write(ctx, inode, 0, uint32(i*100), Slice{Chunkid: uint64(i) + 1, Size: 100, Len: 100}); st != 0 {
+			t.Fatalf("write %d: %s", i, st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	var chunks []Slice
+	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
+		t.Fatalf("read 0: %s", st)
+	}
+	if len(chunks) > 20 {
+		t.Fatalf("inode %d should be compacted, but have %d slices", inode, len(chunks))
+	}
+	<-done
+	// wait for it to update chunks
+	time.Sleep(time.Millisecond * 5)
+	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
+		t.Fatalf("read 0: %s", st)
+	}
+	if len(chunks) > 1 {
+		t.Fatalf("inode %d should be compacted after read, but have %d slices", inode, len(chunks))
+	}
+	if chunks[0].Size != 5000 {
+		t.Fatalf("size of slice should be 5000, but got %d", chunks[0].Size)
+	}
+	l.Lock()
+	deletes := len(deleted)
+	l.Unlock()
+	if deletes < 40 {
+		t.Fatalf("deleted chunks %d is less then 40", deletes)
+	}
+}
+
+func testConcurrentWrite(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "f")
+	if st := m.Create(ctx, 1, "f", 0650, 022, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	// nolint:errcheck
+	defer m.Unlink(ctx, 1, "f")
+
+	var errno syscall.Errno
+	var g sync.WaitGroup
+	for i := 0; i <= 20; i++ {
+		g.Add(1)
+		go func(indx uint32) {
+			defer g.Done()
+			for j := 0; j < 100; j++ {
+				var slice = Slice{Chunkid: 1, Size: 100, Len: 100}
+				st := m.Write(ctx, inode, indx, 0, slice)
+				if st != 0 {
+					errno = st
+					break
+				}
+			}
+		}(uint32(i))
+	}
+	g.Wait()
+	if errno != 0 {
+		t.Fatal()
+	}
+}
+
+// nolint:errcheck
+func testCopyFileRange(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+
+	ctx := Background
+	var iin, iout Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "fin")
+	_ = m.Unlink(ctx, 1, "fout")
+	if st := m.Create(ctx, 1, "fin", 0650, 022, &iin, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "fin")
+	if st := m.Create(ctx, 1, "fout", 0650, 022, &iout, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "fout")
+	m.Write(ctx, iin, 0, 100, Slice{10, 200, 0, 100})
+	m.Write(ctx, iin, 1, 100<<10, Slice{11, 100 << 10, 0, 10 << 10})
+	m.Write(ctx, iin, 3, 0, Slice{12, 63 << 20, 10 << 20, 30 << 20})
+	m.Write(ctx, iout, 2, 10<<20, Slice{13, 50 << 20, 10 << 20, 30 << 20})
+	var copied uint64
+	if st := m.CopyFileRange(ctx, iin, 150, iout, 30<<20, 500<<20, 0, &copied); st != 0 {
+		t.Fatalf("copy file range: %s", st)
+	}
+	var expected uint64 = 3*ChunkSize + 30<<20 - 150
+	if copied != expected {
+		t.Fatalf("expect copy %d bytes, but got %d", expected, copied)
+	}
+	var expectedChunks = [][]Slice{
+		{{0, 30 << 20, 0, 30 << 20}, {10, 200, 50, 50}, {0, 0, 200, ChunkSize - 30<<20 - 50}},
+		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {0, 0, 0, 100 << 10}, {11, 100 << 10, 0, 10 << 10}, {0, 0, 110 << 10, ChunkSize - (30<<20 - 150) - 110<<10}},
+		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {0, 0, 0, 150 + (ChunkSize - 30<<20)}},
+		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {12, 63 << 20, 10 << 20, 30 << 20}},
+	}
+	for i := uint32(0); i < 4; i++ {
+		var chunks []Slice
+		if st := m.Read(ctx, iout, i, &chunks); st != 0 {
+			t.Fatalf("read chunk %d: %s", i, st)
+		}
+		if len(chunks) != len(expectedChunks[i]) {
+			t.Fatalf("expect chunk %d: %+v, but got %+v", i, expectedChunks[i], chunks)
+		}
+		for j, s := range chunks {
+			if s != expectedChunks[i][j] {
+				t.Fatalf("expect slice %d,%d: %+v, but got %+v", i, j, expectedChunks[i][j], s)
+			}
+		}
+	}
+}
+
+func testVolumeLimits(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test", Capacity: 1 << 20, Inodes: 2}, true)
+	ctx := Background
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(ctx, 1, &totalspace, &availspace, &iused, &iavail); st != 0 || totalspace != 1<<20 || iused+iavail != 2 {
+		t.Fatalf("statfs: %s, total %d, iused %d, iavail %d", st, totalspace, iused, iavail)
+	}
+	var f1, f2 Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f1", 0644, 022, &f1, &attr); st != 0 {
+		t.Fatalf("create f1: %s", st)
+	}
+	if st := m.Create(ctx, 1, "f2", 0644, 022, &f2, &attr); st != 0 {
+		t.Fatalf("create f2: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, nil, &attr); st != syscall.ENOSPC {
+		t.Fatalf("mkdir beyond inodes limit: %s", st)
+	}
+	// the usage reserved for the refused changes is released
+	if st := m.StatFS(ctx, 1, &totalspace, &availspace, &iused, &iavail); st != 0 || iused != 2 || iavail != 0 {
+		t.Fatalf("statfs: %s, iused %d, iavail %d", st, iused, iavail)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, f1, 0, 0, &chunkid)
+	if st := m.Write(ctx, f1, 0, 0, Slice{chunkid, 1 << 20, 0, 1 << 20}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, f1, 0, 1<<20, Slice{chunkid, 1 << 20, 0, 1}); st != syscall.ENOSPC {
+		t.Fatalf("write beyond capacity: %s", st)
+	}
+	if st := m.Truncate(ctx, f2, 0, 1, &attr); st != syscall.ENOSPC {
+		t.Fatalf("truncate beyond capacity: %s", st)
+	}
+	if st := m.Fallocate(ctx, f2, 0, 0, 1); st != syscall.ENOSPC {
+		t.Fatalf("fallocate beyond capacity: %s", st)
+	}
+	var copied uint64
+	if st := m.CopyFileRange(ctx, f1, 0, f2, 0, 1<<20, 0, &copied); st != syscall.ENOSPC {
+		t.Fatalf("copy_file_range beyond capacity: %s", st)
+	}
+	if st := m.Truncate(ctx, f1, 0, 1<<19, &attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+	if st := m.CopyFileRange(ctx, f1, 0, f2, 0, 1<<19, 0, &copied); st != 0 || copied != 1<<19 {
+		t.Fatalf("copy_file_range: %s, copied %d", st, copied)
+	}
+}
+
+func testDirQuota(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var q, d, f, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "q", 0755, 022, 0, &q, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	quotas := map[string]*Quota{"/q": {MaxSpace: 1 << 20, MaxInodes: 3}}
+	if err := m.HandleQuota(ctx, QuotaSet, "/q", quotas, false); err != nil {
+		t.Fatalf("set quota: %s", err)
+	}
+	if st := m.Create(ctx, q, "f", 0644, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, f, 0, 0, &chunkid)
+	if st := m.Write(ctx, f, 0, 0, Slice{chunkid, 1 << 20, 0, 1 << 20}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, f, 0, 1<<20, Slice{chunkid, 1 << 20, 0, 1}); st != syscall.EDQUOT {
+		t.Fatalf("write beyond quota: %s", st)
+	}
+	if st := m.Mkdir(ctx, q, "d", 0755, 022, 0, &d, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, d, "g", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Mknod(ctx, q, "h", TypeFile, 0644, 022, 0, &inode, &attr); st != syscall.EDQUOT {
+		t.Fatalf("mknod beyond quota: %s", st)
+	}
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(ctx, d, &totalspace, &availspace, &iused, &iavail); st != 0 || totalspace != 1<<20 || availspace != 0 || iused != 3 || iavail != 0 {
+		t.Fatalf("statfs in quota: %s, %d %d %d %d", st, totalspace, availspace, iused, iavail)
+	}
+
+	// move the file out of the quota, then into a sub-directory
+	if st := m.Rename(ctx, q, "f", 1, "f", &inode, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	if err := m.HandleQuota(ctx, QuotaGet, "/q", quotas, false); err != nil || quotas["/q"].UsedSpace != 0 || quotas["/q"].UsedInodes != 2 {
+		t.Fatalf("get quota: %s %+v", err, quotas["/q"])
+	}
+	if st := m.Rename(ctx, 1, "f", d, "f", &inode, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	if st := m.Truncate(ctx, f, 0, 1<<20+1, &attr); st != syscall.EDQUOT {
+		t.Fatalf("truncate beyond quota: %s", st)
+	}
+	if st := m.Unlink(ctx, d, "g"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if err := m.HandleQuota(ctx, QuotaGet, "/q", quotas, false); err != nil || quotas["/q"].UsedSpace != 1<<20 || quotas["/q"].UsedInodes != 2 {
+		t.Fatalf("get quota: %s %+v", err, quotas["/q"])
+	}
+
+	// the usage could be fixed by check
+	if err := m.(engine).doSetQuota(q, &Quota{MaxSpace: 1 << 20, MaxInodes: 3, UsedSpace: 100, UsedInodes: 100}); err != nil {
+		t.Fatalf("set usage: %s", err)
+	}
+	quotas = make(map[string]*Quota)
+	if err := m.HandleQuota(ctx, QuotaCheck, "", quotas, true); err != nil || quotas["/q"] == nil {
+		t.Fatalf("check quota: %s %+v", err, quotas)
+	}
+	if err := m.HandleQuota(ctx, QuotaGet, "/q", quotas, false); err != nil || quotas["/q"].UsedSpace != 1<<20 || quotas["/q"].UsedInodes != 2 {
+		t.Fatalf("get quota after check: %s %+v", err, quotas["/q"])
+	}
+
+	quotas = make(map[string]*Quota)
+	if err := m.HandleQuota(ctx, QuotaList, "", quotas, false); err != nil || len(quotas) != 1 || quotas["/q"] == nil {
+		t.Fatalf("list quotas: %s %+v", err, quotas)
+	}
+	if err := m.HandleQuota(ctx, QuotaDel, "/q", nil, false); err != nil {
+		t.Fatalf("delete quota: %s", err)
+	}
+	if st := m.Mknod(ctx, q, "h", TypeFile, 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mknod without quota: %s", st)
+	}
+}
+
+func testTrash(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+	_ = m.Init(Format{Name: "test", TrashDays: 1}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var d, f, g, e, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &d, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, d, "f", 0644, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Lookup(ctx, 1, TrashName, &inode, &attr); st != 0 || inode != TrashInode {
+		t.Fatalf("lookup trash: %s %d", st, inode)
+	}
+	if st := m.Create(ctx, TrashInode, "x", 0644, 022, &inode, &attr); st != syscall.EPERM {
+		t.Fatalf("create in trash should fail: %s", st)
+	}
+	if st := m.Unlink(ctx, d, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	var buckets []*Entry
+	if st := m.Readdir(ctx, TrashInode, 0, &buckets); st != 0 || len(buckets) != 3 {
+		t.Fatalf("readdir trash: %s %d", st, len(buckets))
+	}
+	bucket := buckets[2].Inode
+	name := trashEntryName(d, f, "f")
+	if st := m.Lookup(ctx, bucket, name, &inode, &attr); st != 0 || inode != f {
+		t.Fatalf("lookup %s in trash: %s %d", name, st, inode)
+	}
+	// restore it
+	if st := m.Rename(ctx, bucket, name, d, "f", &inode, &attr); st != 0 {
+		t.Fatalf("rename back: %s", st)
+	}
+
+	if st := m.Create(ctx, d, "g", 0644, 022, &g, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, g)
+	if st := m.Rename(ctx, d, "f", d, "g", &inode, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	if st := m.Lookup(ctx, bucket, trashEntryName(d, g, "g"), &inode, &attr); st != 0 || inode != g {
+		t.Fatalf("overwritten file is not in trash: %s", st)
+	}
+	// the file that would be overwritten is kept if the rename is refused
+	var h Ino
+	if st := m.Create(ctx, d, "h", 0644, 022, &h, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, h)
+	if st := m.SetFlags(ctx, h, FlagImmutable); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+	if st := m.Rename(ctx, d, "h", d, "g", &inode, &attr); st != syscall.EPERM {
+		t.Fatalf("rename immutable file: %s", st)
+	}
+	if st := m.Lookup(ctx, d, "g", &inode, &attr); st != 0 || inode != f {
+		t.Fatalf("lookup the file not overwritten: %s %d", st, inode)
+	}
+	if st := m.SetFlags(ctx, h, 0); st != 0 {
+		t.Fatalf("clear flags: %s", st)
+	}
+	if st := m.Unlink(ctx, d, "h"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Mkdir(ctx, d, "e", 0755, 022, 0, &e, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != syscall.ENOTEMPTY {
+		t.Fatalf("rmdir non-empty directory: %s", st)
+	}
+	if st := m.Rmr(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmr: %s", st)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, bucket, 0, &entries); st != 0 || len(entries) != 7 {
+		t.Fatalf("readdir bucket: %s %d", st, len(entries))
+	}
+	// remove from the trash for good
+	if st := m.Unlink(ctx, bucket, trashEntryName(d, g, "g")); st != 0 {
+		t.Fatalf("unlink in trash: %s", st)
+	}
+	if st := m.GetAttr(ctx, g, &attr); st != syscall.ENOENT {
+		t.Fatalf("file removed from trash still exists: %s", st)
+	}
+
+	cleaner, ok := m.(interface{ doCleanupTrash(time.Time) })
+	if !ok {
+		t.Fatalf("no cleanup of trash")
+	}
+	cleaner.doCleanupTrash(time.Now())
+	if st := m.GetAttr(ctx, bucket, &attr); st != 0 {
+		t.Fatalf("bucket within retention is purged: %s", st)
+	}
+	cleaner.doCleanupTrash(time.Now().Add(time.Hour * 26))
+	if st := m.GetAttr(ctx, bucket, &attr); st != syscall.ENOENT {
+		t.Fatalf("bucket is not purged: %s", st)
+	}
+	if st := m.GetAttr(ctx, e, &attr); st != syscall.ENOENT {
+		t.Fatalf("directory in bucket is not purged: %s", st)
+	}
+	if st := m.Readdir(ctx, TrashInode, 0, &buckets); st != 0 || len(buckets) != 2 {
+		t.Fatalf("readdir trash: %s %d", st, len(buckets))
+	}
+}
+
+func testDirStats(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var a, b, c, f, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "a", 0755, 022, 0, &a, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(ctx, a, "b", 0755, 022, 0, &b, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "c", 0755, 022, 0, &c, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, b, "f", 0644, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, f, 0, 0, &chunkid)
+	if st := m.Write(ctx, f, 0, 0, Slice{chunkid, 5000, 0, 5000}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Symlink(ctx, b, "s", "f", &inode, &attr); st != 0 {
+		t.Fatalf("symlink: %s", st)
+	}
+	if st := m.Link(ctx, f, c, "h", &attr); st != 0 {
+		t.Fatalf("link: %s", st)
+	}
+	check := func(inode Ino, expected Summary) {
+		var s Summary
+		if st := m.Summary(ctx, inode, &s); st != 0 || s != expected {
+			t.Fatalf("summary of %d: %s %+v, expected %+v", inode, st, s, expected)
+		}
+	}
+	check(a, Summary{Length: 5001, Size: 4096*3 + 8192, Files: 2, Dirs: 2})
+	check(c, Summary{Length: 5000, Size: 4096 + 8192, Files: 1, Dirs: 1})
+	check(1, Summary{Length: 10001, Size: 4096*5 + 8192*2, Files: 3, Dirs: 4})
+
+	// a file with hardlinks is counted in all its parents
+	if st := m.Truncate(ctx, f, 0, 6000, &attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+	check(a, Summary{Length: 6001, Size: 4096*3 + 8192, Files: 2, Dirs: 2})
+	check(c, Summary{Length: 6000, Size: 4096 + 8192, Files: 1, Dirs: 1})
+	if st := m.Truncate(ctx, f, 0, 5000, &attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+
+	if st := m.Rename(ctx, a, "b", c, "b", &inode, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	check(a, Summary{Size: 4096, Dirs: 1})
+	check(c, Summary{Length: 10001, Size: 4096*3 + 8192*2, Files: 3, Dirs: 2})
+	if st := m.Unlink(ctx, c, "h"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Truncate(ctx, f, 0, 100, &attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+	check(c, Summary{Length: 101, Size: 4096 * 4, Files: 2, Dirs: 2})
+	if st := m.Unlink(ctx, b, "s"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "a"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+	check(1, Summary{Length: 100, Size: 4096 * 4, Files: 1, Dirs: 3})
+
+	if n, err := m.CheckDirStats(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check stats: %d %s", n, err)
+	}
+	en := m.(engine)
+	if err := en.doSetDirStat(c, &dirStat{length: 1}); err != nil {
+		t.Fatalf("set stats: %s", err)
+	}
+	if err := en.doDelDirStat(b); err != nil {
+		t.Fatalf("remove stats: %s", err)
+	}
+	// a directory without stats is walked through
+	check(b, Summary{Length: 100, Size: 4096 * 2, Files: 1, Dirs: 1})
+	if n, err := m.CheckDirStats(ctx, true); err != nil || n != 2 {
+		t.Fatalf("repair stats: %d %s", n, err)
+	}
+	if n, err := m.CheckDirStats(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check stats after repair: %d %s", n, err)
+	}
+	check(c, Summary{Length: 100, Size: 4096 * 3, Files: 1, Dirs: 2})
+}
+
+func testUpdateFormat(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test", Compression: "lz4"}, true)
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	changed := *format
+	changed.BlockSize = 1024
+	if err = m.UpdateFormat(&changed); err == nil {
+		t.Fatalf("block size should not be changed")
+	}
+	changed = *format
+	changed.TrashDays = -1
+	if err = m.UpdateFormat(&changed); err == nil {
+		t.Fatalf("negative trash days should fail")
+	}
+	changed.TrashDays = 1
+	changed.Compression = "none"
+	if err = m.UpdateFormat(&changed); err == nil {
+		t.Fatalf("compression should not be disabled")
+	}
+	changed.Compression = "zstd"
+	changed.Capacity = 1 << 30
+	changed.AccessKey = "ak"
+	if err = m.UpdateFormat(&changed); err != nil {
+		t.Fatalf("update format: %s", err)
+	}
+	if format, err = m.Load(); err != nil || *format != changed {
+		t.Fatalf("load updated format: %+v %s", format, err)
+	}
+	var attr Attr
+	if st := m.GetAttr(Background, TrashInode, &attr); st != 0 || attr.Typ != TypeDirectory {
+		t.Fatalf("trash is not created: %s", st)
+	}
+}
+
+func testEvents(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	format.EventDays = 1
+	if err = m.UpdateFormat(format); err != nil {
+		t.Fatalf("enable change log: %s", err)
+	}
+	ctx := Background
+	var parent, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &parent, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var chunkid uint64
+	if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	m.Close(ctx, inode)
+	if st := m.Rename(ctx, parent, "f", 1, "g", nil, nil); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, "user.k", []byte("v")); st != 0 {
+		t.Fatalf("setxattr: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "g"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	// the failed changes are not logged
+	if st := m.RemoveXattr(ctx, parent, "user.k"); st != ENOATTR {
+		t.Fatalf("removexattr: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+
+	expected := []Event{
+		{Type: EventCreate, Inode: parent, Parent: 1, Name: "d", Path: "/d"},
+		{Type: EventCreate, Inode: inode, Parent: parent, Name: "f", Path: "/d/f"},
+		{Type: EventWrite, Inode: inode, Parent: parent, Path: "/d/f"},
+		{Type: EventRename, Inode: inode, Parent: parent, Name: "f", DstParent: 1, DstName: "g", Path: "/d/f", DstPath: "/g"},
+		{Type: EventSetXattr, Inode: inode, Parent: 1, Name: "user.k", Path: "/g"},
+		{Type: EventUnlink, Inode: inode, Parent: 1, Name: "g", Path: "/g"},
+		{Type: EventRmdir, Inode: parent, Parent: 1, Name: "d", Path: "/d"},
+	}
+	var events []*Event
+	var offset string
+	for {
+		n := len(events)
+		if st := m.ReadEvents(ctx, &offset, 3, &events); st != 0 {
+			t.Fatalf("read events: %s", st)
+		}
+		if len(events) == n {
+			break
+		}
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expect %d events, but got %d", len(expected), len(events))
+	}
+	for i, e := range events {
+		got := *e
+		got.Offset, got.Time = "", 0
+		if got != expected[i] {
+			t.Fatalf("event %d: expect %+v, but got %+v", i, expected[i], got)
+		}
+	}
+	// resume from the offset of an event
+	offset = events[4].Offset
+	var rest []*Event
+	if st := m.ReadEvents(ctx, &offset, 0, &rest); st != 0 || len(rest) != 2 || rest[0].Type != EventUnlink {
+		t.Fatalf("read events after %s: %s %d", events[4].Offset, st, len(rest))
+	}
+}
+
+func testCheckMeta(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var a, b, f, g, o Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "a", 0755, 022, 0, &a, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(ctx, a, "b", 0755, 022, 0, &b, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, a, "f", 0644, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, f, 0, 0, &chunkid)
+	if st := m.Write(ctx, f, 0, 0, Slice{chunkid, 5000, 0, 5000}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Link(ctx, f, 1, "h", &attr); st != 0 {
+		t.Fatalf("link: %s", st)
+	}
+	if st := m.Create(ctx, 1, "g", 0644, 022, &g, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Create(ctx, 1, "o", 0644, 022, &o, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if n, err := m.CheckMeta(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check meta: %d %s", n, err)
+	}
+
+	en := m.(engine)
+	// an entry pointing to nothing, and an orphan file (which drifts totalInodes)
+	if err := en.doLoadEdge(a, "dangling", TypeFile, 9999999); err != nil {
+		t.Fatalf("load edge: %s", err)
+	}
+	if err := en.doDeleteEdge(1, "o"); err != nil {
+		t.Fatalf("delete edge: %s", err)
+	}
+	// wrong links and parent
+	setAttr := func(inode Ino, fn func(attr *Attr)) {
+		var attr Attr
+		if st := en.doGetAttr(ctx, inode, &attr); st != 0 {
+			t.Fatalf("getattr %d: %s", inode, st)
+		}
+		fn(&attr)
+		if err := en.doSaveAttr(inode, &attr); err != nil {
+			t.Fatalf("save attr %d: %s", inode, err)
+		}
+	}
+	setAttr(a, func(attr *Attr) { attr.Nlink = 5 })
+	setAttr(b, func(attr *Attr) { attr.Parent = 1 })
+	setAttr(f, func(attr *Attr) { attr.Nlink = 1 })
+	// drifted counter, wrong and leaked references of slices
+	if err := en.setCounter(usedSpace, 1); err != nil {
+		t.Fatalf("set counter: %s", err)
+	}
+	if err := en.doSetSliceRef(chunkid, 5000, 5); err != nil {
+		t.Fatalf("set references: %s", err)
+	}
+	if err := en.doSetSliceRef(chunkid+1000, 100, 2); err != nil {
+		t.Fatalf("set references: %s", err)
+	}
+	// a deleted file that still exists
+	if st := en.doGetAttr(ctx, g, &attr); st != 0 {
+		t.Fatalf("getattr: %s", st)
+	}
+	if err := en.doRemoveNode(g, &attr); err != nil {
+		t.Fatalf("remove node: %s", err)
+	}
+	if err := en.doLoadNode(&loadedNode{inode: g, attr: attr}); err != nil {
+		t.Fatalf("load node: %s", err)
+	}
+
+	if n, err := m.CheckMeta(ctx, false); err != nil || n != 10 {
+		t.Fatalf("check meta: %d %s", n, err)
+	}
+	if n, err := m.CheckMeta(ctx, true); err != nil || n != 10 {
+		t.Fatalf("repair meta: %d %s", n, err)
+	}
+	if n, err := m.CheckMeta(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check meta after repair: %d %s", n, err)
+	}
+	if st := en.doGetAttr(ctx, o, &attr); st != syscall.ENOENT {
+		t.Fatalf("orphan is not removed: %s", st)
+	}
+	if st := en.doGetAttr(ctx, f, &attr); st != 0 || attr.Nlink != 2 {
+		t.Fatalf("links of hard-linked file: %s %d", st, attr.Nlink)
+	}
+	if st := en.doGetAttr(ctx, b, &attr); st != 0 || attr.Parent != a {
+		t.Fatalf("parent of directory: %s %d", st, attr.Parent)
+	}
+	if v, err := en.getCounter(usedSpace); err != nil || v != 8192 {
+		t.Fatalf("used space: %d %s", v, err)
+	}
+}
+
+func testRepairWithClients(t *testing.T, m, other Meta) {
+	if err := other.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	if _, err := m.CheckMeta(Background, false); err != nil {
+		t.Fatalf("check meta with another client: %s", err)
+	}
+	if _, err := m.CheckMeta(Background, true); err == nil {
+		t.Fatalf("repair should be refused while another client is active")
+	}
+}
+
+func testClone(t *testing.T, m Meta) {
+	var deleted int32
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		atomic.AddInt32(&deleted, 1)
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var d, f, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &d, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(ctx, d, "sub", 0700, 022, 0, nil, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, d, "f", 0644, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, f, 0, 0, &chunkid)
+	if st := m.Write(ctx, f, 1, 0, Slice{chunkid, 5000, 0, 5000}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	_ = m.Close(ctx, f)
+	if st := m.SetXattr(ctx, f, "user.a", []byte("v")); st != 0 {
+		t.Fatalf("setxattr: %s", st)
+	}
+	if st := m.Symlink(ctx, d, "s", "f", nil, &attr); st != 0 {
+		t.Fatalf("symlink: %s", st)
+	}
+
+	if st := m.Clone(ctx, d, d, "c"); st != syscall.EINVAL {
+		t.Fatalf("clone into itself should fail: %s", st)
+	}
+	if st := m.Clone(ctx, d, 1, "d"); st != syscall.EEXIST {
+		t.Fatalf("clone to an existing entry should fail: %s", st)
+	}
+	if st := m.Clone(ctx, d, 1, "c"); st != 0 {
+		t.Fatalf("clone: %s", st)
+	}
+	var c Ino
+	var cattr Attr
+	if st := m.Lookup(ctx, 1, "c", &c, &cattr); st != 0 || cattr.Typ != TypeDirectory || cattr.Nlink != 3 || cattr.Mode != 0755 {
+		t.Fatalf("lookup clone: %s %+v", st, cattr)
+	}
+	if st := m.Lookup(ctx, c, "sub", &inode, &attr); st != 0 || attr.Mode != 0700 || attr.Parent != c {
+		t.Fatalf("lookup sub: %s %+v", st, attr)
+	}
+	var cf Ino
+	if st := m.Lookup(ctx, c, "f", &cf, &attr); st != 0 || cf == f || attr.Length != ChunkSize+5000 || attr.Nlink != 1 {
+		t.Fatalf("lookup cloned file: %s %d %+v", st, cf, attr)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, cf, "user.a", &value); st != 0 || string(value) != "v" {
+		t.Fatalf("getxattr: %s %s", st, value)
+	}
+	var target []byte
+	if st := m.Lookup(ctx, c, "s", &inode, &attr); st != 0 {
+		t.Fatalf("lookup symlink: %s", st)
+	}
+	if st := m.ReadLink(ctx, inode, &target); st != 0 || string(target) != "f" {
+		t.Fatalf("readlink: %s %s", st, target)
+	}
+	var src, dst Summary
+	_ = m.Summary(ctx, d, &src)
+	if st := m.Summary(ctx, c, &dst); st != 0 || dst != src {
+		t.Fatalf("summary of clone: %s %+v != %+v", st, dst, src)
+	}
+	if n, err := m.CheckDirStats(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check stats: %d %s", n, err)
+	}
+	en := m.(engine)
+	inodes, _ := en.getCounter(totalInodes)
+	used, _ := en.getCounter(usedSpace)
+	if inodes != 8 || used != 2*align4K(ChunkSize+5000) {
+		t.Fatalf("usage after clone: %d inodes, %d bytes", inodes, used)
+	}
+
+	// the data is shared until both of them are removed
+	if st := m.Unlink(ctx, d, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	var slices []Slice
+	if st := m.Read(ctx, cf, 1, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+		t.Fatalf("read clone: %s %+v", st, slices)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if n := atomic.LoadInt32(&deleted); n != 0 {
+		t.Fatalf("%d chunks are deleted while they're still used", n)
+	}
+	if st := m.Unlink(ctx, c, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	for i := 0; i < 20 && atomic.LoadInt32(&deleted) == 0; i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if n := atomic.LoadInt32(&deleted); n != 1 {
+		t.Fatalf("deleted chunks: %d", n)
+	}
+}
+
+func testSnapshot(t *testing.T, m Meta) {
+	var deleted int32
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		atomic.AddInt32(&deleted, 1)
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var d, f, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &d, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mknod(ctx, d, "f", TypeFile, 0644, 022, 0, &f, &attr); st != 0 {
+		t.Fatalf("mknod: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, f, 0, 0, &chunkid)
+	if st := m.Write(ctx, f, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotCreate, "s1", "/d", nil); err != nil {
+		t.Fatalf("create snapshot: %s", err)
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotCreate, "s1", "/d", nil); err == nil {
+		t.Fatalf("snapshot with an existing name should fail")
+	}
+	if st := m.Lookup(ctx, 1, SnapshotName, &inode, &attr); st != 0 || inode != SnapshotInode {
+		t.Fatalf("lookup snapshots: %s %d", st, inode)
+	}
+	var s1, sf Ino
+	if st := m.Lookup(ctx, SnapshotInode, "s1", &s1, &attr); st != 0 || attr.Flags&FlagSnapshot == 0 {
+		t.Fatalf("lookup snapshot: %s %+v", st, attr)
+	}
+	if st := m.Lookup(ctx, s1, "f", &sf, &attr); st != 0 || attr.Length != 100 {
+		t.Fatalf("lookup file in snapshot: %s %+v", st, attr)
+	}
+
+	// nothing in a snapshot can be changed
+	if st := m.Mkdir(ctx, SnapshotInode, "x", 0755, 022, 0, nil, &attr); st != syscall.EPERM {
+		t.Fatalf("mkdir in snapshots: %s", st)
+	}
+	if st := m.Create(ctx, s1, "x", 0644, 022, nil, &attr); st != syscall.EROFS {
+		t.Fatalf("create in snapshot: %s", st)
+	}
+	if st := m.Unlink(ctx, s1, "f"); st != syscall.EROFS {
+		t.Fatalf("unlink in snapshot: %s", st)
+	}
+	if st := m.Rmdir(ctx, SnapshotInode, "s1"); st != syscall.EROFS {
+		t.Fatalf("rmdir snapshot: %s", st)
+	}
+	if st := m.Rename(ctx, s1, "f", 1, "f", &inode, &attr); st != syscall.EROFS {
+		t.Fatalf("rename out of snapshot: %s", st)
+	}
+	if st := m.Rename(ctx, d, "f", s1, "f2", &inode, &attr); st != syscall.EROFS {
+		t.Fatalf("rename into snapshot: %s", st)
+	}
+	if st := m.Write(ctx, sf, 0, 0, Slice{chunkid, 100, 0, 100}); st != syscall.EROFS {
+		t.Fatalf("write in snapshot: %s", st)
+	}
+	if st := m.Truncate(ctx, sf, 0, 0, &attr); st != syscall.EROFS {
+		t.Fatalf("truncate in snapshot: %s", st)
+	}
+	if st := m.SetAttr(ctx, sf, SetAttrMode, 0, &Attr{Mode: 0777}); st != syscall.EROFS {
+		t.Fatalf("chmod in snapshot: %s", st)
+	}
+	if st := m.SetXattr(ctx, sf, "user.a", []byte("v")); st != syscall.EROFS {
+		t.Fatalf("setxattr in snapshot: %s", st)
+	}
+
+	// the data is kept for the snapshot
+	if st := m.Unlink(ctx, d, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	var slices []Slice
+	if st := m.Read(ctx, sf, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+		t.Fatalf("read snapshot: %s %+v", st, slices)
+	}
+	// a clone out of a snapshot is writable
+	if st := m.Clone(ctx, s1, 1, "r"); st != 0 {
+		t.Fatalf("clone snapshot: %s", st)
+	}
+	var r Ino
+	if st := m.Lookup(ctx, 1, "r", &r, &attr); st != 0 || attr.Flags != 0 {
+		t.Fatalf("lookup restored: %s %+v", st, attr)
+	}
+	if st := m.Unlink(ctx, r, "f"); st != 0 {
+		t.Fatalf("unlink restored: %s", st)
+	}
+
+	snapshots := make(map[string]*Snapshot)
+	if err := m.HandleSnapshot(ctx, SnapshotList, "", "", snapshots); err != nil || len(snapshots) != 1 {
+		t.Fatalf("list snapshots: %s %+v", err, snapshots)
+	}
+	if s := snapshots["s1"]; s == nil || s.Inode != s1 || s.Summary.Files != 1 || s.Summary.Length != 100 {
+		t.Fatalf("snapshot s1: %+v", s)
+	}
+	if n, err := m.CheckDirStats(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check stats: %d %s", n, err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if n := atomic.LoadInt32(&deleted); n != 0 {
+		t.Fatalf("%d chunks are deleted while they're in snapshot", n)
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotDel, "s1", "", nil); err != nil {
+		t.Fatalf("delete snapshot: %s", err)
+	}
+	snapshots = make(map[string]*Snapshot)
+	if err := m.HandleSnapshot(ctx, SnapshotList, "", "", snapshots); err != nil || len(snapshots) != 0 {
+		t.Fatalf("list snapshots: %s %+v", err, snapshots)
+	}
+	for i := 0; i < 20 && atomic.LoadInt32(&deleted) == 0; i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if n := atomic.LoadInt32(&deleted); n != 1 {
+		t.Fatalf("deleted chunks: %d", n)
+	}
+}
+
+func testACL(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test", EnableACL: true}, true)
+	ctx := Background
+	user := NewContext(100, 1000, []uint32{1000})
+	var d, f, sub Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &d, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Access(user, d, 2, nil); st != syscall.EACCES {
+		t.Fatalf("write d without ACL: %s", st)
+	}
+	access := acl{{aclUserObj, 7, aclUndefined}, {aclUser, 7, 1000}, {aclGroupObj, 5, aclUndefined}, {aclMask, 7, aclUndefined}, {aclOther, 5, aclUndefined}}
+	if st := m.SetXattr(user, d, aclAccess, access.encode()); st != syscall.EPERM {
+		t.Fatalf("set ACL by others: %s", st)
+	}
+	if st := m.SetXattr(ctx, d, aclAccess, []byte("invalid")); st != syscall.EINVAL {
+		t.Fatalf("set invalid ACL: %s", st)
+	}
+	if st := m.SetXattr(ctx, d, aclAccess, access.encode()); st != 0 {
+		t.Fatalf("set ACL: %s", st)
+	}
+	if st := m.GetAttr(ctx, d, &attr); st != 0 || attr.Mode != 0775 || attr.Flags&FlagACL == 0 {
+		t.Fatalf("attr after set ACL: %s %o %d", st, attr.Mode, attr.Flags)
+	}
+	if st := m.Access(user, d, 7, nil); st != 0 {
+		t.Fatalf("access d with ACL: %s", st)
+	}
+	// the mask follows the permission of group
+	attr.Mode = 0755
+	if st := m.SetAttr(ctx, d, SetAttrMode, 0, &attr); st != 0 {
+		t.Fatalf("chmod: %s", st)
+	}
+	if st := m.Access(user, d, 2, nil); st != syscall.EACCES {
+		t.Fatalf("write d after chmod: %s", st)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, d, aclAccess, &value); st != 0 {
+		t.Fatalf("get ACL: %s", st)
+	}
+	if a, err := parseACL(value); err != nil || a.entry(aclMask).perm != 5 || a.entry(aclUser).perm != 7 {
+		t.Fatalf("ACL after chmod: %s %+v", err, a)
+	}
+
+	def := acl{{aclUserObj, 7, aclUndefined}, {aclUser, 6, 1000}, {aclGroupObj, 5, aclUndefined}, {aclMask, 7, aclUndefined}, {aclOther, 0, aclUndefined}}
+	if st := m.SetXattr(ctx, d, aclDefault, def.encode()); st != 0 {
+		t.Fatalf("set default ACL: %s", st)
+	}
+	if st := m.Create(ctx, d, "f", 0666, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if attr.Mode != 0660 || attr.Flags&FlagACL == 0 {
+		t.Fatalf("inherited mode %o flags %d", attr.Mode, attr.Flags)
+	}
+	if st := m.Access(user, f, 6, nil); st != 0 {
+		t.Fatalf("access inherited ACL: %s", st)
+	}
+	if st := m.SetXattr(ctx, f, aclDefault, def.encode()); st != syscall.EACCES {
+		t.Fatalf("set default ACL of file: %s", st)
+	}
+	if st := m.Mkdir(ctx, d, "sub", 0777, 022, 0, &sub, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.GetXattr(ctx, sub, aclDefault, &value); st != 0 || !bytes.Equal(value, def.encode()) {
+		t.Fatalf("inherited default ACL: %s %v", st, value)
+	}
+
+	if st := m.RemoveXattr(ctx, f, aclAccess); st != 0 {
+		t.Fatalf("remove ACL: %s", st)
+	}
+	if st := m.GetAttr(ctx, f, &attr); st != 0 || attr.Flags&FlagACL != 0 {
+		t.Fatalf("flags after remove ACL: %s %d", st, attr.Flags)
+	}
+	if st := m.Access(user, f, 2, nil); st != syscall.EACCES {
+		t.Fatalf("access after remove ACL: %s", st)
+	}
+	minimal := acl{{aclUserObj, 6, aclUndefined}, {aclGroupObj, 4, aclUndefined}, {aclOther, 4, aclUndefined}}
+	if st := m.SetXattr(ctx, f, aclAccess, minimal.encode()); st != 0 {
+		t.Fatalf("set minimal ACL: %s", st)
+	}
+	if st := m.GetAttr(ctx, f, &attr); st != 0 || attr.Mode != 0644 || attr.Flags&FlagACL != 0 {
+		t.Fatalf("attr after minimal ACL: %s %o %d", st, attr.Mode, attr.Flags)
+	}
+	if st := m.GetXattr(ctx, f, aclAccess, &value); st != ENOATTR {
+		t.Fatalf("minimal ACL should not be stored: %s", st)
+	}
+
+	if err := m.Init(Format{Name: "test"}, false); err == nil {
+		t.Fatalf("ACL should not be disabled")
+	}
+}
+
+func testReaddirPage(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var dir, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	// more than the entries of a small hash in Redis, which is scanned at once
+	for i := 0; i < 300; i++ {
+		if st := m.Create(ctx, dir, fmt.Sprintf("f%03d", i), 0644, 022, &inode, &attr); st != 0 {
+			t.Fatalf("create f%03d: %s", i, st)
+		}
+	}
+	names := make(map[string]bool)
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > 300 {
+			t.Fatalf("too many pages")
+		}
+		var entries []*Entry
+		if st := m.ReaddirPage(ctx, dir, 1, &cursor, 100, &entries); st != 0 {
+			t.Fatalf("readdir page %d: %s", pages, st)
+		}
+		for _, e := range entries {
+			if e.Attr.Typ != TypeFile || e.Attr.Mode != 0644 {
+				t.Fatalf("attr of %s: %+v", e.Name, e.Attr)
+			}
+			names[string(e.Name)] = true
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	if len(names) != 300 {
+		t.Fatalf("entries: %v", names)
+	}
+	var entries []*Entry
+	if st := m.ReaddirPage(ctx, inode, 0, &cursor, 10, &entries); st != syscall.ENOTDIR {
+		t.Fatalf("readdir page of a file: %s", st)
+	}
+}
+
+// testAllocIDs checks that the IDs reserved in batches by two clients of the same volume never overlap.
+func testAllocIDs(t *testing.T, m, m2 Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var lock sync.Mutex
+	chunks := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(c Meta) {
+			defer wg.Done()
+			for j := 0; j < 600; j++ {
+				var cid uint64
+				if st := c.NewChunk(ctx, 2, 0, 0, &cid); st != 0 {
+					t.Errorf("new chunk: %s", st)
+					return
+				}
+				lock.Lock()
+				if chunks[cid] {
+					t.Errorf("chunk %d is allocated twice", cid)
+				}
+				chunks[cid] = true
+				lock.Unlock()
+			}
+		}([]Meta{m, m2}[i%2])
+	}
+	wg.Wait()
+
+	inodes := map[Ino]bool{1: true}
+	for i := 0; i < 10; i++ {
+		var inode Ino
+		var attr Attr
+		if st := []Meta{m, m2}[i%2].Create(ctx, 1, fmt.Sprintf("f%d", i), 0644, 022, &inode, &attr); st != 0 {
+			t.Fatalf("create f%d: %s", i, st)
+		}
+		if inodes[inode] {
+			t.Fatalf("inode %d is allocated twice", inode)
+		}
+		inodes[inode] = true
+	}
+}
+
+func testSessions(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Open(ctx, inode, 2, &attr); st != 0 {
+		t.Fatalf("open f: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != 0 {
+		t.Fatalf("flock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 2, false, syscall.F_RDLCK, 0, 0xFFFF, 10); st != 0 {
+		t.Fatalf("plock: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+
+	sessions, err := m.ListSessions()
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("list sessions: %+v %s", sessions, err)
+	}
+	s := sessions[0]
+	if s.Stale || s.ProcessID != os.Getpid() || s.Hostname == "" || s.Version == "" {
+		t.Fatalf("session info: %+v", s)
+	}
+	if len(s.Sustained) != 1 || s.Sustained[0] != inode {
+		t.Fatalf("sustained inodes: %+v", s.Sustained)
+	}
+	if len(s.Flocks) != 1 || s.Flocks[0].Inode != inode || s.Flocks[0].Owner != 1 || s.Flocks[0].Type != "W" {
+		t.Fatalf("flocks: %+v", s.Flocks)
+	}
+	if len(s.Plocks) != 1 || s.Plocks[0].Owner != 2 || len(s.Plocks[0].Records) != 1 ||
+		s.Plocks[0].Records[0] != (PlockRecord{syscall.F_RDLCK, 10, 0, 0xFFFF}) {
+		t.Fatalf("plocks: %+v", s.Plocks)
+	}
+
+	if err = m.CleanSession(s.Sid); err != nil {
+		t.Fatalf("clean session: %s", err)
+	}
+	if sessions, err = m.ListSessions(); err != nil || len(sessions) != 0 {
+		t.Fatalf("sessions after cleaned: %+v %s", sessions, err)
+	}
+	if st := m.GetAttr(ctx, inode, &attr); st != syscall.ENOENT {
+		t.Fatalf("the sustained inode should be deleted: %s", st)
+	}
+}
+
+// testVolumePrefix checks that a volume with prefix is separated from the one without in the same engine.
+func testVolumePrefix(t *testing.T, m, pm Meta) {
+	if err := m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err := pm.Init(Format{Name: "prefixed"}, true); err != nil {
+		t.Fatalf("init with prefix: %s", err)
+	}
+	if format, err := m.Load(); err != nil || format.Name != "test" {
+		t.Fatalf("load: %+v %s", format, err)
+	}
+	if format, err := pm.Load(); err != nil || format.Name != "prefixed" {
+		t.Fatalf("load with prefix: %+v %s", format, err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if st := pm.Lookup(ctx, 1, "d", &inode, &attr); st != syscall.ENOENT {
+		t.Fatalf("lookup d in the volume with prefix: %s", st)
+	}
+	if st := pm.Mkdir(ctx, 1, "p", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir p: %s", st)
+	}
+	if st := m.Lookup(ctx, 1, "p", &inode, &attr); st != syscall.ENOENT {
+		t.Fatalf("lookup p in the volume without prefix: %s", st)
+	}
+
+	if err := pm.Reset(); err != nil {
+		t.Fatalf("reset with prefix: %s", err)
+	}
+	if _, err := pm.Load(); err == nil {
+		t.Fatalf("the volume with prefix is not removed")
+	}
+	if st := m.Lookup(ctx, 1, "d", &inode, &attr); st != 0 {
+		t.Fatalf("lookup d after the volume with prefix is removed: %s", st)
+	}
+	if err := pm.Init(Format{Name: "prefixed"}, false); err != nil {
+		t.Fatalf("init with prefix again: %s", err)
+	}
+	if err := m.Reset(); err != nil {
+		t.Fatalf("reset: %s", err)
+	}
+	if _, err := m.Load(); err == nil {
+		t.Fatalf("the volume without prefix is not removed")
+	}
+	if format, err := pm.Load(); err != nil || format.Name != "prefixed" {
+		t.Fatalf("load with prefix after the volume without prefix is removed: %+v %s", format, err)
+	}
+}
+
+func TestSplitPrefix(t *testing.T) {
+	cases := []struct {
+		addr, rest, prefix string
+	}{
+		{"127.0.0.1:6379/1", "127.0.0.1:6379/1", ""},
+		{"127.0.0.1:6379/1?prefix=team1", "127.0.0.1:6379/1", "team1"},
+		{"/tmp/meta.db?prefix=a&_fk=1", "/tmp/meta.db?_fk=1", "a"},
+		{"user:pass@host/db?sslmode=disable&prefix=b", "user:pass@host/db?sslmode=disable", "b"},
+		{"user:pass@host/db?sslmode=disable&prefix=c&connect_timeout=3", "user:pass@host/db?sslmode=disable&connect_timeout=3", "c"},
+	}
+	for _, c := range cases {
+		rest, prefix, err := splitPrefix(c.addr)
+		if err != nil || rest != c.rest || prefix != c.prefix {
+			t.Fatalf("split %s: %q %q %v", c.addr, rest, prefix, err)
+		}
+	}
+	for _, addr := range []string{"host/1?prefix=", "host/1?prefix=Team", "host/1?prefix=a_b", "host/1?prefix=a*"} {
+		if _, _, err := splitPrefix(addr); err == nil {
+			t.Fatalf("invalid prefix in %s should fail", addr)
+		}
+	}
+}
+
+func testAtime(t *testing.T, m Meta, conf *Config) {
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	save := m.(interface{ saveAtimes() }).saveAtimes
+	atimeOf := func() time.Time {
+		var attr Attr
+		if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+			t.Fatalf("getattr: %s", st)
+		}
+		return time.Unix(attr.Atime, int64(attr.Atimensec))
+	}
+	created := atimeOf()
+
+	conf.AtimeMode = NoAtime
+	time.Sleep(time.Millisecond * 10)
+	if st := m.Open(ctx, inode, syscall.O_RDONLY, &attr); st != 0 {
+		t.Fatalf("open: %s", st)
+	}
+	save()
+	if a := atimeOf(); !a.Equal(created) {
+		t.Fatalf("atime is updated with noatime: %s != %s", a, created)
+	}
+
+	conf.AtimeMode = RelAtime
+	m.TouchAtime(ctx, inode, nil)
+	save()
+	touched := atimeOf()
+	if !touched.After(created) {
+		t.Fatalf("atime is not updated with relatime: %s <= %s", touched, created)
+	}
+	// atime is newer than mtime and ctime now
+	time.Sleep(time.Millisecond * 10)
+	m.TouchAtime(ctx, inode, nil)
+	save()
+	if a := atimeOf(); !a.Equal(touched) {
+		t.Fatalf("atime is updated again with relatime: %s != %s", a, touched)
+	}
+
+	conf.AtimeMode = StrictAtime
+	if st := m.Open(ctx, inode, syscall.O_RDONLY, &attr); st != 0 {
+		t.Fatalf("open: %s", st)
+	}
+	save()
+	if a := atimeOf(); !a.After(touched) {
+		t.Fatalf("atime is not updated with strictatime: %s <= %s", a, touched)
+	}
+	if st := m.Open(ctx, inode, syscall.O_WRONLY, &attr); st != 0 {
+		t.Fatalf("open: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	_ = m.Close(ctx, inode)
+}
+
+func testFlags(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var dir, inode, log Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0777, 022, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0666, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Create(ctx, dir, "log", 0666, 022, &log, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	user := NewContext(100, 1000, []uint32{1000})
+	if st := m.SetFlags(user, inode, FlagImmutable); st != syscall.EPERM {
+		t.Fatalf("set flags by user: %s", st)
+	}
+	if st := m.SetFlags(ctx, inode, FlagImmutable|FlagSnapshot); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 || attr.Flags != FlagImmutable {
+		t.Fatalf("flags of immutable file: %d, %s", attr.Flags, st)
+	}
+	var chunkid uint64
+	if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != syscall.EPERM {
+		t.Fatalf("write immutable file: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 100, &attr); st != syscall.EPERM {
+		t.Fatalf("truncate immutable file: %s", st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, &attr); st != syscall.EPERM {
+		t.Fatalf("chmod immutable file: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, "user.k", []byte("v")); st != syscall.EPERM {
+		t.Fatalf("setxattr immutable file: %s", st)
+	}
+	if st := m.Link(ctx, inode, 1, "l", &attr); st != syscall.EPERM {
+		t.Fatalf("link immutable file: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f", dir, "g", nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename immutable file: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink immutable file: %s", st)
+	}
+
+	if st := m.SetFlags(ctx, log, FlagAppend); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+	if st := m.NewChunk(ctx, log, 0, 0, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, log, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("append to append-only file: %s", st)
+	}
+	if st := m.Write(ctx, log, 0, 50, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != syscall.EPERM {
+		t.Fatalf("overwrite append-only file: %s", st)
+	}
+	if st := m.Write(ctx, log, 0, 100, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("append to append-only file: %s", st)
+	}
+	if st := m.Truncate(ctx, log, 0, 0, &attr); st != syscall.EPERM {
+		t.Fatalf("truncate append-only file: %s", st)
+	}
+	if st := m.Fallocate(ctx, log, 0, 0, 200); st != syscall.EPERM {
+		t.Fatalf("fallocate append-only file: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "log"); st != syscall.EPERM {
+		t.Fatalf("unlink append-only file: %s", st)
+	}
+
+	// entries can be added into an append-only directory, but not removed
+	if st := m.SetFlags(ctx, dir, FlagAppend); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+	var other Ino
+	if st := m.Create(ctx, dir, "new", 0666, 022, &other, &attr); st != 0 {
+		t.Fatalf("create in append-only directory: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "new"); st != syscall.EPERM {
+		t.Fatalf("unlink in append-only directory: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "new", 1, "new", nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename out of append-only directory: %s", st)
+	}
+	if st := m.SetFlags(ctx, dir, FlagImmutable); st != 0 {
+		t.Fatalf("set flags: %s", st)
+	}
+	if st := m.Create(ctx, dir, "new2", 0666, 022, &other, &attr); st != syscall.EPERM {
+		t.Fatalf("create in immutable directory: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != syscall.EPERM {
+		t.Fatalf("rmdir immutable directory: %s", st)
+	}
+
+	// everything can be removed once the flags are cleared
+	for _, i := range []Ino{dir, inode, log} {
+		if st := m.SetFlags(ctx, i, 0); st != 0 {
+			t.Fatalf("clear flags of %d: %s", i, st)
+		}
+	}
+	for _, name := range []string{"f", "log", "new"} {
+		if st := m.Unlink(ctx, dir, name); st != 0 {
+			t.Fatalf("unlink %s: %s", name, st)
+		}
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+}
+
+func testRetention(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var dir, inode, other Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0777, 022, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, 1, "f", 0666, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Create(ctx, 1, "g", 0666, 022, &other, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, other)
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if st := m.SetXattr(ctx, inode, RetentionXattr, []byte("tomorrow")); st != syscall.EINVAL {
+		t.Fatalf("set invalid retention: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, RetentionXattr, []byte(until)); st != 0 {
+		t.Fatalf("set retention: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 || attr.Flags&FlagRetention == 0 {
+		t.Fatalf("flags of retained file: %d, %s", attr.Flags, st)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, inode, RetentionXattr, &value); st != 0 || string(value) != until {
+		t.Fatalf("retention: %q, %s", value, st)
+	}
+	var chunkid uint64
+	if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != syscall.EPERM {
+		t.Fatalf("write retained file: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 100, &attr); st != syscall.EPERM {
+		t.Fatalf("truncate retained file: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink retained file: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "g", 1, "f", nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename over retained file: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "f", dir, "f", nil, nil); st != 0 {
+		t.Fatalf("move retained file: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, RetentionXattr, []byte(strconv.FormatInt(time.Now().Unix(), 10))); st != syscall.EPERM {
+		t.Fatalf("shorten retention: %s", st)
+	}
+	if st := m.RemoveXattr(ctx, inode, RetentionXattr); st != syscall.EPERM {
+		t.Fatalf("remove retention: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, RetentionXattr, []byte(time.Now().Add(time.Hour*2).Format(time.RFC3339))); st != 0 {
+		t.Fatalf("extend retention: %s", st)
+	}
+
+	// an expired file can be removed, but not changed
+	if st := m.SetXattr(ctx, other, RetentionXattr, []byte("1")); st != 0 {
+		t.Fatalf("set retention: %s", st)
+	}
+	if st := m.Truncate(ctx, other, 0, 100, &attr); st != syscall.EPERM {
+		t.Fatalf("truncate expired file: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "g"); st != 0 {
+		t.Fatalf("unlink expired file: %s", st)
+	}
+
+	// the files written under a WORM directory are retained once closed
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	format.RetentionDays = 1
+	if err = m.UpdateFormat(format); err != nil {
+		t.Fatalf("set retention days: %s", err)
+	}
+	if st := m.SetXattr(ctx, dir, RetentionXattr, []byte("0")); st != 0 {
+		t.Fatalf("set retention of directory: %s", st)
+	}
+	var sub Ino
+	if st := m.Mkdir(ctx, dir, "sub", 0777, 022, 0, &sub, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, sub, "h", 0666, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Unlink(ctx, sub, "h"); st != syscall.EPERM {
+		t.Fatalf("unlink file in WORM directory: %s", st)
+	}
+}
+
+func testGetPaths(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+	ctx := Background
+	var a, b, f, x Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "a", 0755, 022, 0, &a, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "b", 0755, 022, 0, &b, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, a, "f", 0644, 022, &f, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	expect := func(inode Ino, paths ...string) {
+		t.Helper()
+		if got := m.GetPaths(ctx, inode); strings.Join(got, ",") != strings.Join(paths, ",") {
+			t.Fatalf("paths of inode %d: %v (expected %v)", inode, got, paths)
+		}
+	}
+	expect(1, "/")
+	expect(a, "/a")
+	expect(f, "/a/f")
+	if st := m.Rename(ctx, a, "f", b, "f", nil, &attr); st != 0 || attr.Parent != b {
+		t.Fatalf("rename: %s, parent %d", st, attr.Parent)
+	}
+	expect(f, "/b/f")
+
+	// the parents of hardlinks are counted separately
+	if st := m.Link(ctx, f, a, "g", &attr); st != 0 || attr.Parent != 0 {
+		t.Fatalf("link: %s, parent %d", st, attr.Parent)
+	}
+	if st := m.Link(ctx, f, a, "h", &attr); st != 0 {
+		t.Fatalf("link: %s", st)
+	}
+	expect(f, "/a/g", "/a/h", "/b/f")
+	if st := m.Rename(ctx, a, "h", b, "h", nil, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	expect(f, "/a/g", "/b/f", "/b/h")
+	if st := m.Rename(ctx, 1, "b", a, "c", nil, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	expect(f, "/a/c/f", "/a/c/h", "/a/g")
+	if st := m.Unlink(ctx, a, "g"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	expect(f, "/a/c/f", "/a/c/h")
+	if st := m.Create(ctx, a, "x", 0644, 022, &x, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Rename(ctx, a, "x", b, "f", nil, &attr); st != 0 {
+		t.Fatalf("rename over a hard link: %s", st)
+	}
+	expect(f, "/a/c/h")
+	expect(x, "/a/c/f")
+	if n, err := m.CheckMeta(ctx, false); err != nil || n != 0 {
+		t.Fatalf("check meta: %d %s", n, err)
+	}
+
+	// the broken parents are fixed by fsck
+	en := m.(engine)
+	if err := en.doSetParents(f, map[Ino]int{a: 2}); err != nil {
+		t.Fatalf("set parents: %s", err)
+	}
+	expect(f)
+	if n, err := m.CheckMeta(ctx, true); err != nil || n != 1 {
+		t.Fatalf("repair meta: %d %s", n, err)
+	}
+	expect(f, "/a/c/h")
+	if st := m.Unlink(ctx, b, "h"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if ps, err := en.doGetParents(ctx, f); err != nil || len(ps) != 0 {
+		t.Fatalf("parents of removed file: %v %s", ps, err)
+	}
+	expect(f)
+}
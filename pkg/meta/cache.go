@@ -0,0 +1,237 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedAttr struct {
+	attr   Attr
+	expire int64
+}
+
+type cachedEntry struct {
+	inode  Ino
+	expire int64
+}
+
+type cachedChunk struct {
+	slices []Slice
+	expire int64
+}
+
+// metaCache keeps the attributes, entries and slices of chunks read from the meta engine in memory.
+// It's only used by the engines that can tell the changes made by other clients, the items of a node
+// changed by anyone are invalidated together, and the expired ones are evicted when it's full.
+type metaCache struct {
+	sync.Mutex
+	ttl   int64
+	limit int
+	size  int
+	// gen is increased by every invalidation, the items read before it should not be cached
+	gen uint64
+	// down is set when the changes can't be watched, nothing is cached until it's cleared
+	down bool
+
+	attrs   map[Ino]*cachedAttr
+	entries map[Ino]map[string]*cachedEntry
+	chunks  map[Ino]map[uint32]*cachedChunk
+}
+
+func newMetaCache(ttl time.Duration, limit int) *metaCache {
+	return &metaCache{
+		ttl:     int64(ttl),
+		limit:   limit,
+		attrs:   make(map[Ino]*cachedAttr),
+		entries: make(map[Ino]map[string]*cachedEntry),
+		chunks:  make(map[Ino]map[uint32]*cachedChunk),
+	}
+}
+
+func (c *metaCache) generation() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.gen
+}
+
+func (c *metaCache) getAttr(inode Ino, attr *Attr) bool {
+	c.Lock()
+	defer c.Unlock()
+	a := c.attrs[inode]
+	if a == nil || a.expire < time.Now().UnixNano() {
+		return false
+	}
+	*attr = a.attr
+	return true
+}
+
+func (c *metaCache) putAttr(gen uint64, inode Ino, attr *Attr) {
+	c.Lock()
+	defer c.Unlock()
+	if gen != c.gen || c.down {
+		return
+	}
+	if c.attrs[inode] == nil {
+		c.size++
+	}
+	c.attrs[inode] = &cachedAttr{*attr, c.expire()}
+	c.evict()
+}
+
+func (c *metaCache) getEntry(parent Ino, name string) (Ino, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e := c.entries[parent][name]
+	if e == nil || e.expire < time.Now().UnixNano() {
+		return 0, false
+	}
+	return e.inode, true
+}
+
+func (c *metaCache) putEntry(gen uint64, parent Ino, name string, inode Ino) {
+	c.Lock()
+	defer c.Unlock()
+	if gen != c.gen || c.down {
+		return
+	}
+	es := c.entries[parent]
+	if es == nil {
+		es = make(map[string]*cachedEntry)
+		c.entries[parent] = es
+	}
+	if es[name] == nil {
+		c.size++
+	}
+	es[name] = &cachedEntry{inode, c.expire()}
+	c.evict()
+}
+
+func (c *metaCache) getChunk(inode Ino, indx uint32) ([]Slice, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cc := c.chunks[inode][indx]
+	if cc == nil || cc.expire < time.Now().UnixNano() {
+		return nil, false
+	}
+	return cc.slices, true
+}
+
+func (c *metaCache) putChunk(gen uint64, inode Ino, indx uint32, slices []Slice) {
+	c.Lock()
+	defer c.Unlock()
+	if gen != c.gen || c.down {
+		return
+	}
+	cs := c.chunks[inode]
+	if cs == nil {
+		cs = make(map[uint32]*cachedChunk)
+		c.chunks[inode] = cs
+	}
+	if cs[indx] == nil {
+		c.size++
+	}
+	cs[indx] = &cachedChunk{slices, c.expire()}
+	c.evict()
+}
+
+// invalidate drops the attributes, the entries (of a directory) and the chunks (of a file) of a node.
+func (c *metaCache) invalidate(inode Ino) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	if c.attrs[inode] != nil {
+		delete(c.attrs, inode)
+		c.size--
+	}
+	c.size -= len(c.entries[inode])
+	delete(c.entries, inode)
+	c.size -= len(c.chunks[inode])
+	delete(c.chunks, inode)
+}
+
+// reset drops all the items, and stops caching until the next reset if down is true.
+func (c *metaCache) reset(down bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.down = down
+	c.size = 0
+	c.attrs = make(map[Ino]*cachedAttr)
+	c.entries = make(map[Ino]map[string]*cachedEntry)
+	c.chunks = make(map[Ino]map[uint32]*cachedChunk)
+}
+
+func (c *metaCache) available() bool {
+	c.Lock()
+	defer c.Unlock()
+	return !c.down
+}
+
+func (c *metaCache) expire() int64 {
+	return time.Now().UnixNano() + c.ttl
+}
+
+// evict removes the expired items when the cache is full, or some random ones if none is expired.
+func (c *metaCache) evict() {
+	if c.size <= c.limit {
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, force := range []bool{false, true} {
+		for inode, a := range c.attrs {
+			if force || a.expire < now {
+				delete(c.attrs, inode)
+				c.size--
+			}
+			if force && c.size <= c.limit*9/10 {
+				return
+			}
+		}
+		for parent, es := range c.entries {
+			for name, e := range es {
+				if force || e.expire < now {
+					delete(es, name)
+					c.size--
+				}
+			}
+			if len(es) == 0 {
+				delete(c.entries, parent)
+			}
+			if force && c.size <= c.limit*9/10 {
+				return
+			}
+		}
+		for inode, cs := range c.chunks {
+			for indx, cc := range cs {
+				if force || cc.expire < now {
+					delete(cs, indx)
+					c.size--
+				}
+			}
+			if len(cs) == 0 {
+				delete(c.chunks, inode)
+			}
+			if force && c.size <= c.limit*9/10 {
+				return
+			}
+		}
+		if c.size <= c.limit*9/10 {
+			return
+		}
+	}
+}
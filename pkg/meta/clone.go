@@ -0,0 +1,167 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+)
+
+// Clone copies a file or a whole directory tree as dstName in dstParent, like `cp -rp`.
+//
+// Only the metadata is copied: the chunks of the cloned files point to the same slices as the
+// source, whose references are increased, so no object in the object storage is copied or changed.
+// Hard links in the source are cloned as separated files, and the data not flushed by the writers yet
+// is not cloned. The clone is not atomic, the part cloned before an error is left in place.
+func (m *baseMeta) Clone(ctx Context, srcIno, dstParent Ino, dstName string) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if isReserved(dstParent, dstName) || srcIno == TrashInode || srcIno == SnapshotInode {
+		return syscall.EPERM
+	}
+	var attr, pattr Attr
+	if st := m.GetAttr(ctx, srcIno, &attr); st != 0 {
+		return st
+	}
+	if st := m.GetAttr(ctx, dstParent, &pattr); st != 0 {
+		return st
+	}
+	if pattr.Typ != TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	if pattr.Flags&FlagSnapshot != 0 {
+		return syscall.EROFS
+	}
+	if pattr.Flags&FlagImmutable != 0 {
+		return syscall.EPERM
+	}
+	if st := m.Access(ctx, dstParent, 3, &pattr); st != 0 {
+		return st
+	}
+	return m.clone(ctx, srcIno, &attr, dstParent, dstName, 0, m.dirQuotasOf(ctx, dstParent))
+}
+
+// clone checks the limits of the volume and the quotas before cloning, the flags are set to all the copies.
+func (m *baseMeta) clone(ctx Context, srcIno Ino, attr *Attr, dstParent Ino, dstName string, flags uint8, qs []*Quota) syscall.Errno {
+	if attr.Typ == TypeDirectory {
+		// cloning a directory into itself would never end
+		for inode, depth := dstParent, 0; inode > 1 && depth < 1000; depth++ {
+			if inode == srcIno {
+				return syscall.EINVAL
+			}
+			var a Attr
+			if st := m.en.doGetAttr(ctx, inode, &a); st != 0 {
+				return st
+			}
+			inode = a.Parent
+		}
+	}
+
+	var s Summary
+	if st := m.summary(ctx, srcIno, &s, false); st != 0 {
+		return st
+	}
+	space, inodes := int64(s.Size-s.Dirs*4096), int64(s.Files+s.Dirs)
+	if err := m.checkQuota(space, inodes, m.en.getCounter); err != nil {
+		return errno(err)
+	}
+	if err := m.checkDirQuotas(qs, space, inodes); err != nil {
+		return errno(err)
+	}
+	return m.cloneEntry(ctx, srcIno, attr, dstParent, dstName, flags, qs)
+}
+
+// cloneEntry creates a copy of the node as name in parent, the quotas of the parent are updated with it.
+func (m *baseMeta) cloneEntry(ctx Context, srcIno Ino, attr *Attr, parent Ino, name string, flags uint8, qs []*Quota) syscall.Errno {
+	var mmask uint8 = 4
+	if attr.Typ == TypeDirectory {
+		mmask = 5
+	}
+	if attr.Typ != TypeSymlink {
+		if st := m.Access(ctx, srcIno, mmask, attr); st != 0 {
+			return st
+		}
+	}
+	n := &loadedNode{source: srcIno, attr: *attr, xattrs: make(map[string][]byte)}
+	if attr.Typ == TypeSymlink {
+		target, err := m.en.doReadlink(ctx, srcIno)
+		if err != nil {
+			return errno(err)
+		}
+		n.target = target
+	}
+	var names []byte
+	if st := m.en.ListXattr(ctx, srcIno, &names); st != 0 {
+		return st
+	}
+	for _, xname := range bytes.Split(names, []byte{0}) {
+		if len(xname) == 0 {
+			continue
+		}
+		var value []byte
+		if st := m.en.GetXattr(ctx, srcIno, string(xname), &value); st == 0 {
+			n.xattrs[string(xname)] = value
+		}
+	}
+
+	var created Attr
+	st := m.en.doMknod(ctx, parent, name, attr.Typ, attr.Mode, 0, attr.Rdev, string(n.target), &n.inode, &created)
+	if st != 0 {
+		return st
+	}
+	m.updateDirQuotas(qs, 0, 1)
+
+	if attr.Typ == TypeDirectory {
+		var entries []*Entry
+		if st = m.en.doReaddir(ctx, srcIno, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if st = m.cloneEntry(ctx, e.Inode, e.Attr, n.inode, string(e.Name), flags, qs); st != 0 {
+				return st
+			}
+		}
+		// the links of sub-directories are counted when they are created
+		if st = m.en.doGetAttr(ctx, n.inode, &created); st != 0 {
+			return st
+		}
+		n.attr.Nlink = created.Nlink
+	} else {
+		n.attr.Nlink = 1
+	}
+	n.attr.Parent = parent
+	// a clone out of a snapshot is writable
+	n.attr.Flags = attr.Flags&^FlagSnapshot | flags
+	now := time.Now()
+	n.attr.Ctime = now.Unix()
+	n.attr.Ctimensec = uint32(now.Nanosecond())
+	if ctx.Uid() != 0 && (attr.Uid != ctx.Uid() || attr.Gid != ctx.Gid()) {
+		// the clone belongs to the one who makes it, without the privileges of others
+		n.attr.Uid = ctx.Uid()
+		n.attr.Gid = ctx.Gid()
+		n.attr.Mode &^= 06000
+	}
+	// the chunks are read within the transaction, with the length at that time
+	if err := m.en.doLoadNode(n); err != nil {
+		return errno(err)
+	}
+	if attr.Typ == TypeFile && n.attr.Length > 0 {
+		m.updateDirQuotas(qs, align4K(n.attr.Length), 0)
+	}
+	return 0
+}
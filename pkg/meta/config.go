@@ -15,21 +15,37 @@
 
 package meta
 
+import "time"
+
+// Config is the configuration shared by all the meta engines, an option is ignored by engines that do not support it.
 type Config struct {
-	Addr      string
-	Password  string
-	IORetries int
+	Strict       bool // update ctime
+	Retries      int  // retries of a request to the meta engine
+	ReadOnly     bool // reject any modification and do not run background jobs
+	IORetries    int  // retries of reading or writing object storage
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	CacheTTL     time.Duration // how long the metadata is cached in memory, 0 means no cache
+	CacheLimit   int           // max number of items in the cache of metadata
+	MountPoint   string        // where the volume is mounted, recorded in the session
+	AtimeMode    string        // when to update the access time of files: noatime, relatime or strictatime
 }
 
 type Format struct {
-	Name        string
-	UUID        string
-	Storage     string
-	Bucket      string
-	AccessKey   string
-	SecretKey   string
-	BlockSize   int
-	Compression string
-	Partitions  int
-	EncryptKey  string
+	Name          string
+	UUID          string
+	Storage       string
+	Bucket        string
+	AccessKey     string
+	SecretKey     string
+	BlockSize     int
+	Compression   string
+	Partitions    int
+	EncryptKey    string
+	Capacity      uint64
+	Inodes        uint64
+	TrashDays     int
+	EventDays     int
+	RetentionDays int
+	EnableACL     bool
 }
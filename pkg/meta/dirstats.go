@@ -0,0 +1,320 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"time"
+)
+
+// dirStat is the usage of everything under a directory (the directory itself is not included),
+// which is counted in the same way as Summary.
+//
+// A change is recorded by the engine as a delta of the parent where it happens, in the same
+// transaction as the change itself. The deltas are rolled up into the stats of the directory and
+// all its ancestors in the background, so the usage of a directory is its stats plus the deltas
+// under it that are not rolled up yet. A directory without stats (created by an old client) is
+// summarized by walking through it, until it's fixed by fsck.
+type dirStat struct {
+	length, space, files, dirs int64
+}
+
+func (s *dirStat) add(o *dirStat) {
+	s.length += o.length
+	s.space += o.space
+	s.files += o.files
+	s.dirs += o.dirs
+}
+
+func (s *dirStat) neg() *dirStat {
+	return &dirStat{-s.length, -s.space, -s.files, -s.dirs}
+}
+
+func (s *dirStat) isZero() bool {
+	return s.length == 0 && s.space == 0 && s.files == 0 && s.dirs == 0
+}
+
+// entryStat returns the usage of an entry counted in its parent, sub is the stats of a directory.
+func entryStat(typ uint8, length uint64, sub *dirStat) *dirStat {
+	if typ != TypeDirectory {
+		return &dirStat{int64(length), align4K(length), 1, 0}
+	}
+	s := &dirStat{space: 4096, dirs: 1}
+	if sub != nil {
+		s.add(sub)
+	}
+	return s
+}
+
+// fileStats returns the changes of the parents when the length of a file is changed, a file with
+// hardlinks (whose parent is 0) is counted in every parent once for each entry of it.
+func fileStats(parent Ino, length, space int64, getParents func() (map[Ino]int, error)) (map[Ino]*dirStat, error) {
+	if length == 0 && space == 0 {
+		return nil, nil
+	}
+	parents := map[Ino]int{parent: 1}
+	if parent == 0 {
+		var err error
+		if parents, err = getParents(); err != nil {
+			return nil, err
+		}
+	}
+	stats := make(map[Ino]*dirStat, len(parents))
+	for p, n := range parents {
+		stats[p] = &dirStat{length: length * int64(n), space: space * int64(n)}
+	}
+	return stats, nil
+}
+
+// newDirStat creates empty stats for a new directory, so changes under it can be counted.
+func (m *baseMeta) newDirStat(inode Ino) {
+	if err := m.en.doSetDirStat(inode, &dirStat{}); err != nil {
+		logger.Warnf("create stats of directory %d: %s", inode, err)
+	}
+}
+
+func (m *baseMeta) delDirStat(inode Ino) {
+	if err := m.en.doDelDirStat(inode); err != nil {
+		logger.Warnf("remove stats of directory %d: %s", inode, err)
+	}
+}
+
+func (m *baseMeta) flushDirStats() {
+	for {
+		time.Sleep(time.Second)
+		if !m.conf.ReadOnly {
+			m.syncDirStats()
+		}
+	}
+}
+
+// syncDirStats rolls all the deltas up into the stats of directories, it's safe to be run by
+// multiple clients at the same time.
+func (m *baseMeta) syncDirStats() {
+	deltas, err := m.en.doGetDirDeltas()
+	if err != nil {
+		logger.Warnf("get deltas of directories: %s", err)
+		return
+	}
+	for inode := range deltas {
+		if err = m.en.doFlushDirStat(inode); err != nil {
+			logger.Warnf("flush stats of directory %d: %s", inode, err)
+		}
+	}
+}
+
+// pendingStats returns the sum of deltas not rolled up yet under every directory.
+func (m *baseMeta) pendingStats(ctx Context) (map[Ino]*dirStat, error) {
+	deltas, err := m.en.doGetDirDeltas()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[Ino]*dirStat)
+	parents := make(map[Ino]Ino)
+	for inode, d := range deltas {
+		for depth := 0; inode > 0 && depth < 1000; depth++ {
+			s := pending[inode]
+			if s == nil {
+				s = &dirStat{}
+				pending[inode] = s
+			}
+			s.add(d)
+			if inode == 1 || inode == TrashInode || inode == SnapshotInode {
+				break // the trash and snapshots are not counted in the root
+			}
+			p, ok := parents[inode]
+			if !ok {
+				var attr Attr
+				if st := m.en.doGetAttr(ctx, inode, &attr); st == 0 {
+					p = attr.Parent
+				}
+				parents[inode] = p
+			}
+			inode = p
+		}
+	}
+	return pending, nil
+}
+
+func (m *baseMeta) Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno {
+	return m.summary(ctx, inode, summary, false)
+}
+
+func nonNegative(v int64) uint64 {
+	if v < 0 {
+		return 0
+	}
+	return uint64(v)
+}
+
+// summary counts the usage of an entry, the stats of directories are used unless exact is set.
+// The changes rolled up during that time could be missed or counted twice.
+func (m *baseMeta) summary(ctx Context, inode Ino, summary *Summary, exact bool) syscall.Errno {
+	var pending map[Ino]*dirStat
+	if !exact {
+		var err error
+		if pending, err = m.pendingStats(ctx); err != nil {
+			logger.Warnf("get deltas of directories: %s", err)
+			exact = true
+		}
+	}
+	return m.sumUsage(ctx, inode, summary, pending, exact)
+}
+
+func (m *baseMeta) sumUsage(ctx Context, inode Ino, summary *Summary, pending map[Ino]*dirStat, exact bool) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		summary.Files++
+		summary.Length += attr.Length
+		summary.Size += uint64(align4K(attr.Length))
+		return 0
+	}
+	if !exact {
+		if s, err := m.en.doGetDirStat(inode); err != nil {
+			logger.Warnf("get stats of directory %d: %s", inode, err)
+		} else if s != nil {
+			if d := pending[inode]; d != nil {
+				s.add(d)
+			}
+			summary.Length += nonNegative(s.length)
+			summary.Size += nonNegative(s.space) + 4096
+			summary.Files += nonNegative(s.files)
+			summary.Dirs += nonNegative(s.dirs) + 1
+			return 0
+		}
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return st
+	}
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			if st := m.sumUsage(ctx, e.Inode, summary, pending, exact); st != 0 {
+				return st
+			}
+		} else {
+			summary.Files++
+			summary.Length += e.Attr.Length
+			summary.Size += uint64(align4K(e.Attr.Length))
+		}
+	}
+	summary.Dirs++
+	summary.Size += 4096
+	return 0
+}
+
+// CheckDirStats re-counts the stats of all the directories and reports the inconsistent ones,
+// which are fixed if repair is set. The changes made during the check could be reported as inconsistency.
+func (m *baseMeta) CheckDirStats(ctx Context, repair bool) (int, error) {
+	if repair && m.conf.ReadOnly {
+		return 0, syscall.EROFS
+	}
+	if repair {
+		if err := m.checkNoActiveClient(); err != nil {
+			return 0, err
+		}
+	}
+	if !m.conf.ReadOnly {
+		m.syncDirStats()
+	}
+	pending, err := m.pendingStats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var broken int
+	for _, inode := range m.statRoots(ctx) {
+		if _, err := m.checkDirStat(ctx, inode, repair, pending, &broken); err != nil {
+			return broken, err
+		}
+	}
+	return broken, nil
+}
+
+// statRoots returns the root and the special roots that exist, the stats of their trees are counted separately.
+func (m *baseMeta) statRoots(ctx Context) []Ino {
+	roots := []Ino{1}
+	for _, inode := range []Ino{TrashInode, SnapshotInode} {
+		var attr Attr
+		if st := m.en.doGetAttr(ctx, inode, &attr); st != syscall.ENOENT {
+			roots = append(roots, inode)
+		}
+	}
+	return roots
+}
+
+// rebuildDirStats counts the stats of all the directories from scratch.
+func (m *baseMeta) rebuildDirStats(ctx Context) error {
+	for _, inode := range m.statRoots(ctx) {
+		if _, err := m.checkDirStat(ctx, inode, true, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDirStat returns the counted stats of a directory, the inconsistent ones are counted into broken,
+// or fixed silently if broken is nil. The stats are expected to be the counted ones without the pending deltas.
+func (m *baseMeta) checkDirStat(ctx Context, inode Ino, repair bool, pending map[Ino]*dirStat, broken *int) (*dirStat, error) {
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return nil, st
+	}
+	var counted dirStat
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			sub, err := m.checkDirStat(ctx, e.Inode, repair, pending, broken)
+			if err != nil {
+				return nil, err
+			}
+			counted.add(sub)
+			counted.add(&dirStat{space: 4096, dirs: 1})
+		} else {
+			counted.add(&dirStat{int64(e.Attr.Length), align4K(e.Attr.Length), 1, 0})
+		}
+	}
+	s, err := m.en.doGetDirStat(inode)
+	if err != nil {
+		return nil, err
+	}
+	expected := counted
+	if d := pending[inode]; d != nil {
+		expected.add(d.neg())
+	}
+	if broken == nil {
+		// rebuilding
+		if s == nil || *s != expected {
+			err = m.en.doSetDirStat(inode, &expected)
+		}
+		return &counted, err
+	}
+	if s == nil || *s != expected {
+		*broken++
+		if s == nil {
+			logger.Warnf("Stats of directory %s is missing", m.pathOf(ctx, inode))
+		} else {
+			logger.Warnf("Stats of directory %s is inconsistent: %+v (counted %+v)", m.pathOf(ctx, inode), *s, expected)
+		}
+		if repair {
+			if err = m.en.doSetDirStat(inode, &expected); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &counted, nil
+}
@@ -0,0 +1,606 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+/*
+	A dump is a JSON object like this:
+
+	{
+	"Version": 1,
+	"Setting": {...},
+	"Counters": {...},
+	"FSTree": {
+	  "Attr": {...},
+	  "Entries": {
+	    "name": {
+	      "Attr": {...},
+	      "Symlink": "target",
+	      "Xattrs": [...],
+	      "Chunks": [...],
+	      "Entries": {...}
+	    }
+	  }
+	},
+	"Trash": {...},
+	"Snapshots": {...}
+	}
+
+	The trees of the trash and snapshots are in the same format as FSTree, they're omitted if
+	they don't exist. The tree is written and read as a stream, so only a page of entries of the directories
+	on the current path are kept in memory (the entries are sorted by name within a page).
+	The files with multiple links are written with the full content only once, other links
+	have only the attributes.
+*/
+
+const dumpVersion = 1
+
+// dumpPageSize is the number of entries of a directory read at a time during dump.
+const dumpPageSize = 10000
+
+// DumpedCounters are the counters of a volume.
+type DumpedCounters struct {
+	NextInode   int64
+	NextChunk   int64
+	UsedSpace   int64
+	TotalInodes int64
+}
+
+// DumpedAttr is the attributes of a node in a dump.
+type DumpedAttr struct {
+	Inode     Ino
+	Type      string
+	Flags     uint8 `json:",omitempty"`
+	Mode      uint16
+	Uid       uint32
+	Gid       uint32
+	Atime     int64
+	Mtime     int64
+	Ctime     int64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Nlink     uint32
+	Length    uint64
+	Rdev      uint32 `json:",omitempty"`
+}
+
+// DumpedSlice is a slice of a chunk in a dump.
+type DumpedSlice struct {
+	Pos     uint32
+	Chunkid uint64
+	Size    uint32
+	Off     uint32
+	Len     uint32
+}
+
+// DumpedChunk is a chunk of a file in a dump, the slices are in the order they were written.
+type DumpedChunk struct {
+	Index  uint32
+	Slices []*DumpedSlice
+}
+
+// DumpedXattr is an extended attribute in a dump.
+type DumpedXattr struct {
+	Name  string
+	Value []byte
+}
+
+// DumpedEntry is a node in a dump, the entries of a directory are streamed separately.
+type DumpedEntry struct {
+	Attr    *DumpedAttr
+	Symlink string         `json:",omitempty"`
+	Xattrs  []*DumpedXattr `json:",omitempty"`
+	Chunks  []*DumpedChunk `json:",omitempty"`
+}
+
+// loadedNode is a node restored from a dump (or cloned), which is saved by the engine as a whole.
+type loadedNode struct {
+	inode  Ino
+	attr   Attr
+	target []byte
+	xattrs map[string][]byte
+	chunks map[uint32][]byte
+	// the node cloned from, whose chunks are copied by the engine in the same transaction that increases
+	// the references of the slices, rather than restored into an empty volume
+	source Ino
+}
+
+var typeNames = map[uint8]string{
+	TypeFile:      "regular",
+	TypeDirectory: "directory",
+	TypeSymlink:   "symlink",
+	TypeFIFO:      "fifo",
+	TypeBlockDev:  "blockdev",
+	TypeCharDev:   "chardev",
+	TypeSocket:    "socket",
+}
+
+func typeFromString(name string) uint8 {
+	for t, n := range typeNames {
+		if n == name {
+			return t
+		}
+	}
+	return 0
+}
+
+func dumpAttr(inode Ino, a *Attr) *DumpedAttr {
+	return &DumpedAttr{
+		Inode:     inode,
+		Type:      typeNames[a.Typ],
+		Flags:     a.Flags,
+		Mode:      a.Mode,
+		Uid:       a.Uid,
+		Gid:       a.Gid,
+		Atime:     a.Atime,
+		Mtime:     a.Mtime,
+		Ctime:     a.Ctime,
+		Atimensec: a.Atimensec,
+		Mtimensec: a.Mtimensec,
+		Ctimensec: a.Ctimensec,
+		Nlink:     a.Nlink,
+		Length:    a.Length,
+		Rdev:      a.Rdev,
+	}
+}
+
+func loadAttr(d *DumpedAttr) *Attr {
+	return &Attr{
+		Flags:     d.Flags,
+		Typ:       typeFromString(d.Type),
+		Mode:      d.Mode,
+		Uid:       d.Uid,
+		Gid:       d.Gid,
+		Atime:     d.Atime,
+		Mtime:     d.Mtime,
+		Ctime:     d.Ctime,
+		Atimensec: d.Atimensec,
+		Mtimensec: d.Mtimensec,
+		Ctimensec: d.Ctimensec,
+		Nlink:     d.Nlink,
+		Length:    d.Length,
+		Rdev:      d.Rdev,
+		Full:      true,
+	}
+}
+
+type dumper struct {
+	m         *baseMeta
+	w         *bufio.Writer
+	err       error
+	hardlinks map[Ino]bool
+}
+
+func (d *dumper) write(s string) {
+	if d.err == nil {
+		_, d.err = d.w.WriteString(s)
+	}
+}
+
+func (d *dumper) writeJSON(prefix string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		d.err = err
+		return
+	}
+	d.write(prefix)
+	if d.err == nil {
+		_, d.err = d.w.Write(data)
+	}
+}
+
+func (d *dumper) quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// dumpEntry writes a node and its children, it returns ENOENT if the node is removed during the dump.
+func (d *dumper) dumpEntry(inode Ino, key string, sep string, depth int) syscall.Errno {
+	m := d.m
+	var attr Attr
+	if st := m.en.doGetAttr(Background, inode, &attr); st != 0 {
+		return st
+	}
+	e := &DumpedEntry{Attr: dumpAttr(inode, &attr)}
+	full := true
+	if attr.Typ != TypeDirectory && attr.Nlink > 1 {
+		full = !d.hardlinks[inode]
+		d.hardlinks[inode] = true
+	}
+	if full {
+		if attr.Typ == TypeSymlink {
+			target, err := m.en.doReadlink(Background, inode)
+			if err != nil {
+				return errno(err)
+			}
+			e.Symlink = string(target)
+		}
+		var names []byte
+		if st := m.en.ListXattr(Background, inode, &names); st != 0 {
+			return st
+		}
+		for _, name := range bytes.Split(names, []byte{0}) {
+			if len(name) == 0 {
+				continue
+			}
+			var value []byte
+			if st := m.en.GetXattr(Background, inode, string(name), &value); st == 0 {
+				e.Xattrs = append(e.Xattrs, &DumpedXattr{string(name), value})
+			}
+		}
+		if attr.Typ == TypeFile {
+			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+				buf, err := m.en.doReadChunk(inode, indx)
+				if err != nil {
+					return errno(err)
+				}
+				if len(buf) == 0 {
+					continue
+				}
+				c := &DumpedChunk{Index: indx}
+				for _, s := range readSliceBuf(buf) {
+					c.Slices = append(c.Slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len})
+				}
+				e.Chunks = append(e.Chunks, c)
+			}
+		}
+	}
+	indent := strings.Repeat("  ", depth+1)
+	d.write(sep + strings.Repeat("  ", depth) + key + ": {")
+	d.writeJSON("\n"+indent+"\"Attr\": ", e.Attr)
+	if e.Symlink != "" {
+		d.write(",\n" + indent + "\"Symlink\": " + d.quote(e.Symlink))
+	}
+	if len(e.Xattrs) > 0 {
+		d.writeJSON(",\n"+indent+"\"Xattrs\": ", e.Xattrs)
+	}
+	if len(e.Chunks) > 0 {
+		d.write(",\n" + indent + "\"Chunks\": [")
+		for i, c := range e.Chunks {
+			if i > 0 {
+				d.write(",")
+			}
+			d.writeJSON("\n"+indent+"  ", c)
+		}
+		d.write("\n" + indent + "]")
+	}
+	if attr.Typ == TypeDirectory {
+		d.write(",\n" + indent + "\"Entries\": {")
+		sep := "\n"
+		var cursor string
+		for {
+			// the entries are read page by page, so a huge directory is not loaded into memory at once
+			var entries []*Entry
+			if st := m.en.doReaddirPage(Background, inode, 0, &cursor, dumpPageSize, &entries); st != 0 {
+				return st
+			}
+			sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Name, entries[j].Name) < 0 })
+			for _, c := range entries {
+				if d.err != nil {
+					break
+				}
+				st := d.dumpEntry(c.Inode, d.quote(string(c.Name)), sep, depth+2)
+				if st == syscall.ENOENT {
+					logger.Debugf("%s is removed during dump", c.Name)
+					continue
+				} else if st != 0 {
+					return st
+				}
+				sep = ",\n"
+			}
+			if cursor == "" || d.err != nil {
+				break
+			}
+		}
+		d.write("\n" + indent + "}")
+	}
+	d.write("\n" + strings.Repeat("  ", depth) + "}")
+	return 0
+}
+
+// DumpMeta writes all the metadata of the volume into w as JSON, the secret key is removed.
+func (m *baseMeta) DumpMeta(w io.Writer) error {
+	format, err := m.en.Load()
+	if err != nil {
+		return err
+	}
+	if format.SecretKey != "" {
+		format.SecretKey = "removed"
+	}
+	var counters DumpedCounters
+	for name, v := range map[string]*int64{
+		"nextinode": &counters.NextInode,
+		"nextchunk": &counters.NextChunk,
+		usedSpace:   &counters.UsedSpace,
+		totalInodes: &counters.TotalInodes,
+	} {
+		if *v, err = m.en.getCounter(name); err != nil {
+			return fmt.Errorf("get counter %s: %s", name, err)
+		}
+	}
+
+	d := &dumper{m: m, w: bufio.NewWriterSize(w, 1<<20), hardlinks: make(map[Ino]bool)}
+	d.write(fmt.Sprintf("{\n\"Version\": %d,\n", dumpVersion))
+	d.writeJSON("\"Setting\": ", format)
+	d.writeJSON(",\n\"Counters\": ", counters)
+	if st := d.dumpEntry(1, "\"FSTree\"", ",\n", 0); st != 0 {
+		return fmt.Errorf("dump tree: %s", st)
+	}
+	// the snapshots keep the slices they reference, so they're dumped with the trash
+	for _, root := range []struct {
+		inode Ino
+		key   string
+	}{{TrashInode, "Trash"}, {SnapshotInode, "Snapshots"}} {
+		if st := d.dumpEntry(root.inode, d.quote(root.key), ",\n", 0); st != 0 && st != syscall.ENOENT {
+			return fmt.Errorf("dump %s: %s", root.key, st)
+		}
+	}
+	d.write("\n}\n")
+	if d.err != nil {
+		return d.err
+	}
+	return d.w.Flush()
+}
+
+type loader struct {
+	m           *baseMeta
+	dec         *json.Decoder
+	hardlinks   map[Ino]bool
+	parents     map[Ino]map[Ino]int // the parents of the files with hardlinks
+	maxInode    Ino
+	maxChunk    uint64
+	usedSpace   int64
+	totalInodes int64
+}
+
+func (l *loader) expect(delim json.Delim) error {
+	t, err := l.dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expect %s but got %v", delim, t)
+	}
+	return nil
+}
+
+func (l *loader) key() (string, error) {
+	t, err := l.dec.Token()
+	if err != nil {
+		return "", err
+	}
+	k, ok := t.(string)
+	if !ok {
+		return "", fmt.Errorf("expect a key but got %v", t)
+	}
+	return k, nil
+}
+
+// loadEntry reads a node and its children, and saves them into the engine.
+func (l *loader) loadEntry(parent Ino, name string) (uint8, error) {
+	if err := l.expect('{'); err != nil {
+		return 0, err
+	}
+	var e DumpedEntry
+	var subdirs uint32
+	for l.dec.More() {
+		key, err := l.key()
+		if err != nil {
+			return 0, err
+		}
+		switch key {
+		case "Attr":
+			err = l.dec.Decode(&e.Attr)
+		case "Symlink":
+			err = l.dec.Decode(&e.Symlink)
+		case "Xattrs":
+			err = l.dec.Decode(&e.Xattrs)
+		case "Chunks":
+			err = l.dec.Decode(&e.Chunks)
+		case "Entries":
+			if e.Attr == nil {
+				return 0, fmt.Errorf("no attributes before entries of %s", name)
+			}
+			if err = l.expect('{'); err != nil {
+				return 0, err
+			}
+			for l.dec.More() {
+				cname, err := l.key()
+				if err != nil {
+					return 0, err
+				}
+				typ, err := l.loadEntry(e.Attr.Inode, cname)
+				if err != nil {
+					return 0, err
+				}
+				if typ == TypeDirectory {
+					subdirs++
+				}
+			}
+			err = l.expect('}')
+		default:
+			var skip json.RawMessage
+			err = l.dec.Decode(&skip)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("load %s of %s: %s", key, name, err)
+		}
+	}
+	if err := l.expect('}'); err != nil {
+		return 0, err
+	}
+	if e.Attr == nil {
+		return 0, fmt.Errorf("no attributes for %s", name)
+	}
+
+	inode := e.Attr.Inode
+	attr := loadAttr(e.Attr)
+	if attr.Typ == 0 {
+		return 0, fmt.Errorf("invalid type of %s: %s", name, e.Attr.Type)
+	}
+	if parent != 0 {
+		if err := l.m.en.doLoadEdge(parent, name, attr.Typ, inode); err != nil {
+			return 0, fmt.Errorf("save entry %s: %s", name, err)
+		}
+	}
+	hardlink := attr.Typ != TypeDirectory && attr.Nlink > 1
+	if hardlink {
+		if l.parents[inode] == nil {
+			l.parents[inode] = make(map[Ino]int)
+		}
+		l.parents[inode][parent]++
+		if l.hardlinks[inode] {
+			return attr.Typ, nil
+		}
+		l.hardlinks[inode] = true
+	}
+
+	n := &loadedNode{inode: inode, attr: *attr, target: []byte(e.Symlink)}
+	n.attr.Parent = parent
+	if parent == 0 {
+		n.attr.Parent = 1
+	} else if hardlink {
+		n.attr.Parent = 0
+	}
+	if attr.Typ == TypeDirectory {
+		n.attr.Nlink = 2 + subdirs
+	}
+	if len(e.Xattrs) > 0 {
+		n.xattrs = make(map[string][]byte)
+		for _, x := range e.Xattrs {
+			n.xattrs[x.Name] = x.Value
+		}
+	}
+	if len(e.Chunks) > 0 {
+		n.chunks = make(map[uint32][]byte)
+		for _, c := range e.Chunks {
+			buf := make([]byte, 0, sliceBytes*len(c.Slices))
+			for _, s := range c.Slices {
+				buf = append(buf, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
+				if s.Chunkid > l.maxChunk {
+					l.maxChunk = s.Chunkid
+				}
+			}
+			n.chunks[c.Index] = buf
+		}
+	}
+	if err := l.m.en.doLoadNode(n); err != nil {
+		return 0, fmt.Errorf("save node %d: %s", inode, err)
+	}
+	// the roots are not allocated from the counter
+	if parent != 0 {
+		l.totalInodes++
+		if inode > l.maxInode {
+			l.maxInode = inode
+		}
+	}
+	if attr.Typ == TypeFile {
+		l.usedSpace += align4K(attr.Length)
+	}
+	return attr.Typ, nil
+}
+
+// LoadMeta restores the metadata from a dump into an empty engine, the counters
+// are rebuilt from the loaded nodes when the dumped ones fall behind.
+func (m *baseMeta) LoadMeta(r io.Reader) error {
+	if format, err := m.en.Load(); err == nil {
+		return fmt.Errorf("volume %s already exists in the meta engine", format.Name)
+	}
+	l := &loader{m: m, dec: json.NewDecoder(bufio.NewReaderSize(r, 1<<20)), hardlinks: make(map[Ino]bool), parents: make(map[Ino]map[Ino]int)}
+	if err := l.expect('{'); err != nil {
+		return err
+	}
+	var format *Format
+	var counters DumpedCounters
+	var loaded bool
+	for l.dec.More() {
+		key, err := l.key()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "Version":
+			var v int
+			if err = l.dec.Decode(&v); err == nil && v > dumpVersion {
+				return fmt.Errorf("unsupported version of dump: %d", v)
+			}
+		case "Setting":
+			err = l.dec.Decode(&format)
+		case "Counters":
+			err = l.dec.Decode(&counters)
+		case "FSTree":
+			if format == nil {
+				return fmt.Errorf("no setting before the tree")
+			}
+			if err = m.en.Init(*format, false); err != nil {
+				return fmt.Errorf("init: %s", err)
+			}
+			_, err = l.loadEntry(0, "/")
+			loaded = true
+		case "Trash", "Snapshots":
+			if !loaded {
+				return fmt.Errorf("no tree before %s", key)
+			}
+			_, err = l.loadEntry(0, key)
+		default:
+			var skip json.RawMessage
+			err = l.dec.Decode(&skip)
+		}
+		if err != nil {
+			return fmt.Errorf("load %s: %s", key, err)
+		}
+	}
+	if !loaded {
+		return fmt.Errorf("no tree found")
+	}
+	for inode, parents := range l.parents {
+		if err := m.en.doSetParents(inode, parents); err != nil {
+			return fmt.Errorf("save parents of inode %d: %s", inode, err)
+		}
+	}
+
+	if counters.NextInode < int64(l.maxInode) {
+		counters.NextInode = int64(l.maxInode)
+	}
+	if counters.NextChunk < int64(l.maxChunk) {
+		counters.NextChunk = int64(l.maxChunk)
+	}
+	for name, v := range map[string]int64{
+		"nextinode": counters.NextInode,
+		"nextchunk": counters.NextChunk,
+		usedSpace:   l.usedSpace,
+		totalInodes: l.totalInodes,
+	} {
+		if err := m.en.setCounter(name, v); err != nil {
+			return fmt.Errorf("set counter %s: %s", name, err)
+		}
+	}
+	if err := m.rebuildDirStats(Background); err != nil {
+		return fmt.Errorf("build stats of directories: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func testDumpAndLoad(t *testing.T, src, dst Meta) {
+	_ = src.Init(Format{Name: "test", SecretKey: "secret"}, true)
+	ctx := Background
+	var dir, inode Ino
+	var attr Attr
+	if st := src.Mkdir(ctx, 1, "d", 0755, 022, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := src.Mkdir(ctx, dir, "sub", 0755, 022, 0, nil, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := src.Create(ctx, dir, "f", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var chunkid uint64
+	_ = src.NewChunk(ctx, inode, 0, 0, &chunkid)
+	if st := src.Write(ctx, inode, 0, 100, Slice{chunkid, 1 << 20, 0, 1 << 20}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := src.Write(ctx, inode, 1, 0, Slice{chunkid, 1 << 20, 0, 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := src.SetXattr(ctx, inode, "user.a", []byte{0, 1, 255}); st != 0 {
+		t.Fatalf("setxattr: %s", st)
+	}
+	if st := src.Link(ctx, inode, 1, "hard", &attr); st != 0 {
+		t.Fatalf("link: %s", st)
+	}
+	if st := src.Symlink(ctx, 1, "s", "d/f", nil, &attr); st != 0 {
+		t.Fatalf("symlink: %s", st)
+	}
+	if err := src.HandleSnapshot(ctx, SnapshotCreate, "s1", "/d", nil); err != nil {
+		t.Fatalf("snapshot: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.DumpMeta(&buf); err != nil {
+		t.Fatalf("dump: %s", err)
+	}
+	var dumped map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &dumped); err != nil {
+		t.Fatalf("invalid json: %s\n%s", err, buf.String())
+	}
+	if s := dumped["Setting"].(map[string]interface{}); s["SecretKey"] != "removed" {
+		t.Fatalf("secret key is not removed: %v", s["SecretKey"])
+	}
+
+	if err := dst.LoadMeta(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if err := dst.LoadMeta(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatalf("load into a formatted volume should fail")
+	}
+	var buf2 bytes.Buffer
+	if err := dst.DumpMeta(&buf2); err != nil {
+		t.Fatalf("dump: %s", err)
+	}
+	if buf.String() != buf2.String() {
+		t.Fatalf("dumps are different:\n%s\n%s", buf.String(), buf2.String())
+	}
+
+	if st := dst.Lookup(ctx, 1, "hard", &inode, &attr); st != 0 || attr.Nlink != 2 || attr.Length != ChunkSize+100 {
+		t.Fatalf("lookup hard link: %s %+v", st, attr)
+	}
+	var slices []Slice
+	if st := dst.Read(ctx, inode, 1, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+		t.Fatalf("read: %s %+v", st, slices)
+	}
+	var sym Ino
+	var target []byte
+	if st := dst.Lookup(ctx, 1, "s", &sym, &attr); st != 0 {
+		t.Fatalf("lookup symlink: %s", st)
+	}
+	if st := dst.ReadLink(ctx, sym, &target); st != 0 || string(target) != "d/f" {
+		t.Fatalf("readlink: %s %s", st, target)
+	}
+	if paths := dst.GetPaths(ctx, inode); len(paths) != 2 || paths[0] != "/d/f" || paths[1] != "/hard" {
+		t.Fatalf("paths of hard link after load: %v", paths)
+	}
+	var totalspace, availspace, iused, iavail uint64
+	_ = dst.StatFS(ctx, 1, &totalspace, &availspace, &iused, &iavail)
+	if iused != 7 {
+		t.Fatalf("used inodes: %d", iused)
+	}
+	snapshots := make(map[string]*Snapshot)
+	if err := dst.HandleSnapshot(ctx, SnapshotList, "", "", snapshots); err != nil || len(snapshots) != 1 || snapshots["s1"] == nil {
+		t.Fatalf("snapshots after load: %s %v", err, snapshots)
+	}
+	if s := snapshots["s1"].Summary; s.Files != 1 || s.Dirs != 2 || s.Length != ChunkSize+100 {
+		t.Fatalf("summary of snapshot after load: %+v", s)
+	}
+	var srcSummary, dstSummary Summary
+	_ = src.Summary(ctx, 1, &srcSummary)
+	if st := dst.Summary(ctx, 1, &dstSummary); st != 0 || dstSummary != srcSummary {
+		t.Fatalf("summary after load: %s %+v != %+v", st, dstSummary, srcSummary)
+	}
+	if n, err := dst.CheckDirStats(ctx, false); err != nil || n != 0 {
+		t.Fatalf("stats of directories after load: %d %s", n, err)
+	}
+	var nextInode Ino
+	if st := dst.Mkdir(ctx, 1, "new", 0755, 022, 0, &nextInode, &attr); st != 0 || nextInode <= inode {
+		t.Fatalf("mkdir after load: %s, inode %d", st, nextInode)
+	}
+}
+
+func TestDumpAndLoad(t *testing.T) {
+	src := newKVClient(t, "memkv", "")
+	dst := newSQLiteMeta(t, "/tmp/jfs-unit-test-load.db")
+	testDumpAndLoad(t, src, dst)
+
+	src = newSQLiteMeta(t, "/tmp/jfs-unit-test-dump.db")
+	dst = newKVClient(t, "bolt", "/tmp/jfs-unit-test-load.bolt")
+	testDumpAndLoad(t, src, dst)
+}
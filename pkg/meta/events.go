@@ -0,0 +1,200 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"time"
+)
+
+const (
+	EventCreate      = iota + 1 // a file, directory, symlink or special node is created
+	EventLink                   // a hard link is created
+	EventWrite                  // a file written by the session is closed
+	EventRename                 // an entry is moved to DstParent and renamed to DstName
+	EventUnlink                 // a file is removed
+	EventRmdir                  // a directory is removed
+	EventSetAttr                // the attributes of a node are changed
+	EventSetXattr               // an extended attribute (Name) is set
+	EventRemoveXattr            // an extended attribute (Name) is removed
+)
+
+var eventNames = map[uint8]string{
+	EventCreate:      "create",
+	EventLink:        "link",
+	EventWrite:       "write",
+	EventRename:      "rename",
+	EventUnlink:      "unlink",
+	EventRmdir:       "rmdir",
+	EventSetAttr:     "setattr",
+	EventSetXattr:    "setxattr",
+	EventRemoveXattr: "removexattr",
+}
+
+// Event is a change of the file system recorded in the change log. The entry changed is Name in Parent,
+// or Parent is the one of the node (zero if it's unknown) when the change is not made on an entry, and
+// Name is the name of the extended attribute for the xattr events. The paths are resolved when the
+// change is made, they are empty if the node is not in the tree.
+type Event struct {
+	Offset    string `json:"-"` // the position in the change log, which is assigned by the meta engine
+	Time      int64  // unix time in nanoseconds
+	Type      uint8
+	Inode     Ino
+	Parent    Ino
+	Name      string `json:",omitempty"`
+	DstParent Ino    `json:",omitempty"`
+	DstName   string `json:",omitempty"`
+	Path      string `json:",omitempty"` // the path of the entry (or the node) changed
+	DstPath   string `json:",omitempty"` // the new path of a renamed entry
+}
+
+// TypeName returns the name of the type of the event.
+func (e *Event) TypeName() string {
+	if n, ok := eventNames[e.Type]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+func (m *baseMeta) eventDays() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.format.EventDays
+}
+
+// eventContext carries the event of a change into the meta engine, which appends it into the change log
+// in the same transaction as the change, so the log has exactly the changes committed, in their order.
+type eventContext struct {
+	Context
+	event *Event
+	inode *Ino // the node changed, which is only known by the engine, e.g. the one created
+}
+
+// withEvent returns the context to make the change of the event with, the node changed is read from
+// inode if it's not nil.
+func withEvent(ctx Context, e *Event, inode *Ino) Context {
+	if e == nil {
+		return ctx
+	}
+	return &eventContext{ctx, e, inode}
+}
+
+// withoutEvent returns the context for the other changes made along with the one logged.
+func withoutEvent(ctx Context) Context {
+	if c, ok := ctx.(*eventContext); ok {
+		return c.Context
+	}
+	return ctx
+}
+
+// eventOf returns the event to be appended with the change made with the context, or nil.
+func eventOf(ctx Context) *Event {
+	c, ok := ctx.(*eventContext)
+	if !ok {
+		return nil
+	}
+	if c.inode != nil {
+		c.event.Inode = *c.inode
+	}
+	return c.event
+}
+
+// entryEvent returns the event of a change on the entry, or nil if the change log is disabled. It's
+// called before the change is made, when the path of the entry can be resolved.
+func (m *baseMeta) entryEvent(ctx Context, typ uint8, inode, parent Ino, name string) *Event {
+	if m.eventDays() == 0 {
+		return nil
+	}
+	return &Event{
+		Time:   time.Now().UnixNano(),
+		Type:   typ,
+		Inode:  inode,
+		Parent: parent,
+		Name:   name,
+		Path:   m.entryPath(ctx, parent, name),
+	}
+}
+
+// nodeEvent returns the event of a change on the node, or nil if the change log is disabled. The name
+// is the one of the extended attribute changed.
+func (m *baseMeta) nodeEvent(ctx Context, typ uint8, inode Ino, name string) *Event {
+	if m.eventDays() == 0 {
+		return nil
+	}
+	e := &Event{
+		Time:  time.Now().UnixNano(),
+		Type:  typ,
+		Inode: inode,
+		Name:  name,
+	}
+	if inode == 1 || inode == TrashInode || inode == SnapshotInode {
+		e.Path = m.nodePath(ctx, inode)
+	} else if parent, n := m.nameOf(ctx, inode); n != "" {
+		e.Parent, e.Path = parent, m.entryPath(ctx, parent, n)
+	}
+	return e
+}
+
+// logEvent appends an event that is not made along with a change of the metadata, e.g. a file is written.
+func (m *baseMeta) logEvent(e *Event) {
+	if e == nil {
+		return
+	}
+	if err := m.en.doAppendEvent(e); err != nil {
+		logger.Warnf("append %s event of inode %d: %s", e.TypeName(), e.Inode, err)
+	}
+}
+
+// markWritten remembers the files written by the session, whose write events are logged (and the default
+// retention is set) once they are closed.
+func (m *baseMeta) markWritten(inode Ino) {
+	if m.eventDays() == 0 && m.retentionDays() == 0 {
+		return
+	}
+	m.Lock()
+	m.writtenFiles[inode] = true
+	m.Unlock()
+}
+
+func (m *baseMeta) ReadEvents(ctx Context, offset *string, limit int, events *[]*Event) syscall.Errno {
+	if limit <= 0 {
+		limit = 1000
+	}
+	es, err := m.en.doReadEvents(*offset, limit)
+	if err != nil {
+		return errno(err)
+	}
+	if len(es) > 0 {
+		*offset = es[len(es)-1].Offset
+	}
+	*events = append(*events, es...)
+	return 0
+}
+
+func (m *baseMeta) cleanupEvents() {
+	for {
+		time.Sleep(time.Hour)
+		if ok, err := m.ClaimJob("CleanupEvents", time.Hour); err != nil {
+			logger.Warnf("claim job to cleanup events: %s", err)
+		} else if ok {
+			// all the events are dropped once the change log is disabled
+			edge := time.Now().Add(-time.Duration(24*m.eventDays()) * time.Hour)
+			if err = m.en.doTrimEvents(edge.UnixNano()); err != nil {
+				logger.Warnf("cleanup events before %s: %s", edge, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "syscall"
+
+func (m *baseMeta) SetFlags(ctx Context, inode Ino, flags uint8) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	attr.Flags = attr.Flags&^(FlagImmutable|FlagAppend) | flags&(FlagImmutable|FlagAppend)
+	return m.en.doSetAttr(withEvent(ctx, m.nodeEvent(ctx, EventSetAttr, inode, ""), nil), inode, SetAttrFlag, 0, &attr)
+}
+
+// checkFlags returns EROFS if the node is in a snapshot, or EPERM if it has any of the flags.
+func (m *baseMeta) checkFlags(ctx Context, inode Ino, flags uint8) syscall.Errno {
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Flags&FlagSnapshot != 0 {
+		return syscall.EROFS
+	}
+	if attr.Flags&flags != 0 {
+		return syscall.EPERM
+	}
+	return 0
+}
@@ -0,0 +1,388 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+type fsckEntry struct {
+	parent Ino
+	name   string
+	inode  Ino
+}
+
+// metaChecker holds all the nodes and entries of a volume, which are checked against each other.
+type metaChecker struct {
+	*baseMeta
+	ctx    Context
+	repair bool
+	broken int
+
+	nodes   map[Ino]*Attr
+	entries map[Ino][]fsckEntry // by parent
+	found   map[Ino]fsckEntry   // the entry a node is reached by first
+	links   map[Ino]uint32      // the entries of reachable directories pointing to a node
+	parents map[Ino]map[Ino]int // the entries pointing to a file by the parents
+	subdirs map[Ino]uint32
+	removed map[Ino]bool
+}
+
+func isRoot(inode Ino) bool {
+	return inode == 1 || inode == TrashInode || inode == SnapshotInode
+}
+
+// CheckMeta walks through the whole tree from the roots, then checks the links of nodes, the counters,
+// the references of slices and the deleted files against it. The inconsistent ones are reported, and
+// fixed if repair is set. The changes made during the check could be reported as inconsistency.
+func (m *baseMeta) CheckMeta(ctx Context, repair bool) (int, error) {
+	if repair && m.conf.ReadOnly {
+		return 0, syscall.EROFS
+	}
+	if repair {
+		if err := m.checkNoActiveClient(); err != nil {
+			return 0, err
+		}
+	}
+	c := &metaChecker{
+		baseMeta: m,
+		ctx:      ctx,
+		repair:   repair,
+		nodes:    make(map[Ino]*Attr),
+		entries:  make(map[Ino][]fsckEntry),
+		found:    make(map[Ino]fsckEntry),
+		links:    make(map[Ino]uint32),
+		parents:  make(map[Ino]map[Ino]int),
+		subdirs:  make(map[Ino]uint32),
+		removed:  make(map[Ino]bool),
+	}
+	err := m.en.doScanNodes(ctx, func(inode Ino, attr *Attr) error {
+		a := *attr
+		c.nodes[inode] = &a
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan nodes: %s", err)
+	}
+	err = m.en.doScanEdges(ctx, func(parent Ino, name string, _type uint8, inode Ino) error {
+		c.entries[parent] = append(c.entries[parent], fsckEntry{parent, name, inode})
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan entries: %s", err)
+	}
+	for _, check := range []func() error{c.walk, c.checkOrphans, c.checkLinks, c.checkCounters, c.checkSlices, c.checkDelFiles} {
+		if err = check(); err != nil {
+			return c.broken, err
+		}
+	}
+	return c.broken, nil
+}
+
+// checkNoActiveClient makes sure no other client is alive before repairing, since the findings from
+// the scans are not checked again, and the changes made by them in between would be destroyed.
+func (m *baseMeta) checkNoActiveClient() error {
+	sessions, err := m.en.ListSessions()
+	if err != nil {
+		return fmt.Errorf("list sessions: %s", err)
+	}
+	var active int
+	for _, s := range sessions {
+		if !s.Stale && s.Sid != uint64(m.sid) {
+			active++
+		}
+	}
+	if active > 0 {
+		return fmt.Errorf("%d clients are still active, umount them before repairing", active)
+	}
+	return nil
+}
+
+func (c *metaChecker) report(format string, args ...interface{}) {
+	c.broken++
+	logger.Warnf(format, args...)
+}
+
+// pathOf returns the path of a reachable node, or the inode for others.
+func (c *metaChecker) pathOf(inode Ino) string {
+	var names []string
+	for inode != 1 {
+		e, ok := c.found[inode]
+		if !ok {
+			return fmt.Sprintf("inode(%d)", inode)
+		}
+		names = append([]string{e.name}, names...)
+		inode = e.parent
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// walk goes through the tree from the roots, and counts the links of the nodes reached.
+func (c *metaChecker) walk() error {
+	var queue []Ino
+	for _, e := range []fsckEntry{{0, "", 1}, {1, TrashName, TrashInode}, {1, SnapshotName, SnapshotInode}} {
+		if c.nodes[e.inode] != nil {
+			c.found[e.inode] = e
+			queue = append(queue, e.inode)
+		}
+	}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, e := range c.entries[parent] {
+			attr := c.nodes[e.inode]
+			if attr == nil {
+				c.report("Entry %s points to missing inode %d", strings.TrimSuffix(c.pathOf(parent), "/")+"/"+e.name, e.inode)
+				if c.repair {
+					if err := c.en.doDeleteEdge(parent, e.name); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			c.links[e.inode]++
+			if attr.Typ == TypeDirectory {
+				c.subdirs[parent]++
+			} else {
+				if c.parents[e.inode] == nil {
+					c.parents[e.inode] = make(map[Ino]int)
+				}
+				c.parents[e.inode][parent]++
+			}
+			if _, ok := c.found[e.inode]; !ok {
+				c.found[e.inode] = e
+				if attr.Typ == TypeDirectory {
+					queue = append(queue, e.inode)
+				}
+			}
+		}
+	}
+
+	// the entries of a directory are removed with it, but could be left behind by a broken client
+	for parent, es := range c.entries {
+		if attr := c.nodes[parent]; attr != nil && attr.Typ == TypeDirectory {
+			continue
+		}
+		for _, e := range es {
+			c.report("Entry %s of inode %d is not in a directory", e.name, parent)
+			if c.repair {
+				if err := c.en.doDeleteEdge(parent, e.name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkOrphans removes the nodes not reachable from the roots, except the files still opened by a session.
+func (c *metaChecker) checkOrphans() error {
+	sessions, err := c.en.ListSessions()
+	if err != nil {
+		return fmt.Errorf("list sessions: %s", err)
+	}
+	opened := make(map[Ino]bool)
+	for _, s := range sessions {
+		for _, inode := range s.Sustained {
+			opened[inode] = true
+		}
+	}
+	for inode, attr := range c.nodes {
+		if _, ok := c.found[inode]; ok || attr.Nlink == 0 && opened[inode] {
+			continue
+		}
+		c.report("Inode %d (%s, %d bytes) is not reachable from the root", inode, typeNames[attr.Typ], attr.Length)
+		c.removed[inode] = true
+		if !c.repair {
+			continue
+		}
+		if err = c.en.doRemoveNode(inode, attr); err != nil {
+			return err
+		}
+		if attr.Typ == TypeDirectory {
+			c.delDirStat(inode)
+			if q, err := c.en.doGetQuota(inode); err == nil && q != nil {
+				if err = c.en.doDelQuota(inode); err != nil {
+					logger.Warnf("remove quota of directory %d: %s", inode, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkLinks checks the links and the parents of the reachable nodes.
+func (c *metaChecker) checkLinks() error {
+	for inode, e := range c.found {
+		attr := c.nodes[inode]
+		fixed := *attr
+		fixed.Nlink = c.links[inode]
+		if attr.Typ == TypeDirectory {
+			fixed.Nlink = 2 + c.subdirs[inode]
+			if inode != 1 {
+				fixed.Parent = e.parent
+			}
+		} else if attr.Parent > 0 && fixed.Nlink <= 1 {
+			fixed.Parent = e.parent
+		} else {
+			// the parents are counted separately once a file has hardlinks
+			fixed.Parent = 0
+			if err := c.checkParents(inode); err != nil {
+				return err
+			}
+		}
+		if fixed.Nlink != attr.Nlink {
+			c.report("%s has %d links (counted %d)", c.pathOf(inode), attr.Nlink, fixed.Nlink)
+		}
+		if fixed.Parent != attr.Parent {
+			c.report("Parent of %s is %d (expected %d)", c.pathOf(inode), attr.Parent, fixed.Parent)
+		}
+		if fixed == *attr {
+			continue
+		}
+		if c.repair {
+			if err := c.en.doSaveAttr(inode, &fixed); err != nil {
+				return err
+			}
+		}
+		*attr = fixed
+	}
+	return nil
+}
+
+// checkParents checks the parents of a file with hardlinks against the entries pointing to it.
+func (c *metaChecker) checkParents(inode Ino) error {
+	parents, err := c.en.doGetParents(c.ctx, inode)
+	if err != nil {
+		return err
+	}
+	counted := c.parents[inode]
+	same := len(parents) == len(counted)
+	for p, n := range counted {
+		same = same && parents[p] == n
+	}
+	if same {
+		return nil
+	}
+	c.report("Parents of %s are %v (counted %v)", c.pathOf(inode), parents, counted)
+	if c.repair {
+		return c.en.doSetParents(inode, counted)
+	}
+	return nil
+}
+
+// checkCounters re-counts the used space and inodes with the nodes left.
+func (c *metaChecker) checkCounters() error {
+	var space, inodes int64
+	for inode, attr := range c.nodes {
+		if c.removed[inode] {
+			continue
+		}
+		if attr.Typ == TypeFile {
+			space += align4K(attr.Length)
+		}
+		// the unlinked files are not counted even if they are still opened
+		if attr.Nlink > 0 && !isRoot(inode) {
+			inodes++
+		}
+	}
+	for _, counter := range []struct {
+		name  string
+		value int64
+	}{{usedSpace, space}, {totalInodes, inodes}} {
+		v, err := c.en.getCounter(counter.name)
+		if err != nil {
+			return fmt.Errorf("get counter %s: %s", counter.name, err)
+		}
+		if v == counter.value {
+			continue
+		}
+		c.report("Counter %s is %d (counted %d)", counter.name, v, counter.value)
+		if c.repair {
+			if err = c.en.setCounter(counter.name, counter.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSlices compares the references of slices with the times they are used in all the chunks, including
+// the ones of deleted files that are not cleaned yet.
+func (c *metaChecker) checkSlices() error {
+	var slices []Slice
+	if st := c.en.ListSlices(c.ctx, &slices); st != 0 {
+		return fmt.Errorf("list slices: %s", st)
+	}
+	used := make(map[Slice]int64)
+	for _, s := range slices {
+		used[Slice{Chunkid: s.Chunkid, Size: s.Size}]++
+	}
+	refs, err := c.en.doListSliceRefs()
+	if err != nil {
+		return fmt.Errorf("list references of slices: %s", err)
+	}
+	for s, n := range used {
+		r, ok := refs[s]
+		if !ok {
+			r = 1
+		}
+		if r == n {
+			continue
+		}
+		c.report("Slice %d (%d bytes) has %d references (counted %d)", s.Chunkid, s.Size, r, n)
+		if c.repair {
+			if err = c.en.doSetSliceRef(s.Chunkid, s.Size, n); err != nil {
+				return err
+			}
+		}
+	}
+	for s, r := range refs {
+		if _, ok := used[s]; ok || r <= 0 {
+			continue
+		}
+		// the objects of it are deleted by the cleanup of slices once it's not referenced
+		c.report("Slice %d (%d bytes) has %d references but is not used", s.Chunkid, s.Size, r)
+		if c.repair {
+			if err = c.en.doSetSliceRef(s.Chunkid, s.Size, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDelFiles drops the deleted files which still exist, whose chunks should not be cleaned.
+func (c *metaChecker) checkDelFiles() error {
+	files, err := c.en.doListDelFiles()
+	if err != nil {
+		return fmt.Errorf("list deleted files: %s", err)
+	}
+	for inode, length := range files {
+		if c.nodes[inode] == nil || c.removed[inode] {
+			continue
+		}
+		c.report("Deleted file %d (%d bytes) still exists as %s", inode, length, c.pathOf(inode))
+		if c.repair {
+			if err = c.en.doRemoveDelFile(inode, length); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -16,7 +16,12 @@
 package meta
 
 import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -28,6 +33,10 @@ const (
 	CompactChunk = 1001
 	// Rmr is a message to remove a directory recursively.
 	Rmr = 1002
+	// Clone is a message to clone a file or directory.
+	Clone = 1003
+	// Info is a message to get the paths and the layout of data of a node.
+	Info = 1004
 )
 
 const (
@@ -40,6 +49,21 @@ const (
 	TypeSocket    = 7 // type for socket
 )
 
+const (
+	// FlagSnapshot marks a node in a snapshot, which can't be changed.
+	FlagSnapshot uint8 = 1 << iota
+	// FlagACL marks a node with an extended access ACL.
+	FlagACL
+	// FlagImmutable marks a node which can't be changed, removed or renamed, and no entry can be
+	// added into or removed from an immutable directory (chattr +i).
+	FlagImmutable
+	// FlagAppend marks a file which can only be appended, or a directory whose entries can't be
+	// removed or renamed (chattr +a).
+	FlagAppend
+	// FlagRetention marks a node with a retention, see RetentionXattr.
+	FlagRetention
+)
+
 const (
 	// SetAttrMode is a mask to update a attribute of node
 	SetAttrMode = 1 << iota
@@ -51,6 +75,9 @@ const (
 	SetAttrCtime
 	SetAttrAtimeNow
 	SetAttrMtimeNow
+
+	// SetAttrFlag is a mask to update the flags of a node, which is only used internally.
+	SetAttrFlag = 1 << 15
 )
 
 // MsgCallback is a callback for messages from meta service.
@@ -58,7 +85,7 @@ type MsgCallback func(...interface{}) error
 
 // Attr represents attributes of a node.
 type Attr struct {
-	Flags     uint8  // reserved flags
+	Flags     uint8  // flags of a node, see FlagSnapshot, FlagACL, FlagImmutable, FlagAppend and FlagRetention
 	Typ       uint8  // type of a node
 	Mode      uint16 // permission mode
 	Uid       uint32 // owner id
@@ -72,7 +99,7 @@ type Attr struct {
 	Nlink     uint32 // number of links (sub-directories or hardlinks)
 	Length    uint64 // length of regular file
 	Rdev      uint32 // device number
-	Parent    Ino    // inode of parent, only for Directory
+	Parent    Ino    // inode of parent, 0 for a file with hardlinks (see GetPaths)
 	Full      bool   // the attributes are completed or not
 }
 
@@ -133,11 +160,19 @@ type Meta interface {
 	Init(format Format, force bool) error
 	// Load loads the existing setting of a formatted volume from meta service.
 	Load() (*Format, error)
+	// UpdateFormat saves the changed setting of a formatted volume, only the credentials, the bucket,
+	// the limits, the trash, the change log and the compression of new data can be changed.
+	UpdateFormat(format *Format) error
 	// NewSession create a new client session.
 	NewSession() error
+	// ListSessions returns all the sessions with the files they hold open and the locks they own.
+	ListSessions() ([]*Session, error)
+	// CleanSession removes the locks and the open files of a dead session, and the session itself.
+	CleanSession(sid uint64) error
 
-	// StatFS returns summary statistics of a volume.
-	StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno
+	// StatFS returns summary statistics of a volume, or the quota of the nearest directory
+	// containing inode if there is one.
+	StatFS(ctx Context, inode Ino, totalspace, availspace, iused, iavail *uint64) syscall.Errno
 	// Access checks the access permission on given inode.
 	Access(ctx Context, inode Ino, modemask uint8, attr *Attr) syscall.Errno
 	// Lookup returns the inode and attributes for the given entry in a directory.
@@ -146,6 +181,9 @@ type Meta interface {
 	GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	// SetAttr updates the attributes for given node.
 	SetAttr(ctx Context, inode Ino, set uint16, sggidclearmode uint8, attr *Attr) syscall.Errno
+	// SetFlags sets the immutable and append-only flags (FlagImmutable and FlagAppend) of a node,
+	// the other bits of flags are ignored. Only root can change them.
+	SetFlags(ctx Context, inode Ino, flags uint8) syscall.Errno
 	// Truncate changes the length for given file.
 	Truncate(ctx Context, inode Ino, flags uint8, attrlength uint64, attr *Attr) syscall.Errno
 	// Fallocate preallocate given space for given file.
@@ -171,6 +209,10 @@ type Meta interface {
 	Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno
 	// Readdir returns all entries for given directory, which include attributes if plus is true.
 	Readdir(ctx Context, inode Ino, wantattr uint8, entries *[]*Entry) syscall.Errno
+	// ReaddirPage appends a page of entries (without "." and "..") for given directory, starting from the cursor,
+	// which is empty for the first page. The cursor is updated to the position of the next page, or empty after
+	// the last one. A page has about limit entries, an entry could be returned twice if the directory is changed.
+	ReaddirPage(ctx Context, inode Ino, wantattr uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno
 	// Create creates a file in a directory with given name.
 	Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno
 	// Open checks permission on a node and track it as open.
@@ -205,10 +247,102 @@ type Meta interface {
 	Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno
 	// Rmr remove all the files and directories recursively.
 	Rmr(ctx Context, inode Ino, name string) syscall.Errno
+	// Clone copies a file or directory as name in parent without copying the data.
+	Clone(ctx Context, srcIno, parent Ino, name string) syscall.Errno
+	// GetPaths returns all the paths of a node in order, the hardlinks of a file have one path for each.
+	// The nodes not reachable from the root, e.g. the files removed but still opened, have no path.
+	GetPaths(ctx Context, inode Ino) []string
 
 	// ListSlices returns all slices used by all files.
 	ListSlices(ctx Context, slices *[]Slice) syscall.Errno
 
+	// HandleQuota sets, gets, deletes, lists or checks the quota of directories by path.
+	HandleQuota(ctx Context, cmd uint8, dpath string, quotas map[string]*Quota, repair bool) error
+	// HandleSnapshot creates, lists or deletes the snapshots of directories.
+	HandleSnapshot(ctx Context, cmd uint8, name, dpath string, snapshots map[string]*Snapshot) error
+	// CheckDirStats returns the number of directories whose stats are inconsistent, and fixes them if repair is set.
+	CheckDirStats(ctx Context, repair bool) (int, error)
+	// CheckMeta returns the number of broken invariants of the metadata (links, orphans, counters, references
+	// of slices and deleted files), and fixes them if repair is set.
+	CheckMeta(ctx Context, repair bool) (int, error)
+
+	// DumpMeta writes the whole tree with the setting and counters into w as JSON.
+	DumpMeta(w io.Writer) error
+	// LoadMeta restores a dump from r into an empty meta engine.
+	LoadMeta(r io.Reader) error
+	// Reset removes all the metadata of the volume, the other volumes in the same engine are not touched.
+	Reset() error
+
+	// ClaimJob returns true if the periodic job has not been run by any session within
+	// the interval, and records that it's run by the current one from now on.
+	ClaimJob(name string, interval time.Duration) (bool, error)
+
+	// Name returns the name of the meta engine.
+	Name() string
+
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
+	// TouchAtime updates the access time of a file that is opened or read according to the atime mode,
+	// the change is saved in background later. The attributes are looked up if attr is nil.
+	TouchAtime(ctx Context, inode Ino, attr *Attr)
+	// ReadEvents appends at most limit events after the offset (empty for the beginning) in the change log,
+	// and updates the offset to the last one read.
+	ReadEvents(ctx Context, offset *string, limit int, events *[]*Event) syscall.Errno
+	// OnReload adds a callback called with the new setting, once it's changed by others.
+	OnReload(cb func(format *Format))
+}
+
+// Creator creates a Meta client for the address (URL without scheme) of an engine.
+type Creator func(driver, addr string, conf *Config) (Meta, error)
+
+var metaDrivers = make(map[string]Creator)
+
+// Register adds a meta engine for the scheme name.
+func Register(name string, register Creator) {
+	metaDrivers[name] = register
+}
+
+var prefixOption = regexp.MustCompile(`[?&]prefix=[^&]*`)
+
+// splitPrefix removes the option `prefix` from the query of addr, which is the name of a volume
+// to tell it apart from the others in the same engine, and returns the rest of addr with it.
+func splitPrefix(addr string) (string, string, error) {
+	loc := prefixOption.FindStringIndex(addr)
+	if loc == nil {
+		return addr, "", nil
+	}
+	prefix := addr[loc[0]+len("?prefix=") : loc[1]]
+	if prefix == "" || strings.Trim(prefix, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		return "", "", fmt.Errorf("invalid prefix %q: only lowercase letters and digits are allowed", prefix)
+	}
+	if addr[loc[0]] == '?' && loc[1] < len(addr) {
+		// the next option becomes the first one
+		return addr[:loc[0]] + "?" + addr[loc[1]+1:], prefix, nil
+	}
+	return addr[:loc[0]] + addr[loc[1]:], prefix, nil
+}
+
+// NewClient creates a Meta client for the given URL, the engine is chosen by its scheme
+// (a URL without scheme is treated as a Redis address).
+func NewClient(uri string, conf *Config) Meta {
+	if !strings.Contains(uri, "://") {
+		uri = "redis://" + uri
+	}
+	logger.Infof("Meta address: %s", uri)
+	p := strings.Index(uri, "://")
+	driver := uri[:p]
+	f, ok := metaDrivers[driver]
+	if !ok {
+		logger.Fatalf("Invalid meta driver: %s", driver)
+	}
+	m, err := f(driver, uri[p+3:], conf)
+	if err != nil {
+		logger.Fatalf("Meta %s is not available: %s", uri, err)
+	}
+	if v := m.(engine).serverVersion(); v != "" {
+		logger.Infof("Meta engine: %s %s", m.Name(), v)
+	} else {
+		logger.Infof("Meta engine: %s", m.Name())
+	}
+	return m
 }
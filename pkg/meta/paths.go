@@ -0,0 +1,152 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// entryName is an entry pointing to a node, which is remembered to resolve the paths in the change log.
+type entryName struct {
+	parent Ino
+	name   string
+}
+
+func (m *baseMeta) GetPaths(ctx Context, inode Ino) []string {
+	if inode == 1 {
+		return []string{"/"}
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return nil
+	}
+	if attr.Typ == TypeDirectory {
+		if p := m.pathOf(ctx, inode); strings.HasPrefix(p, "/") {
+			return []string{p}
+		}
+		return nil
+	}
+
+	parents := map[Ino]int{attr.Parent: 1}
+	if attr.Parent == 0 {
+		var err error
+		if parents, err = m.en.doGetParents(ctx, inode); err != nil {
+			logger.Warnf("get parents of inode %d: %s", inode, err)
+			return nil
+		}
+	}
+	var paths []string
+	for parent := range parents {
+		dir := "/"
+		if parent != 1 {
+			// the parent could be removed or moved out of the tree in the meantime
+			if dir = m.pathOf(ctx, parent); !strings.HasPrefix(dir, "/") {
+				continue
+			}
+		}
+		for _, name := range m.namesOf(ctx, parent, inode) {
+			paths = append(paths, path.Join(dir, name))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// namesOf returns the names of the entries in the directory pointing to the node.
+func (m *baseMeta) namesOf(ctx Context, parent, inode Ino) []string {
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, parent, 0, &entries); st != 0 {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Inode == inode {
+			names = append(names, string(e.Name))
+		}
+	}
+	return names
+}
+
+// rememberName keeps the entry found or made for a node, so its path can be resolved without
+// listing the parent.
+func (m *baseMeta) rememberName(inode, parent Ino, name string) {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.entryNames) >= 100000 {
+		m.entryNames = make(map[Ino]entryName)
+	}
+	m.entryNames[inode] = entryName{parent, name}
+}
+
+// nameOf returns an entry pointing to the node, the remembered one is checked by a lookup before used,
+// so the parent is listed only when the entry is unknown or changed.
+func (m *baseMeta) nameOf(ctx Context, inode Ino) (Ino, string) {
+	m.Lock()
+	e, ok := m.entryNames[inode]
+	m.Unlock()
+	if ok {
+		var ino Ino
+		if m.en.doLookup(ctx, e.parent, e.name, &ino, nil) == 0 && ino == inode {
+			return e.parent, e.name
+		}
+	}
+	var attr Attr
+	if m.en.doGetAttr(ctx, inode, &attr) != 0 {
+		return 0, ""
+	}
+	parents := map[Ino]int{attr.Parent: 1}
+	if attr.Parent == 0 {
+		var err error
+		if parents, err = m.en.doGetParents(ctx, inode); err != nil {
+			return 0, ""
+		}
+	}
+	for parent := range parents {
+		if names := m.namesOf(ctx, parent, inode); len(names) > 0 {
+			m.rememberName(inode, parent, names[0])
+			return parent, names[0]
+		}
+	}
+	return 0, ""
+}
+
+// nodePath returns a path of the node, or an empty string if it's not in the tree.
+func (m *baseMeta) nodePath(ctx Context, inode Ino) string {
+	switch inode {
+	case 1:
+		return "/"
+	case TrashInode:
+		return "/" + TrashName
+	case SnapshotInode:
+		return "/" + SnapshotName
+	}
+	parent, name := m.nameOf(ctx, inode)
+	if name == "" {
+		return ""
+	}
+	return m.entryPath(ctx, parent, name)
+}
+
+// entryPath returns the path of the entry in the directory, or an empty string if it's not in the tree.
+func (m *baseMeta) entryPath(ctx Context, parent Ino, name string) string {
+	dir := m.nodePath(ctx, parent)
+	if dir == "" {
+		return ""
+	}
+	return path.Join(dir, name)
+}
@@ -0,0 +1,361 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// QuotaSet sets the limits of a directory.
+	QuotaSet uint8 = iota
+	// QuotaGet returns the limits and usage of a directory.
+	QuotaGet
+	// QuotaDel removes the quota of a directory.
+	QuotaDel
+	// QuotaList returns all the quotas.
+	QuotaList
+	// QuotaCheck re-counts the usage of the quotas.
+	QuotaCheck
+)
+
+// Quota is the limits and usage of a directory, a zero limit means unlimited.
+// The space is counted in the same way as the used space of a volume.
+type Quota struct {
+	MaxSpace, MaxInodes   int64
+	UsedSpace, UsedInodes int64
+	// changes made by this session but not flushed into the meta engine yet
+	newSpace, newInodes int64
+}
+
+func (q *Quota) exceeded(space, inodes int64) bool {
+	if space > 0 {
+		max := atomic.LoadInt64(&q.MaxSpace)
+		if max > 0 && atomic.LoadInt64(&q.UsedSpace)+atomic.LoadInt64(&q.newSpace)+space > max {
+			return true
+		}
+	}
+	if inodes > 0 {
+		max := atomic.LoadInt64(&q.MaxInodes)
+		if max > 0 && atomic.LoadInt64(&q.UsedInodes)+atomic.LoadInt64(&q.newInodes)+inodes > max {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Quota) update(space, inodes int64) {
+	atomic.AddInt64(&q.newSpace, space)
+	atomic.AddInt64(&q.newInodes, inodes)
+}
+
+func (m *baseMeta) getQuota(inode Ino) *Quota {
+	m.quotaLock.RLock()
+	defer m.quotaLock.RUnlock()
+	return m.dirQuotas[inode]
+}
+
+// dirQuotasOf returns the quotas of the directory and all its ancestors, from the nearest one.
+func (m *baseMeta) dirQuotasOf(ctx Context, inode Ino) []*Quota {
+	m.quotaLock.RLock()
+	n := len(m.dirQuotas)
+	m.quotaLock.RUnlock()
+	if n == 0 {
+		return nil
+	}
+	var qs []*Quota
+	for depth := 0; inode > 0 && depth < 1000; depth++ {
+		if q := m.getQuota(inode); q != nil {
+			qs = append(qs, q)
+		}
+		if inode == 1 {
+			break
+		}
+		var attr Attr
+		if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+			logger.Warnf("get parent of inode %d: %s", inode, st)
+			break
+		}
+		inode = attr.Parent
+	}
+	return qs
+}
+
+// fileQuotas returns the quotas that a file is counted in.
+func (m *baseMeta) fileQuotas(ctx Context, inode Ino) []*Quota {
+	m.quotaLock.RLock()
+	n := len(m.dirQuotas)
+	m.quotaLock.RUnlock()
+	if n == 0 {
+		return nil
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return nil
+	}
+	if attr.Parent > 0 {
+		return m.dirQuotasOf(ctx, attr.Parent)
+	}
+	// a file with hardlinks is counted once in the quotas of all its parents
+	parents, err := m.en.doGetParents(ctx, inode)
+	if err != nil {
+		logger.Warnf("get parents of inode %d: %s", inode, err)
+		return nil
+	}
+	var qs []*Quota
+	counted := make(map[*Quota]bool)
+	for p := range parents {
+		for _, q := range m.dirQuotasOf(ctx, p) {
+			if !counted[q] {
+				counted[q] = true
+				qs = append(qs, q)
+			}
+		}
+	}
+	return qs
+}
+
+func (m *baseMeta) checkDirQuotas(qs []*Quota, space, inodes int64) error {
+	for _, q := range qs {
+		if q.exceeded(space, inodes) {
+			return syscall.EDQUOT
+		}
+	}
+	return nil
+}
+
+func (m *baseMeta) updateDirQuotas(qs []*Quota, space, inodes int64) {
+	if space == 0 && inodes == 0 {
+		return
+	}
+	for _, q := range qs {
+		q.update(space, inodes)
+	}
+}
+
+// quotaDiff returns the quotas in a but not in b.
+func quotaDiff(a, b []*Quota) []*Quota {
+	var diff []*Quota
+	for _, q := range a {
+		found := false
+		for _, o := range b {
+			if q == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, q)
+		}
+	}
+	return diff
+}
+
+func (m *baseMeta) flushQuotas() {
+	for {
+		time.Sleep(time.Second * 3)
+		m.syncQuotas()
+	}
+}
+
+// syncQuotas flushes the changes of usage into the meta engine, then reloads all the quotas
+// to see the changes made by other sessions.
+func (m *baseMeta) syncQuotas() {
+	deltas := make(map[Ino]*Quota)
+	m.quotaLock.RLock()
+	for inode, q := range m.dirQuotas {
+		space := atomic.SwapInt64(&q.newSpace, 0)
+		inodes := atomic.SwapInt64(&q.newInodes, 0)
+		if space != 0 || inodes != 0 {
+			deltas[inode] = &Quota{UsedSpace: space, UsedInodes: inodes}
+		}
+	}
+	m.quotaLock.RUnlock()
+	if len(deltas) > 0 {
+		if err := m.en.doFlushQuotas(deltas); err != nil {
+			logger.Warnf("flush quotas: %s", err)
+			m.quotaLock.RLock()
+			for inode, d := range deltas {
+				if q := m.dirQuotas[inode]; q != nil {
+					q.update(d.UsedSpace, d.UsedInodes)
+				}
+			}
+			m.quotaLock.RUnlock()
+			return
+		}
+	}
+	m.loadQuotas()
+}
+
+func (m *baseMeta) loadQuotas() {
+	quotas, err := m.en.doLoadQuotas()
+	if err != nil {
+		logger.Warnf("load quotas: %s", err)
+		return
+	}
+	m.quotaLock.Lock()
+	defer m.quotaLock.Unlock()
+	for inode, q := range quotas {
+		if old := m.dirQuotas[inode]; old != nil {
+			atomic.StoreInt64(&old.MaxSpace, q.MaxSpace)
+			atomic.StoreInt64(&old.MaxInodes, q.MaxInodes)
+			atomic.StoreInt64(&old.UsedSpace, q.UsedSpace)
+			atomic.StoreInt64(&old.UsedInodes, q.UsedInodes)
+		} else {
+			m.dirQuotas[inode] = q
+		}
+	}
+	for inode := range m.dirQuotas {
+		if quotas[inode] == nil {
+			delete(m.dirQuotas, inode)
+		}
+	}
+}
+
+// resolve returns the inode of a path, which is relative to the root of the volume.
+func (m *baseMeta) resolve(ctx Context, p string) (Ino, *Attr, error) {
+	inode := Ino(1)
+	attr := &Attr{}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 {
+		return 0, nil, st
+	}
+	for _, name := range strings.Split(path.Clean("/"+p), "/") {
+		if name == "" {
+			continue
+		}
+		if st := m.Lookup(ctx, inode, name, &inode, attr); st != 0 {
+			return 0, nil, fmt.Errorf("lookup %s: %s", name, st)
+		}
+	}
+	return inode, attr, nil
+}
+
+// pathOf returns a path of the inode, or the inode itself if it's not in the tree.
+func (m *baseMeta) pathOf(ctx Context, inode Ino) string {
+	if p := m.nodePath(ctx, inode); p != "" {
+		return p
+	}
+	return fmt.Sprintf("inode(%d)", inode)
+}
+
+// countUsage returns the usage of a directory as it's counted by a quota, the stats of
+// directories are not trusted if exact is set.
+func (m *baseMeta) countUsage(ctx Context, inode Ino, exact bool) (space, inodes int64, err error) {
+	var summary Summary
+	if st := m.summary(ctx, inode, &summary, exact); st != 0 {
+		return 0, 0, st
+	}
+	// the directory itself is not counted
+	space = int64(summary.Size - summary.Dirs*4096)
+	inodes = int64(summary.Files + summary.Dirs - 1)
+	return
+}
+
+func (m *baseMeta) HandleQuota(ctx Context, cmd uint8, dpath string, quotas map[string]*Quota, repair bool) error {
+	if cmd != QuotaGet && cmd != QuotaList && m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	m.syncQuotas()
+	var inode Ino
+	if cmd != QuotaList && !(cmd == QuotaCheck && dpath == "") {
+		var attr *Attr
+		var err error
+		if inode, attr, err = m.resolve(ctx, dpath); err != nil {
+			return err
+		}
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+	}
+
+	switch cmd {
+	case QuotaSet:
+		q := quotas[dpath]
+		if q == nil {
+			return fmt.Errorf("no quota is given for %s", dpath)
+		}
+		old, err := m.en.doGetQuota(inode)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			q.UsedSpace, q.UsedInodes = old.UsedSpace, old.UsedInodes
+		} else if q.UsedSpace, q.UsedInodes, err = m.countUsage(ctx, inode, false); err != nil {
+			return err
+		}
+		if err = m.en.doSetQuota(inode, q); err != nil {
+			return err
+		}
+		m.loadQuotas()
+	case QuotaGet:
+		q, err := m.en.doGetQuota(inode)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("no quota for %s", dpath)
+		}
+		quotas[dpath] = q
+	case QuotaDel:
+		if err := m.en.doDelQuota(inode); err != nil {
+			return err
+		}
+		m.loadQuotas()
+	case QuotaList, QuotaCheck:
+		all, err := m.en.doLoadQuotas()
+		if err != nil {
+			return err
+		}
+		for ino, q := range all {
+			if cmd == QuotaCheck && inode > 0 && ino != inode {
+				continue
+			}
+			p := m.pathOf(ctx, ino)
+			quotas[p] = q
+			if cmd == QuotaList {
+				continue
+			}
+			space, inodes, err := m.countUsage(ctx, ino, true)
+			if err != nil {
+				return fmt.Errorf("count usage of %s: %s", p, err)
+			}
+			if space == q.UsedSpace && inodes == q.UsedInodes {
+				continue
+			}
+			logger.Warnf("Usage of quota on %s is inconsistent: space %d (counted %d), inodes %d (counted %d)",
+				p, q.UsedSpace, space, q.UsedInodes, inodes)
+			if repair {
+				q.UsedSpace, q.UsedInodes = space, inodes
+				if err = m.en.doSetQuota(ino, q); err != nil {
+					return err
+				}
+				logger.Infof("Usage of quota on %s is fixed", p)
+			}
+		}
+		if cmd == QuotaCheck && inode > 0 && len(quotas) == 0 {
+			return fmt.Errorf("no quota for %s", dpath)
+		}
+		m.loadQuotas()
+	default:
+		return fmt.Errorf("unknown quota command %d", cmd)
+	}
+	return nil
+}
@@ -16,9 +16,8 @@
 package meta
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
@@ -28,6 +27,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -45,8 +45,16 @@ import (
 	Flock: lockf$inode -> { $sid_$owner -> ltype }
 	POSIX lock: lockp$inode -> { $sid_$owner -> Plock(pid,ltype,start,end) }
 	Sessions: sessions -> [ $sid -> heartbeat ]
+	Session info: sessionInfos -> { $sid -> {JSON} }
+	Sustained inodes: session$sid -> [$inode]
 	Removed files: delfiles -> [$inode:$length -> seconds]
 	Slices refs: k$chunkid_$size -> refcount
+	Dir stats: u$inode -> {length,space,files,dirs}
+	Dir deltas: w$inode -> {length,space,files,dirs}, dirDeltas -> [$inode]
+	Change log: events -> stream of {event -> JSON}
+
+	All the keys above are prefixed by {$prefix} if the prefix of volume is given in the URL, or a hash
+	tag {$db} in Redis Cluster, so the keys of a volume are in the same slot.
 */
 
 var logger = utils.GetLogger("juicefs")
@@ -55,13 +63,16 @@ const usedSpace = "usedSpace"
 const totalInodes = "totalInodes"
 const delfiles = "delfiles"
 const allSessions = "sessions"
+const sessionInfos = "sessionInfos"
+const changeEvents = "events"
+const dirDeltas = "dirDeltas"
 
 const scriptLookup = `
 local parse = function(buf, idx, pos)
 	return bit.lshift(string.byte(buf, idx), pos)
 end
 
-local buf = redis.call('HGET', KEYS[1], KEYS[2])
+local buf = redis.call('HGET', KEYS[1], ARGV[1])
 if not buf then
        return false
 end
@@ -77,46 +88,57 @@ local ino =  parse(buf, 1, 56) +
              parse(buf, 6, 16) +
              parse(buf, 7, 8) +
              parse(buf, 8, 0)
-return {ino, redis.call('GET', "i" .. tostring(ino))}
+return {ino, redis.call('GET', ARGV[2] .. tostring(ino))}
 `
 
-// RedisConfig is config for Redis client.
-type RedisConfig struct {
-	Strict  bool // update ctime
-	Retries int
-}
-
 type redisMeta struct {
-	sync.Mutex
-	conf    *RedisConfig
-	rdb     *redis.Client
+	*baseMeta
+	rdb     redis.UniversalClient
+	prefix  string           // prefix of all the keys, a hash tag in Redis Cluster
 	txlocks [1024]sync.Mutex // Pessimistic locks to reduce conflict on Redis
 
-	sid          int64
-	openFiles    map[Ino]int
-	removedFiles map[Ino]bool
-	compacting   map[uint64]bool
-	symlinks     *sync.Map
-	msgCallbacks *msgCallbacks
-
 	shaLookup string // The SHA returned by Redis for the loaded `scriptLookup`
 }
 
 var _ Meta = &redisMeta{}
+var _ engine = &redisMeta{}
 
-type msgCallbacks struct {
-	sync.Mutex
-	callbacks map[uint32]MsgCallback
+func init() {
+	Register("redis", newRedisMeta)
+	Register("rediss", newRedisMeta)
 }
 
-// NewRedisMeta return a meta store using Redis.
-func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
+// newRedisMeta return a meta store using Redis.
+func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
+	addr, name, err := splitPrefix(addr)
+	if err != nil {
+		return nil, err
+	}
+	url := driver + "://" + addr
 	opt, err := redis.ParseURL(url)
 	if err != nil {
 		return nil, fmt.Errorf("parse %s: %s", url, err)
 	}
-	var rdb *redis.Client
-	if strings.Contains(opt.Addr, ",") {
+	readTimeout, writeTimeout := conf.ReadTimeout, conf.WriteTimeout
+	if readTimeout == 0 {
+		readTimeout = time.Second * 30
+	}
+	if writeTimeout == 0 {
+		writeTimeout = time.Second * 5
+	}
+	// the addresses of multiple hosts are mangled by ParseURL
+	hosts := addr
+	if p := strings.LastIndex(hosts, "@"); p >= 0 {
+		hosts = hosts[p+1:]
+	}
+	if p := strings.Index(hosts, "/"); p >= 0 {
+		hosts = hosts[:p]
+	}
+	addrs := strings.Split(hosts, ",")
+	var rdb redis.UniversalClient
+	var prefix string
+	if len(addrs) > 1 && !strings.Contains(addrs[0], ":") {
+		// the name of master is followed by the addresses of sentinels
 		var fopt redis.FailoverOptions
 		ps := strings.Split(opt.Addr, ",")
 		fopt.MasterName = ps[0]
@@ -145,9 +167,31 @@ func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
 		fopt.MaxRetries = conf.Retries
 		fopt.MinRetryBackoff = time.Millisecond * 100
 		fopt.MaxRetryBackoff = time.Minute * 1
-		fopt.ReadTimeout = time.Second * 30
-		fopt.WriteTimeout = time.Second * 5
+		fopt.ReadTimeout = readTimeout
+		fopt.WriteTimeout = writeTimeout
 		rdb = redis.NewFailoverClient(&fopt)
+	} else if len(addrs) > 1 {
+		// the addresses of some nodes in Redis Cluster, all with port
+		var copt redis.ClusterOptions
+		copt.Addrs = addrs
+		copt.Username = opt.Username
+		copt.Password = opt.Password
+		if copt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
+			copt.Password = os.Getenv("REDIS_PASSWORD")
+		}
+		if opt.TLSConfig != nil {
+			// the name of server is taken from the address of each node
+			copt.TLSConfig = &tls.Config{}
+		}
+		copt.MaxRetries = conf.Retries
+		copt.MinRetryBackoff = time.Millisecond * 100
+		copt.MaxRetryBackoff = time.Minute * 1
+		copt.ReadTimeout = readTimeout
+		copt.WriteTimeout = writeTimeout
+		rdb = redis.NewClusterClient(&copt)
+		// there is only one database in Redis Cluster, the number in the URL tells the volumes apart
+		// if no prefix is given
+		prefix = fmt.Sprintf("{%d}", opt.DB)
 	} else {
 		if opt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
 			opt.Password = os.Getenv("REDIS_PASSWORD")
@@ -155,28 +199,187 @@ func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
 		opt.MaxRetries = conf.Retries
 		opt.MinRetryBackoff = time.Millisecond * 100
 		opt.MaxRetryBackoff = time.Minute * 1
-		opt.ReadTimeout = time.Second * 30
-		opt.WriteTimeout = time.Second * 5
+		opt.ReadTimeout = readTimeout
+		opt.WriteTimeout = writeTimeout
 		rdb = redis.NewClient(opt)
 	}
+	if name != "" {
+		prefix = "{" + name + "}"
+	}
 	m := &redisMeta{
-		conf:         conf,
-		rdb:          rdb,
-		openFiles:    make(map[Ino]int),
-		removedFiles: make(map[Ino]bool),
-		compacting:   make(map[uint64]bool),
-		symlinks:     &sync.Map{},
-		msgCallbacks: &msgCallbacks{
-			callbacks: make(map[uint32]MsgCallback),
-		},
+		baseMeta: newBaseMeta(conf),
+		rdb:      rdb,
+		prefix:   prefix,
 	}
-
+	m.en = m
 	m.checkServerConfig()
+	if conf.CacheTTL > 0 {
+		c := newMetaCache(conf.CacheTTL, conf.CacheLimit)
+		if err = m.watchChanges(c); err != nil {
+			logger.Warnf("Metadata will not be cached because the changes can't be watched: %s, "+
+				"please enable the keyspace notifications (K$lhg) in the configuration of Redis", err)
+		} else {
+			m.cache = c
+		}
+	}
 	return m, nil
 }
 
+// watchChanges subscribes the keyspace notifications of Redis to invalidate the cache, the
+// notifications for the keys of nodes, entries and chunks should be enabled by the operator.
+func (r *redisMeta) watchChanges(c *metaCache) error {
+	ctx := Background
+	check := func(ctx context.Context, c redis.Cmdable) error {
+		cfg, err := c.ConfigGet(ctx, "notify-keyspace-events").Result()
+		if err != nil {
+			return fmt.Errorf("check notify-keyspace-events: %s", err)
+		}
+		var events string
+		if len(cfg) == 2 {
+			events, _ = cfg[1].(string)
+		}
+		var missing string
+		for _, e := range "K$lhg" {
+			if !strings.ContainsRune(events, e) && (e == 'K' || !strings.ContainsRune(events, 'A')) {
+				missing += string(e)
+			}
+		}
+		if missing != "" {
+			return fmt.Errorf("notify-keyspace-events is %q, which misses %q", events, missing)
+		}
+		return nil
+	}
+	var db int
+	var err error
+	switch c := r.rdb.(type) {
+	case *redis.ClusterClient:
+		// the notifications are sent by the node holding the keys, which is the same
+		// one the pattern (with the hash tag) is subscribed from
+		err = c.ForEachMaster(ctx, func(ctx context.Context, n *redis.Client) error { return check(ctx, n) })
+	case *redis.Client:
+		db = c.Options().DB
+		err = check(ctx, c)
+	}
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("__keyspace@%d__:", db)
+	// the heartbeats are published to the subscription itself, the notifications might be lost
+	// when they are missing, so the cache is not used until they are received again
+	heartbeat := fmt.Sprintf("%sheartbeat%d", r.prefix, rand.Int63())
+	ps := r.rdb.PSubscribe(ctx, prefix+r.prefix+"[idc][0-9]*")
+	if _, err = ps.Receive(ctx); err == nil {
+		err = ps.Subscribe(ctx, heartbeat)
+	}
+	if err != nil {
+		_ = ps.Close()
+		return err
+	}
+	last := time.Now().UnixNano()
+	go func() {
+		// go-redis subscribes again silently after reconnected, the changes made in between are unknown
+		for msg := range ps.ChannelWithSubscriptions(ctx, 10000) {
+			atomic.StoreInt64(&last, time.Now().UnixNano())
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				c.reset(false)
+			case *redis.Message:
+				if msg.Channel == heartbeat {
+					if !c.available() {
+						logger.Infof("Notifications of Redis are received again, metadata cache is enabled")
+						c.reset(false)
+					}
+				} else if inode := r.keyInode(strings.TrimPrefix(msg.Channel, prefix)); inode > 0 {
+					c.invalidate(inode)
+				}
+			}
+		}
+	}()
+	go func() {
+		for range time.Tick(time.Second) {
+			_ = r.rdb.Publish(ctx, heartbeat, "").Err()
+			if time.Now().UnixNano()-atomic.LoadInt64(&last) > int64(3*time.Second) && c.available() {
+				logger.Warnf("No notifications from Redis in 3 seconds, metadata cache is disabled")
+				c.reset(true)
+			}
+		}
+	}()
+	return nil
+}
+
+// keyInode returns the inode of a key of node, entries or chunk, or 0 for other keys.
+func (r *redisMeta) keyInode(key string) Ino {
+	if !strings.HasPrefix(key, r.prefix) {
+		return 0
+	}
+	key = key[len(r.prefix):]
+	if len(key) < 2 || !strings.ContainsRune("idc", rune(key[0])) {
+		return 0
+	}
+	s := key[1:]
+	if i := strings.IndexByte(s, '_'); key[0] == 'c' && i > 0 {
+		s = s[:i]
+	}
+	inode, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return Ino(inode)
+}
+
+// invalidate drops the cached metadata of the changed keys, the changes made by other clients
+// are received from the keyspace notifications.
+func (r *redisMeta) invalidate(keys ...string) {
+	if r.cache == nil {
+		return
+	}
+	for _, key := range keys {
+		if inode := r.keyInode(key); inode > 0 {
+			r.cache.invalidate(inode)
+		}
+	}
+}
+
+func (r *redisMeta) Reset() error {
+	ctx := Background
+	return r.scan(ctx, "*", func(keys []string) error {
+		if r.prefix == "" {
+			// the keys of the volumes with prefix are left
+			var own []string
+			for _, k := range keys {
+				if !strings.HasPrefix(k, "{") {
+					own = append(own, k)
+				}
+			}
+			keys = own
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		return r.rdb.Del(ctx, keys...).Err()
+	})
+}
+
+func (r *redisMeta) Name() string {
+	return "redis"
+}
+
+func (r *redisMeta) serverVersion() string {
+	info, err := r.rdb.Info(Background, "server").Result()
+	if err != nil {
+		logger.Warnf("get version of Redis: %s", err)
+		return ""
+	}
+	for _, l := range strings.Split(info, "\n") {
+		if strings.HasPrefix(l, "redis_version:") {
+			return strings.TrimSpace(l[len("redis_version:"):])
+		}
+	}
+	return ""
+}
+
 func (r *redisMeta) Init(format Format, force bool) error {
-	body, err := r.rdb.Get(Background, "setting").Bytes()
+	body, err := r.rdb.Get(Background, r.prefix+"setting").Bytes()
 	if err != nil && err != redis.Nil {
 		return err
 	}
@@ -190,10 +393,17 @@ func (r *redisMeta) Init(format Format, force bool) error {
 			old.SecretKey = "removed"
 			logger.Warnf("Existing volume will be overwrited: %+v", old)
 		} else {
-			// only AccessKey and SecretKey can be safely updated.
+			// only AccessKey, SecretKey, the limits, TrashDays and EnableACL can be safely updated.
 			format.UUID = old.UUID
 			old.AccessKey = format.AccessKey
 			old.SecretKey = format.SecretKey
+			old.Capacity = format.Capacity
+			old.Inodes = format.Inodes
+			old.TrashDays = format.TrashDays
+			if !old.EnableACL {
+				// ACL can be enabled for an existing volume, but not disabled
+				old.EnableACL = format.EnableACL
+			}
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -206,7 +416,8 @@ func (r *redisMeta) Init(format Format, force bool) error {
 	if err != nil {
 		logger.Fatalf("json: %s", err)
 	}
-	err = r.rdb.Set(Background, "setting", data, 0).Err()
+	r.setFormat(&format)
+	err = r.rdb.Set(Background, r.prefix+"setting", data, 0).Err()
 	if err != nil {
 		return err
 	}
@@ -222,11 +433,26 @@ func (r *redisMeta) Init(format Format, force bool) error {
 	attr.Nlink = 2
 	attr.Length = 4 << 10
 	attr.Parent = 1
-	return r.rdb.Set(Background, r.inodeKey(1), r.marshal(&attr), 0).Err()
+	if err = r.rdb.Set(Background, r.inodeKey(1), r.marshal(&attr), 0).Err(); err != nil {
+		return err
+	}
+	if body == nil {
+		if err = r.doSetDirStat(1, &dirStat{}); err != nil {
+			return err
+		}
+	}
+	if format.TrashDays > 0 {
+		created, err := r.rdb.SetNX(Background, r.inodeKey(TrashInode), r.marshal(specialRootAttr()), 0).Result()
+		if err != nil || !created {
+			return err
+		}
+		return r.doSetDirStat(TrashInode, &dirStat{})
+	}
+	return nil
 }
 
 func (r *redisMeta) Load() (*Format, error) {
-	body, err := r.rdb.Get(Background, "setting").Bytes()
+	body, err := r.rdb.Get(Background, r.prefix+"setting").Bytes()
 	if err == redis.Nil {
 		return nil, fmt.Errorf("no volume found")
 	}
@@ -238,76 +464,92 @@ func (r *redisMeta) Load() (*Format, error) {
 	if err != nil {
 		return nil, fmt.Errorf("json: %s", err)
 	}
+	r.setFormat(&format)
 	return &format, nil
 }
 
 func (r *redisMeta) NewSession() error {
 	var err error
-	r.sid, err = r.rdb.Incr(Background, "nextsession").Result()
+	if c, ok := r.rdb.(*redis.ClusterClient); ok {
+		// the script is run by the node holding the keys, which could be changed
+		err = c.ForEachMaster(Background, func(ctx context.Context, n *redis.Client) error {
+			return n.ScriptLoad(ctx, scriptLookup).Err()
+		})
+		r.shaLookup = redis.NewScript(scriptLookup).Hash()
+	} else {
+		r.shaLookup, err = r.rdb.ScriptLoad(Background, scriptLookup).Result()
+	}
+	if err != nil {
+		logger.Warnf("load scriptLookup: %v", err)
+		r.shaLookup = ""
+	}
+	r.loadQuotas()
+	go r.flushQuotas()
+	go r.refreshFormat()
+	if r.conf.ReadOnly {
+		return nil
+	}
+
+	r.sid, err = r.rdb.Incr(Background, r.prefix+"nextsession").Result()
 	if err != nil {
 		return fmt.Errorf("create session: %s", err)
 	}
 	logger.Debugf("session is is %d", r.sid)
-
-	r.shaLookup, err = r.rdb.ScriptLoad(Background, scriptLookup).Result()
+	_, err = r.rdb.Pipelined(Background, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(Background, r.prefix+allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))})
+		pipe.HSet(Background, r.prefix+sessionInfos, strconv.Itoa(int(r.sid)), r.newSessionInfo())
+		return nil
+	})
 	if err != nil {
-		logger.Warnf("load scriptLookup: %v", err)
-		r.shaLookup = ""
+		return fmt.Errorf("set session info: %s", err)
 	}
 
 	go r.refreshSession()
 	go r.cleanupDeletedFiles()
 	go r.cleanupSlices()
 	go r.cleanupLeakedChunks()
+	go r.cleanupTrash()
+	go r.cleanupEvents()
+	go r.flushDirStats()
+	go r.flushAtimes()
 	return nil
 }
 
-func (r *redisMeta) OnMsg(mtype uint32, cb MsgCallback) {
-	r.msgCallbacks.Lock()
-	defer r.msgCallbacks.Unlock()
-	r.msgCallbacks.callbacks[mtype] = cb
-}
-
-func (r *redisMeta) newMsg(mid uint32, args ...interface{}) error {
-	r.msgCallbacks.Lock()
-	cb, ok := r.msgCallbacks.callbacks[mid]
-	r.msgCallbacks.Unlock()
-	if ok {
-		return cb(args...)
-	}
-	return fmt.Errorf("message %d is not supported", mid)
-}
-
 func (r *redisMeta) sessionKey(sid int64) string {
-	return "session" + strconv.FormatInt(sid, 10)
+	return r.prefix + "session" + strconv.FormatInt(sid, 10)
 }
 
 func (r *redisMeta) symKey(inode Ino) string {
-	return "s" + inode.String()
+	return r.prefix + "s" + inode.String()
 }
 
 func (r *redisMeta) inodeKey(inode Ino) string {
-	return "i" + inode.String()
+	return r.prefix + "i" + inode.String()
 }
 
 func (r *redisMeta) entryKey(parent Ino) string {
-	return "d" + parent.String()
+	return r.prefix + "d" + parent.String()
 }
 
 func (r *redisMeta) chunkKey(inode Ino, indx uint32) string {
-	return "c" + inode.String() + "_" + strconv.FormatInt(int64(indx), 10)
+	return r.prefix + "c" + inode.String() + "_" + strconv.FormatInt(int64(indx), 10)
 }
 
 func (r *redisMeta) sliceKey(chunkid uint64, size uint32) string {
-	return "k" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(size), 10)
+	return r.prefix + "k" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(size), 10)
+}
+
+// parentKey is the hash of the parents of a file with hardlinks, with the number of entries in each one.
+func (r *redisMeta) parentKey(inode Ino) string {
+	return r.prefix + "p" + inode.String()
 }
 
 func (r *redisMeta) xattrKey(inode Ino) string {
-	return "x" + inode.String()
+	return r.prefix + "x" + inode.String()
 }
 
 func (r *redisMeta) flockKey(inode Ino) string {
-	return "lockf" + inode.String()
+	return r.prefix + "lockf" + inode.String()
 }
 
 func (r *redisMeta) ownerKey(owner uint64) string {
@@ -315,133 +557,71 @@ func (r *redisMeta) ownerKey(owner uint64) string {
 }
 
 func (r *redisMeta) plockKey(inode Ino) string {
-	return "lockp" + inode.String()
+	return r.prefix + "lockp" + inode.String()
 }
 
-func (r *redisMeta) nextInode() (Ino, error) {
-	ino, err := r.rdb.Incr(Background, "nextinode").Uint64()
-	if ino == 1 {
-		ino, err = r.rdb.Incr(Background, "nextinode").Uint64()
-	}
-	return Ino(ino), err
+func (r *redisMeta) getCounter(name string) (int64, error) {
+	c, cancel := context.WithTimeout(Background, time.Millisecond*300)
+	defer cancel()
+	return r.rdb.IncrBy(c, r.prefix+name, 0).Result()
 }
 
-func (r *redisMeta) packEntry(_type uint8, inode Ino) []byte {
-	wb := utils.NewBuffer(9)
-	wb.Put8(_type)
-	wb.Put64(uint64(inode))
-	return wb.Bytes()
+func (r *redisMeta) incrCounter(name string, delta int64) (int64, error) {
+	return r.rdb.IncrBy(Background, r.prefix+name, delta).Result()
 }
 
-func (r *redisMeta) parseEntry(buf []byte) (uint8, Ino) {
-	if len(buf) != 9 {
-		panic("invalid entry")
-	}
-	return buf[0], Ino(binary.BigEndian.Uint64(buf[1:]))
+// reservation is the usage of the volume reserved before a transaction.
+type reservation struct {
+	space, inodes int64
 }
 
-func (r *redisMeta) parseAttr(buf []byte, attr *Attr) {
-	if attr == nil {
-		return
+// reserve checks the limits of the volume and reserves space bytes and inodes with INCRBY before the
+// transaction using them, so the transactions don't watch the counters, which are changed by all the
+// clients. Only the usage with a limit is reserved, the rest should be increased in the transaction,
+// and the reserved one should be released if the transaction fails.
+func (r *redisMeta) reserve(ctx Context, space, inodes int64) (*reservation, error) {
+	capacity, maxInodes := r.limits()
+	rv := &reservation{}
+	if space > 0 && capacity > 0 {
+		used, err := r.rdb.IncrBy(ctx, r.prefix+usedSpace, space).Result()
+		if err != nil {
+			return nil, err
+		}
+		rv.space = space
+		if used > int64(capacity) {
+			r.release(ctx, rv)
+			return nil, syscall.ENOSPC
+		}
 	}
-	rb := utils.FromBuffer(buf)
-	attr.Flags = rb.Get8()
-	attr.Mode = rb.Get16()
-	attr.Typ = uint8(attr.Mode >> 12)
-	attr.Mode &= 0xfff
-	attr.Uid = rb.Get32()
-	attr.Gid = rb.Get32()
-	attr.Atime = int64(rb.Get64())
-	attr.Atimensec = rb.Get32()
-	attr.Mtime = int64(rb.Get64())
-	attr.Mtimensec = rb.Get32()
-	attr.Ctime = int64(rb.Get64())
-	attr.Ctimensec = rb.Get32()
-	attr.Nlink = rb.Get32()
-	attr.Length = rb.Get64()
-	attr.Rdev = rb.Get32()
-	if rb.Left() >= 8 {
-		attr.Parent = Ino(rb.Get64())
-	}
-	attr.Full = true
-	logger.Tracef("attr: %+v -> %+v", buf, attr)
-}
-
-func (r *redisMeta) marshal(attr *Attr) []byte {
-	w := utils.NewBuffer(36 + 24 + 4 + 8)
-	w.Put8(attr.Flags)
-	w.Put16((uint16(attr.Typ) << 12) | (attr.Mode & 0xfff))
-	w.Put32(attr.Uid)
-	w.Put32(attr.Gid)
-	w.Put64(uint64(attr.Atime))
-	w.Put32(attr.Atimensec)
-	w.Put64(uint64(attr.Mtime))
-	w.Put32(attr.Mtimensec)
-	w.Put64(uint64(attr.Ctime))
-	w.Put32(attr.Ctimensec)
-	w.Put32(attr.Nlink)
-	w.Put64(attr.Length)
-	w.Put32(attr.Rdev)
-	w.Put64(uint64(attr.Parent))
-	logger.Tracef("attr: %+v -> %+v", attr, w.Bytes())
-	return w.Bytes()
-}
-
-func align4K(length uint64) int64 {
-	if length == 0 {
-		return 0
+	if inodes > 0 && maxInodes > 0 {
+		used, err := r.rdb.IncrBy(ctx, r.prefix+totalInodes, inodes).Result()
+		if err != nil {
+			r.release(ctx, rv)
+			return nil, err
+		}
+		rv.inodes = inodes
+		if used > int64(maxInodes) {
+			r.release(ctx, rv)
+			return nil, syscall.ENOSPC
+		}
 	}
-	return int64((((length - 1) >> 12) + 1) << 12)
+	return rv, nil
 }
 
-func (r *redisMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
-	*totalspace = 1 << 50
-	c, cancel := context.WithTimeout(ctx, time.Millisecond*300)
-	defer cancel()
-	used, _ := r.rdb.IncrBy(c, usedSpace, 0).Result()
-	used = ((used >> 16) + 1) << 16 // aligned to 64K
-	*availspace = *totalspace - uint64(used)
-	inodes, _ := r.rdb.IncrBy(c, totalInodes, 0).Result()
-	*iused = uint64(inodes)
-	*iavail = 10 << 20
-	return 0
-}
-
-func (r *redisMeta) Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno {
-	var attr Attr
-	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
-		return st
-	}
-	if attr.Typ == TypeDirectory {
-		var entries []*Entry
-		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
-			return st
+func (r *redisMeta) release(ctx Context, rv *reservation) {
+	if rv.space > 0 {
+		if err := r.rdb.DecrBy(ctx, r.prefix+usedSpace, rv.space).Err(); err != nil {
+			logger.Warnf("release %d bytes reserved: %s", rv.space, err)
 		}
-		for _, e := range entries {
-			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
-				continue
-			}
-			if e.Attr.Typ == TypeDirectory {
-				if st := r.Summary(ctx, e.Inode, summary); st != 0 {
-					return st
-				}
-			} else {
-				summary.Files++
-				summary.Length += e.Attr.Length
-				summary.Size += uint64(align4K(e.Attr.Length))
-			}
+	}
+	if rv.inodes > 0 {
+		if err := r.rdb.DecrBy(ctx, r.prefix+totalInodes, rv.inodes).Err(); err != nil {
+			logger.Warnf("release %d inodes reserved: %s", rv.inodes, err)
 		}
-		summary.Dirs++
-		summary.Size += 4096
-	} else {
-		summary.Files++
-		summary.Length += attr.Length
-		summary.Size += uint64(align4K(attr.Length))
 	}
-	return 0
 }
 
-func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+func (r *redisMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
 	var foundIno Ino
 	var encodedAttr []byte
 	var err error
@@ -449,7 +629,7 @@ func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, att
 	entryKey := r.entryKey(parent)
 	if len(r.shaLookup) > 0 && attr != nil {
 		var res interface{}
-		res, err = r.rdb.EvalSha(ctx, r.shaLookup, []string{entryKey, name}).Result()
+		res, err = r.rdb.EvalSha(ctx, r.shaLookup, []string{entryKey}, name, r.prefix+"i").Result()
 		if err != nil {
 			if strings.Contains(err.Error(), "NOSCRIPT") || strings.Contains(err.Error(), "Error running script") {
 				logger.Warnf("eval lookup: %s", err)
@@ -493,44 +673,7 @@ func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, att
 	return errno(err)
 }
 
-func (r *redisMeta) accessMode(attr *Attr, uid uint32, gid uint32) uint8 {
-	if uid == 0 {
-		return 0x7
-	}
-	mode := attr.Mode
-	if uid == attr.Uid {
-		return uint8(mode>>6) & 7
-	}
-	if gid == attr.Gid {
-		return uint8(mode>>3) & 7
-	}
-	return uint8(mode & 7)
-}
-
-func (r *redisMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) syscall.Errno {
-	if ctx.Uid() == 0 {
-		return 0
-	}
-
-	if attr == nil || !attr.Full {
-		if attr == nil {
-			attr = &Attr{}
-		}
-		err := r.GetAttr(ctx, inode, attr)
-		if err != 0 {
-			return err
-		}
-	}
-
-	mode := r.accessMode(attr, ctx.Uid(), ctx.Gid())
-	if mode&mmask != mmask {
-		logger.Debugf("Access inode %d %o, mode %o, request mode %o", inode, attr.Mode, mode, mmask)
-		return syscall.EACCES
-	}
-	return 0
-}
-
-func (r *redisMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+func (r *redisMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	var c context.Context = ctx
 	if inode == 1 {
 		var cancel func()
@@ -541,13 +684,6 @@ func (r *redisMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	if err == nil {
 		r.parseAttr(a, attr)
 	}
-	if err != nil && inode == 1 {
-		err = nil
-		attr.Typ = TypeDirectory
-		attr.Mode = 0777
-		attr.Nlink = 2
-		attr.Length = 4 << 10
-	}
 	return errno(err)
 }
 
@@ -577,6 +713,7 @@ func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 	}()
 	l.Lock()
 	defer l.Unlock()
+	defer r.invalidate(keys...)
 	for i := 0; i < 50; i++ {
 		err = r.rdb.Watch(ctx, txf, keys...)
 		if err == redis.TxFailedErr {
@@ -589,8 +726,45 @@ func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 	return errno(err)
 }
 
+// scan calls fn with the keys matching pattern in batches, the prefix of keys is prepended to pattern.
+func (r *redisMeta) scan(ctx context.Context, pattern string, fn func(keys []string) error) error {
+	scanNode := func(ctx context.Context, c redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := c.Scan(ctx, cursor, r.prefix+pattern, 10000).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err = fn(keys); err != nil {
+					return err
+				}
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+	if c, ok := r.rdb.(*redis.ClusterClient); ok {
+		// the keys are in one of the masters
+		var mu sync.Mutex
+		return c.ForEachMaster(ctx, func(ctx context.Context, n *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scanNode(ctx, n)
+		})
+	}
+	return scanNode(ctx, r.rdb)
+}
+
 func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	if r.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := r.fileQuotas(ctx, inode)
+	var delta int64
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		var t Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
@@ -600,6 +774,12 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 		if t.Typ != TypeFile {
 			return syscall.EPERM
 		}
+		if t.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if t.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
 		old := t.Length
 		var zeroChunks []uint32
 		if length > old {
@@ -608,12 +788,12 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 				var cursor uint64
 				var keys []string
 				for {
-					keys, cursor, err = tx.Scan(ctx, cursor, fmt.Sprintf("c%d_*", inode), 10000).Result()
+					keys, cursor, err = tx.Scan(ctx, cursor, fmt.Sprintf("%sc%d_*", r.prefix, inode), 10000).Result()
 					if err != nil {
 						return err
 					}
 					for _, key := range keys {
-						indx, err := strconv.Atoi(strings.Split(key, "_")[1])
+						indx, err := strconv.Atoi(key[strings.LastIndexByte(key, '_')+1:])
 						if err != nil {
 							logger.Errorf("parse %s: %s", key, err)
 							continue
@@ -632,12 +812,26 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 				}
 			}
 		}
+		if err = r.checkDirQuotas(qs, align4K(length)-align4K(old), 0); err != nil {
+			return err
+		}
+		delta = align4K(length) - align4K(old)
+		stats, err := fileStats(t.Parent, int64(length)-int64(old), delta, func() (map[Ino]int, error) {
+			return r.getParents(ctx, tx, inode)
+		})
+		if err != nil {
+			return err
+		}
 		t.Length = length
 		now := time.Now()
 		t.Mtime = now.Unix()
 		t.Mtimensec = uint32(now.Nanosecond())
 		t.Ctime = now.Unix()
 		t.Ctimensec = uint32(now.Nanosecond())
+		rv, err := r.reserve(ctx, delta, 0)
+		if err != nil {
+			return err
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
 			if length > old {
@@ -672,16 +866,21 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 					pipe.RPush(ctx, r.chunkKey(inode, uint32(length/ChunkSize)), w.Bytes())
 				}
 			}
-			pipe.IncrBy(ctx, usedSpace, align4K(length)-align4K(old))
+			pipe.IncrBy(ctx, r.prefix+usedSpace, delta-rv.space)
+			r.updateDirStats(ctx, pipe, stats)
 			return nil
 		})
-		if err == nil {
-			if attr != nil {
-				*attr = t
-			}
+		if err != nil {
+			r.release(ctx, rv)
+		} else if attr != nil {
+			*attr = t
 		}
 		return err
 	}, r.inodeKey(inode))
+	if st == 0 {
+		r.updateDirQuotas(qs, delta, 0)
+	}
+	return st
 }
 
 const (
@@ -695,6 +894,11 @@ const (
 )
 
 func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if r.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := r.fileQuotas(ctx, inode)
+	var delta int64
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -710,7 +914,7 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 	if size == 0 {
 		return syscall.EINVAL
 	}
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		var t Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
@@ -723,6 +927,12 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		if t.Typ != TypeFile {
 			return syscall.EPERM
 		}
+		if t.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if t.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
 		length := t.Length
 		if off+size > t.Length {
 			if mode&fallocKeepSize == 0 {
@@ -731,10 +941,24 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		}
 
 		old := t.Length
+		if err = r.checkDirQuotas(qs, align4K(length)-align4K(old), 0); err != nil {
+			return err
+		}
+		delta = align4K(length) - align4K(old)
+		stats, err := fileStats(t.Parent, int64(length)-int64(old), delta, func() (map[Ino]int, error) {
+			return r.getParents(ctx, tx, inode)
+		})
+		if err != nil {
+			return err
+		}
 		t.Length = length
 		now := time.Now()
 		t.Ctime = now.Unix()
 		t.Ctimensec = uint32(now.Nanosecond())
+		rv, err := r.reserve(ctx, delta, 0)
+		if err != nil {
+			return err
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
 			if mode&(fallocZeroRange|fallocPunchHole) != 0 {
@@ -759,14 +983,22 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 					size -= l
 				}
 			}
-			pipe.IncrBy(ctx, usedSpace, align4K(length)-align4K(old))
+			pipe.IncrBy(ctx, r.prefix+usedSpace, delta-rv.space)
+			r.updateDirStats(ctx, pipe, stats)
 			return nil
 		})
+		if err != nil {
+			r.release(ctx, rv)
+		}
 		return err
 	}, r.inodeKey(inode))
+	if st == 0 {
+		r.updateDirQuotas(qs, delta, 0)
+	}
+	return st
 }
 
-func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+func (r *redisMeta) doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	return r.txn(ctx, func(tx *redis.Tx) error {
 		var cur Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
@@ -774,6 +1006,12 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			return err
 		}
 		r.parseAttr(a, &cur)
+		if cur.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if cur.Flags&(FlagImmutable|FlagAppend) != 0 && set&^SetAttrFlag != 0 {
+			return syscall.EPERM
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -795,6 +1033,9 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			}
 			cur.Mode = attr.Mode
 		}
+		if set&SetAttrFlag != 0 {
+			cur.Flags = attr.Flags
+		}
 		now := time.Now()
 		if set&SetAttrAtime != 0 {
 			cur.Atime = attr.Atime
@@ -816,6 +1057,7 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 		cur.Ctimensec = uint32(now.Nanosecond())
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&cur), 0)
+			r.appendEvent(ctx, pipe)
 			return nil
 		})
 		if err == nil {
@@ -825,28 +1067,11 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 	}, r.inodeKey(inode))
 }
 
-func (r *redisMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
-	if target, ok := r.symlinks.Load(inode); ok {
-		*path = target.([]byte)
-		return 0
-	}
-	target, err := r.rdb.Get(ctx, r.symKey(inode)).Bytes()
-	if err == nil {
-		*path = target
-		r.symlinks.Store(inode, target)
-	}
-	return errno(err)
-}
-
-func (r *redisMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
-	return r.mknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
-}
-
-func (r *redisMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, inode *Ino, attr *Attr) syscall.Errno {
-	return r.mknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+func (r *redisMeta) doReadlink(ctx Context, inode Ino) ([]byte, error) {
+	return r.rdb.Get(ctx, r.symKey(inode)).Bytes()
 }
 
-func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
 	ino, err := r.nextInode()
 	if err != nil {
 		return errno(err)
@@ -854,6 +1079,7 @@ func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mod
 	if attr == nil {
 		attr = &Attr{}
 	}
+	attr.Flags = 0
 	attr.Typ = _type
 	attr.Mode = mode & ^cumask
 	attr.Uid = ctx.Uid()
@@ -885,6 +1111,12 @@ func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mod
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 
 		err = tx.HGet(ctx, r.entryKey(parent), name).Err()
 		if err != nil && err != redis.Nil {
@@ -911,37 +1143,36 @@ func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mod
 			attr.Gid = pattr.Gid
 		}
 
+		rv, err := r.reserve(ctx, 0, 1)
+		if err != nil {
+			return err
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.appendEvent(ctx, pipe)
 			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(_type, ino))
 			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
 			pipe.Set(ctx, r.inodeKey(ino), r.marshal(attr), 0)
 			if _type == TypeSymlink {
 				pipe.Set(ctx, r.symKey(ino), path, 0)
 			} else if _type == TypeFile {
-				pipe.IncrBy(ctx, usedSpace, align4K(0))
+				pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(0))
+			} else if _type == TypeDirectory {
+				pipe.HSet(ctx, r.dirStatKey(ino), "length", 0, "space", 0, "files", 0, "dirs", 0)
+			}
+			if rv.inodes == 0 {
+				pipe.Incr(ctx, r.prefix+totalInodes)
 			}
-			pipe.Incr(ctx, totalInodes)
+			r.updateDirStat(ctx, pipe, parent, entryStat(_type, attr.Length, nil))
 			return nil
 		})
+		if err != nil {
+			r.release(ctx, rv)
+		}
 		return err
 	}, r.inodeKey(parent), r.entryKey(parent))
 }
 
-func (r *redisMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
-	return r.Mknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, inode, attr)
-}
-
-func (r *redisMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
-	err := r.Mknod(ctx, parent, name, TypeFile, mode, cumask, 0, inode, attr)
-	if err == 0 && inode != nil {
-		r.Lock()
-		r.openFiles[*inode] = 1
-		r.Unlock()
-	}
-	return err
-}
-
-func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
+func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 	buf, err := r.rdb.HGet(ctx, r.entryKey(parent), name).Bytes()
 	if err != nil {
 		return errno(err)
@@ -988,9 +1219,18 @@ func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.appendEvent(ctx, pipe)
 			pipe.HDel(ctx, r.entryKey(parent), name)
 			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
 			pipe.Del(ctx, r.xattrKey(inode))
+			r.updateDirStat(ctx, pipe, parent, entryStat(_type, attr.Length, nil).neg())
+			if attr.Parent == 0 {
+				if attr.Nlink > 0 {
+					pipe.HIncrBy(ctx, r.parentKey(inode), parent.String(), -1)
+				} else {
+					pipe.Del(ctx, r.parentKey(inode))
+				}
+			}
 			if attr.Nlink > 0 {
 				pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
 			} else {
@@ -1003,12 +1243,12 @@ func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 						pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
 						pipe.SAdd(ctx, r.sessionKey(r.sid), strconv.Itoa(int(inode)))
 					} else {
-						pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(inode, attr.Length)})
+						pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(inode, attr.Length)})
 						pipe.Del(ctx, r.inodeKey(inode))
-						pipe.IncrBy(ctx, usedSpace, -align4K(attr.Length))
+						pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
 					}
 				}
-				pipe.IncrBy(ctx, totalInodes, -1)
+				pipe.IncrBy(ctx, r.prefix+totalInodes, -1)
 			}
 			return nil
 		})
@@ -1025,13 +1265,7 @@ func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 	}, r.entryKey(parent), r.inodeKey(parent), r.inodeKey(inode))
 }
 
-func (r *redisMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
-	if name == "." {
-		return syscall.EINVAL
-	}
-	if name == ".." {
-		return syscall.ENOTEMPTY
-	}
+func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	buf, err := r.rdb.HGet(ctx, r.entryKey(parent), name).Bytes()
 	if err != nil {
 		return errno(err)
@@ -1074,97 +1308,36 @@ func (r *redisMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
 		if cnt > 0 {
 			return syscall.ENOTEMPTY
 		}
+		sub, err := r.getDirStat(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.appendEvent(ctx, pipe)
 			pipe.HDel(ctx, r.entryKey(parent), name)
 			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
 			pipe.Del(ctx, r.inodeKey(inode))
 			pipe.Del(ctx, r.xattrKey(inode))
 			// pipe.Del(ctx, r.entryKey(inode))
-			pipe.IncrBy(ctx, totalInodes, -1)
+			pipe.IncrBy(ctx, r.prefix+totalInodes, -1)
+			r.updateDirStat(ctx, pipe, parent, entryStat(TypeDirectory, 0, sub).neg())
+			r.delDirStat(ctx, pipe, inode)
 			return nil
 		})
 		return err
-	}, r.inodeKey(parent), r.entryKey(parent), r.inodeKey(inode), r.entryKey(inode))
+	}, r.inodeKey(parent), r.entryKey(parent), r.inodeKey(inode), r.entryKey(inode), r.dirStatKey(inode))
 }
 
-func (r *redisMeta) emptyDir(ctx Context, inode Ino, concurrent chan int) syscall.Errno {
-	if st := r.Access(ctx, inode, 3, nil); st != 0 {
-		return st
-	}
-	var entries []*Entry
-	if st := r.Readdir(ctx, inode, 0, &entries); st != 0 {
-		return st
-	}
-	var wg sync.WaitGroup
-	var status syscall.Errno
-	for _, e := range entries {
-		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
-			continue
-		}
-		if e.Attr.Typ == TypeDirectory {
-			select {
-			case concurrent <- 1:
-				wg.Add(1)
-				go func(child Ino, name string) {
-					defer wg.Done()
-					e := r.emptyEntry(ctx, inode, name, child, concurrent)
-					if e != 0 {
-						status = e
-					}
-					<-concurrent
-				}(e.Inode, string(e.Name))
-			default:
-				if st := r.emptyEntry(ctx, inode, string(e.Name), e.Inode, concurrent); st != 0 {
-					return st
-				}
-			}
-		} else {
-			if st := r.Unlink(ctx, inode, string(e.Name)); st != 0 {
-				return st
-			}
-		}
-	}
-	wg.Wait()
-	return status
-}
-
-func (r *redisMeta) emptyEntry(ctx Context, parent Ino, name string, inode Ino, concurrent chan int) syscall.Errno {
-	st := r.emptyDir(ctx, inode, concurrent)
-	if st == 0 {
-		st = r.Rmdir(ctx, parent, name)
-		if st == syscall.ENOTEMPTY {
-			st = r.emptyEntry(ctx, parent, name, inode, concurrent)
-		}
-	}
-	return st
-}
-
-func (r *redisMeta) Rmr(ctx Context, parent Ino, name string) syscall.Errno {
-	if st := r.Access(ctx, parent, 3, nil); st != 0 {
-		return st
-	}
-	var inode Ino
-	var attr Attr
-	if st := r.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
-		return st
-	}
-	if attr.Typ != TypeDirectory {
-		return r.Unlink(ctx, parent, name)
-	}
-	concurrent := make(chan int, 50)
-	return r.emptyEntry(ctx, parent, name, inode, concurrent)
-}
-
-func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno {
-	buf, err := r.rdb.HGet(ctx, r.entryKey(parentSrc), nameSrc).Bytes()
-	if err != nil {
-		return errno(err)
+func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno {
+	buf, err := r.rdb.HGet(ctx, r.entryKey(parentSrc), nameSrc).Bytes()
+	if err != nil {
+		return errno(err)
 	}
 	typ, ino := r.parseEntry(buf)
+	if inode != nil {
+		*inode = ino
+	}
 	if parentSrc == parentDst && nameSrc == nameDst {
-		if inode != nil {
-			*inode = ino
-		}
 		return 0
 	}
 	buf, err = r.rdb.HGet(ctx, r.entryKey(parentDst), nameDst).Bytes()
@@ -1172,6 +1345,9 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		return errno(err)
 	}
 	keys := []string{r.entryKey(parentSrc), r.inodeKey(parentSrc), r.inodeKey(ino), r.entryKey(parentDst), r.inodeKey(parentDst)}
+	if typ == TypeDirectory && parentSrc != parentDst {
+		keys = append(keys, r.entryKey(ino), r.dirStatKey(ino))
+	}
 
 	var dino Ino
 	var dtyp uint8
@@ -1179,7 +1355,7 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		dtyp, dino = r.parseEntry(buf)
 		keys = append(keys, r.inodeKey(dino))
 		if dtyp == TypeDirectory {
-			keys = append(keys, r.entryKey(dino))
+			keys = append(keys, r.entryKey(dino), r.dirStatKey(dino))
 		}
 	}
 
@@ -1189,6 +1365,7 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			return err
 		}
 		var tattr Attr
+		var tsub *dirStat
 		var opened bool
 		if err == nil {
 			if ctx.Value(CtxKey("behavior")) == "Hadoop" {
@@ -1206,6 +1383,9 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				if cnt != 0 {
 					return syscall.ENOTEMPTY
 				}
+				if tsub, err = r.getDirStat(ctx, tx, dino); err != nil {
+					return err
+				}
 			} else {
 				a, err := tx.Get(ctx, r.inodeKey(dino)).Bytes()
 				if err != nil {
@@ -1254,26 +1434,62 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		if dattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		// a directory is moved into the trash only when it's removed
+		if typ == TypeDirectory && parentSrc != parentDst && dattr.Parent == TrashInode {
+			if cnt, err := tx.HLen(ctx, r.entryKey(ino)).Result(); err != nil {
+				return err
+			} else if cnt > 0 {
+				return syscall.ENOTEMPTY
+			}
+		}
 		dattr.Mtime = now.Unix()
 		dattr.Mtimensec = uint32(now.Nanosecond())
 		dattr.Ctime = now.Unix()
 		dattr.Ctimensec = uint32(now.Nanosecond())
 		r.parseAttr([]byte(rs[2].(string)), &iattr)
-		iattr.Parent = parentDst
+		// the parents of a file with hardlinks are counted separately
+		if iattr.Parent > 0 {
+			iattr.Parent = parentDst
+		}
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
+		var sub *dirStat
 		if typ == TypeDirectory && parentSrc != parentDst {
 			sattr.Nlink--
 			dattr.Nlink++
+			if sub, err = r.getDirStat(ctx, tx, ino); err != nil {
+				return err
+			}
 		}
 		if attr != nil {
 			*attr = iattr
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.appendEvent(ctx, pipe)
 			pipe.HDel(ctx, r.entryKey(parentSrc), nameSrc)
 			pipe.Set(ctx, r.inodeKey(parentSrc), r.marshal(&sattr), 0)
+			if parentSrc != parentDst {
+				moved := entryStat(typ, iattr.Length, sub)
+				r.updateDirStat(ctx, pipe, parentSrc, moved.neg())
+				r.updateDirStat(ctx, pipe, parentDst, moved)
+			}
+			if iattr.Parent == 0 && parentSrc != parentDst {
+				pipe.HIncrBy(ctx, r.parentKey(ino), parentSrc.String(), -1)
+				pipe.HIncrBy(ctx, r.parentKey(ino), parentDst.String(), 1)
+			}
 			if dino > 0 {
+				r.updateDirStat(ctx, pipe, parentDst, entryStat(dtyp, tattr.Length, tsub).neg())
+				if dtyp == TypeDirectory {
+					r.delDirStat(ctx, pipe, dino)
+				}
+				if dtyp != TypeDirectory && tattr.Parent == 0 {
+					if tattr.Nlink > 0 {
+						pipe.HIncrBy(ctx, r.parentKey(dino), parentDst.String(), -1)
+					} else {
+						pipe.Del(ctx, r.parentKey(dino))
+					}
+				}
 				if dtyp != TypeDirectory && tattr.Nlink > 0 {
 					pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
 				} else {
@@ -1288,12 +1504,12 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 							pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
 							pipe.SAdd(ctx, r.sessionKey(r.sid), strconv.Itoa(int(dino)))
 						} else {
-							pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(dino, dattr.Length)})
+							pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(dino, dattr.Length)})
 							pipe.Del(ctx, r.inodeKey(dino))
-							pipe.IncrBy(ctx, usedSpace, -align4K(tattr.Length))
+							pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(tattr.Length))
 						}
 					}
-					pipe.IncrBy(ctx, totalInodes, -1)
+					pipe.IncrBy(ctx, r.prefix+totalInodes, -1)
 					pipe.Del(ctx, r.xattrKey(dino))
 				}
 				pipe.HDel(ctx, r.entryKey(parentDst), nameDst)
@@ -1318,7 +1534,7 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	}, keys...)
 }
 
-func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
+func (r *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
 	return r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(parent), r.inodeKey(inode)).Result()
 		if err != nil {
@@ -1344,6 +1560,9 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
 		iattr.Nlink++
+		// the parents are counted separately once a file has more than one link
+		oldParent := iattr.Parent
+		iattr.Parent = 0
 
 		err = tx.HGet(ctx, r.entryKey(parent), name).Err()
 		if err != nil && err != redis.Nil {
@@ -1353,9 +1572,15 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.appendEvent(ctx, pipe)
 			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(iattr.Typ, inode))
 			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&iattr), 0)
+			if oldParent > 0 {
+				pipe.HIncrBy(ctx, r.parentKey(inode), oldParent.String(), 1)
+			}
+			pipe.HIncrBy(ctx, r.parentKey(inode), parent.String(), 1)
+			r.updateDirStat(ctx, pipe, parent, entryStat(iattr.Typ, iattr.Length, nil))
 			return nil
 		})
 		if err == nil && attr != nil {
@@ -1365,26 +1590,30 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 	}, r.inodeKey(inode), r.entryKey(parent), r.inodeKey(parent))
 }
 
-func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
-	var attr Attr
-	if err := r.GetAttr(ctx, inode, &attr); err != 0 {
+// fillAttr reads the attributes of the entries.
+func (r *redisMeta) fillAttr(ctx Context, es []*Entry) error {
+	if len(es) == 0 {
+		return nil
+	}
+	var keys = make([]string, len(es))
+	for i, e := range es {
+		keys[i] = r.inodeKey(e.Inode)
+	}
+	rs, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
 		return err
 	}
-	*entries = []*Entry{
-		{
-			Inode: inode,
-			Name:  []byte("."),
-			Attr:  &Attr{Typ: TypeDirectory},
-		},
-	}
-	if attr.Parent > 0 {
-		*entries = append(*entries, &Entry{
-			Inode: attr.Parent,
-			Name:  []byte(".."),
-			Attr:  &Attr{Typ: TypeDirectory},
-		})
+	for j, re := range rs {
+		if re != nil {
+			if a, ok := re.(string); ok {
+				r.parseAttr([]byte(a), es[j].Attr)
+			}
+		}
 	}
+	return nil
+}
 
+func (r *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
 	var keys []string
 	var cursor uint64
 	var err error
@@ -1410,28 +1639,10 @@ func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entr
 	}
 
 	if plus != 0 {
-		fillAttr := func(es []*Entry) error {
-			var keys = make([]string, len(es))
-			for i, e := range es {
-				keys[i] = r.inodeKey(e.Inode)
-			}
-			rs, err := r.rdb.MGet(ctx, keys...).Result()
-			if err != nil {
-				return err
-			}
-			for j, re := range rs {
-				if re != nil {
-					if a, ok := re.(string); ok {
-						r.parseAttr([]byte(a), es[j].Attr)
-					}
-				}
-			}
-			return nil
-		}
 		batchSize := 4096
 		nEntries := len(*entries)
 		if nEntries <= batchSize {
-			err = fillAttr(*entries)
+			err = r.fillAttr(ctx, *entries)
 		} else {
 			indexCh := make(chan []*Entry, 10)
 			var wg sync.WaitGroup
@@ -1440,7 +1651,7 @@ func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entr
 				go func() {
 					defer wg.Done()
 					for es := range indexCh {
-						e := fillAttr(es)
+						e := r.fillAttr(ctx, es)
 						if e != nil {
 							err = e
 							break
@@ -1465,36 +1676,108 @@ func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entr
 	return 0
 }
 
-func (r *redisMeta) cleanStaleSession(sid int64) {
+// doReaddirPage scans the entries with HSCAN, whose cursor is used as the cursor of pages. A page could have
+// more entries than limit if the hash is small (encoded as a list), and an entry could be returned twice
+// if the hash is resized between pages.
+func (r *redisMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno {
+	var c uint64
+	if *cursor != "" {
+		var err error
+		if c, err = strconv.ParseUint(*cursor, 10, 64); err != nil {
+			return syscall.EINVAL
+		}
+	}
+	var es []*Entry
+	for {
+		keys, next, err := r.rdb.HScan(ctx, r.entryKey(inode), c, "*", int64(limit)).Result()
+		if err != nil {
+			return errno(err)
+		}
+		for i := 0; i < len(keys); i += 2 {
+			typ, ino := r.parseEntry([]byte(keys[i+1]))
+			es = append(es, &Entry{Inode: ino, Name: []byte(keys[i]), Attr: &Attr{Typ: typ}})
+		}
+		c = next
+		// HSCAN could return nothing before the end
+		if len(es) > 0 || c == 0 {
+			break
+		}
+	}
+	if plus != 0 {
+		if err := r.fillAttr(ctx, es); err != nil {
+			return errno(err)
+		}
+	}
+	if c == 0 {
+		*cursor = ""
+	} else {
+		*cursor = strconv.FormatUint(c, 10)
+	}
+	*entries = append(*entries, es...)
+	return 0
+}
+
+func (r *redisMeta) cleanStaleSession(sid int64) error {
 	var ctx = Background
-	inodes, err := r.rdb.LRange(ctx, r.sessionKey(sid), 0, 1000).Result()
+	inodes, err := r.rdb.SMembers(ctx, r.sessionKey(sid)).Result()
 	if err != nil {
-		return
+		return err
 	}
 	for _, sinode := range inodes {
 		inode, _ := strconv.ParseInt(sinode, 10, 0)
-		if err := r.deleteInode(Ino(inode)); err != nil {
+		if err = r.doDeleteSustainedInode(sid, Ino(inode)); err != nil {
 			logger.Errorf("Failed to delete inode %d: %s", inode, err)
+			return err
 		}
 	}
-	if len(inodes) == 0 {
-		r.rdb.Del(ctx, r.sessionKey(sid))
-		r.rdb.ZRem(ctx, allSessions, strconv.Itoa(int(sid)))
-	}
+	ssid := strconv.Itoa(int(sid))
+	_, err = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.sessionKey(sid))
+		pipe.ZRem(ctx, r.prefix+allSessions, ssid)
+		pipe.HDel(ctx, r.prefix+sessionInfos, ssid)
+		return nil
+	})
+	return err
+}
+
+// cleanLocks removes all the flocks and plocks owned by the sessions.
+func (r *redisMeta) cleanLocks(sids map[string]bool) error {
+	var ctx = Background
+	return r.scan(ctx, "lock*", func(keys []string) error {
+		for _, k := range keys {
+			owners, err := r.rdb.HKeys(ctx, k).Result()
+			if err != nil {
+				return err
+			}
+			for _, o := range owners {
+				p := strings.Split(o, "_")[0]
+				if _, ok := sids[p]; ok {
+					err = r.rdb.HDel(ctx, k, o).Err()
+					logger.Infof("cleanup lock on %s from session %s: %s", k, p, err)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
 }
 
 func (r *redisMeta) cleanStaleSessions() {
 	now := time.Now()
 	var ctx = Background
 	rng := &redis.ZRangeBy{Max: strconv.Itoa(int(now.Add(time.Minute * -10).Unix())), Count: 100}
-	staleSessions, _ := r.rdb.ZRangeByScore(ctx, allSessions, rng).Result()
+	staleSessions, _ := r.rdb.ZRangeByScore(ctx, r.prefix+allSessions, rng).Result()
 	for _, ssid := range staleSessions {
 		sid, _ := strconv.Atoi(ssid)
-		r.cleanStaleSession(int64(sid))
+		if err := r.cleanStaleSession(int64(sid)); err != nil {
+			logger.Warnf("clean stale session %d: %s", sid, err)
+		}
 	}
 
-	rng = &redis.ZRangeBy{Max: strconv.Itoa(int(now.Add(time.Minute * -3).Unix())), Count: 100}
-	staleSessions, err := r.rdb.ZRangeByScore(ctx, allSessions, rng).Result()
+	rng = &redis.ZRangeBy{Max: strconv.Itoa(int(now.Add(-staleAfter).Unix())), Count: 100}
+	staleSessions, err := r.rdb.ZRangeByScore(ctx, r.prefix+allSessions, rng).Result()
 	if err != nil || len(staleSessions) == 0 {
 		return
 	}
@@ -1502,34 +1785,76 @@ func (r *redisMeta) cleanStaleSessions() {
 	for _, sid := range staleSessions {
 		sids[sid] = true
 	}
-	var cursor uint64
-	var keys []string
-	for {
-		keys, cursor, err = r.rdb.Scan(ctx, cursor, "lock*", 1000).Result()
+	_ = r.cleanLocks(sids)
+}
+
+func (r *redisMeta) ListSessions() ([]*Session, error) {
+	var ctx = Background
+	zs, err := r.rdb.ZRangeWithScores(ctx, r.prefix+allSessions, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := r.rdb.HGetAll(ctx, r.prefix+sessionInfos).Result()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	sessionOf := make(map[string]*Session)
+	for _, z := range zs {
+		ssid := z.Member.(string)
+		sid, _ := strconv.ParseUint(ssid, 10, 64)
+		s := newSession(sid, int64(z.Score), []byte(infos[ssid]))
+		inodes, err := r.rdb.SMembers(ctx, r.sessionKey(int64(sid))).Result()
 		if err != nil {
-			break
+			return nil, err
 		}
+		for _, sinode := range inodes {
+			inode, _ := strconv.ParseUint(sinode, 10, 64)
+			s.Sustained = append(s.Sustained, Ino(inode))
+		}
+		sessions = append(sessions, s)
+		sessionOf[ssid] = s
+	}
+	err = r.scan(ctx, "lock*", func(keys []string) error {
 		for _, k := range keys {
-			owners, _ := r.rdb.HKeys(ctx, k).Result()
-			for _, o := range owners {
-				p := strings.Split(o, "_")[0]
-				if _, ok := sids[p]; ok {
-					err = r.rdb.HDel(ctx, k, o).Err()
-					logger.Infof("cleanup lock on %s from session %s: %s", k, p, err)
+			locks, err := r.rdb.HGetAll(ctx, k).Result()
+			if err != nil {
+				return err
+			}
+			key := strings.TrimPrefix(k, r.prefix)
+			inode, _ := strconv.ParseUint(key[5:], 10, 64)
+			for o, v := range locks {
+				ps := strings.Split(o, "_")
+				s := sessionOf[ps[0]]
+				if s == nil || len(ps) != 2 {
+					continue
+				}
+				owner, _ := strconv.ParseUint(ps[1], 16, 64)
+				if key[4] == 'f' {
+					s.Flocks = append(s.Flocks, Flock{Ino(inode), owner, v})
+				} else {
+					s.Plocks = append(s.Plocks, Plock{Ino(inode), owner, parsePlockRecords([]byte(v))})
 				}
 			}
 		}
-		if cursor == 0 {
-			break
-		}
+		return nil
+	})
+	sortSessions(sessions)
+	return sessions, err
+}
+
+func (r *redisMeta) CleanSession(sid uint64) error {
+	if err := r.cleanLocks(map[string]bool{strconv.FormatUint(sid, 10): true}); err != nil {
+		return err
 	}
+	return r.cleanStaleSession(int64(sid))
 }
 
 func (r *redisMeta) refreshSession() {
 	for {
 		time.Sleep(time.Minute)
 		now := time.Now()
-		r.rdb.ZAdd(Background, allSessions, &redis.Z{Score: float64(now.Unix()), Member: strconv.Itoa(int(r.sid))})
+		r.rdb.ZAdd(Background, r.prefix+allSessions, &redis.Z{Score: float64(now.Unix()), Member: strconv.Itoa(int(r.sid))})
 		go r.cleanStaleSessions()
 	}
 }
@@ -1546,9 +1871,9 @@ func (r *redisMeta) deleteInode(inode Ino) error {
 	}
 	r.parseAttr(a, &attr)
 	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(time.Now().Unix()), Member: r.toDelete(inode, attr.Length)})
+		pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(time.Now().Unix()), Member: r.toDelete(inode, attr.Length)})
 		pipe.Del(ctx, r.inodeKey(inode))
-		pipe.IncrBy(ctx, usedSpace, -align4K(attr.Length))
+		pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
 		return nil
 	})
 	if err == nil {
@@ -1557,97 +1882,78 @@ func (r *redisMeta) deleteInode(inode Ino) error {
 	return err
 }
 
-func (r *redisMeta) Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscall.Errno {
-	var err syscall.Errno
-	if attr != nil {
-		err = r.GetAttr(ctx, inode, attr)
-	}
-	if err == 0 {
-		r.Lock()
-		r.openFiles[inode] = r.openFiles[inode] + 1
-		r.Unlock()
-	}
-	return 0
-}
-
-func (r *redisMeta) Close(ctx Context, inode Ino) syscall.Errno {
-	r.Lock()
-	defer r.Unlock()
-	refs := r.openFiles[inode]
-	if refs <= 1 {
-		delete(r.openFiles, inode)
-		if r.removedFiles[inode] {
-			delete(r.removedFiles, inode)
-			go func() {
-				if err := r.deleteInode(inode); err == nil {
-					r.rdb.SRem(ctx, r.sessionKey(r.sid), strconv.Itoa(int(inode)))
-				}
-			}()
-		}
-	} else {
-		r.openFiles[inode] = refs - 1
+func (r *redisMeta) doDeleteSustainedInode(sid int64, inode Ino) error {
+	err := r.deleteInode(inode)
+	if err == nil {
+		r.rdb.SRem(Background, r.sessionKey(sid), strconv.Itoa(int(inode)))
 	}
-	return 0
+	return err
 }
 
-func buildSlice(ss []*slice) []Slice {
-	var root *slice
-	for _, s := range ss {
-		if root != nil {
-			var right *slice
-			s.left, right = root.cut(s.pos)
-			_, s.right = right.cut(s.pos + s.len)
+func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
+	var gen uint64
+	if r.cache != nil {
+		if cached, ok := r.cache.getChunk(inode, indx); ok {
+			*chunks = append([]Slice(nil), cached...)
+			return 0
 		}
-		root = s
+		gen = r.cache.generation()
 	}
-	var pos uint32
-	var chunks []Slice
-	root.visit(func(s *slice) {
-		if s.pos > pos {
-			chunks = append(chunks, Slice{Size: s.pos - pos, Len: s.pos - pos})
-			pos = s.pos
-		}
-		chunks = append(chunks, Slice{Chunkid: s.chunkid, Size: s.size, Off: s.off, Len: s.len})
-		pos += s.len
-	})
-	return chunks
-}
-
-func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
 	vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000000).Result()
 	if err != nil {
 		return errno(err)
 	}
 	ss := readSlices(vals)
 	*chunks = buildSlice(ss)
+	if r.cache != nil {
+		r.cache.putChunk(gen, inode, indx, append([]Slice(nil), *chunks...))
+	}
 	if len(vals) >= 5 {
 		go r.compactChunk(inode, indx)
 	}
 	return 0
 }
 
-func (r *redisMeta) NewChunk(ctx Context, inode Ino, indx uint32, offset uint32, chunkid *uint64) syscall.Errno {
-	cid, err := r.rdb.Incr(ctx, "nextchunk").Uint64()
-	if err == nil {
-		*chunkid = cid
-	}
-	return errno(err)
-}
-
 func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	if r.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := r.fileQuotas(ctx, inode)
+	var delta int64
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		var attr Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
 		r.parseAttr(a, &attr)
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if attr.Flags&(FlagImmutable|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		// an append-only file could have been flagged after it's opened
+		if attr.Flags&FlagAppend != 0 && uint64(indx)*ChunkSize+uint64(off) < attr.Length {
+			return syscall.EPERM
+		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
-		var added int64
+		var added, grown int64
 		if newleng > attr.Length {
 			added = align4K(newleng) - align4K(attr.Length)
+			grown = int64(newleng - attr.Length)
 			attr.Length = newleng
 		}
+		if err = r.checkDirQuotas(qs, added, 0); err != nil {
+			return err
+		}
+		delta = added
+		stats, err := fileStats(attr.Parent, grown, delta, func() (map[Ino]int, error) {
+			return r.getParents(ctx, tx, inode)
+		})
+		if err != nil {
+			return err
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1661,26 +1967,43 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		w.Put32(slice.Off)
 		w.Put32(slice.Len)
 
+		rv, err := r.reserve(ctx, added, 0)
+		if err != nil {
+			return err
+		}
 		var rpush *redis.IntCmd
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			rpush = pipe.RPush(ctx, r.chunkKey(inode, indx), w.Bytes())
 			// most of chunk are used by single inode, so use that as the default (1 == not exists)
 			// pipe.Incr(ctx, r.sliceKey(slice.Chunkid, slice.Size))
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
-			if added > 0 {
-				pipe.IncrBy(ctx, usedSpace, added)
+			if added > rv.space {
+				pipe.IncrBy(ctx, r.prefix+usedSpace, added-rv.space)
 			}
+			r.updateDirStats(ctx, pipe, stats)
 			return nil
 		})
-		if err == nil && rpush.Val()%20 == 0 {
+		if err != nil {
+			r.release(ctx, rv)
+		} else if rpush.Val()%20 == 0 {
 			go r.compactChunk(inode, indx)
 		}
 		return err
 	}, r.inodeKey(inode))
+	if st == 0 {
+		r.updateDirQuotas(qs, delta, 0)
+		r.markWritten(inode)
+	}
+	return st
 }
 
 func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	if r.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := r.fileQuotas(ctx, fout)
+	var delta int64
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(fin), r.inodeKey(fout)).Result()
 		if err != nil {
 			return err
@@ -1705,13 +2028,30 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if attr.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
-		var added int64
+		var added, grown int64
 		if newleng > attr.Length {
 			added = align4K(newleng) - align4K(attr.Length)
+			grown = int64(newleng - attr.Length)
 			attr.Length = newleng
 		}
+		if err = r.checkDirQuotas(qs, added, 0); err != nil {
+			return err
+		}
+		delta = added
+		stats, err := fileStats(attr.Parent, grown, delta, func() (map[Ino]int, error) {
+			return r.getParents(ctx, tx, fout)
+		})
+		if err != nil {
+			return err
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1727,6 +2067,10 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 			return err
 		}
 
+		rv, err := r.reserve(ctx, added, 0)
+		if err != nil {
+			return err
+		}
 		_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
 			coff := offIn / ChunkSize * ChunkSize
 			for _, v := range vals {
@@ -1792,23 +2136,31 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 				coff += ChunkSize
 			}
 			pipe.Set(ctx, r.inodeKey(fout), r.marshal(&attr), 0)
-			if added > 0 {
-				pipe.IncrBy(ctx, usedSpace, added)
+			if added > rv.space {
+				pipe.IncrBy(ctx, r.prefix+usedSpace, added-rv.space)
 			}
+			r.updateDirStats(ctx, pipe, stats)
 			return nil
 		})
-		if err == nil {
+		if err != nil {
+			r.release(ctx, rv)
+		} else {
 			*copied = size
 		}
 		return err
 	}, r.inodeKey(fout), r.inodeKey(fin))
+	if st == 0 {
+		r.updateDirQuotas(qs, delta, 0)
+		r.markWritten(fout)
+	}
+	return st
 }
 
 func (r *redisMeta) cleanupDeletedFiles() {
 	for {
 		time.Sleep(time.Minute)
 		now := time.Now()
-		members, _ := r.rdb.ZRangeByScore(Background, delfiles, &redis.ZRangeBy{Min: strconv.Itoa(0), Max: strconv.Itoa(int(now.Add(time.Hour).Unix())), Count: 1000}).Result()
+		members, _ := r.rdb.ZRangeByScore(Background, r.prefix+delfiles, &redis.ZRangeBy{Min: strconv.Itoa(0), Max: strconv.Itoa(int(now.Add(time.Hour).Unix())), Count: 1000}).Result()
 		for _, member := range members {
 			ps := strings.Split(member, ":")
 			inode, _ := strconv.ParseInt(ps[0], 10, 0)
@@ -1828,29 +2180,18 @@ func (r *redisMeta) cleanupSlices() {
 	for {
 		time.Sleep(time.Hour)
 		var ctx = Background
-		var ckeys []string
-		var cursor uint64
-		var err error
-		for {
-			ckeys, cursor, err = r.rdb.Scan(ctx, cursor, "k*", 1000).Result()
-			if err != nil {
-				logger.Errorf("scan slices: %s", err)
-				break
-			}
-			if len(ckeys) == 0 {
-				break
-			}
+		err := r.scan(ctx, "k*", func(ckeys []string) error {
 			values, err := r.rdb.MGet(ctx, ckeys...).Result()
 			if err != nil {
 				logger.Warnf("mget slices: %s", err)
-				continue
+				return nil
 			}
 			for i, v := range values {
 				if v == nil {
 					continue
 				}
 				if strings.HasPrefix(v.(string), "-") { // < 0
-					ps := strings.Split(ckeys[i], "_")
+					ps := strings.Split(strings.TrimPrefix(ckeys[i], r.prefix), "_")
 					if len(ps) == 2 {
 						chunkid, _ := strconv.Atoi(ps[0][1:])
 						size, _ := strconv.Atoi(ps[1])
@@ -1861,9 +2202,10 @@ func (r *redisMeta) cleanupSlices() {
 				}
 
 			}
-			if cursor == 0 {
-				break
-			}
+			return nil
+		})
+		if err != nil {
+			logger.Errorf("scan slices: %s", err)
 		}
 	}
 }
@@ -1871,20 +2213,12 @@ func (r *redisMeta) cleanupSlices() {
 func (r *redisMeta) cleanupLeakedChunks() {
 	time.Sleep(time.Second * 10)
 	var ctx = Background
-	var ckeys []string
-	var cursor uint64
-	var err error
-	for {
-		ckeys, cursor, err = r.rdb.Scan(ctx, cursor, "c*", 1000).Result()
-		if err != nil {
-			logger.Errorf("scan all chunks: %s", err)
-			break
-		}
+	err := r.scan(ctx, "c*", func(ckeys []string) error {
 		var ikeys []string
 		var rs []*redis.IntCmd
 		p := r.rdb.Pipeline()
 		for _, k := range ckeys {
-			ps := strings.Split(k, "_")
+			ps := strings.Split(strings.TrimPrefix(k, r.prefix), "_")
 			if len(ps) != 2 {
 				continue
 			}
@@ -1893,26 +2227,25 @@ func (r *redisMeta) cleanupLeakedChunks() {
 			rs = append(rs, p.Exists(ctx, r.inodeKey(Ino(ino))))
 		}
 		if len(rs) == 0 {
-			break
+			return nil
 		}
-		_, err = p.Exec(ctx)
-		if err != nil {
-			logger.Errorf("check inodes: %s", err)
-			return
+		if _, err := p.Exec(ctx); err != nil {
+			return fmt.Errorf("check inodes: %s", err)
 		}
 		for i, rr := range rs {
 			if rr.Val() == 0 {
 				key := ikeys[i]
 				logger.Debugf("found leaked chunk %s", key)
-				ps := strings.Split(key, "_")
+				ps := strings.Split(strings.TrimPrefix(key, r.prefix), "_")
 				ino, _ := strconv.ParseInt(ps[0][1:], 10, 0)
 				indx, _ := strconv.Atoi(ps[1])
 				_ = r.deleteChunk(Ino(ino), uint32(indx))
 			}
 		}
-		if cursor == 0 {
-			break
-		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("scan all chunks: %s", err)
 	}
 }
 
@@ -2003,7 +2336,7 @@ func (r *redisMeta) deleteFile(inode Ino, length uint64, tracking string) {
 	if tracking == "" {
 		tracking = inode.String() + ":" + strconv.FormatInt(int64(length), 10)
 	}
-	_ = r.rdb.ZRem(ctx, delfiles, tracking)
+	_ = r.rdb.ZRem(ctx, r.prefix+delfiles, tracking)
 }
 
 func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
@@ -2027,7 +2360,7 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 	if err != nil {
 		return
 	}
-	chunkid, err := r.rdb.Incr(ctx, "nextchunk").Uint64()
+	chunkid, err := r.nextChunkID()
 	if err != nil {
 		return
 	}
@@ -2111,21 +2444,15 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 
 func (r *redisMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
 	*slices = nil
-	var cursor uint64
 	p := r.rdb.Pipeline()
-	for {
-		keys, c, err := r.rdb.Scan(ctx, cursor, "c*_*", 10000).Result()
-		if err != nil {
-			logger.Warnf("scan chunks: %s", err)
-			return errno(err)
-		}
+	err := r.scan(ctx, "c*_*", func(keys []string) error {
 		for _, key := range keys {
 			_ = p.LRange(ctx, key, 0, 100000000)
 		}
 		cmds, err := p.Exec(ctx)
 		if err != nil {
 			logger.Warnf("list slices: %s", err)
-			return errno(err)
+			return err
 		}
 		for _, cmd := range cmds {
 			vals := cmd.(*redis.StringSliceCmd).Val()
@@ -2136,12 +2463,12 @@ func (r *redisMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
 				}
 			}
 		}
-		if c == 0 {
-			break
-		}
-		cursor = c
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("scan chunks: %s", err)
 	}
-	return 0
+	return errno(err)
 }
 
 func (r *redisMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
@@ -2166,17 +2493,36 @@ func (r *redisMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Err
 	return 0
 }
 
-func (r *redisMeta) SetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
-	_, err := r.rdb.HSet(ctx, r.xattrKey(inode), name, value).Result()
+func (r *redisMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if st := r.checkWritable(ctx, inode); st != 0 {
+		return st
+	}
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.xattrKey(inode), name, value)
+		r.appendEvent(ctx, pipe)
+		return nil
+	})
 	return errno(err)
 }
 
-func (r *redisMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
-	n, err := r.rdb.HDel(ctx, r.xattrKey(inode), name).Result()
-	if n == 0 {
-		err = ENOATTR
+func (r *redisMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if st := r.checkWritable(ctx, inode); st != 0 {
+		return st
 	}
-	return errno(err)
+	key := r.xattrKey(inode)
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		if ok, err := tx.HExists(ctx, key, name).Result(); err != nil {
+			return err
+		} else if !ok {
+			return ENOATTR
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, key, name)
+			r.appendEvent(ctx, pipe)
+			return nil
+		})
+		return err
+	}, key)
 }
 
 func (r *redisMeta) checkServerConfig() {
@@ -2190,3 +2536,671 @@ func (r *redisMeta) checkServerConfig() {
 		logger.Warnf("parse info: %s", err)
 	}
 }
+
+func (r *redisMeta) doReadChunk(inode Ino, indx uint32) ([]byte, error) {
+	vals, err := r.rdb.LRange(Background, r.chunkKey(inode, indx), 0, 1000000).Result()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(vals, "")), nil
+}
+
+func (r *redisMeta) setCounter(name string, value int64) error {
+	return r.rdb.Set(Background, r.prefix+name, value, 0).Err()
+}
+
+func (r *redisMeta) setIfSmall(name string, value, diff int64) (bool, error) {
+	var ctx = Background
+	name = r.prefix + name
+	var updated bool
+	err := r.txn(ctx, func(tx *redis.Tx) error {
+		updated = false
+		old, err := tx.Get(ctx, name).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if old > value-diff {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, name, value, 0)
+			return nil
+		})
+		updated = err == nil
+		return err
+	}, name)
+	return updated, errnoErr(err)
+}
+
+func (r *redisMeta) doLoadNode(n *loadedNode) error {
+	if n.source > 0 {
+		return r.loadClone(n)
+	}
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.inodeKey(n.inode), r.marshal(&n.attr), 0)
+		if n.attr.Typ == TypeSymlink {
+			pipe.Set(ctx, r.symKey(n.inode), n.target, 0)
+		}
+		for name, value := range n.xattrs {
+			pipe.HSet(ctx, r.xattrKey(n.inode), name, value)
+		}
+		for indx, buf := range n.chunks {
+			key := r.chunkKey(n.inode, indx)
+			for _, s := range readSliceBuf(buf) {
+				pipe.RPush(ctx, key, marshalSlice(s.pos, s.chunkid, s.size, s.off, s.len))
+			}
+		}
+		return nil
+	})
+	r.invalidate(r.inodeKey(n.inode))
+	if err != nil {
+		return err
+	}
+	// a missing key means one reference, so the first one is saved as 0
+	for _, buf := range n.chunks {
+		for _, s := range readSliceBuf(buf) {
+			if s.chunkid == 0 {
+				continue
+			}
+			key := r.sliceKey(s.chunkid, s.size)
+			ok, err := r.rdb.SetNX(ctx, key, 0, 0).Result()
+			if err == nil && !ok {
+				err = r.rdb.Incr(ctx, key).Err()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadClone saves a cloned node. The chunks of the source are read and the references of their slices
+// are increased in one transaction, which is retried if the chunks are changed by others before committed,
+// so the slices can't be released by a concurrent write, compaction or deletion of the source.
+func (r *redisMeta) loadClone(n *loadedNode) error {
+	ctx := Background
+	return errnoErr(r.txn(ctx, func(tx *redis.Tx) error {
+		var chunks map[uint32][]string
+		if n.attr.Typ == TypeFile {
+			a, err := tx.Get(ctx, r.inodeKey(n.source)).Bytes()
+			if err != nil {
+				return err
+			}
+			var sattr Attr
+			r.parseAttr(a, &sattr)
+			n.attr.Length = sattr.Length
+			var keys []string
+			for indx := uint32(0); uint64(indx)*ChunkSize < sattr.Length; indx++ {
+				keys = append(keys, r.chunkKey(n.source, indx))
+			}
+			if len(keys) > 0 {
+				if err = tx.Watch(ctx, keys...).Err(); err != nil {
+					return err
+				}
+			}
+			cmds := make([]*redis.StringSliceCmd, len(keys))
+			_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, key := range keys {
+					cmds[i] = pipe.LRange(ctx, key, 0, -1)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			chunks = make(map[uint32][]string)
+			for i, cmd := range cmds {
+				if vals := cmd.Val(); len(vals) > 0 {
+					chunks[uint32(i)] = vals
+				}
+			}
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(n.inode), r.marshal(&n.attr), 0)
+			if n.attr.Typ == TypeSymlink {
+				pipe.Set(ctx, r.symKey(n.inode), n.target, 0)
+			}
+			for name, value := range n.xattrs {
+				pipe.HSet(ctx, r.xattrKey(n.inode), name, value)
+			}
+			for indx, vals := range chunks {
+				key := r.chunkKey(n.inode, indx)
+				for i, s := range readSlices(vals) {
+					pipe.RPush(ctx, key, vals[i])
+					if s.chunkid > 0 {
+						pipe.Incr(ctx, r.sliceKey(s.chunkid, s.size))
+					}
+				}
+			}
+			if n.attr.Typ == TypeFile && n.attr.Length > 0 {
+				pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(n.attr.Length))
+				// a clone is created as an empty file
+				r.updateDirStat(ctx, pipe, n.attr.Parent, &dirStat{length: int64(n.attr.Length), space: align4K(n.attr.Length)})
+			}
+			return nil
+		})
+		return err
+	}, r.inodeKey(n.source), r.inodeKey(n.inode)))
+}
+
+func (r *redisMeta) doLoadEdge(parent Ino, name string, _type uint8, inode Ino) error {
+	return r.rdb.HSet(Background, r.entryKey(parent), name, r.packEntry(_type, inode)).Err()
+}
+
+func (r *redisMeta) doGetParents(ctx Context, inode Ino) (map[Ino]int, error) {
+	return r.getParents(ctx, r.rdb, inode)
+}
+
+func (r *redisMeta) getParents(ctx Context, c redis.Cmdable, inode Ino) (map[Ino]int, error) {
+	vals, err := c.HGetAll(ctx, r.parentKey(inode)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ps := make(map[Ino]int)
+	for k, v := range vals {
+		// the counts are decreased to 0 instead of being removed
+		if n, _ := strconv.Atoi(v); n > 0 {
+			p, err := strconv.ParseUint(k, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parent %q of inode %d", k, inode)
+			}
+			ps[Ino(p)] = n
+		}
+	}
+	return ps, nil
+}
+
+func (r *redisMeta) doSetParents(inode Ino, parents map[Ino]int) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.parentKey(inode))
+		for p, n := range parents {
+			pipe.HSet(ctx, r.parentKey(inode), p.String(), n)
+		}
+		return nil
+	})
+	return err
+}
+
+const (
+	dirQuota      = "dirQuota"
+	dirUsedSpace  = "dirUsedSpace"
+	dirUsedInodes = "dirUsedInodes"
+)
+
+func (r *redisMeta) doLoadQuotas() (map[Ino]*Quota, error) {
+	ctx := Background
+	var limits, spaces, inodes *redis.StringStringMapCmd
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		limits = pipe.HGetAll(ctx, r.prefix+dirQuota)
+		spaces = pipe.HGetAll(ctx, r.prefix+dirUsedSpace)
+		inodes = pipe.HGetAll(ctx, r.prefix+dirUsedInodes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	quotas := make(map[Ino]*Quota)
+	for k, v := range limits.Val() {
+		inode, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || len(v) != 16 {
+			logger.Errorf("invalid quota %s: %v", k, []byte(v))
+			continue
+		}
+		q := r.parseQuota([]byte(v))
+		q.UsedSpace, _ = strconv.ParseInt(spaces.Val()[k], 10, 64)
+		q.UsedInodes, _ = strconv.ParseInt(inodes.Val()[k], 10, 64)
+		quotas[Ino(inode)] = q
+	}
+	return quotas, nil
+}
+
+func (r *redisMeta) parseQuota(buf []byte) *Quota {
+	b := utils.FromBuffer(buf)
+	return &Quota{MaxSpace: int64(b.Get64()), MaxInodes: int64(b.Get64())}
+}
+
+func (r *redisMeta) doGetQuota(inode Ino) (*Quota, error) {
+	ctx := Background
+	field := inode.String()
+	var limit, space, inodes *redis.StringCmd
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		limit = pipe.HGet(ctx, r.prefix+dirQuota, field)
+		space = pipe.HGet(ctx, r.prefix+dirUsedSpace, field)
+		inodes = pipe.HGet(ctx, r.prefix+dirUsedInodes, field)
+		return nil
+	})
+	if err == redis.Nil && limit.Err() == redis.Nil {
+		return nil, nil
+	} else if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	buf, _ := limit.Bytes()
+	if len(buf) != 16 {
+		return nil, fmt.Errorf("invalid quota of inode %d: %v", inode, buf)
+	}
+	q := r.parseQuota(buf)
+	q.UsedSpace, _ = space.Int64()
+	q.UsedInodes, _ = inodes.Int64()
+	return q, nil
+}
+
+func (r *redisMeta) doSetQuota(inode Ino, quota *Quota) error {
+	ctx := Background
+	field := inode.String()
+	w := utils.NewBuffer(16)
+	w.Put64(uint64(quota.MaxSpace))
+	w.Put64(uint64(quota.MaxInodes))
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.prefix+dirQuota, field, w.Bytes())
+		pipe.HSet(ctx, r.prefix+dirUsedSpace, field, quota.UsedSpace)
+		pipe.HSet(ctx, r.prefix+dirUsedInodes, field, quota.UsedInodes)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doDelQuota(inode Ino) error {
+	ctx := Background
+	field := inode.String()
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, r.prefix+dirQuota, field)
+		pipe.HDel(ctx, r.prefix+dirUsedSpace, field)
+		pipe.HDel(ctx, r.prefix+dirUsedInodes, field)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doFlushQuotas(deltas map[Ino]*Quota) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for inode, d := range deltas {
+			field := inode.String()
+			pipe.HIncrBy(ctx, r.prefix+dirUsedSpace, field, d.UsedSpace)
+			pipe.HIncrBy(ctx, r.prefix+dirUsedInodes, field, d.UsedInodes)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) dirStatKey(inode Ino) string {
+	return r.prefix + "u" + inode.String()
+}
+
+func (r *redisMeta) dirDeltaKey(inode Ino) string {
+	return r.prefix + "w" + inode.String()
+}
+
+func parseDirStat(vals map[string]string) *dirStat {
+	var s dirStat
+	s.length, _ = strconv.ParseInt(vals["length"], 10, 64)
+	s.space, _ = strconv.ParseInt(vals["space"], 10, 64)
+	s.files, _ = strconv.ParseInt(vals["files"], 10, 64)
+	s.dirs, _ = strconv.ParseInt(vals["dirs"], 10, 64)
+	return &s
+}
+
+func (r *redisMeta) getDirStat(ctx Context, c redis.Cmdable, inode Ino) (*dirStat, error) {
+	vals, err := c.HGetAll(ctx, r.dirStatKey(inode)).Result()
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+	return parseDirStat(vals), nil
+}
+
+func (r *redisMeta) doGetDirStat(inode Ino) (*dirStat, error) {
+	return r.getDirStat(Background, r.rdb, inode)
+}
+
+func (r *redisMeta) doSetDirStat(inode Ino, stat *dirStat) error {
+	return r.rdb.HSet(Background, r.dirStatKey(inode), "length", stat.length, "space", stat.space, "files", stat.files, "dirs", stat.dirs).Err()
+}
+
+func (r *redisMeta) doDelDirStat(inode Ino) error {
+	_, err := r.rdb.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+		r.delDirStat(Background, pipe, inode)
+		return nil
+	})
+	return err
+}
+
+// updateDirStat records a change under the directory within the transaction.
+func (r *redisMeta) updateDirStat(ctx Context, pipe redis.Pipeliner, parent Ino, d *dirStat) {
+	if parent == 0 || d.isZero() {
+		return
+	}
+	key := r.dirDeltaKey(parent)
+	pipe.HIncrBy(ctx, key, "length", d.length)
+	pipe.HIncrBy(ctx, key, "space", d.space)
+	pipe.HIncrBy(ctx, key, "files", d.files)
+	pipe.HIncrBy(ctx, key, "dirs", d.dirs)
+	pipe.SAdd(ctx, r.prefix+dirDeltas, parent.String())
+}
+
+func (r *redisMeta) updateDirStats(ctx Context, pipe redis.Pipeliner, stats map[Ino]*dirStat) {
+	for parent, d := range stats {
+		r.updateDirStat(ctx, pipe, parent, d)
+	}
+}
+
+func (r *redisMeta) delDirStat(ctx Context, pipe redis.Pipeliner, inode Ino) {
+	pipe.Del(ctx, r.dirStatKey(inode), r.dirDeltaKey(inode))
+	pipe.SRem(ctx, r.prefix+dirDeltas, inode.String())
+}
+
+func (r *redisMeta) doGetDirDeltas() (map[Ino]*dirStat, error) {
+	ctx := Background
+	members, err := r.rdb.SMembers(ctx, r.prefix+dirDeltas).Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.StringStringMapCmd, len(members))
+	_, err = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, m := range members {
+			inode, _ := strconv.ParseUint(m, 10, 64)
+			cmds[i] = pipe.HGetAll(ctx, r.dirDeltaKey(Ino(inode)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	deltas := make(map[Ino]*dirStat, len(members))
+	for i, m := range members {
+		inode, _ := strconv.ParseUint(m, 10, 64)
+		deltas[Ino(inode)] = parseDirStat(cmds[i].Val())
+	}
+	return deltas, nil
+}
+
+func (r *redisMeta) doFlushDirStat(inode Ino) error {
+	ctx := Background
+	key := r.dirDeltaKey(inode)
+	return errnoErr(r.txn(ctx, func(tx *redis.Tx) error {
+		vals, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		d := parseDirStat(vals)
+		// the ancestors are watched, so it's retried if any of them is moved in the meantime
+		var keys []string
+		for p, depth := inode, 0; p > 0 && depth < 1000 && !d.isZero(); depth++ {
+			keys = append(keys, r.dirStatKey(p))
+			if p == 1 || p == TrashInode || p == SnapshotInode {
+				break
+			}
+			if err = tx.Watch(ctx, r.inodeKey(p)).Err(); err != nil {
+				return err
+			}
+			a, err := tx.Get(ctx, r.inodeKey(p)).Bytes()
+			if err == redis.Nil {
+				break
+			} else if err != nil {
+				return err
+			}
+			var attr Attr
+			r.parseAttr(a, &attr)
+			p = attr.Parent
+		}
+		exists := make([]*redis.IntCmd, len(keys))
+		_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				exists[i] = pipe.Exists(ctx, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				if exists[i].Val() == 0 {
+					continue // removed or not tracked
+				}
+				pipe.HIncrBy(ctx, k, "length", d.length)
+				pipe.HIncrBy(ctx, k, "space", d.space)
+				pipe.HIncrBy(ctx, k, "files", d.files)
+				pipe.HIncrBy(ctx, k, "dirs", d.dirs)
+			}
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, r.prefix+dirDeltas, inode.String())
+			return nil
+		})
+		return err
+	}, key))
+}
+
+func (r *redisMeta) doScanNodes(ctx Context, fn func(inode Ino, attr *Attr) error) error {
+	return r.scan(ctx, "i[0-9]*", func(keys []string) error {
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			inode, err := strconv.ParseUint(keys[i][len(r.prefix)+1:], 10, 64)
+			if v == nil || err != nil {
+				continue
+			}
+			var attr Attr
+			r.parseAttr([]byte(v.(string)), &attr)
+			if err = fn(Ino(inode), &attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *redisMeta) doScanEdges(ctx Context, fn func(parent Ino, name string, _type uint8, inode Ino) error) error {
+	return r.scan(ctx, "d[0-9]*", func(keys []string) error {
+		cmds, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.HGetAll(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, cmd := range cmds {
+			parent, err := strconv.ParseUint(keys[i][len(r.prefix)+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			for name, buf := range cmd.(*redis.StringStringMapCmd).Val() {
+				typ, inode := r.parseEntry([]byte(buf))
+				if err = fn(Ino(parent), name, typ, inode); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (r *redisMeta) doSaveAttr(inode Ino, attr *Attr) error {
+	err := r.rdb.Set(Background, r.inodeKey(inode), r.marshal(attr), 0).Err()
+	r.invalidate(r.inodeKey(inode))
+	return err
+}
+
+func (r *redisMeta) doDeleteEdge(parent Ino, name string) error {
+	err := r.rdb.HDel(Background, r.entryKey(parent), name).Err()
+	r.invalidate(r.entryKey(parent))
+	return err
+}
+
+func (r *redisMeta) doRemoveNode(inode Ino, attr *Attr) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.inodeKey(inode), r.xattrKey(inode), r.parentKey(inode))
+		switch attr.Typ {
+		case TypeDirectory:
+			pipe.Del(ctx, r.entryKey(inode))
+		case TypeSymlink:
+			pipe.Del(ctx, r.symKey(inode))
+		case TypeFile:
+			pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(time.Now().Unix()), Member: r.toDelete(inode, attr.Length)})
+		}
+		return nil
+	})
+	r.invalidate(r.inodeKey(inode), r.entryKey(inode))
+	return err
+}
+
+func (r *redisMeta) doListSliceRefs() (map[Slice]int64, error) {
+	ctx := Background
+	refs := make(map[Slice]int64)
+	err := r.scan(ctx, "k*", func(keys []string) error {
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			ps := strings.Split(keys[i][len(r.prefix)+1:], "_")
+			if v == nil || len(ps) != 2 {
+				continue
+			}
+			chunkid, _ := strconv.ParseUint(ps[0], 10, 64)
+			size, _ := strconv.ParseUint(ps[1], 10, 32)
+			n, _ := strconv.ParseInt(v.(string), 10, 64)
+			// a slice is referenced once without the key, so the value is one less than the references
+			refs[Slice{Chunkid: chunkid, Size: uint32(size)}] = n + 1
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (r *redisMeta) doSetSliceRef(chunkid uint64, size uint32, refs int64) error {
+	return r.rdb.Set(Background, r.sliceKey(chunkid, size), refs-1, 0).Err()
+}
+
+func (r *redisMeta) doListDelFiles() (map[Ino]uint64, error) {
+	members, err := r.rdb.ZRange(Background, r.prefix+delfiles, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[Ino]uint64)
+	for _, member := range members {
+		ps := strings.Split(member, ":")
+		if len(ps) != 2 {
+			continue // created by old clients
+		}
+		inode, _ := strconv.ParseUint(ps[0], 10, 64)
+		length, _ := strconv.ParseUint(ps[1], 10, 64)
+		files[Ino(inode)] = length
+	}
+	return files, nil
+}
+
+func (r *redisMeta) doRemoveDelFile(inode Ino, length uint64) error {
+	return r.rdb.ZRem(Background, r.prefix+delfiles, r.toDelete(inode, length)).Err()
+}
+
+func (r *redisMeta) doSaveFormat(format *Format, data []byte) error {
+	if err := r.rdb.Set(Background, r.prefix+"setting", data, 0).Err(); err != nil {
+		return err
+	}
+	if format.TrashDays > 0 {
+		created, err := r.rdb.SetNX(Background, r.inodeKey(TrashInode), r.marshal(specialRootAttr()), 0).Result()
+		if err != nil || !created {
+			return err
+		}
+		return r.doSetDirStat(TrashInode, &dirStat{})
+	}
+	return nil
+}
+
+func (r *redisMeta) doAppendEvent(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.rdb.XAdd(Background, &redis.XAddArgs{
+		Stream: r.prefix + changeEvents,
+		Values: map[string]interface{}{"event": data},
+	}).Err()
+}
+
+// appendEvent appends the event of the change made with the context in the transaction of it.
+func (r *redisMeta) appendEvent(ctx Context, pipe redis.Pipeliner) {
+	if e := eventOf(ctx); e != nil {
+		data, _ := json.Marshal(e)
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: r.prefix + changeEvents,
+			Values: map[string]interface{}{"event": data},
+		})
+	}
+}
+
+func (r *redisMeta) doReadEvents(offset string, limit int) ([]*Event, error) {
+	start := offset
+	if start == "" {
+		start = "-"
+	}
+	// the range is inclusive, so the one at the offset is read again and skipped
+	msgs, err := r.rdb.XRangeN(Background, r.prefix+changeEvents, start, "+", int64(limit)+1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var events []*Event
+	for _, msg := range msgs {
+		if msg.ID == offset || len(events) == limit {
+			continue
+		}
+		data, _ := msg.Values["event"].(string)
+		var e Event
+		if err = json.Unmarshal([]byte(data), &e); err != nil {
+			logger.Warnf("corrupted event %s: %s", msg.ID, err)
+			continue
+		}
+		e.Offset = msg.ID
+		events = append(events, &e)
+	}
+	return events, nil
+}
+
+func (r *redisMeta) doTrimEvents(before int64) error {
+	// the IDs of the entries in a stream start with the time they are added in milliseconds
+	end := strconv.FormatInt(before/1e6, 10)
+	for {
+		msgs, err := r.rdb.XRangeN(Background, r.prefix+changeEvents, "-", end, 1000).Result()
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+		ids := make([]string, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = msg.ID
+		}
+		if err = r.rdb.XDel(Background, r.prefix+changeEvents, ids...).Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *redisMeta) doTouchAtime(inode Ino, atime time.Time) error {
+	ctx := Background
+	return errnoErr(r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		r.parseAttr(a, &attr)
+		if !atime.After(time.Unix(attr.Atime, int64(attr.Atimensec))) {
+			return nil
+		}
+		attr.Atime = atime.Unix()
+		attr.Atimensec = uint32(atime.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode)))
+}
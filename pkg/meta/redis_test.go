@@ -17,7 +17,7 @@ package meta
 
 import (
 	"fmt"
-	"sync"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -64,325 +64,80 @@ func BenchmarkReadSlices(b *testing.B) {
 	}
 }
 
-// nolint:errcheck
 func TestRedisClient(t *testing.T) {
-	var conf RedisConfig
-	m, err := NewRedisMeta("redis://127.0.0.1:6379/7", &conf)
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1:6379/7", &conf)
 	if err != nil {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
-	m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
-	_ = m.Init(Format{Name: "test"}, true)
-	_ = m.NewSession()
-	ctx := Background
-	var parent, inode Ino
-	var attr = &Attr{}
-	if st := m.Mkdir(ctx, 1, "d", 0640, 022, 0, &parent, attr); st != 0 {
-		t.Fatalf("mkdir %s", st)
-	}
-	defer m.Rmdir(ctx, 1, "d")
-	if st := m.Lookup(ctx, 1, "d", &parent, attr); st != 0 {
-		t.Fatalf("lookup dir: %s", st)
-	}
-	if st := m.Access(ctx, parent, 4, attr); st != 0 {
-		t.Fatalf("access dir: %s", st)
-	}
-	if st := m.Create(ctx, parent, "f", 0650, 022, &inode, attr); st != 0 {
-		t.Fatalf("create file %s", st)
-	}
-	defer m.Unlink(ctx, parent, "f")
-	if st := m.Lookup(ctx, parent, "f", &inode, attr); st != 0 {
-		t.Fatalf("lookup file: %s", st)
-	}
-	attr.Mtime = 2
-	attr.Uid = 1
-	if st := m.SetAttr(ctx, inode, SetAttrMtime|SetAttrUID, 0, attr); st != 0 {
-		t.Fatalf("setattr file %s", st)
-	}
-	if st := m.GetAttr(ctx, inode, attr); st != 0 {
-		t.Fatalf("getattr file %s", st)
-	}
-	if attr.Mtime != 2 || attr.Uid != 1 {
-		t.Fatalf("mtime:%d uid:%d", attr.Mtime, attr.Uid)
-	}
-	var entries []*Entry
-	if st := m.Readdir(ctx, parent, 0, &entries); st != 0 {
-		t.Fatalf("readdir: %s", st)
-	} else if len(entries) != 3 {
-		t.Fatalf("entries: %d", len(entries))
-	} else if string(entries[0].Name) != "." || string(entries[1].Name) != ".." || string(entries[2].Name) != "f" {
-		t.Fatalf("entries: %+v", entries)
-	}
-	if st := m.Rename(ctx, parent, "f", 1, "f2", &inode, attr); st != 0 {
-		t.Fatalf("rename f %s", st)
-	}
-	defer func() {
-		_ = m.Unlink(ctx, 1, "f2")
-	}()
-	if st := m.Lookup(ctx, 1, "f2", &inode, attr); st != 0 {
-		t.Fatalf("lookup f2: %s", st)
-	}
-
-	// data
-	var chunkid uint64
-	if st := m.Open(ctx, inode, 2, attr); st != 0 {
-		t.Fatalf("open f2: %s", st)
-	}
-	if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
-		t.Fatalf("write chunk: %s", st)
-	}
-	var s = Slice{Chunkid: chunkid, Size: 100, Len: 100}
-	if st := m.Write(ctx, inode, 0, 100, s); st != 0 {
-		t.Fatalf("write end: %s", st)
-	}
-	var chunks []Slice
-	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
-		t.Fatalf("read chunk: %s", st)
-	}
-	if len(chunks) != 2 || chunks[0].Chunkid != 0 || chunks[0].Size != 100 || chunks[1].Chunkid != chunkid || chunks[1].Size != 100 {
-		t.Fatalf("chunks: %v", chunks)
-	}
-	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 100, 50); st != 0 {
-		t.Fatalf("fallocate: %s", st)
-	}
-	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
-		t.Fatalf("read chunk: %s", st)
-	}
-	if len(chunks) != 3 || chunks[1].Chunkid != 0 || chunks[1].Len != 50 || chunks[2].Chunkid != chunkid || chunks[2].Len != 50 {
-		t.Fatalf("chunks: %v", chunks)
-	}
-
-	// xattr
-	if st := m.SetXattr(ctx, inode, "a", []byte("v")); st != 0 {
-		t.Fatalf("setxattr: %s", st)
-	}
-	var value []byte
-	if st := m.GetXattr(ctx, inode, "a", &value); st != 0 || string(value) != "v" {
-		t.Fatalf("getxattr: %s %v", st, value)
-	}
-	if st := m.ListXattr(ctx, inode, &value); st != 0 || string(value) != "a\000" {
-		t.Fatalf("listxattr: %s %v", st, value)
-	}
-	if st := m.RemoveXattr(ctx, inode, "a"); st != 0 {
-		t.Fatalf("setxattr: %s", st)
-	}
-
-	// flock
-	if st := m.Flock(ctx, inode, 1, syscall.F_RDLCK, false); st != 0 {
-		t.Fatalf("flock rlock: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 2, syscall.F_RDLCK, false); st != 0 {
-		t.Fatalf("flock rlock: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != syscall.EAGAIN {
-		t.Fatalf("flock wlock: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 2, syscall.F_UNLCK, false); st != 0 {
-		t.Fatalf("flock unlock: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != 0 {
-		t.Fatalf("flock wlock again: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 2, syscall.F_WRLCK, false); st != syscall.EAGAIN {
-		t.Fatalf("flock wlock: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 2, syscall.F_RDLCK, false); st != syscall.EAGAIN {
-		t.Fatalf("flock rlock: %s", st)
-	}
-	if st := m.Flock(ctx, inode, 1, syscall.F_UNLCK, false); st != 0 {
-		t.Fatalf("flock unlock: %s", st)
-	}
+	testMetaClient(t, m)
+}
 
-	// POSIX locks
-	if st := m.Setlk(ctx, inode, 1, false, syscall.F_RDLCK, 0, 0xFFFF, 1); st != 0 {
-		t.Fatalf("plock rlock: %s", st)
-	}
-	if st := m.Setlk(ctx, inode, 2, false, syscall.F_RDLCK, 0, 0x2FFFF, 1); st != 0 {
-		t.Fatalf("plock rlock: %s", st)
-	}
-	if st := m.Setlk(ctx, inode, 2, false, syscall.F_WRLCK, 0, 0xFFFF, 1); st != syscall.EAGAIN {
-		t.Fatalf("plock wlock: %s", st)
-	}
-	if st := m.Setlk(ctx, inode, 2, false, syscall.F_WRLCK, 0x10000, 0x20000, 1); st != 0 {
-		t.Fatalf("plock wlock: %s", st)
-	}
-	if st := m.Setlk(ctx, inode, 1, false, syscall.F_UNLCK, 0, 0x20000, 1); st != 0 {
-		t.Fatalf("plock unlock: %s", st)
-	}
-	if st := m.Setlk(ctx, inode, 2, false, syscall.F_WRLCK, 0, 0xFFFF, 10); st != 0 {
-		t.Fatalf("plock wlock: %s", st)
-	}
-	if st := m.Setlk(ctx, inode, 1, false, syscall.F_WRLCK, 0, 0xFFFF, 1); st != syscall.EAGAIN {
-		t.Fatalf("plock rlock: %s", st)
-	}
-	var ltype, pid uint32 = syscall.F_WRLCK, 1
-	var start, end uint64 = 0, 0xFFFF
-	if st := m.Getlk(ctx, inode, 1, &ltype, &start, &end, &pid); st != 0 || ltype != syscall.F_WRLCK || pid != 10 || start != 0 || end != 0xFFFF {
-		t.Fatalf("plock get rlock: %s, %d %d %x %x", st, ltype, pid, start, end)
-	}
-	if st := m.Setlk(ctx, inode, 2, false, syscall.F_UNLCK, 0, 0x2FFFF, 1); st != 0 {
-		t.Fatalf("plock unlock: %s", st)
+// TestRedisKeyPrefix runs the client with the keys prefixed as in Redis Cluster.
+func TestRedisKeyPrefix(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1:6379/6", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
 	}
-	ltype = syscall.F_WRLCK
-	start, end = 0, 0xFFFFFF
-	if st := m.Getlk(ctx, inode, 1, &ltype, &start, &end, &pid); st != 0 || ltype != syscall.F_UNLCK || pid != 0 || start != 0 || end != 0 {
-		t.Fatalf("plock get rlock: %s, %d %d %x %x", st, ltype, pid, start, end)
+	r := m.(*redisMeta)
+	if err = r.rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
 	}
+	r.prefix = "{6}"
+	testMetaClient(t, m)
 
-	// concurrent locks
-	var g sync.WaitGroup
-	var count int
-	for i := 0; i < 100; i++ {
-		g.Add(1)
-		go func(i int) {
-			defer g.Done()
-			if st := m.Setlk(ctx, inode, uint64(i), true, syscall.F_WRLCK, 0, 0xFFFF, uint32(i)); st != 0 {
-				err = st
-			}
-			count++
-			time.Sleep(time.Millisecond)
-			count--
-			if count > 0 {
-				logger.Errorf("count should be be zero but got %d", count)
-			}
-			if st := m.Setlk(ctx, inode, uint64(i), false, syscall.F_UNLCK, 0, 0xFFFF, uint32(i)); st != 0 {
-				logger.Errorf("plock unlock: %s", st)
-				err = st
+	var cursor uint64
+	for {
+		keys, next, err := r.rdb.Scan(Background, cursor, "*", 1000).Result()
+		if err != nil {
+			t.Fatalf("scan keys: %s", err)
+		}
+		for _, k := range keys {
+			if !strings.HasPrefix(k, r.prefix) {
+				t.Fatalf("key %s is not prefixed by %s", k, r.prefix)
 			}
-		}(i)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
 	}
-	g.Wait()
-
-	if st := m.Unlink(ctx, 1, "f2"); st != 0 {
-		t.Fatalf("unlink: %s", st)
+	if inode := r.keyInode(r.prefix + "c123_4"); inode != 123 {
+		t.Fatalf("inode of prefixed chunk key: %d", inode)
 	}
-	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
-		t.Fatalf("rmdir: %s", st)
+	if inode := r.keyInode("c123_4"); inode != 0 {
+		t.Fatalf("inode of chunk key without prefix: %d", inode)
 	}
 }
 
 func TestCompaction(t *testing.T) {
-	var conf RedisConfig
-	m, err := NewRedisMeta("redis://127.0.0.1:6379/8", &conf)
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1:6379/8", &conf)
 	if err != nil {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
-	_ = m.Init(Format{Name: "test"}, true)
-	done := make(chan bool, 1)
-	var l sync.Mutex
-	deleted := make(map[uint64]int)
-	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
-		l.Lock()
-		chunkid := args[0].(uint64)
-		deleted[chunkid] = 1
-		l.Unlock()
-		return nil
-	})
-	m.OnMsg(CompactChunk, func(args ...interface{}) error {
-		select {
-		case done <- true:
-		default:
-		}
-		return nil
-	})
-	_ = m.NewSession()
-	ctx := Background
-	var inode Ino
-	var attr = &Attr{}
-	if st := m.Create(ctx, 1, "f", 0650, 022, &inode, attr); st != 0 {
-		t.Fatalf("create file %s", st)
-	}
-	defer func() {
-		_ = m.Unlink(ctx, 1, "f")
-	}()
-	for i := 0; i < 50; i++ {
-		if st := m.Write(ctx, inode, 0, uint32(i*100), Slice{Chunkid: uint64(i) + 1, Size: 100, Len: 100}); st != 0 {
-			t.Fatalf("write %d: %s", i, st)
-		}
-		time.Sleep(time.Millisecond)
-	}
-	<-done
-	var chunks []Slice
-	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
-		t.Fatalf("read 0: %s", st)
-	}
-	if len(chunks) > 20 {
-		t.Fatalf("inode %d should be compacted, but have %d slices", inode, len(chunks))
-	}
-	<-done
-	// wait for it to update chunks
-	time.Sleep(time.Millisecond * 5)
-	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
-		t.Fatalf("read 0: %s", st)
-	}
-	if len(chunks) > 1 {
-		t.Fatalf("inode %d should be compacted after read, but have %d slices", inode, len(chunks))
-	}
-	if chunks[0].Size != 5000 {
-		t.Fatalf("size of slice should be 5000, but got %d", chunks[0].Size)
-	}
-	l.Lock()
-	deletes := len(deleted)
-	l.Unlock()
-	if deletes < 40 {
-		t.Fatalf("deleted chunks %d is less then 40", deletes)
-	}
+	testCompaction(t, m)
 }
 
 func TestConcurrentWrite(t *testing.T) {
-	var conf RedisConfig
-	m, err := NewRedisMeta("redis://127.0.0.1/9", &conf)
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/9", &conf)
 	if err != nil {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
-	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
-		return nil
-	})
-	m.OnMsg(CompactChunk, func(args ...interface{}) error {
-		return nil
-	})
-	_ = m.Init(Format{Name: "test"}, true)
-	_ = m.NewSession()
-
-	ctx := Background
-	var inode Ino
-	var attr = &Attr{}
-	_ = m.Unlink(ctx, 1, "f")
-	if st := m.Create(ctx, 1, "f", 0650, 022, &inode, attr); st != 0 {
-		t.Fatalf("create file %s", st)
-	}
-	// nolint:errcheck
-	defer m.Unlink(ctx, 1, "f")
-
-	var errno syscall.Errno
-	var g sync.WaitGroup
-	for i := 0; i <= 20; i++ {
-		g.Add(1)
-		go func(indx uint32) {
-			defer g.Done()
-			for j := 0; j < 100; j++ {
-				var slice = Slice{Chunkid: 1, Size: 100, Len: 100}
-				st := m.Write(ctx, inode, indx, 0, slice)
-				if st != 0 {
-					errno = st
-					break
-				}
-			}
-		}(uint32(i))
-	}
-	g.Wait()
-	if errno != 0 {
-		t.Fatal()
-	}
+	testConcurrentWrite(t, m)
 }
 
 // nolint:errcheck
 func TestTruncateAndDelete(t *testing.T) {
-	var conf RedisConfig
-	m, err := NewRedisMeta("redis://127.0.0.1/10", &conf)
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/10", &conf)
 	if err != nil {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
@@ -419,7 +174,7 @@ func TestTruncateAndDelete(t *testing.T) {
 		var keys, ks []string
 		var cursor uint64
 		for {
-			ks, cursor, err = r.rdb.Scan(ctx, cursor, pattern, 1000).Result()
+			ks, cursor, err = r.rdb.Scan(ctx, cursor, r.prefix+pattern, 1000).Result()
 			keys = append(keys, ks...)
 			if err != nil || cursor == 0 {
 				break
@@ -445,70 +200,19 @@ func TestTruncateAndDelete(t *testing.T) {
 	}
 }
 
-// nolint:errcheck
 func TestCopyFileRange(t *testing.T) {
-	var conf RedisConfig
-	m, err := NewRedisMeta("redis://127.0.0.1/10", &conf)
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/10", &conf)
 	if err != nil {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
-	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
-		return nil
-	})
-	_ = m.Init(Format{Name: "test"}, true)
-	_ = m.NewSession()
-
-	ctx := Background
-	var iin, iout Ino
-	var attr = &Attr{}
-	_ = m.Unlink(ctx, 1, "fin")
-	_ = m.Unlink(ctx, 1, "fout")
-	if st := m.Create(ctx, 1, "fin", 0650, 022, &iin, attr); st != 0 {
-		t.Fatalf("create file %s", st)
-	}
-	defer m.Unlink(ctx, 1, "fin")
-	if st := m.Create(ctx, 1, "fout", 0650, 022, &iout, attr); st != 0 {
-		t.Fatalf("create file %s", st)
-	}
-	defer m.Unlink(ctx, 1, "fout")
-	m.Write(ctx, iin, 0, 100, Slice{10, 200, 0, 100})
-	m.Write(ctx, iin, 1, 100<<10, Slice{11, 100 << 10, 0, 10 << 10})
-	m.Write(ctx, iin, 3, 0, Slice{12, 63 << 20, 10 << 20, 30 << 20})
-	m.Write(ctx, iout, 2, 10<<20, Slice{13, 50 << 20, 10 << 20, 30 << 20})
-	var copied uint64
-	if st := m.CopyFileRange(ctx, iin, 150, iout, 30<<20, 500<<20, 0, &copied); st != 0 {
-		t.Fatalf("copy file range: %s", st)
-	}
-	var expected uint64 = 3*ChunkSize + 30<<20 - 150
-	if copied != expected {
-		t.Fatalf("expect copy %d bytes, but got %d", expected, copied)
-	}
-	var expectedChunks = [][]Slice{
-		{{0, 30 << 20, 0, 30 << 20}, {10, 200, 50, 50}, {0, 0, 200, ChunkSize - 30<<20 - 50}},
-		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {0, 0, 0, 100 << 10}, {11, 100 << 10, 0, 10 << 10}, {0, 0, 110 << 10, ChunkSize - (30<<20 - 150) - 110<<10}},
-		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {0, 0, 0, 150 + (ChunkSize - 30<<20)}},
-		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {12, 63 << 20, 10 << 20, 30 << 20}},
-	}
-	for i := uint32(0); i < 4; i++ {
-		var chunks []Slice
-		if st := m.Read(ctx, iout, i, &chunks); st != 0 {
-			t.Fatalf("read chunk %d: %s", i, st)
-		}
-		if len(chunks) != len(expectedChunks[i]) {
-			t.Fatalf("expect chunk %d: %+v, but got %+v", i, expectedChunks[i], chunks)
-		}
-		for j, s := range chunks {
-			if s != expectedChunks[i][j] {
-				t.Fatalf("expect slice %d,%d: %+v, but got %+v", i, j, expectedChunks[i][j], s)
-			}
-		}
-	}
+	testCopyFileRange(t, m)
 }
 
 func benchmarkReaddir(b *testing.B, n int) {
-	var conf RedisConfig
-	m, err := NewRedisMeta("redis://127.0.0.1/10", &conf)
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/10", &conf)
 	if err != nil {
 		b.Logf("redis is not available: %s", err)
 		b.Skip()
@@ -554,3 +258,407 @@ func BenchmarkReaddir100k(b *testing.B) {
 func BenchmarkReaddir10m(b *testing.B) {
 	benchmarkReaddir(b, 10000000)
 }
+
+func TestRedisDumpAndLoad(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/11", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	rdb := m.(*redisMeta).rdb
+	if err = rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testDumpAndLoad(t, newKVClient(t, "memkv", ""), m)
+
+	_ = rdb.FlushDB(Background)
+	m, _ = newRedisMeta("redis", "127.0.0.1/11", &conf) // without the changes of the last volume
+	testDumpAndLoad(t, m, newKVClient(t, "memkv", ""))
+}
+
+func TestVolumeLimits(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/12", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testVolumeLimits(t, m)
+}
+
+func TestDirQuota(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testDirQuota(t, m)
+}
+
+func TestTrash(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/14", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testTrash(t, m)
+}
+
+func TestDirStats(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/15", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testDirStats(t, m)
+}
+
+func TestClone(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/14", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testClone(t, m)
+}
+
+func TestSnapshot(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/15", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testSnapshot(t, m)
+}
+
+func TestACL(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testACL(t, m)
+}
+
+func TestRedisReaddirPage(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testReaddirPage(t, m)
+}
+
+func TestRedisAllocIDs(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m2, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Fatalf("create another client: %s", err)
+	}
+	testAllocIDs(t, m, m2)
+}
+
+func TestRedisSessions(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testSessions(t, m)
+}
+
+func TestRedisCheckMeta(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testCheckMeta(t, m)
+	other, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Fatalf("create another client: %s", err)
+	}
+	testRepairWithClients(t, m, other)
+}
+
+func TestRedisUpdateFormat(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testUpdateFormat(t, m)
+}
+
+func TestRedisEvents(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testEvents(t, m)
+}
+
+func TestRedisAtime(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testAtime(t, m, &conf)
+}
+
+func TestRedisFlags(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testFlags(t, m)
+}
+
+func TestRedisRetention(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testRetention(t, m)
+}
+
+func TestRedisGetPaths(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testGetPaths(t, m)
+}
+
+func TestMetaCache(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	r := m.(*redisMeta)
+	if err = r.rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	_ = m.Init(Format{Name: "test"}, true)
+	other, _ := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	// set up the cache without the keyspace notifications, which are not supported by every server
+	r.cache = newMetaCache(time.Minute, 100)
+
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{1, 100, 0, 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	var slices []Slice
+	if st := m.Lookup(ctx, 1, "f", &inode, &attr); st != 0 {
+		t.Fatalf("lookup: %s", st)
+	}
+	if st := m.Read(ctx, inode, 0, &slices); st != 0 || len(slices) != 1 {
+		t.Fatalf("read: %s %+v", st, slices)
+	}
+
+	attr.Mode = 0600
+	if st := other.SetAttr(ctx, inode, SetAttrMode, 0, &attr); st != 0 {
+		t.Fatalf("setattr: %s", st)
+	}
+	if st := other.Write(ctx, inode, 0, 100, Slice{2, 100, 0, 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 || attr.Mode != 0644 {
+		t.Fatalf("cached attr: %s %o", st, attr.Mode)
+	}
+	if st := m.Read(ctx, inode, 0, &slices); st != 0 || len(slices) != 1 {
+		t.Fatalf("cached slices: %s %+v", st, slices)
+	}
+	r.invalidate(r.inodeKey(inode)) // like a notification from Redis
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 || attr.Mode != 0600 {
+		t.Fatalf("attr after invalidated: %s %o", st, attr.Mode)
+	}
+	if st := m.Read(ctx, inode, 0, &slices); st != 0 || len(slices) != 2 {
+		t.Fatalf("slices after invalidated: %s %+v", st, slices)
+	}
+
+	// the changes by itself are seen at once
+	attr.Mode = 0640
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, &attr); st != 0 {
+		t.Fatalf("setattr: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 || attr.Mode != 0640 {
+		t.Fatalf("attr after setattr: %s %o", st, attr.Mode)
+	}
+	if st := other.Unlink(ctx, 1, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	r.invalidate(r.entryKey(1))
+	if st := m.Lookup(ctx, 1, "f", &inode, &attr); st != syscall.ENOENT {
+		t.Fatalf("lookup after unlink: %s", st)
+	}
+
+	for i := 0; i < 200; i++ {
+		r.cache.putAttr(r.cache.generation(), Ino(1000+i), &attr)
+	}
+	if r.cache.size > 100 || len(r.cache.attrs) > 100 {
+		t.Fatalf("cache is not bounded: %d %d", r.cache.size, len(r.cache.attrs))
+	}
+	gen := r.cache.generation()
+	r.invalidate(r.chunkKey(2000, 0))
+	r.cache.putAttr(gen, 2000, &attr)
+	if r.cache.getAttr(2000, &attr) {
+		t.Fatalf("attr read before invalidated should not be cached")
+	}
+	// the notifications might be lost while the subscription is down
+	r.cache.reset(true)
+	r.cache.putAttr(r.cache.generation(), 2000, &attr)
+	if r.cache.size != 0 || r.cache.getAttr(2000, &attr) {
+		t.Fatalf("attr should not be cached while the notifications are down: %d", r.cache.size)
+	}
+	r.cache.reset(false)
+	r.cache.putAttr(r.cache.generation(), 2000, &attr)
+	if !r.cache.getAttr(2000, &attr) {
+		t.Fatalf("attr should be cached after subscribed again")
+	}
+
+	conf.CacheTTL = time.Minute
+	cached, _ := newRedisMeta("redis", "127.0.0.1/13", &conf)
+	if cached.(*redisMeta).cache == nil {
+		t.Logf("keyspace notifications are not supported")
+		return
+	}
+	if st := m.Create(ctx, 1, "g", 0644, 022, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := cached.GetAttr(ctx, inode, &attr); st != 0 {
+		t.Fatalf("getattr: %s", st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, &attr); st != 0 {
+		t.Fatalf("setattr: %s", st)
+	}
+	for i := 0; i < 100; i++ {
+		if st := cached.GetAttr(ctx, inode, &attr); st == 0 && attr.Mode == 0600 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("cache is not invalidated by notification: %o", attr.Mode)
+}
+
+func TestRedisVolumePrefix(t *testing.T) {
+	var conf Config
+	m, err := newRedisMeta("redis", "127.0.0.1:6379/5", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	if err = m.(*redisMeta).rdb.FlushDB(Background).Err(); err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	pm, err := newRedisMeta("redis", "127.0.0.1:6379/5?prefix=team", &conf)
+	if err != nil {
+		t.Fatalf("create meta with prefix: %s", err)
+	}
+	testVolumePrefix(t, m, pm)
+}
@@ -85,7 +85,7 @@ type plock struct {
 	end   uint64
 }
 
-func (r *redisMeta) loadLocks(d []byte) []plock {
+func loadLocks(d []byte) []plock {
 	var ls []plock
 	rb := utils.FromBuffer(d)
 	for rb.HasMore() {
@@ -94,7 +94,7 @@ func (r *redisMeta) loadLocks(d []byte) []plock {
 	return ls
 }
 
-func (r *redisMeta) dumpLocks(ls []plock) []byte {
+func dumpLocks(ls []plock) []byte {
 	wb := utils.NewBuffer(uint32(len(ls)) * 24)
 	for _, l := range ls {
 		wb.Put32(l.ltype)
@@ -105,7 +105,7 @@ func (r *redisMeta) dumpLocks(ls []plock) []byte {
 	return wb.Bytes()
 }
 
-func (r *redisMeta) insertLocks(ls []plock, i int, nl plock) []plock {
+func insertLocks(ls []plock, i int, nl plock) []plock {
 	nls := make([]plock, len(ls)+1)
 	copy(nls[:i], ls[:i])
 	nls[i] = nl
@@ -114,14 +114,14 @@ func (r *redisMeta) insertLocks(ls []plock, i int, nl plock) []plock {
 	return ls
 }
 
-func (r *redisMeta) updateLocks(ls []plock, nl plock) []plock {
+func updateLocks(ls []plock, nl plock) []plock {
 	// ls is ordered by l.start without overlap
 	var i int
 	for i < len(ls) && nl.end > nl.start {
 		l := ls[i]
 		if l.end < nl.start {
 		} else if l.start < nl.start {
-			ls = r.insertLocks(ls, i+1, plock{nl.ltype, nl.pid, nl.start, l.end})
+			ls = insertLocks(ls, i+1, plock{nl.ltype, nl.pid, nl.start, l.end})
 			ls[i].end = nl.start
 			i++
 			nl.start = l.end
@@ -130,11 +130,11 @@ func (r *redisMeta) updateLocks(ls []plock, nl plock) []plock {
 			ls[i].start = nl.start
 			nl.start = l.end
 		} else if l.start < nl.end {
-			ls = r.insertLocks(ls, i, nl)
+			ls = insertLocks(ls, i, nl)
 			ls[i+1].start = nl.end
 			nl.start = nl.end
 		} else {
-			ls = r.insertLocks(ls, i, nl)
+			ls = insertLocks(ls, i, nl)
 			nl.start = nl.end
 		}
 		i++
@@ -174,7 +174,7 @@ func (r *redisMeta) Getlk(ctx Context, inode Ino, owner uint64, ltype *uint32, s
 	}
 	delete(owners, lkey) // exclude itself
 	for k, d := range owners {
-		ls := r.loadLocks([]byte(d))
+		ls := loadLocks([]byte(d))
 		for _, l := range ls {
 			// find conflicted locks
 			if (*ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && *end > l.start && *start < l.end {
@@ -209,16 +209,16 @@ func (r *redisMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltyp
 				if err != nil {
 					return err
 				}
-				ls := r.loadLocks([]byte(d))
+				ls := loadLocks([]byte(d))
 				if len(ls) == 0 {
 					return nil
 				}
-				ls = r.updateLocks(ls, lock)
+				ls = updateLocks(ls, lock)
 				_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 					if len(ls) == 0 {
 						pipe.HDel(ctx, r.plockKey(inode), lkey)
 					} else {
-						pipe.HSet(ctx, r.plockKey(inode), lkey, r.dumpLocks(ls))
+						pipe.HSet(ctx, r.plockKey(inode), lkey, dumpLocks(ls))
 					}
 					return nil
 				})
@@ -228,10 +228,10 @@ func (r *redisMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltyp
 			if err != nil {
 				return err
 			}
-			ls := r.loadLocks([]byte(owners[lkey]))
+			ls := loadLocks([]byte(owners[lkey]))
 			delete(owners, lkey)
 			for _, d := range owners {
-				ls := r.loadLocks([]byte(d))
+				ls := loadLocks([]byte(d))
 				for _, l := range ls {
 					// find conflicted locks
 					if (ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && end > l.start && start < l.end {
@@ -239,9 +239,9 @@ func (r *redisMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltyp
 					}
 				}
 			}
-			ls = r.updateLocks(ls, lock)
+			ls = updateLocks(ls, lock)
 			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-				pipe.HSet(ctx, r.plockKey(inode), lkey, r.dumpLocks(ls))
+				pipe.HSet(ctx, r.plockKey(inode), lkey, dumpLocks(ls))
 				return nil
 			})
 			return err
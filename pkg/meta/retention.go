@@ -0,0 +1,134 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetentionXattr is the extended attribute for the retention of a node, which is the time (in RFC3339 or unix
+// seconds) until which the node can't be removed or replaced. Once a file has a retention, its content can't be
+// changed any more (write once, read many), but it can be removed after the retention expires. The retention
+// can be extended but never shortened or removed.
+//
+// A directory with a retention is a WORM directory, the files written under it get a retention of
+// Format.RetentionDays once they are closed.
+const RetentionXattr = "user.juicefs.retention"
+
+func (m *baseMeta) retentionDays() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.format.RetentionDays
+}
+
+// ParseRetention parses the value of RetentionXattr.
+func ParseRetention(value []byte) (time.Time, error) {
+	if secs, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, string(value))
+}
+
+// retention returns the time until which the node is retained, which is zero if it has no retention.
+func (m *baseMeta) retention(ctx Context, inode Ino, attr *Attr) (time.Time, syscall.Errno) {
+	if attr == nil {
+		attr = &Attr{}
+		if st := m.en.doGetAttr(ctx, inode, attr); st != 0 {
+			return time.Time{}, st
+		}
+	}
+	if attr.Flags&FlagRetention == 0 {
+		return time.Time{}, 0
+	}
+	var value []byte
+	if st := m.en.GetXattr(ctx, inode, RetentionXattr, &value); st != 0 {
+		if st == ENOATTR {
+			st = 0
+		}
+		return time.Time{}, st
+	}
+	until, err := ParseRetention(value)
+	if err != nil {
+		logger.Warnf("invalid retention of inode %d: %q", inode, value)
+	}
+	return until, 0
+}
+
+// checkRetention returns EPERM if the node is retained now.
+func (m *baseMeta) checkRetention(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	until, st := m.retention(ctx, inode, attr)
+	if st == 0 && until.After(time.Now()) {
+		st = syscall.EPERM
+	}
+	return st
+}
+
+func (m *baseMeta) setRetention(ctx Context, inode Ino, value []byte) syscall.Errno {
+	until, err := ParseRetention(value)
+	if err != nil {
+		return syscall.EINVAL
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	cur, st := m.retention(ctx, inode, &attr)
+	if st != 0 {
+		return st
+	}
+	if until.Before(cur) {
+		return syscall.EPERM
+	}
+	if st = m.en.doSetXattr(ctx, inode, RetentionXattr, []byte(until.UTC().Format(time.RFC3339))); st != 0 {
+		return st
+	}
+	if attr.Flags&FlagRetention == 0 {
+		attr.Flags |= FlagRetention
+		st = m.en.doSetAttr(withoutEvent(ctx), inode, SetAttrFlag, 0, &attr)
+	}
+	return st
+}
+
+// retainWritten sets the default retention to a file written and closed if it's under a WORM directory.
+func (m *baseMeta) retainWritten(ctx Context, inode Ino) {
+	days := m.retentionDays()
+	if days == 0 {
+		return
+	}
+	var attr Attr
+	if m.en.doGetAttr(ctx, inode, &attr) != 0 || attr.Typ != TypeFile || attr.Flags&FlagRetention != 0 {
+		return
+	}
+	for parent, depth := attr.Parent, 0; parent > 0 && depth < 1000; depth++ {
+		var pattr Attr
+		if m.GetAttr(ctx, parent, &pattr) != 0 {
+			return
+		}
+		if pattr.Flags&FlagRetention != 0 {
+			until := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+			if st := m.setRetention(ctx, inode, []byte(strconv.FormatInt(until.Unix(), 10))); st != 0 {
+				logger.Warnf("set retention of inode %d: %s", inode, st)
+			}
+			return
+		}
+		if parent == 1 {
+			return
+		}
+		parent = pattr.Parent
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+	jfsversion "github.com/juicedata/juicefs/pkg/version"
+)
+
+// staleAfter is how long a session could live without refreshing, the locks it owns are cleaned after that.
+const staleAfter = time.Minute * 3
+
+// SessionInfo tells which client a session belongs to.
+type SessionInfo struct {
+	Version    string
+	Hostname   string
+	IPAddrs    []string `json:",omitempty"`
+	MountPoint string   `json:",omitempty"`
+	ProcessID  int
+	StartTime  time.Time
+}
+
+// Flock is a BSD lock owned by a session.
+type Flock struct {
+	Inode Ino
+	Owner uint64
+	Type  string
+}
+
+// PlockRecord is a range of file locked by a process.
+type PlockRecord struct {
+	Type  uint32
+	Pid   uint32
+	Start uint64
+	End   uint64
+}
+
+// Plock is the POSIX locks on a file owned by a session.
+type Plock struct {
+	Inode   Ino
+	Owner   uint64
+	Records []PlockRecord
+}
+
+// Session is a client of the volume, with the files it holds open (deleted but not closed yet) and the
+// locks it owns.
+type Session struct {
+	Sid       uint64
+	Heartbeat time.Time
+	Stale     bool
+	SessionInfo
+	Sustained []Ino   `json:",omitempty"`
+	Flocks    []Flock `json:",omitempty"`
+	Plocks    []Plock `json:",omitempty"`
+}
+
+// newSessionInfo returns the information of the current client as JSON.
+func (m *baseMeta) newSessionInfo() []byte {
+	host, err := os.Hostname()
+	if err != nil {
+		logger.Warnf("get hostname: %s", err)
+	}
+	info := SessionInfo{
+		Version:    jfsversion.Version(),
+		Hostname:   host,
+		IPAddrs:    localIPs(),
+		MountPoint: m.conf.MountPoint,
+		ProcessID:  os.Getpid(),
+		StartTime:  time.Now(),
+	}
+	data, err := json.Marshal(&info)
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+	return data
+}
+
+func localIPs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warnf("get addresses of interfaces: %s", err)
+		return nil
+	}
+	var ips []string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			ips = append(ips, n.IP.String())
+		}
+	}
+	return ips
+}
+
+// newSession builds a session from the heartbeat and the information stored by the client.
+func newSession(sid uint64, heartbeat int64, info []byte) *Session {
+	s := &Session{Sid: sid, Heartbeat: time.Unix(heartbeat, 0)}
+	s.Stale = time.Since(s.Heartbeat) > staleAfter
+	// the sessions created by old clients have no information
+	if len(info) > 0 {
+		if err := json.Unmarshal(info, &s.SessionInfo); err != nil {
+			logger.Warnf("invalid information of session %d: %s", sid, err)
+		}
+	}
+	return s
+}
+
+func parsePlockRecords(buf []byte) []PlockRecord {
+	var rs []PlockRecord
+	rb := utils.FromBuffer(buf)
+	for rb.HasMore() {
+		rs = append(rs, PlockRecord{rb.Get32(), rb.Get32(), rb.Get64(), rb.Get64()})
+	}
+	return rs
+}
+
+func sortSessions(sessions []*Session) {
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Sid < sessions[j].Sid })
+}
@@ -17,6 +17,8 @@ package meta
 
 import "github.com/juicedata/juicefs/pkg/utils"
 
+const sliceBytes = 24
+
 type slice struct {
 	chunkid uint64
 	size    uint32
@@ -97,3 +99,29 @@ func readSlices(vals []string) []*slice {
 	}
 	return ss
 }
+
+func readSliceBuf(buf []byte) []*slice {
+	if len(buf)%sliceBytes != 0 {
+		logger.Errorf("corrupt slices: len=%d", len(buf))
+		return nil
+	}
+	nSlices := len(buf) / sliceBytes
+	slices := make([]slice, nSlices)
+	ss := make([]*slice, nSlices)
+	for i := 0; i < len(buf); i += sliceBytes {
+		s := &slices[i/sliceBytes]
+		s.read(buf[i:])
+		ss[i/sliceBytes] = s
+	}
+	return ss
+}
+
+func marshalSlice(pos uint32, chunkid uint64, size, off, len uint32) []byte {
+	w := utils.NewBuffer(sliceBytes)
+	w.Put32(pos)
+	w.Put64(chunkid)
+	w.Put32(size)
+	w.Put32(off)
+	w.Put32(len)
+	return w.Bytes()
+}
@@ -0,0 +1,132 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// SnapshotInode is the inode of the directory holding all the snapshots, like the trash
+	// it's not an entry of the root but can be looked up from the root with SnapshotName.
+	SnapshotInode Ino = TrashInode + 1
+	SnapshotName      = ".snapshots"
+)
+
+const (
+	// SnapshotCreate takes a snapshot of a directory.
+	SnapshotCreate uint8 = iota
+	// SnapshotList returns all the snapshots.
+	SnapshotList
+	// SnapshotDel removes a snapshot.
+	SnapshotDel
+)
+
+// Snapshot is a read-only copy of a directory, which can be browsed as .snapshots/Name in the root.
+type Snapshot struct {
+	Inode   Ino
+	Created time.Time
+	Summary Summary
+}
+
+// specialRoot returns the inode of a special directory that can be looked up from the root by name.
+func specialRoot(name string) Ino {
+	switch name {
+	case TrashName:
+		return TrashInode
+	case SnapshotName:
+		return SnapshotInode
+	}
+	return 0
+}
+
+// isReserved tells whether an entry can't be created or replaced by the users.
+func isReserved(parent Ino, name string) bool {
+	return parent == 1 && specialRoot(name) > 0 || parent == TrashInode || parent == SnapshotInode
+}
+
+// checkWritable returns EROFS if the node is in a snapshot.
+func (m *baseMeta) checkWritable(ctx Context, inode Ino) syscall.Errno {
+	return m.checkFlags(ctx, inode, 0)
+}
+
+// HandleSnapshot takes a snapshot of the directory dpath as name, lists all the snapshots into
+// snapshots, or removes the snapshot of name.
+//
+// A snapshot is a clone of the directory whose nodes are flagged as read-only, so the slices it
+// references are never deleted by the compaction or gc. It's taken file by file, so the files
+// changed during that time could be seen in different states.
+func (m *baseMeta) HandleSnapshot(ctx Context, cmd uint8, name, dpath string, snapshots map[string]*Snapshot) error {
+	if cmd != SnapshotList && m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	if cmd != SnapshotList && (name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/')) {
+		return fmt.Errorf("invalid name of snapshot: %q", name)
+	}
+	switch cmd {
+	case SnapshotCreate:
+		inode, attr, err := m.resolve(ctx, dpath)
+		if err != nil {
+			return err
+		}
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if inode == TrashInode || inode == SnapshotInode || attr.Flags&FlagSnapshot != 0 {
+			return fmt.Errorf("can't take snapshot of %s", dpath)
+		}
+		var root Attr
+		if st := m.en.doGetAttr(ctx, SnapshotInode, &root); st == syscall.ENOENT {
+			if err = m.en.doLoadNode(&loadedNode{inode: SnapshotInode, attr: *specialRootAttr()}); err != nil {
+				return err
+			}
+			m.newDirStat(SnapshotInode)
+		} else if st != 0 {
+			return st
+		}
+		// the snapshots are not counted in any quota of directories
+		if st := m.clone(ctx, inode, attr, SnapshotInode, name, FlagSnapshot, nil); st != 0 {
+			return fmt.Errorf("snapshot %s as %s: %s", dpath, name, st)
+		}
+	case SnapshotList:
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, SnapshotInode, 1, &entries); st != 0 && st != syscall.ENOENT {
+			return st
+		}
+		for _, e := range entries {
+			s := &Snapshot{Inode: e.Inode, Created: time.Unix(e.Attr.Ctime, int64(e.Attr.Ctimensec))}
+			if st := m.summary(ctx, e.Inode, &s.Summary, false); st != 0 {
+				return st
+			}
+			snapshots[string(e.Name)] = s
+		}
+	case SnapshotDel:
+		var inode Ino
+		var attr Attr
+		if st := m.en.doLookup(ctx, SnapshotInode, name, &inode, &attr); st != 0 {
+			return fmt.Errorf("lookup snapshot %s: %s", name, st)
+		}
+		if st := m.purgeEntry(ctx, SnapshotInode, name, inode, attr.Typ); st != 0 {
+			return fmt.Errorf("remove snapshot %s: %s", name, st)
+		}
+	default:
+		return fmt.Errorf("unknown command: %d", cmd)
+	}
+	return nil
+}
@@ -0,0 +1,2654 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/*
+	setting: name -> value
+	counter: name -> value
+	node: inode -> type,flags,mode,uid,gid,atime,mtime,ctime,nlink,length,rdev,parent
+	edge: (parent, name) -> inode,type
+	parent: (inode, parent) -> cnt (for the files with hardlinks)
+	chunk: (inode, indx) -> [Slice{pos,id,length,off,len}]
+	chunk_ref: (chunkid, size) -> refs
+	symlink: inode -> target
+	xattr: (inode, name) -> value
+	flock: (inode, sid, owner) -> ltype
+	plock: (inode, sid, owner) -> [Plock(pid,ltype,start,end)]
+	session: sid -> heartbeat
+	sustained: (sid, inode)
+	delfile: inode -> length,expire
+	dir_stats: inode -> length,space,files,dirs
+	dir_delta: inode -> length,space,files,dirs (not rolled up into dir_stats yet)
+	event: id -> ts,data
+
+	The names of tables are prefixed by jfs_, or jfs_$prefix_ if the prefix of volume is given in the URL.
+*/
+
+type dbMeta struct {
+	*baseMeta
+	db      *sql.DB
+	driver  string
+	prefix  string           // prefix of the tables instead of jfs_, for the volume with a prefix
+	txlocks [1024]sync.Mutex // Pessimistic locks to reduce conflict on database
+}
+
+var _ Meta = &dbMeta{}
+var _ engine = &dbMeta{}
+
+func init() {
+	Register("sqlite3", newSQLMeta)
+	Register("mysql", newSQLMeta)
+	Register("postgres", newSQLMeta)
+}
+
+// newSQLMeta return a meta store using a SQL database, the driver could be sqlite3, mysql or postgres.
+func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
+	addr, name, err := splitPrefix(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch driver {
+	case "sqlite3":
+		if !strings.Contains(addr, "?") {
+			addr += "?"
+		} else {
+			addr += "&"
+		}
+		addr += "_busy_timeout=5000&_txlock=immediate&_journal=WAL"
+	case "mysql":
+		addr = strings.Replace(addr, "@(", "@tcp(", 1)
+		// let UPDATE report the matched rows, which is required by upsert
+		if !strings.Contains(addr, "?") {
+			addr += "?"
+		} else {
+			addr += "&"
+		}
+		addr += "clientFoundRows=true"
+		if conf.ReadTimeout > 0 {
+			addr += "&readTimeout=" + conf.ReadTimeout.String()
+		}
+		if conf.WriteTimeout > 0 {
+			addr += "&writeTimeout=" + conf.WriteTimeout.String()
+		}
+	case "postgres":
+		addr = "postgres://" + addr
+	default:
+		return nil, fmt.Errorf("unsupported driver: %s", driver)
+	}
+	db, err := sql.Open(driver, addr)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %s", driver, err)
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("ping %s: %s", driver, err)
+	}
+	db.SetConnMaxLifetime(time.Minute * 10)
+	m := &dbMeta{
+		baseMeta: newBaseMeta(conf),
+		db:       db,
+		driver:   driver,
+	}
+	if name != "" {
+		m.prefix = "jfs_" + name + "_"
+	}
+	m.en = m
+	return m, nil
+}
+
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (m *dbMeta) Name() string {
+	return m.driver
+}
+
+func (m *dbMeta) serverVersion() string {
+	q := "SELECT version()"
+	if m.driver == "sqlite3" {
+		q = "SELECT sqlite_version()"
+	}
+	var v string
+	if err := m.db.QueryRow(q).Scan(&v); err != nil {
+		logger.Warnf("get version of %s: %s", m.driver, err)
+	}
+	return v
+}
+
+// q rewrites the names of tables with the prefix of the volume, and the placeholders for the dialect of the driver.
+func (m *dbMeta) q(query string) string {
+	if m.prefix != "" {
+		query = strings.ReplaceAll(query, "jfs_", m.prefix)
+	}
+	if m.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	var n int
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (m *dbMeta) forUpdate(lock bool) string {
+	if lock && m.driver != "sqlite3" {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+func (m *dbMeta) blobType(small bool) string {
+	switch m.driver {
+	case "mysql":
+		if small {
+			return "VARBINARY(255)"
+		}
+		return "LONGBLOB"
+	case "postgres":
+		return "BYTEA"
+	default:
+		return "BLOB"
+	}
+}
+
+func (m *dbMeta) createTables() error {
+	blob := m.blobType(false)
+	name := m.blobType(true)
+	tables := []string{
+		"CREATE TABLE IF NOT EXISTS jfs_setting (name VARCHAR(255) NOT NULL PRIMARY KEY, value TEXT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_counter (name VARCHAR(255) NOT NULL PRIMARY KEY, value BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_node (inode BIGINT NOT NULL PRIMARY KEY, type INTEGER NOT NULL, flags INTEGER NOT NULL, mode INTEGER NOT NULL, uid BIGINT NOT NULL, gid BIGINT NOT NULL, " +
+			"atime BIGINT NOT NULL, mtime BIGINT NOT NULL, ctime BIGINT NOT NULL, nlink BIGINT NOT NULL, length BIGINT NOT NULL, rdev BIGINT NOT NULL, parent BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_edge (parent BIGINT NOT NULL, name " + name + " NOT NULL, inode BIGINT NOT NULL, type INTEGER NOT NULL, PRIMARY KEY (parent, name))",
+		"CREATE TABLE IF NOT EXISTS jfs_chunk (inode BIGINT NOT NULL, indx INTEGER NOT NULL, slices " + blob + " NOT NULL, PRIMARY KEY (inode, indx))",
+		"CREATE TABLE IF NOT EXISTS jfs_chunk_ref (chunkid BIGINT NOT NULL, size BIGINT NOT NULL, refs BIGINT NOT NULL, PRIMARY KEY (chunkid, size))",
+		"CREATE TABLE IF NOT EXISTS jfs_symlink (inode BIGINT NOT NULL PRIMARY KEY, target " + blob + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_xattr (inode BIGINT NOT NULL, name VARCHAR(255) NOT NULL, value " + blob + " NOT NULL, PRIMARY KEY (inode, name))",
+		"CREATE TABLE IF NOT EXISTS jfs_flock (inode BIGINT NOT NULL, sid BIGINT NOT NULL, owner BIGINT NOT NULL, ltype CHAR(1) NOT NULL, PRIMARY KEY (inode, sid, owner))",
+		"CREATE TABLE IF NOT EXISTS jfs_plock (inode BIGINT NOT NULL, sid BIGINT NOT NULL, owner BIGINT NOT NULL, records " + blob + " NOT NULL, PRIMARY KEY (inode, sid, owner))",
+		"CREATE TABLE IF NOT EXISTS jfs_session (sid BIGINT NOT NULL PRIMARY KEY, heartbeat BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_session_info (sid BIGINT NOT NULL PRIMARY KEY, info " + blob + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_sustained (sid BIGINT NOT NULL, inode BIGINT NOT NULL, PRIMARY KEY (sid, inode))",
+		"CREATE TABLE IF NOT EXISTS jfs_delfile (inode BIGINT NOT NULL PRIMARY KEY, length BIGINT NOT NULL, expire BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_dir_quota (inode BIGINT NOT NULL PRIMARY KEY, max_space BIGINT NOT NULL, max_inodes BIGINT NOT NULL, used_space BIGINT NOT NULL, used_inodes BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_dir_stats (inode BIGINT NOT NULL PRIMARY KEY, length BIGINT NOT NULL, space BIGINT NOT NULL, files BIGINT NOT NULL, dirs BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_dir_delta (inode BIGINT NOT NULL PRIMARY KEY, length BIGINT NOT NULL, space BIGINT NOT NULL, files BIGINT NOT NULL, dirs BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_event (id BIGINT NOT NULL PRIMARY KEY, ts BIGINT NOT NULL, data " + blob + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS jfs_parent (inode BIGINT NOT NULL, parent BIGINT NOT NULL, cnt INTEGER NOT NULL, PRIMARY KEY (inode, parent))",
+	}
+	for _, t := range tables {
+		if _, err := m.db.Exec(m.q(t)); err != nil {
+			return fmt.Errorf("create table: %s", err)
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) Init(format Format, force bool) error {
+	if err := m.createTables(); err != nil {
+		return err
+	}
+	old, err := m.Load()
+	if err != nil && err != errNoVolume {
+		return err
+	}
+	if old != nil {
+		if force {
+			old.SecretKey = "removed"
+			logger.Warnf("Existing volume will be overwrited: %+v", *old)
+		} else {
+			// only AccessKey, SecretKey, the limits, TrashDays and EnableACL can be safely updated.
+			format.UUID = old.UUID
+			old.AccessKey = format.AccessKey
+			old.SecretKey = format.SecretKey
+			old.Capacity = format.Capacity
+			old.Inodes = format.Inodes
+			old.TrashDays = format.TrashDays
+			if !old.EnableACL {
+				// ACL can be enabled for an existing volume, but not disabled
+				old.EnableACL = format.EnableACL
+			}
+			if format != *old {
+				old.SecretKey = ""
+				format.SecretKey = ""
+				return fmt.Errorf("cannot update format from %+v to %+v", *old, format)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(format, "", "")
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+	m.setFormat(&format)
+
+	// root inode
+	var attr Attr
+	attr.Typ = TypeDirectory
+	attr.Mode = 0777
+	ts := time.Now().Unix()
+	attr.Atime = ts
+	attr.Mtime = ts
+	attr.Ctime = ts
+	attr.Nlink = 2
+	attr.Length = 4 << 10
+	attr.Parent = 1
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		if err := m.upsert(tx, "UPDATE jfs_setting SET value=? WHERE name=?", "INSERT INTO jfs_setting(value, name) VALUES(?, ?)", string(data), "format"); err != nil {
+			return err
+		}
+		var a Attr
+		err := m.getNode(tx, 1, &a, true)
+		if err == syscall.ENOENT {
+			err = m.insertNode(tx, 1, &attr)
+		} else if err == nil {
+			err = m.updateNode(tx, 1, &attr)
+		}
+		if err == nil && old == nil {
+			err = m.insertDirStat(tx, 1)
+		}
+		if err != nil || format.TrashDays == 0 {
+			return err
+		}
+		if err = m.getNode(tx, TrashInode, &a, true); err == syscall.ENOENT {
+			if err = m.insertNode(tx, TrashInode, specialRootAttr()); err == nil {
+				err = m.insertDirStat(tx, TrashInode)
+			}
+		}
+		return err
+	}))
+}
+
+var errNoVolume = fmt.Errorf("no volume found")
+
+func (m *dbMeta) Reset() error {
+	for _, t := range []string{"setting", "counter", "node", "edge", "chunk", "chunk_ref", "symlink", "xattr",
+		"flock", "plock", "session", "session_info", "sustained", "delfile", "dir_quota", "dir_stats", "dir_delta", "event", "parent"} {
+		if _, err := m.db.Exec(m.q("DROP TABLE IF EXISTS jfs_" + t)); err != nil {
+			return fmt.Errorf("drop table: %s", err)
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) Load() (*Format, error) {
+	var body string
+	err := m.db.QueryRow(m.q("SELECT value FROM jfs_setting WHERE name=?"), "format").Scan(&body)
+	if err == sql.ErrNoRows || err != nil && isMissingTable(err) {
+		return nil, errNoVolume
+	}
+	if err != nil {
+		return nil, err
+	}
+	var format Format
+	err = json.Unmarshal([]byte(body), &format)
+	if err != nil {
+		return nil, fmt.Errorf("json: %s", err)
+	}
+	m.setFormat(&format)
+	return &format, nil
+}
+
+func (m *dbMeta) NewSession() error {
+	m.loadQuotas()
+	go m.flushQuotas()
+	go m.refreshFormat()
+	if m.conf.ReadOnly {
+		return nil
+	}
+	if err := m.createTables(); err != nil {
+		return err
+	}
+	sid, err := m.incrCounter("nextsession", 1)
+	if err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+	m.sid = sid
+	_, err = m.db.Exec(m.q("INSERT INTO jfs_session(sid, heartbeat) VALUES(?, ?)"), m.sid, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("insert session: %s", err)
+	}
+	_, err = m.db.Exec(m.q("INSERT INTO jfs_session_info(sid, info) VALUES(?, ?)"), m.sid, m.newSessionInfo())
+	if err != nil {
+		return fmt.Errorf("insert session info: %s", err)
+	}
+	logger.Debugf("session is %d", m.sid)
+
+	go m.refreshSession()
+	go m.cleanupDeletedFiles()
+	go m.cleanupSlices()
+	go m.cleanupLeakedChunks()
+	go m.cleanupTrash()
+	go m.cleanupEvents()
+	go m.flushDirStats()
+	go m.flushAtimes()
+	return nil
+}
+
+func (m *dbMeta) shouldRetry(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(syscall.Errno); ok {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"database is locked", "database table is locked", "deadlock", "try restarting transaction",
+		"could not serialize", "duplicate entry", "duplicate key", "unique constraint"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *dbMeta) txn(f func(tx *sql.Tx) error, inodes ...Ino) syscall.Errno {
+	if len(inodes) > 0 {
+		l := &m.txlocks[uint64(inodes[0])%uint64(len(m.txlocks))]
+		l.Lock()
+		defer l.Unlock()
+	}
+	var err error
+	for i := 0; i < 50; i++ {
+		var tx *sql.Tx
+		tx, err = m.db.Begin()
+		if err == nil {
+			err = f(tx)
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				_ = tx.Rollback()
+			}
+		}
+		if m.shouldRetry(err) {
+			logger.Debugf("conflicted transaction, restart it (tried %d): %s", i+1, err)
+			time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
+			continue
+		}
+		break
+	}
+	return errno(err)
+}
+
+func errnoErr(eno syscall.Errno) error {
+	if eno == 0 {
+		return nil
+	}
+	return eno
+}
+
+// upsert runs the update statement, and the insert one if no row is updated.
+// Both statements take the same arguments in the same order.
+func (m *dbMeta) upsert(q querier, update, insert string, args ...interface{}) error {
+	r, err := q.Exec(m.q(update), args...)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = q.Exec(m.q(insert), args...)
+	return err
+}
+
+func (m *dbMeta) updateCounter(q querier, name string, delta int64) error {
+	return m.upsert(q, "UPDATE jfs_counter SET value=value+? WHERE name=?", "INSERT INTO jfs_counter(value, name) VALUES(?, ?)", delta, name)
+}
+
+// updateParent adds delta to the number of entries of a file with hardlinks in the parent.
+func (m *dbMeta) updateParent(q querier, inode, parent Ino, delta int) error {
+	return m.upsert(q, "UPDATE jfs_parent SET cnt=cnt+? WHERE inode=? AND parent=?", "INSERT INTO jfs_parent(cnt, inode, parent) VALUES(?, ?, ?)", delta, uint64(inode), uint64(parent))
+}
+
+func (m *dbMeta) incrCounter(name string, delta int64) (int64, error) {
+	var v int64
+	err := m.txn(func(tx *sql.Tx) error {
+		if err := m.updateCounter(tx, name, delta); err != nil {
+			return err
+		}
+		return tx.QueryRow(m.q("SELECT value FROM jfs_counter WHERE name=?"), name).Scan(&v)
+	})
+	return v, errnoErr(err)
+}
+
+func (m *dbMeta) getCounter(name string) (int64, error) {
+	var v int64
+	err := m.db.QueryRow(m.q("SELECT value FROM jfs_counter WHERE name=?"), name).Scan(&v)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return v, err
+}
+
+// counterOf returns a function to read counters within the transaction, the rows are locked
+// until the transaction is finished.
+func (m *dbMeta) counterOf(tx *sql.Tx) func(name string) (int64, error) {
+	return func(name string) (int64, error) {
+		var v int64
+		err := tx.QueryRow(m.q("SELECT value FROM jfs_counter WHERE name=?"+m.forUpdate(true)), name).Scan(&v)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return v, err
+	}
+}
+
+const nodeColumns = "type, flags, mode, uid, gid, atime, mtime, ctime, nlink, length, rdev, parent"
+
+func toNano(sec int64, nsec uint32) int64 {
+	return sec*1e9 + int64(nsec)
+}
+
+func (m *dbMeta) parseNode(row scanner, attr *Attr) error {
+	var atime, mtime, ctime int64
+	err := row.Scan(&attr.Typ, &attr.Flags, &attr.Mode, &attr.Uid, &attr.Gid, &atime, &mtime, &ctime, &attr.Nlink, &attr.Length, &attr.Rdev, &attr.Parent)
+	if err != nil {
+		return err
+	}
+	attr.Atime, attr.Atimensec = atime/1e9, uint32(atime%1e9)
+	attr.Mtime, attr.Mtimensec = mtime/1e9, uint32(mtime%1e9)
+	attr.Ctime, attr.Ctimensec = ctime/1e9, uint32(ctime%1e9)
+	attr.Full = true
+	return nil
+}
+
+func (m *dbMeta) nodeArgs(attr *Attr) []interface{} {
+	return []interface{}{attr.Typ, attr.Flags, attr.Mode, attr.Uid, attr.Gid, toNano(attr.Atime, attr.Atimensec),
+		toNano(attr.Mtime, attr.Mtimensec), toNano(attr.Ctime, attr.Ctimensec), attr.Nlink, attr.Length, attr.Rdev, uint64(attr.Parent)}
+}
+
+func (m *dbMeta) getNode(q querier, inode Ino, attr *Attr, lock bool) error {
+	err := m.parseNode(q.QueryRow(m.q("SELECT "+nodeColumns+" FROM jfs_node WHERE inode=?"+m.forUpdate(lock)), uint64(inode)), attr)
+	if err == sql.ErrNoRows {
+		return syscall.ENOENT
+	}
+	return err
+}
+
+func (m *dbMeta) insertNode(q querier, inode Ino, attr *Attr) error {
+	args := append([]interface{}{uint64(inode)}, m.nodeArgs(attr)...)
+	_, err := q.Exec(m.q("INSERT INTO jfs_node(inode, "+nodeColumns+") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"), args...)
+	return err
+}
+
+func (m *dbMeta) updateNode(q querier, inode Ino, attr *Attr) error {
+	args := append(m.nodeArgs(attr), uint64(inode))
+	_, err := q.Exec(m.q("UPDATE jfs_node SET type=?, flags=?, mode=?, uid=?, gid=?, atime=?, mtime=?, ctime=?, nlink=?, length=?, rdev=?, parent=? WHERE inode=?"), args...)
+	return err
+}
+
+func (m *dbMeta) deleteNode(q querier, inode Ino) error {
+	_, err := q.Exec(m.q("DELETE FROM jfs_node WHERE inode=?"), uint64(inode))
+	return err
+}
+
+func (m *dbMeta) getEntry(q querier, parent Ino, name string, lock bool) (uint8, Ino, error) {
+	var typ uint8
+	var inode Ino
+	err := q.QueryRow(m.q("SELECT type, inode FROM jfs_edge WHERE parent=? AND name=?"+m.forUpdate(lock)), uint64(parent), []byte(name)).Scan(&typ, &inode)
+	if err == sql.ErrNoRows {
+		err = syscall.ENOENT
+	}
+	return typ, inode, err
+}
+
+func (m *dbMeta) hasChildren(q querier, inode Ino) (bool, error) {
+	var n int
+	err := q.QueryRow(m.q("SELECT COUNT(*) FROM jfs_edge WHERE parent=?"), uint64(inode)).Scan(&n)
+	return n > 0, err
+}
+
+func (m *dbMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	_, ino, err := m.getEntry(m.db, parent, name, false)
+	if err == nil && attr != nil {
+		err = m.getNode(m.db, ino, attr, false)
+	}
+	if err == nil && inode != nil {
+		*inode = ino
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	return errno(m.getNode(m.db, inode, attr, false))
+}
+
+func (m *dbMeta) doReadlink(ctx Context, inode Ino) ([]byte, error) {
+	var target []byte
+	err := m.db.QueryRow(m.q("SELECT target FROM jfs_symlink WHERE inode=?"), uint64(inode)).Scan(&target)
+	if err == sql.ErrNoRows {
+		err = syscall.ENOENT
+	}
+	return target, err
+}
+
+// appendSlice adds a slice into the chunk and returns the number of slices in it.
+func (m *dbMeta) appendSlice(q querier, inode Ino, indx uint32, buf []byte) (int, error) {
+	var slices []byte
+	err := q.QueryRow(m.q("SELECT slices FROM jfs_chunk WHERE inode=? AND indx=?"+m.forUpdate(true)), uint64(inode), indx).Scan(&slices)
+	if err == sql.ErrNoRows {
+		_, err = q.Exec(m.q("INSERT INTO jfs_chunk(inode, indx, slices) VALUES(?, ?, ?)"), uint64(inode), indx, buf)
+		return 1, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	slices = append(slices, buf...)
+	_, err = q.Exec(m.q("UPDATE jfs_chunk SET slices=? WHERE inode=? AND indx=?"), slices, uint64(inode), indx)
+	return len(slices) / sliceBytes, err
+}
+
+func (m *dbMeta) updateRef(q querier, chunkid uint64, size uint32, delta int64) (int64, error) {
+	err := m.upsert(q, "UPDATE jfs_chunk_ref SET refs=refs+? WHERE chunkid=? AND size=?",
+		"INSERT INTO jfs_chunk_ref(refs, chunkid, size) VALUES(?, ?, ?)", delta, chunkid, size)
+	if err != nil {
+		return 0, err
+	}
+	var refs int64
+	err = q.QueryRow(m.q("SELECT refs FROM jfs_chunk_ref WHERE chunkid=? AND size=?"), chunkid, size).Scan(&refs)
+	return refs, err
+}
+
+func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, inode)
+	var delta int64
+	st := m.txn(func(tx *sql.Tx) error {
+		var t Attr
+		if err := m.getNode(tx, inode, &t, true); err != nil {
+			return err
+		}
+		if t.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if t.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		old := t.Length
+		var zeroChunks []uint32
+		if length > old {
+			rows, err := tx.Query(m.q("SELECT indx FROM jfs_chunk WHERE inode=? AND indx>? AND indx<?"), uint64(inode), old/ChunkSize, length/ChunkSize)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var indx uint32
+				if err = rows.Scan(&indx); err != nil {
+					_ = rows.Close()
+					return err
+				}
+				zeroChunks = append(zeroChunks, indx)
+			}
+			_ = rows.Close()
+		}
+		if err := m.checkQuota(align4K(length)-align4K(old), 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, align4K(length)-align4K(old), 0); err != nil {
+			return err
+		}
+		delta = align4K(length) - align4K(old)
+		if err := m.updateFileStats(tx, inode, t.Parent, int64(length)-int64(old), delta); err != nil {
+			return err
+		}
+		t.Length = length
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		if err := m.updateNode(tx, inode, &t); err != nil {
+			return err
+		}
+		if length > old {
+			// zero out from old to length
+			var l = uint32(length - old)
+			if length > (old/ChunkSize+1)*ChunkSize {
+				l = ChunkSize - uint32(old%ChunkSize)
+			}
+			if _, err := m.appendSlice(tx, inode, uint32(old/ChunkSize), marshalSlice(uint32(old%ChunkSize), 0, 0, 0, l)); err != nil {
+				return err
+			}
+			buf := marshalSlice(0, 0, 0, 0, ChunkSize)
+			for _, indx := range zeroChunks {
+				if _, err := m.appendSlice(tx, inode, indx, buf); err != nil {
+					return err
+				}
+			}
+			if length > (old/ChunkSize+1)*ChunkSize && length%ChunkSize > 0 {
+				if _, err := m.appendSlice(tx, inode, uint32(length/ChunkSize), marshalSlice(0, 0, 0, 0, uint32(length%ChunkSize))); err != nil {
+					return err
+				}
+			}
+		}
+		if err := m.updateCounter(tx, usedSpace, align4K(length)-align4K(old)); err != nil {
+			return err
+		}
+		if attr != nil {
+			*attr = t
+		}
+		return nil
+	}, inode)
+	if st == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+	}
+	return st
+}
+
+func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, inode)
+	var delta int64
+	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
+		return syscall.EINVAL
+	}
+	if mode&fallocInsertRange != 0 && mode != fallocInsertRange {
+		return syscall.EINVAL
+	}
+	if mode == fallocInsertRange || mode == fallocCollapesRange {
+		return syscall.ENOTSUP
+	}
+	if mode&fallocPunchHole != 0 && mode&fallocKeepSize == 0 {
+		return syscall.EINVAL
+	}
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	st := m.txn(func(tx *sql.Tx) error {
+		var t Attr
+		if err := m.getNode(tx, inode, &t, true); err != nil {
+			return err
+		}
+		if t.Typ == TypeFIFO {
+			return syscall.EPIPE
+		}
+		if t.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if t.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		length := t.Length
+		if off+size > t.Length {
+			if mode&fallocKeepSize == 0 {
+				length = off + size
+			}
+		}
+
+		old := t.Length
+		if err := m.checkQuota(align4K(length)-align4K(old), 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, align4K(length)-align4K(old), 0); err != nil {
+			return err
+		}
+		delta = align4K(length) - align4K(old)
+		if err := m.updateFileStats(tx, inode, t.Parent, int64(length)-int64(old), delta); err != nil {
+			return err
+		}
+		t.Length = length
+		now := time.Now()
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		if err := m.updateNode(tx, inode, &t); err != nil {
+			return err
+		}
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			if off+size > old {
+				size = old - off
+			}
+			for size > 0 {
+				indx := uint32(off / ChunkSize)
+				coff := off % ChunkSize
+				l := size
+				if coff+size > ChunkSize {
+					l = ChunkSize - coff
+				}
+				if _, err := m.appendSlice(tx, inode, indx, marshalSlice(uint32(coff), 0, 0, 0, uint32(l))); err != nil {
+					return err
+				}
+				off += l
+				size -= l
+			}
+		}
+		return m.updateCounter(tx, usedSpace, align4K(length)-align4K(old))
+	}, inode)
+	if st == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+	}
+	return st
+}
+
+func (m *dbMeta) doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		var cur Attr
+		if err := m.getNode(tx, inode, &cur, true); err != nil {
+			return err
+		}
+		if cur.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if cur.Flags&(FlagImmutable|FlagAppend) != 0 && set&^SetAttrFlag != 0 {
+			return syscall.EPERM
+		}
+		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
+			attr.Mode |= (cur.Mode & 06000)
+		}
+		if (cur.Mode&06000) != 0 && (set&(SetAttrUID|SetAttrGID)) != 0 {
+			cur.Mode &= 01777
+			attr.Mode &= 01777
+		}
+		if set&SetAttrUID != 0 {
+			cur.Uid = attr.Uid
+		}
+		if set&SetAttrGID != 0 {
+			cur.Gid = attr.Gid
+		}
+		if set&SetAttrMode != 0 {
+			if ctx.Uid() != 0 && (attr.Mode&02000) != 0 {
+				if ctx.Gid() != cur.Gid {
+					attr.Mode &= 05777
+				}
+			}
+			cur.Mode = attr.Mode
+		}
+		if set&SetAttrFlag != 0 {
+			cur.Flags = attr.Flags
+		}
+		now := time.Now()
+		if set&SetAttrAtime != 0 {
+			cur.Atime = attr.Atime
+			cur.Atimensec = attr.Atimensec
+		}
+		if set&SetAttrAtimeNow != 0 {
+			cur.Atime = now.Unix()
+			cur.Atimensec = uint32(now.Nanosecond())
+		}
+		if set&SetAttrMtime != 0 {
+			cur.Mtime = attr.Mtime
+			cur.Mtimensec = attr.Mtimensec
+		}
+		if set&SetAttrMtimeNow != 0 {
+			cur.Mtime = now.Unix()
+			cur.Mtimensec = uint32(now.Nanosecond())
+		}
+		cur.Ctime = now.Unix()
+		cur.Ctimensec = uint32(now.Nanosecond())
+		if err := m.updateNode(tx, inode, &cur); err != nil {
+			return err
+		}
+		*attr = cur
+		return nil
+	}), inode)
+}
+
+func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	ino, err := m.nextInode()
+	if err != nil {
+		return errno(err)
+	}
+	if attr == nil {
+		attr = &Attr{}
+	}
+	attr.Flags = 0
+	attr.Typ = _type
+	attr.Mode = mode & ^cumask
+	attr.Uid = ctx.Uid()
+	attr.Gid = ctx.Gid()
+	if _type == TypeDirectory {
+		attr.Nlink = 2
+		attr.Length = 4 << 10
+	} else {
+		attr.Nlink = 1
+		if _type == TypeSymlink {
+			attr.Length = uint64(len(path))
+		} else {
+			attr.Length = 0
+			attr.Rdev = rdev
+		}
+	}
+	attr.Parent = parent
+	attr.Full = true
+	if inode != nil {
+		*inode = ino
+	}
+
+	return m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		var pattr Attr
+		if err := m.getNode(tx, parent, &pattr, true); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if pattr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		_, _, err := m.getEntry(tx, parent, name, true)
+		if err == nil {
+			return syscall.EEXIST
+		} else if err != syscall.ENOENT {
+			return err
+		}
+
+		if err := m.checkQuota(0, 1, m.counterOf(tx)); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if _type == TypeDirectory {
+			pattr.Nlink++
+		}
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		if ctx.Value(CtxKey("behavior")) == "Hadoop" {
+			attr.Gid = pattr.Gid
+		}
+
+		if _, err = tx.Exec(m.q("INSERT INTO jfs_edge(parent, name, inode, type) VALUES(?, ?, ?, ?)"), uint64(parent), []byte(name), uint64(ino), _type); err != nil {
+			return err
+		}
+		if err = m.updateNode(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if err = m.insertNode(tx, ino, attr); err != nil {
+			return err
+		}
+		if _type == TypeSymlink {
+			if _, err = tx.Exec(m.q("INSERT INTO jfs_symlink(inode, target) VALUES(?, ?)"), uint64(ino), []byte(path)); err != nil {
+				return err
+			}
+		} else if _type == TypeDirectory {
+			if err = m.insertDirStat(tx, ino); err != nil {
+				return err
+			}
+		}
+		if err = m.updateDirStat(tx, parent, entryStat(_type, attr.Length, nil)); err != nil {
+			return err
+		}
+		return m.updateCounter(tx, totalInodes, 1)
+	}), parent)
+}
+
+// removeInode drops a file that has no more links, it's kept until closed if it's still opened.
+func (m *dbMeta) removeInode(q querier, inode Ino, attr *Attr, opened bool) error {
+	var err error
+	switch attr.Typ {
+	case TypeFile:
+		if opened {
+			if err = m.updateNode(q, inode, attr); err == nil {
+				_, err = q.Exec(m.q("INSERT INTO jfs_sustained(sid, inode) VALUES(?, ?)"), m.sid, uint64(inode))
+			}
+		} else {
+			if _, err = q.Exec(m.q("INSERT INTO jfs_delfile(inode, length, expire) VALUES(?, ?, ?)"), uint64(inode), attr.Length, time.Now().Unix()); err == nil {
+				if err = m.deleteNode(q, inode); err == nil {
+					err = m.updateCounter(q, usedSpace, -align4K(attr.Length))
+				}
+			}
+		}
+	case TypeSymlink:
+		if _, err = q.Exec(m.q("DELETE FROM jfs_symlink WHERE inode=?"), uint64(inode)); err == nil {
+			err = m.deleteNode(q, inode)
+		}
+	case TypeDirectory:
+		if err = m.deleteNode(q, inode); err == nil {
+			err = m.delDirStat(q, inode)
+		}
+	default:
+		err = m.deleteNode(q, inode)
+	}
+	if err == nil {
+		_, err = q.Exec(m.q("DELETE FROM jfs_xattr WHERE inode=?"), uint64(inode))
+	}
+	if err == nil && attr.Parent == 0 {
+		_, err = q.Exec(m.q("DELETE FROM jfs_parent WHERE inode=?"), uint64(inode))
+	}
+	if err == nil {
+		err = m.updateCounter(q, totalInodes, -1)
+	}
+	return err
+}
+
+func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
+	var _type uint8
+	var inode Ino
+	var attr Attr
+	var opened bool
+	err := m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		var pattr Attr
+		if err := m.getNode(tx, parent, &pattr, true); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		var err error
+		_type, inode, err = m.getEntry(tx, parent, name, true)
+		if err != nil {
+			return err
+		}
+		if _type == TypeDirectory {
+			return syscall.EPERM
+		}
+		if err = m.getNode(tx, inode, &attr, true); err != nil {
+			return err
+		}
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Nlink--
+		opened = false
+		if _type == TypeFile && attr.Nlink == 0 {
+			m.Lock()
+			opened = m.isOpen(inode)
+			m.Unlock()
+		}
+
+		if _, err = tx.Exec(m.q("DELETE FROM jfs_edge WHERE parent=? AND name=?"), uint64(parent), []byte(name)); err != nil {
+			return err
+		}
+		if err = m.updateNode(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if err = m.updateDirStat(tx, parent, entryStat(_type, attr.Length, nil).neg()); err != nil {
+			return err
+		}
+		if attr.Nlink > 0 {
+			if attr.Parent == 0 {
+				if err = m.updateParent(tx, inode, parent, -1); err != nil {
+					return err
+				}
+			}
+			return m.updateNode(tx, inode, &attr)
+		}
+		return m.removeInode(tx, inode, &attr, opened)
+	}), parent)
+	if err == 0 && _type == TypeFile && attr.Nlink == 0 {
+		if opened {
+			m.Lock()
+			m.removedFiles[inode] = true
+			m.Unlock()
+		} else {
+			go m.deleteFile(inode, attr.Length)
+		}
+	}
+	return err
+}
+
+func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		var pattr Attr
+		if err := m.getNode(tx, parent, &pattr, true); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		typ, inode, err := m.getEntry(tx, parent, name, true)
+		if err != nil {
+			return err
+		}
+		if typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if has, err := m.hasChildren(tx, inode); err != nil {
+			return err
+		} else if has {
+			return syscall.ENOTEMPTY
+		}
+		sub, err := m.getDirStat(tx, inode, true)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		pattr.Nlink--
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+
+		if _, err = tx.Exec(m.q("DELETE FROM jfs_edge WHERE parent=? AND name=?"), uint64(parent), []byte(name)); err != nil {
+			return err
+		}
+		if err = m.updateNode(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if err = m.updateDirStat(tx, parent, entryStat(TypeDirectory, 0, sub).neg()); err != nil {
+			return err
+		}
+		var attr = Attr{Typ: TypeDirectory}
+		return m.removeInode(tx, inode, &attr, false)
+	}), parent)
+}
+
+func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno {
+	var dino Ino
+	var dtyp uint8
+	var tattr Attr
+	var opened bool
+	err := m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		var sattr, iattr Attr
+		var sub, tsub *dirStat
+		if err := m.getNode(tx, parentSrc, &sattr, true); err != nil {
+			return err
+		}
+		if sattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		typ, ino, err := m.getEntry(tx, parentSrc, nameSrc, true)
+		if err != nil {
+			return err
+		}
+		if inode != nil {
+			*inode = ino
+		}
+		if parentSrc == parentDst && nameSrc == nameDst {
+			return nil
+		}
+		var dattr = &sattr
+		if parentDst != parentSrc {
+			dattr = &Attr{}
+			if err = m.getNode(tx, parentDst, dattr, true); err != nil {
+				return err
+			}
+			if dattr.Typ != TypeDirectory {
+				return syscall.ENOTDIR
+			}
+			// a directory is moved into the trash only when it's removed
+			if typ == TypeDirectory && dattr.Parent == TrashInode {
+				if has, err := m.hasChildren(tx, ino); err != nil {
+					return err
+				} else if has {
+					return syscall.ENOTEMPTY
+				}
+			}
+		}
+		now := time.Now()
+		dtyp, dino, err = m.getEntry(tx, parentDst, nameDst, true)
+		if err == syscall.ENOENT {
+			dino = 0
+		} else if err != nil {
+			return err
+		} else {
+			if ctx.Value(CtxKey("behavior")) == "Hadoop" {
+				return syscall.EEXIST
+			}
+			if err = m.getNode(tx, dino, &tattr, true); err != nil {
+				return err
+			}
+			if dtyp == TypeDirectory {
+				if has, err := m.hasChildren(tx, dino); err != nil {
+					return err
+				} else if has {
+					return syscall.ENOTEMPTY
+				}
+				if tsub, err = m.getDirStat(tx, dino, true); err != nil {
+					return err
+				}
+			} else {
+				tattr.Nlink--
+				if tattr.Nlink > 0 {
+					tattr.Ctime = now.Unix()
+					tattr.Ctimensec = uint32(now.Nanosecond())
+				} else if dtyp == TypeFile {
+					m.Lock()
+					opened = m.isOpen(dino)
+					m.Unlock()
+				}
+			}
+		}
+
+		if err = m.getNode(tx, ino, &iattr, true); err != nil {
+			return err
+		}
+		sattr.Mtime = now.Unix()
+		sattr.Mtimensec = uint32(now.Nanosecond())
+		sattr.Ctime = now.Unix()
+		sattr.Ctimensec = uint32(now.Nanosecond())
+		dattr.Mtime = now.Unix()
+		dattr.Mtimensec = uint32(now.Nanosecond())
+		dattr.Ctime = now.Unix()
+		dattr.Ctimensec = uint32(now.Nanosecond())
+		// the parents of a file with hardlinks are counted separately
+		if iattr.Parent > 0 {
+			iattr.Parent = parentDst
+		} else if parentSrc != parentDst {
+			if err = m.updateParent(tx, ino, parentSrc, -1); err != nil {
+				return err
+			}
+			if err = m.updateParent(tx, ino, parentDst, 1); err != nil {
+				return err
+			}
+		}
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		if typ == TypeDirectory && parentSrc != parentDst {
+			sattr.Nlink--
+			dattr.Nlink++
+			if sub, err = m.getDirStat(tx, ino, true); err != nil {
+				return err
+			}
+		}
+		if attr != nil {
+			*attr = iattr
+		}
+
+		if _, err = tx.Exec(m.q("DELETE FROM jfs_edge WHERE parent=? AND name=?"), uint64(parentSrc), []byte(nameSrc)); err != nil {
+			return err
+		}
+		if parentSrc != parentDst {
+			moved := entryStat(typ, iattr.Length, sub)
+			if err = m.updateDirStat(tx, parentSrc, moved.neg()); err != nil {
+				return err
+			}
+			if err = m.updateDirStat(tx, parentDst, moved); err != nil {
+				return err
+			}
+		}
+		if dino > 0 {
+			if _, err = tx.Exec(m.q("DELETE FROM jfs_edge WHERE parent=? AND name=?"), uint64(parentDst), []byte(nameDst)); err != nil {
+				return err
+			}
+			if err = m.updateDirStat(tx, parentDst, entryStat(dtyp, tattr.Length, tsub).neg()); err != nil {
+				return err
+			}
+			if dtyp != TypeDirectory && tattr.Nlink > 0 {
+				if err = m.updateNode(tx, dino, &tattr); err == nil && tattr.Parent == 0 {
+					err = m.updateParent(tx, dino, parentDst, -1)
+				}
+			} else {
+				if dtyp == TypeDirectory {
+					dattr.Nlink--
+				}
+				err = m.removeInode(tx, dino, &tattr, opened)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = tx.Exec(m.q("INSERT INTO jfs_edge(parent, name, inode, type) VALUES(?, ?, ?, ?)"), uint64(parentDst), []byte(nameDst), uint64(ino), typ); err != nil {
+			return err
+		}
+		if err = m.updateNode(tx, parentSrc, &sattr); err != nil {
+			return err
+		}
+		if parentDst != parentSrc {
+			if err = m.updateNode(tx, parentDst, dattr); err != nil {
+				return err
+			}
+		}
+		return m.updateNode(tx, ino, &iattr)
+	}), parentSrc)
+	if err == 0 && dino > 0 && dtyp == TypeFile && tattr.Nlink == 0 {
+		if opened {
+			m.Lock()
+			m.removedFiles[dino] = true
+			m.Unlock()
+		} else {
+			go m.deleteFile(dino, tattr.Length)
+		}
+	}
+	return err
+}
+
+func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		var pattr, iattr Attr
+		if err := m.getNode(tx, parent, &pattr, true); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if err := m.getNode(tx, inode, &iattr, true); err != nil {
+			return err
+		}
+		if iattr.Typ == TypeDirectory {
+			return syscall.EPERM
+		}
+		_, _, err := m.getEntry(tx, parent, name, true)
+		if err == nil {
+			return syscall.EEXIST
+		} else if err != syscall.ENOENT {
+			return err
+		}
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Nlink++
+		// the parents are counted separately once a file has more than one link
+		if iattr.Parent > 0 {
+			if err = m.updateParent(tx, inode, iattr.Parent, 1); err != nil {
+				return err
+			}
+			iattr.Parent = 0
+		}
+		if err = m.updateParent(tx, inode, parent, 1); err != nil {
+			return err
+		}
+		if err = m.updateDirStat(tx, parent, entryStat(iattr.Typ, iattr.Length, nil)); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(m.q("INSERT INTO jfs_edge(parent, name, inode, type) VALUES(?, ?, ?, ?)"), uint64(parent), []byte(name), uint64(inode), iattr.Typ); err != nil {
+			return err
+		}
+		if err = m.updateNode(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if err = m.updateNode(tx, inode, &iattr); err != nil {
+			return err
+		}
+		if attr != nil {
+			*attr = iattr
+		}
+		return nil
+	}), parent)
+}
+
+func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
+	_, err := m.queryEntries(plus, "e.parent=?", entries, uint64(inode))
+	return errno(err)
+}
+
+func (m *dbMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno {
+	// the names are compared as bytes (stored as blob), the cursor is the last name in the previous page
+	n, err := m.queryEntries(plus, "e.parent=? AND e.name>? ORDER BY e.name LIMIT ?", entries, uint64(inode), []byte(*cursor), limit)
+	if err != nil {
+		return errno(err)
+	}
+	if n < limit {
+		*cursor = ""
+	} else {
+		*cursor = string((*entries)[len(*entries)-1].Name)
+	}
+	return 0
+}
+
+// queryEntries appends the entries matching cond, which is on the edges as e, and returns the number of them.
+func (m *dbMeta) queryEntries(plus uint8, cond string, entries *[]*Entry, args ...interface{}) (int, error) {
+	var rows *sql.Rows
+	var err error
+	if plus != 0 {
+		rows, err = m.db.Query(m.q("SELECT e.name, e.inode, n.type, n.flags, n.mode, n.uid, n.gid, n.atime, n.mtime, n.ctime, n.nlink, n.length, n.rdev, n.parent "+
+			"FROM jfs_edge e INNER JOIN jfs_node n ON e.inode=n.inode WHERE "+cond), args...)
+	} else {
+		rows, err = m.db.Query(m.q("SELECT e.name, e.inode, e.type FROM jfs_edge e WHERE "+cond), args...)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n int
+	for rows.Next() {
+		e := &Entry{Attr: &Attr{}}
+		if plus != 0 {
+			err = m.parseNode(prefixScanner{rows, []interface{}{&e.Name, &e.Inode}}, e.Attr)
+		} else {
+			err = rows.Scan(&e.Name, &e.Inode, &e.Attr.Typ)
+		}
+		if err != nil {
+			return n, err
+		}
+		*entries = append(*entries, e)
+		n++
+	}
+	return n, rows.Err()
+}
+
+// prefixScanner scans some leading columns before the ones asked by the caller.
+type prefixScanner struct {
+	s      scanner
+	prefix []interface{}
+}
+
+func (p prefixScanner) Scan(dest ...interface{}) error {
+	return p.s.Scan(append(p.prefix, dest...)...)
+}
+
+func (m *dbMeta) doDeleteSustainedInode(sid int64, inode Ino) error {
+	err := m.deleteInode(inode)
+	if err == nil {
+		_, err = m.db.Exec(m.q("DELETE FROM jfs_sustained WHERE sid=? AND inode=?"), sid, uint64(inode))
+	}
+	return err
+}
+
+func (m *dbMeta) deleteInode(inode Ino) error {
+	var attr Attr
+	eno := m.txn(func(tx *sql.Tx) error {
+		if err := m.getNode(tx, inode, &attr, true); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.q("INSERT INTO jfs_delfile(inode, length, expire) VALUES(?, ?, ?)"), uint64(inode), attr.Length, time.Now().Unix()); err != nil {
+			return err
+		}
+		if err := m.deleteNode(tx, inode); err != nil {
+			return err
+		}
+		return m.updateCounter(tx, usedSpace, -align4K(attr.Length))
+	}, inode)
+	if eno == syscall.ENOENT {
+		return nil
+	}
+	if eno == 0 {
+		go m.deleteFile(inode, attr.Length)
+	}
+	return errnoErr(eno)
+}
+
+func (m *dbMeta) cleanStaleSession(sid int64) error {
+	rows, err := m.db.Query(m.q("SELECT inode FROM jfs_sustained WHERE sid=?"), sid)
+	if err != nil {
+		return err
+	}
+	var inodes []Ino
+	for rows.Next() {
+		var inode Ino
+		if rows.Scan(&inode) == nil {
+			inodes = append(inodes, inode)
+		}
+	}
+	_ = rows.Close()
+	for _, inode := range inodes {
+		if err = m.doDeleteSustainedInode(sid, inode); err != nil {
+			logger.Errorf("Failed to delete inode %d: %s", inode, err)
+			return err
+		}
+	}
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		for _, table := range []string{"jfs_session", "jfs_session_info"} {
+			if _, err := tx.Exec(m.q("DELETE FROM "+table+" WHERE sid=?"), sid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// cleanLocks removes all the flocks and plocks owned by the session.
+func (m *dbMeta) cleanLocks(sid int64) error {
+	for _, table := range []string{"jfs_flock", "jfs_plock"} {
+		if _, err := m.db.Exec(m.q("DELETE FROM "+table+" WHERE sid=?"), sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) cleanStaleSessions() {
+	now := time.Now()
+	rows, err := m.db.Query(m.q("SELECT sid FROM jfs_session WHERE heartbeat<?"), now.Add(-staleAfter).Unix())
+	if err != nil {
+		return
+	}
+	var sids []int64
+	for rows.Next() {
+		var sid int64
+		if rows.Scan(&sid) == nil {
+			sids = append(sids, sid)
+		}
+	}
+	_ = rows.Close()
+	for _, sid := range sids {
+		if err = m.cleanLocks(sid); err != nil {
+			logger.Warnf("cleanup locks from session %d: %s", sid, err)
+		}
+		if err = m.cleanStaleSession(sid); err != nil {
+			logger.Warnf("clean stale session %d: %s", sid, err)
+		}
+	}
+}
+
+// queryRows runs a query and calls fn for every row.
+func (m *dbMeta) queryRows(query string, fn func(rows *sql.Rows) error) error {
+	rows, err := m.db.Query(m.q(query))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (m *dbMeta) ListSessions() ([]*Session, error) {
+	var sessions []*Session
+	sessionOf := make(map[uint64]*Session)
+	err := m.queryRows("SELECT s.sid, s.heartbeat, i.info FROM jfs_session s LEFT JOIN jfs_session_info i ON s.sid=i.sid", func(rows *sql.Rows) error {
+		var sid uint64
+		var heartbeat int64
+		var info []byte
+		if err := rows.Scan(&sid, &heartbeat, &info); err != nil {
+			return err
+		}
+		s := newSession(sid, heartbeat, info)
+		sessions = append(sessions, s)
+		sessionOf[sid] = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = m.queryRows("SELECT sid, inode FROM jfs_sustained", func(rows *sql.Rows) error {
+		var sid, inode uint64
+		if err := rows.Scan(&sid, &inode); err != nil {
+			return err
+		}
+		if s := sessionOf[sid]; s != nil {
+			s.Sustained = append(s.Sustained, Ino(inode))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = m.queryRows("SELECT sid, inode, owner, ltype FROM jfs_flock", func(rows *sql.Rows) error {
+		var sid, inode, owner uint64
+		var ltype string
+		if err := rows.Scan(&sid, &inode, &owner, &ltype); err != nil {
+			return err
+		}
+		if s := sessionOf[sid]; s != nil {
+			s.Flocks = append(s.Flocks, Flock{Ino(inode), owner, ltype})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = m.queryRows("SELECT sid, inode, owner, records FROM jfs_plock", func(rows *sql.Rows) error {
+		var sid, inode, owner uint64
+		var records []byte
+		if err := rows.Scan(&sid, &inode, &owner, &records); err != nil {
+			return err
+		}
+		if s := sessionOf[sid]; s != nil {
+			s.Plocks = append(s.Plocks, Plock{Ino(inode), owner, parsePlockRecords(records)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (m *dbMeta) CleanSession(sid uint64) error {
+	if err := m.cleanLocks(int64(sid)); err != nil {
+		return err
+	}
+	return m.cleanStaleSession(int64(sid))
+}
+
+func (m *dbMeta) refreshSession() {
+	for {
+		time.Sleep(time.Minute)
+		_, err := m.db.Exec(m.q("UPDATE jfs_session SET heartbeat=? WHERE sid=?"), time.Now().Unix(), m.sid)
+		if err != nil {
+			logger.Warnf("refresh session %d: %s", m.sid, err)
+		}
+		go m.cleanStaleSessions()
+	}
+}
+
+func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
+	var buf []byte
+	err := m.db.QueryRow(m.q("SELECT slices FROM jfs_chunk WHERE inode=? AND indx=?"), uint64(inode), indx).Scan(&buf)
+	if err == sql.ErrNoRows {
+		*chunks = nil
+		return 0
+	}
+	if err != nil {
+		return errno(err)
+	}
+	ss := readSliceBuf(buf)
+	*chunks = buildSlice(ss)
+	if len(ss) >= 5 {
+		go m.compactChunk(inode, indx)
+	}
+	return 0
+}
+
+func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, inode)
+	var delta int64
+	var slices int
+	err := m.txn(func(tx *sql.Tx) error {
+		var attr Attr
+		if err := m.getNode(tx, inode, &attr, true); err != nil {
+			return err
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if attr.Flags&(FlagImmutable|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		// an append-only file could have been flagged after it's opened
+		if attr.Flags&FlagAppend != 0 && uint64(indx)*ChunkSize+uint64(off) < attr.Length {
+			return syscall.EPERM
+		}
+		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
+		var added, grown int64
+		if newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			grown = int64(newleng - attr.Length)
+			attr.Length = newleng
+		}
+		if err := m.checkQuota(added, 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, added, 0); err != nil {
+			return err
+		}
+		delta = added
+		if err := m.updateFileStats(tx, inode, attr.Parent, grown, delta); err != nil {
+			return err
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+
+		var err error
+		slices, err = m.appendSlice(tx, inode, indx, marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
+		if err != nil {
+			return err
+		}
+		if slice.Chunkid > 0 {
+			if _, err = m.updateRef(tx, slice.Chunkid, slice.Size, 1); err != nil {
+				return err
+			}
+		}
+		if err = m.updateNode(tx, inode, &attr); err != nil {
+			return err
+		}
+		if added > 0 {
+			return m.updateCounter(tx, usedSpace, added)
+		}
+		return nil
+	}, inode)
+	if err == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+		m.markWritten(inode)
+	}
+	if err == 0 && slices%20 == 0 {
+		go m.compactChunk(inode, indx)
+	}
+	return err
+}
+
+func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, fout)
+	var delta int64
+	st := m.txn(func(tx *sql.Tx) error {
+		var sattr, attr Attr
+		if err := m.getNode(tx, fin, &sattr, false); err != nil {
+			return err
+		}
+		if sattr.Typ != TypeFile {
+			return syscall.EINVAL
+		}
+		if offIn >= sattr.Length {
+			*copied = 0
+			return nil
+		}
+		if offIn+size > sattr.Length {
+			size = sattr.Length - offIn
+		}
+		if err := m.getNode(tx, fout, &attr, true); err != nil {
+			return err
+		}
+		if attr.Typ != TypeFile {
+			return syscall.EINVAL
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if attr.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+
+		newleng := offOut + size
+		var added, grown int64
+		if newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			grown = int64(newleng - attr.Length)
+			attr.Length = newleng
+		}
+		if err := m.checkQuota(added, 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, added, 0); err != nil {
+			return err
+		}
+		delta = added
+		if err := m.updateFileStats(tx, fout, attr.Parent, grown, delta); err != nil {
+			return err
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+
+		rows, err := tx.Query(m.q("SELECT indx, slices FROM jfs_chunk WHERE inode=? AND indx>=? AND indx<=?"), uint64(fin), offIn/ChunkSize, (offIn+size)/ChunkSize)
+		if err != nil {
+			return err
+		}
+		chunks := make(map[uint32][]byte)
+		for rows.Next() {
+			var indx uint32
+			var buf []byte
+			if err = rows.Scan(&indx, &buf); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			chunks[indx] = buf
+		}
+		_ = rows.Close()
+
+		coff := offIn / ChunkSize * ChunkSize
+		for i := offIn / ChunkSize; i <= (offIn+size)/ChunkSize; i++ {
+			// Add a zero chunk for hole
+			ss := append([]*slice{{len: ChunkSize}}, readSliceBuf(chunks[uint32(i)])...)
+			cs := buildSlice(ss)
+			var tpos uint32
+			for _, s := range cs {
+				pos := tpos
+				tpos += s.Len
+				if coff+uint64(pos) < offIn+size && coff+uint64(pos)+uint64(s.Len) > offIn {
+					if coff+uint64(pos) < offIn {
+						dec := uint32(offIn - coff - uint64(pos))
+						s.Off += dec
+						pos += dec
+						s.Len -= dec
+					}
+					if coff+uint64(pos)+uint64(s.Len) > offIn+size {
+						dec := uint32(offIn + size - (coff + uint64(pos) + uint64(s.Len)))
+						s.Len -= dec
+					}
+					doff := coff + uint64(pos) - offIn + offOut
+					indx := uint32(doff / ChunkSize)
+					dpos := uint32(doff % ChunkSize)
+					if dpos+s.Len > ChunkSize {
+						if _, err = m.appendSlice(tx, fout, indx, marshalSlice(dpos, s.Chunkid, s.Size, s.Off, ChunkSize-dpos)); err != nil {
+							return err
+						}
+						skip := ChunkSize - dpos
+						if _, err = m.appendSlice(tx, fout, indx+1, marshalSlice(0, s.Chunkid, s.Size, s.Off+skip, s.Len-skip)); err != nil {
+							return err
+						}
+						if s.Chunkid > 0 {
+							if _, err = m.updateRef(tx, s.Chunkid, s.Size, 2); err != nil {
+								return err
+							}
+						}
+					} else {
+						if _, err = m.appendSlice(tx, fout, indx, marshalSlice(dpos, s.Chunkid, s.Size, s.Off, s.Len)); err != nil {
+							return err
+						}
+						if s.Chunkid > 0 {
+							if _, err = m.updateRef(tx, s.Chunkid, s.Size, 1); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+			coff += ChunkSize
+		}
+		if err = m.updateNode(tx, fout, &attr); err != nil {
+			return err
+		}
+		if added > 0 {
+			if err = m.updateCounter(tx, usedSpace, added); err != nil {
+				return err
+			}
+		}
+		*copied = size
+		return nil
+	}, fout)
+	if st == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+		m.markWritten(fout)
+	}
+	return st
+}
+
+func (m *dbMeta) cleanupDeletedFiles() {
+	for {
+		time.Sleep(time.Minute)
+		rows, err := m.db.Query(m.q("SELECT inode, length FROM jfs_delfile WHERE expire<?"), time.Now().Add(-time.Hour).Unix())
+		if err != nil {
+			continue
+		}
+		var inodes []Ino
+		var lengths []uint64
+		for rows.Next() {
+			var inode Ino
+			var length uint64
+			if rows.Scan(&inode, &length) == nil {
+				inodes = append(inodes, inode)
+				lengths = append(lengths, length)
+			}
+		}
+		_ = rows.Close()
+		for i, inode := range inodes {
+			logger.Debugf("cleanup chunks of inode %d with %d bytes", inode, lengths[i])
+			m.deleteFile(inode, lengths[i])
+		}
+	}
+}
+
+func (m *dbMeta) cleanupSlices() {
+	for {
+		time.Sleep(time.Hour)
+		rows, err := m.db.Query(m.q("SELECT chunkid, size FROM jfs_chunk_ref WHERE refs<=0"))
+		if err != nil {
+			logger.Errorf("scan slices: %s", err)
+			continue
+		}
+		var ss []Slice
+		for rows.Next() {
+			var s Slice
+			if rows.Scan(&s.Chunkid, &s.Size) == nil {
+				ss = append(ss, s)
+			}
+		}
+		_ = rows.Close()
+		for _, s := range ss {
+			m.deleteSlice(s.Chunkid, s.Size)
+		}
+	}
+}
+
+func (m *dbMeta) cleanupLeakedChunks() {
+	time.Sleep(time.Second * 10)
+	rows, err := m.db.Query(m.q("SELECT c.inode, c.indx FROM jfs_chunk c LEFT JOIN jfs_node n ON c.inode=n.inode WHERE n.inode IS NULL"))
+	if err != nil {
+		logger.Errorf("scan all chunks: %s", err)
+		return
+	}
+	type chunk struct {
+		inode Ino
+		indx  uint32
+	}
+	var cs []chunk
+	for rows.Next() {
+		var c chunk
+		if rows.Scan(&c.inode, &c.indx) == nil {
+			cs = append(cs, c)
+		}
+	}
+	_ = rows.Close()
+	for _, c := range cs {
+		logger.Debugf("found leaked chunk %d_%d", c.inode, c.indx)
+		_ = m.deleteChunk(c.inode, c.indx)
+	}
+}
+
+func (m *dbMeta) deleteSlice(chunkid uint64, size uint32) {
+	err := m.newMsg(DeleteChunk, chunkid, size)
+	if err != nil {
+		logger.Warnf("delete chunk %d (%d bytes): %s", chunkid, size, err)
+	} else {
+		_, err = m.db.Exec(m.q("DELETE FROM jfs_chunk_ref WHERE chunkid=? AND size=?"), chunkid, size)
+		if err != nil {
+			logger.Errorf("delete slice %d: %s", chunkid, err)
+		}
+	}
+}
+
+func (m *dbMeta) deleteChunk(inode Ino, indx uint32) error {
+	var unused []*slice
+	err := m.txn(func(tx *sql.Tx) error {
+		unused = nil
+		var buf []byte
+		err := tx.QueryRow(m.q("SELECT slices FROM jfs_chunk WHERE inode=? AND indx=?"+m.forUpdate(true)), uint64(inode), indx).Scan(&buf)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(m.q("DELETE FROM jfs_chunk WHERE inode=? AND indx=?"), uint64(inode), indx); err != nil {
+			return err
+		}
+		for _, s := range readSliceBuf(buf) {
+			if s.chunkid == 0 {
+				continue
+			}
+			refs, err := m.updateRef(tx, s.chunkid, s.size, -1)
+			if err != nil {
+				return err
+			}
+			if refs <= 0 {
+				unused = append(unused, s)
+			}
+		}
+		return nil
+	}, inode)
+	if err != 0 {
+		return fmt.Errorf("delete slice from chunk %d_%d fail: %s, retry later", inode, indx, err)
+	}
+	for _, s := range unused {
+		m.deleteSlice(s.chunkid, s.size)
+	}
+	return nil
+}
+
+func (m *dbMeta) deleteFile(inode Ino, length uint64) {
+	rows, err := m.db.Query(m.q("SELECT indx FROM jfs_chunk WHERE inode=?"), uint64(inode))
+	if err != nil {
+		logger.Warnf("delete chunks of inode %d: %s", inode, err)
+		return
+	}
+	var indexes []uint32
+	for rows.Next() {
+		var indx uint32
+		if rows.Scan(&indx) == nil {
+			indexes = append(indexes, indx)
+		}
+	}
+	_ = rows.Close()
+	for _, indx := range indexes {
+		if err = m.deleteChunk(inode, indx); err != nil {
+			logger.Warnf("delete chunk %d_%d: %s", inode, indx, err)
+			return
+		}
+	}
+	_, _ = m.db.Exec(m.q("DELETE FROM jfs_delfile WHERE inode=?"), uint64(inode))
+}
+
+func (m *dbMeta) compactChunk(inode Ino, indx uint32) {
+	// avoid too many or duplicated compaction
+	m.Lock()
+	k := uint64(inode) + (uint64(indx) << 32)
+	if len(m.compacting) > 10 || m.compacting[k] {
+		m.Unlock()
+		return
+	}
+	m.compacting[k] = true
+	m.Unlock()
+	defer func() {
+		m.Lock()
+		delete(m.compacting, k)
+		m.Unlock()
+	}()
+
+	var buf []byte
+	err := m.db.QueryRow(m.q("SELECT slices FROM jfs_chunk WHERE inode=? AND indx=?"), uint64(inode), indx).Scan(&buf)
+	if err != nil {
+		return
+	}
+	if len(buf) > sliceBytes*200 {
+		buf = buf[:sliceBytes*200]
+	}
+	chunkid, err := m.nextChunkID()
+	if err != nil {
+		return
+	}
+
+	ss := readSliceBuf(buf)
+	chunks := buildSlice(ss)
+	var size uint32
+	for _, s := range chunks {
+		size += s.Len
+	}
+	logger.Debugf("compact %d %d %d %d", inode, indx, len(ss), len(chunks))
+	err = m.newMsg(CompactChunk, chunks, chunkid)
+	if err != nil {
+		logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+		return
+	}
+	var unused []*slice
+	var left int
+	st := m.txn(func(tx *sql.Tx) error {
+		unused = nil
+		var buf2 []byte
+		err := tx.QueryRow(m.q("SELECT slices FROM jfs_chunk WHERE inode=? AND indx=?"+m.forUpdate(true)), uint64(inode), indx).Scan(&buf2)
+		if err == sql.ErrNoRows {
+			return syscall.EINVAL
+		} else if err != nil {
+			return err
+		}
+		if len(buf2) < len(buf) || !bytes.Equal(buf, buf2[:len(buf)]) {
+			return syscall.EINVAL
+		}
+		buf2 = append(marshalSlice(0, chunkid, size, 0, size), buf2[len(buf):]...)
+		left = len(buf2) / sliceBytes
+		if _, err = tx.Exec(m.q("UPDATE jfs_chunk SET slices=? WHERE inode=? AND indx=?"), buf2, uint64(inode), indx); err != nil {
+			return err
+		}
+		if _, err = m.updateRef(tx, chunkid, size, 1); err != nil {
+			return err
+		}
+		for _, s := range ss {
+			if s.chunkid == 0 {
+				continue
+			}
+			refs, err := m.updateRef(tx, s.chunkid, s.size, -1)
+			if err != nil {
+				return err
+			}
+			if refs <= 0 {
+				unused = append(unused, s)
+			}
+		}
+		return nil
+	}, inode)
+
+	if st == syscall.EINVAL {
+		m.deleteSlice(chunkid, size)
+	} else if st == 0 {
+		for _, s := range unused {
+			m.deleteSlice(s.chunkid, s.size)
+		}
+		if left > 5 {
+			go func() {
+				// wait for the current compaction to finish
+				time.Sleep(time.Millisecond * 10)
+				m.compactChunk(inode, indx)
+			}()
+		}
+	} else {
+		logger.Warnf("compact %d_%d: %s", inode, indx, st)
+	}
+}
+
+func (m *dbMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
+	*slices = nil
+	rows, err := m.db.Query(m.q("SELECT slices FROM jfs_chunk"))
+	if err != nil {
+		return errno(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var buf []byte
+		if err = rows.Scan(&buf); err != nil {
+			return errno(err)
+		}
+		for _, s := range readSliceBuf(buf) {
+			if s.chunkid > 0 {
+				*slices = append(*slices, Slice{Chunkid: s.chunkid, Size: s.size})
+			}
+		}
+	}
+	return errno(rows.Err())
+}
+
+func (m *dbMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	err := m.db.QueryRow(m.q("SELECT value FROM jfs_xattr WHERE inode=? AND name=?"), uint64(inode), name).Scan(vbuff)
+	if err == sql.ErrNoRows {
+		err = ENOATTR
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno {
+	rows, err := m.db.Query(m.q("SELECT name FROM jfs_xattr WHERE inode=?"), uint64(inode))
+	if err != nil {
+		return errno(err)
+	}
+	defer rows.Close()
+	*names = nil
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return errno(err)
+		}
+		*names = append(*names, []byte(name)...)
+		*names = append(*names, 0)
+	}
+	return errno(rows.Err())
+}
+
+func (m *dbMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if st := m.checkWritable(ctx, inode); st != 0 {
+		return st
+	}
+	return m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		return m.upsert(tx, "UPDATE jfs_xattr SET value=? WHERE inode=? AND name=?",
+			"INSERT INTO jfs_xattr(value, inode, name) VALUES(?, ?, ?)", value, uint64(inode), name)
+	}), inode)
+}
+
+func (m *dbMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if st := m.checkWritable(ctx, inode); st != 0 {
+		return st
+	}
+	return m.txn(m.logged(ctx, func(tx *sql.Tx) error {
+		r, err := tx.Exec(m.q("DELETE FROM jfs_xattr WHERE inode=? AND name=?"), uint64(inode), name)
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n == 0 {
+			return ENOATTR
+		}
+		return nil
+	}), inode)
+}
+
+func (m *dbMeta) doReadChunk(inode Ino, indx uint32) ([]byte, error) {
+	var buf []byte
+	err := m.db.QueryRow(m.q("SELECT slices FROM jfs_chunk WHERE inode=? AND indx=?"), uint64(inode), indx).Scan(&buf)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return buf, err
+}
+
+func (m *dbMeta) setCounter(name string, value int64) error {
+	return m.upsert(m.db, "UPDATE jfs_counter SET value=? WHERE name=?", "INSERT INTO jfs_counter(value, name) VALUES(?, ?)", value, name)
+}
+
+func (m *dbMeta) setIfSmall(name string, value, diff int64) (bool, error) {
+	var updated bool
+	err := m.txn(func(tx *sql.Tx) error {
+		updated = false
+		r, err := tx.Exec(m.q("UPDATE jfs_counter SET value=? WHERE name=? AND value<=?"), value, name, value-diff)
+		if err != nil {
+			return err
+		}
+		if n, err := r.RowsAffected(); err != nil || n > 0 {
+			updated = err == nil
+			return err
+		}
+		var old int64
+		err = tx.QueryRow(m.q("SELECT value FROM jfs_counter WHERE name=?"), name).Scan(&old)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		// a conflicting insertion from another session will be retried by txn()
+		_, err = tx.Exec(m.q("INSERT INTO jfs_counter(value, name) VALUES(?, ?)"), value, name)
+		updated = err == nil
+		return err
+	})
+	return updated, errnoErr(err)
+}
+
+func (m *dbMeta) doLoadNode(n *loadedNode) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		if n.source > 0 && n.attr.Typ == TypeFile {
+			// the chunks of the source are locked until the references of the slices are increased
+			var sattr Attr
+			if err := m.getNode(tx, n.source, &sattr, true); err != nil {
+				return err
+			}
+			n.attr.Length = sattr.Length
+			n.chunks = make(map[uint32][]byte)
+			rows, err := tx.Query(m.q("SELECT indx, slices FROM jfs_chunk WHERE inode=?"+m.forUpdate(true)), uint64(n.source))
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var indx uint32
+				var buf []byte
+				if err = rows.Scan(&indx, &buf); err != nil {
+					_ = rows.Close()
+					return err
+				}
+				if uint64(indx)*ChunkSize < sattr.Length && len(buf) > 0 {
+					n.chunks[indx] = buf
+				}
+			}
+			_ = rows.Close()
+			if err = m.updateCounter(tx, usedSpace, align4K(sattr.Length)); err != nil {
+				return err
+			}
+		}
+		// the root node is created by Init()
+		err := m.upsert(tx, "UPDATE jfs_node SET type=?, flags=?, mode=?, uid=?, gid=?, atime=?, mtime=?, ctime=?, nlink=?, length=?, rdev=?, parent=? WHERE inode=?",
+			"INSERT INTO jfs_node("+nodeColumns+", inode) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", append(m.nodeArgs(&n.attr), uint64(n.inode))...)
+		if err != nil {
+			return err
+		}
+		if n.attr.Typ == TypeSymlink {
+			// the symlink is created already when it's cloned
+			if _, err = tx.Exec(m.q("DELETE FROM jfs_symlink WHERE inode=?"), uint64(n.inode)); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(m.q("INSERT INTO jfs_symlink(inode, target) VALUES(?, ?)"), uint64(n.inode), n.target); err != nil {
+				return err
+			}
+		}
+		for name, value := range n.xattrs {
+			if _, err = tx.Exec(m.q("INSERT INTO jfs_xattr(inode, name, value) VALUES(?, ?, ?)"), uint64(n.inode), name, value); err != nil {
+				return err
+			}
+		}
+		for indx, buf := range n.chunks {
+			if _, err = tx.Exec(m.q("INSERT INTO jfs_chunk(inode, indx, slices) VALUES(?, ?, ?)"), uint64(n.inode), indx, buf); err != nil {
+				return err
+			}
+			for _, s := range readSliceBuf(buf) {
+				if s.chunkid > 0 {
+					if _, err = m.updateRef(tx, s.chunkid, s.size, 1); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if n.source > 0 && n.attr.Typ == TypeFile {
+			// a clone is created as an empty file
+			return m.updateDirStat(tx, n.attr.Parent, &dirStat{length: int64(n.attr.Length), space: align4K(n.attr.Length)})
+		}
+		return nil
+	}, n.inode))
+}
+
+func (m *dbMeta) doLoadEdge(parent Ino, name string, _type uint8, inode Ino) error {
+	_, err := m.db.Exec(m.q("INSERT INTO jfs_edge(parent, name, inode, type) VALUES(?, ?, ?, ?)"), uint64(parent), []byte(name), uint64(inode), _type)
+	return err
+}
+
+func (m *dbMeta) doGetParents(ctx Context, inode Ino) (map[Ino]int, error) {
+	return m.getParents(m.db, inode)
+}
+
+func (m *dbMeta) getParents(q querier, inode Ino) (map[Ino]int, error) {
+	ps := make(map[Ino]int)
+	rows, err := q.Query(m.q("SELECT parent, cnt FROM jfs_parent WHERE inode=? AND cnt>0"), uint64(inode))
+	if err != nil {
+		if isMissingTable(err) {
+			return ps, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p uint64
+		var n int
+		if err = rows.Scan(&p, &n); err != nil {
+			return nil, err
+		}
+		ps[Ino(p)] = n
+	}
+	return ps, rows.Err()
+}
+
+func (m *dbMeta) doSetParents(inode Ino, parents map[Ino]int) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(m.q("DELETE FROM jfs_parent WHERE inode=?"), uint64(inode)); err != nil {
+			return err
+		}
+		for p, n := range parents {
+			if _, err := tx.Exec(m.q("INSERT INTO jfs_parent(inode, parent, cnt) VALUES(?, ?, ?)"), uint64(inode), uint64(p), n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, inode))
+}
+
+// isMissingTable returns true if the error is caused by a table that's not created yet,
+// which happens in volumes formatted by older versions.
+func isMissingTable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such table") || strings.Contains(msg, "doesn't exist") || strings.Contains(msg, "does not exist")
+}
+
+func (m *dbMeta) doLoadQuotas() (map[Ino]*Quota, error) {
+	rows, err := m.db.Query(m.q("SELECT inode, max_space, max_inodes, used_space, used_inodes FROM jfs_dir_quota"))
+	if err != nil {
+		if isMissingTable(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	quotas := make(map[Ino]*Quota)
+	for rows.Next() {
+		var inode uint64
+		var q Quota
+		if err = rows.Scan(&inode, &q.MaxSpace, &q.MaxInodes, &q.UsedSpace, &q.UsedInodes); err != nil {
+			return nil, err
+		}
+		quotas[Ino(inode)] = &q
+	}
+	return quotas, rows.Err()
+}
+
+func (m *dbMeta) doGetQuota(inode Ino) (*Quota, error) {
+	var q Quota
+	err := m.db.QueryRow(m.q("SELECT max_space, max_inodes, used_space, used_inodes FROM jfs_dir_quota WHERE inode=?"), uint64(inode)).Scan(
+		&q.MaxSpace, &q.MaxInodes, &q.UsedSpace, &q.UsedInodes)
+	if err == sql.ErrNoRows || err != nil && isMissingTable(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (m *dbMeta) doSetQuota(inode Ino, quota *Quota) error {
+	if err := m.createTables(); err != nil {
+		return err
+	}
+	return m.upsert(m.db, "UPDATE jfs_dir_quota SET max_space=?, max_inodes=?, used_space=?, used_inodes=? WHERE inode=?",
+		"INSERT INTO jfs_dir_quota(max_space, max_inodes, used_space, used_inodes, inode) VALUES(?, ?, ?, ?, ?)",
+		quota.MaxSpace, quota.MaxInodes, quota.UsedSpace, quota.UsedInodes, uint64(inode))
+}
+
+func (m *dbMeta) doDelQuota(inode Ino) error {
+	_, err := m.db.Exec(m.q("DELETE FROM jfs_dir_quota WHERE inode=?"), uint64(inode))
+	if err != nil && isMissingTable(err) {
+		err = nil
+	}
+	return err
+}
+
+func (m *dbMeta) doFlushQuotas(deltas map[Ino]*Quota) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		for inode, d := range deltas {
+			if _, err := tx.Exec(m.q("UPDATE jfs_dir_quota SET used_space=used_space+?, used_inodes=used_inodes+? WHERE inode=?"),
+				d.UsedSpace, d.UsedInodes, uint64(inode)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (m *dbMeta) getDirStat(q querier, inode Ino, lock bool) (*dirStat, error) {
+	var s dirStat
+	err := q.QueryRow(m.q("SELECT length, space, files, dirs FROM jfs_dir_stats WHERE inode=?"+m.forUpdate(lock)), uint64(inode)).Scan(
+		&s.length, &s.space, &s.files, &s.dirs)
+	if err == sql.ErrNoRows || err != nil && isMissingTable(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *dbMeta) doGetDirStat(inode Ino) (*dirStat, error) {
+	return m.getDirStat(m.db, inode, false)
+}
+
+// insertDirStat creates empty stats for a new directory.
+func (m *dbMeta) insertDirStat(q querier, inode Ino) error {
+	_, err := q.Exec(m.q("INSERT INTO jfs_dir_stats(inode, length, space, files, dirs) VALUES(?, 0, 0, 0, 0)"), uint64(inode))
+	return err
+}
+
+func (m *dbMeta) doSetDirStat(inode Ino, stat *dirStat) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(m.q("DELETE FROM jfs_dir_stats WHERE inode=?"), uint64(inode)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(m.q("INSERT INTO jfs_dir_stats(inode, length, space, files, dirs) VALUES(?, ?, ?, ?, ?)"),
+			uint64(inode), stat.length, stat.space, stat.files, stat.dirs)
+		return err
+	}))
+}
+
+// delDirStat removes the stats and the delta of a directory.
+func (m *dbMeta) delDirStat(q querier, inode Ino) error {
+	if _, err := q.Exec(m.q("DELETE FROM jfs_dir_stats WHERE inode=?"), uint64(inode)); err != nil {
+		return err
+	}
+	_, err := q.Exec(m.q("DELETE FROM jfs_dir_delta WHERE inode=?"), uint64(inode))
+	return err
+}
+
+func (m *dbMeta) doDelDirStat(inode Ino) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		return m.delDirStat(tx, inode)
+	}))
+}
+
+// updateDirStat records a change under the directory within the transaction.
+func (m *dbMeta) updateDirStat(q querier, parent Ino, d *dirStat) error {
+	if parent == 0 || d.isZero() {
+		return nil
+	}
+	return m.upsert(q, "UPDATE jfs_dir_delta SET length=length+?, space=space+?, files=files+?, dirs=dirs+? WHERE inode=?",
+		"INSERT INTO jfs_dir_delta(length, space, files, dirs, inode) VALUES(?, ?, ?, ?, ?)",
+		d.length, d.space, d.files, d.dirs, uint64(parent))
+}
+
+// updateFileStats records the change of length of a file in its parents within the transaction.
+func (m *dbMeta) updateFileStats(q querier, inode, parent Ino, length, space int64) error {
+	stats, err := fileStats(parent, length, space, func() (map[Ino]int, error) {
+		return m.getParents(q, inode)
+	})
+	if err != nil {
+		return err
+	}
+	for p, d := range stats {
+		if err = m.updateDirStat(q, p, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) doGetDirDeltas() (map[Ino]*dirStat, error) {
+	deltas := make(map[Ino]*dirStat)
+	err := m.queryRows("SELECT inode, length, space, files, dirs FROM jfs_dir_delta", func(rows *sql.Rows) error {
+		var inode uint64
+		var d dirStat
+		if err := rows.Scan(&inode, &d.length, &d.space, &d.files, &d.dirs); err != nil {
+			return err
+		}
+		deltas[Ino(inode)] = &d
+		return nil
+	})
+	if err != nil && isMissingTable(err) {
+		return deltas, nil
+	}
+	return deltas, err
+}
+
+func (m *dbMeta) doFlushDirStat(inode Ino) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		var d dirStat
+		err := tx.QueryRow(m.q("SELECT length, space, files, dirs FROM jfs_dir_delta WHERE inode=?"+m.forUpdate(true)), uint64(inode)).Scan(
+			&d.length, &d.space, &d.files, &d.dirs)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// the ancestors are locked, so they can't be moved in the meantime
+		for p, depth := inode, 0; p > 0 && depth < 1000 && !d.isZero(); depth++ {
+			if _, err = tx.Exec(m.q("UPDATE jfs_dir_stats SET length=length+?, space=space+?, files=files+?, dirs=dirs+? WHERE inode=?"),
+				d.length, d.space, d.files, d.dirs, uint64(p)); err != nil {
+				return err
+			}
+			if p == 1 || p == TrashInode || p == SnapshotInode {
+				break
+			}
+			var attr Attr
+			if err = m.getNode(tx, p, &attr, true); err == syscall.ENOENT {
+				break
+			} else if err != nil {
+				return err
+			}
+			p = attr.Parent
+		}
+		_, err = tx.Exec(m.q("DELETE FROM jfs_dir_delta WHERE inode=?"), uint64(inode))
+		return err
+	}, inode))
+}
+
+func (m *dbMeta) doScanNodes(ctx Context, fn func(inode Ino, attr *Attr) error) error {
+	return m.queryRows("SELECT inode, "+nodeColumns+" FROM jfs_node", func(rows *sql.Rows) error {
+		var inode Ino
+		var attr Attr
+		if err := m.parseNode(prefixScanner{rows, []interface{}{&inode}}, &attr); err != nil {
+			return err
+		}
+		return fn(inode, &attr)
+	})
+}
+
+func (m *dbMeta) doScanEdges(ctx Context, fn func(parent Ino, name string, _type uint8, inode Ino) error) error {
+	return m.queryRows("SELECT parent, name, type, inode FROM jfs_edge", func(rows *sql.Rows) error {
+		var parent, inode Ino
+		var name []byte
+		var typ uint8
+		if err := rows.Scan(&parent, &name, &typ, &inode); err != nil {
+			return err
+		}
+		return fn(parent, string(name), typ, inode)
+	})
+}
+
+func (m *dbMeta) doSaveAttr(inode Ino, attr *Attr) error {
+	return m.updateNode(m.db, inode, attr)
+}
+
+func (m *dbMeta) doDeleteEdge(parent Ino, name string) error {
+	_, err := m.db.Exec(m.q("DELETE FROM jfs_edge WHERE parent=? AND name=?"), uint64(parent), []byte(name))
+	return err
+}
+
+func (m *dbMeta) doRemoveNode(inode Ino, attr *Attr) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		var err error
+		switch attr.Typ {
+		case TypeDirectory:
+			_, err = tx.Exec(m.q("DELETE FROM jfs_edge WHERE parent=?"), uint64(inode))
+		case TypeSymlink:
+			_, err = tx.Exec(m.q("DELETE FROM jfs_symlink WHERE inode=?"), uint64(inode))
+		case TypeFile:
+			_, err = tx.Exec(m.q("INSERT INTO jfs_delfile(inode, length, expire) VALUES(?, ?, ?)"), uint64(inode), attr.Length, time.Now().Unix())
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(m.q("DELETE FROM jfs_xattr WHERE inode=?"), uint64(inode)); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(m.q("DELETE FROM jfs_parent WHERE inode=?"), uint64(inode)); err != nil {
+			return err
+		}
+		return m.deleteNode(tx, inode)
+	}, inode))
+}
+
+func (m *dbMeta) doListSliceRefs() (map[Slice]int64, error) {
+	refs := make(map[Slice]int64)
+	err := m.queryRows("SELECT chunkid, size, refs FROM jfs_chunk_ref", func(rows *sql.Rows) error {
+		var s Slice
+		var n int64
+		if err := rows.Scan(&s.Chunkid, &s.Size, &n); err != nil {
+			return err
+		}
+		refs[s] = n
+		return nil
+	})
+	return refs, err
+}
+
+func (m *dbMeta) doSetSliceRef(chunkid uint64, size uint32, refs int64) error {
+	return m.upsert(m.db, "UPDATE jfs_chunk_ref SET refs=? WHERE chunkid=? AND size=?",
+		"INSERT INTO jfs_chunk_ref(refs, chunkid, size) VALUES(?, ?, ?)", refs, chunkid, size)
+}
+
+func (m *dbMeta) doListDelFiles() (map[Ino]uint64, error) {
+	files := make(map[Ino]uint64)
+	err := m.queryRows("SELECT inode, length FROM jfs_delfile", func(rows *sql.Rows) error {
+		var inode Ino
+		var length uint64
+		if err := rows.Scan(&inode, &length); err != nil {
+			return err
+		}
+		files[inode] = length
+		return nil
+	})
+	return files, err
+}
+
+func (m *dbMeta) doRemoveDelFile(inode Ino, length uint64) error {
+	_, err := m.db.Exec(m.q("DELETE FROM jfs_delfile WHERE inode=?"), uint64(inode))
+	return err
+}
+
+func (m *dbMeta) doSaveFormat(format *Format, data []byte) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		err := m.upsert(tx, "UPDATE jfs_setting SET value=? WHERE name=?", "INSERT INTO jfs_setting(value, name) VALUES(?, ?)", string(data), "format")
+		if err != nil || format.TrashDays == 0 {
+			return err
+		}
+		var a Attr
+		if err = m.getNode(tx, TrashInode, &a, true); err == syscall.ENOENT {
+			if err = m.insertNode(tx, TrashInode, specialRootAttr()); err == nil {
+				err = m.insertDirStat(tx, TrashInode)
+			}
+		}
+		return err
+	}))
+}
+
+func (m *dbMeta) doAppendEvent(e *Event) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		return m.insertEvent(tx, e)
+	}))
+}
+
+// insertEvent inserts the event in the transaction, the row of the counter is locked until it's
+// committed, so the events are committed in order.
+func (m *dbMeta) insertEvent(tx *sql.Tx, e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err = m.updateCounter(tx, "nextEvent", 1); err != nil {
+		return err
+	}
+	var id int64
+	if err = tx.QueryRow(m.q("SELECT value FROM jfs_counter WHERE name=?"), "nextEvent").Scan(&id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(m.q("INSERT INTO jfs_event(id, ts, data) VALUES(?, ?, ?)"), id, e.Time, data)
+	return err
+}
+
+// logged returns the transaction of the change made with the context, which inserts the event of it.
+func (m *dbMeta) logged(ctx Context, f func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	if eventOf(ctx) == nil {
+		return f
+	}
+	return func(tx *sql.Tx) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		return m.insertEvent(tx, eventOf(ctx))
+	}
+}
+
+func (m *dbMeta) doReadEvents(offset string, limit int) ([]*Event, error) {
+	var last int64
+	if offset != "" {
+		var err error
+		if last, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid offset: %s", offset)
+		}
+	}
+	var events []*Event
+	err := m.queryRows(fmt.Sprintf("SELECT id, data FROM jfs_event WHERE id>%d ORDER BY id LIMIT %d", last, limit), func(rows *sql.Rows) error {
+		var id int64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			logger.Warnf("corrupted event %d: %s", id, err)
+			return nil
+		}
+		e.Offset = strconv.FormatInt(id, 10)
+		events = append(events, &e)
+		return nil
+	})
+	return events, err
+}
+
+func (m *dbMeta) doTrimEvents(before int64) error {
+	_, err := m.db.Exec(m.q("DELETE FROM jfs_event WHERE ts<?"), before)
+	return err
+}
+
+func (m *dbMeta) doTouchAtime(inode Ino, atime time.Time) error {
+	return errnoErr(m.txn(func(tx *sql.Tx) error {
+		var attr Attr
+		if err := m.getNode(tx, inode, &attr, true); err != nil {
+			return err
+		}
+		if !atime.After(time.Unix(attr.Atime, int64(attr.Atimensec))) {
+			return nil
+		}
+		attr.Atime = atime.Unix()
+		attr.Atimensec = uint32(atime.Nanosecond())
+		return m.updateNode(tx, inode, &attr)
+	}, inode))
+}
@@ -0,0 +1,188 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func newSQLiteMeta(t *testing.T, path string) Meta {
+	_ = os.Remove(path)
+	m, err := newSQLMeta("sqlite3", path, &Config{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	return m
+}
+
+func TestSQLClient(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test.db")
+	testMetaClient(t, m)
+}
+
+func TestSQLCompaction(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-compact.db")
+	testCompaction(t, m)
+}
+
+func TestSQLConcurrentWrite(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-write.db")
+	testConcurrentWrite(t, m)
+}
+
+func TestSQLCopyFileRange(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-copy.db")
+	testCopyFileRange(t, m)
+}
+
+func TestReadOnlyClient(t *testing.T) {
+	path := "/tmp/jfs-unit-test-ro.db"
+	m := newSQLiteMeta(t, path)
+	if err := m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ro := NewClient("sqlite3://"+path, &Config{ReadOnly: true})
+	if ro.Name() != "sqlite3" {
+		t.Fatalf("engine: %s", ro.Name())
+	}
+	if err := ro.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := ro.Mkdir(ctx, 1, "d", 0755, 022, 0, &inode, &attr); st != syscall.EROFS {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := ro.SetAttr(ctx, 1, SetAttrMode, 0, &attr); st != syscall.EROFS {
+		t.Fatalf("setattr: %s", st)
+	}
+	if st := ro.GetAttr(ctx, 1, &attr); st != 0 {
+		t.Fatalf("getattr: %s", st)
+	}
+}
+
+func TestSQLVolumeLimits(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-limits.db")
+	testVolumeLimits(t, m)
+}
+
+func TestSQLDirQuota(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-quota.db")
+	testDirQuota(t, m)
+}
+
+func TestSQLTrash(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-trash.db")
+	testTrash(t, m)
+}
+
+func TestSQLDirStats(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-stats.db")
+	testDirStats(t, m)
+}
+
+func TestSQLClone(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-clone.db")
+	testClone(t, m)
+}
+
+func TestSQLSnapshot(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-snapshot.db")
+	testSnapshot(t, m)
+}
+
+func TestSQLACL(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-acl.db")
+	testACL(t, m)
+}
+
+func TestSQLReaddirPage(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-readdir.db")
+	testReaddirPage(t, m)
+}
+
+func TestSQLAllocIDs(t *testing.T) {
+	path := "/tmp/jfs-unit-test-alloc.db"
+	m := newSQLiteMeta(t, path)
+	m2, err := newSQLMeta("sqlite3", path, &Config{})
+	if err != nil {
+		t.Fatalf("create another client: %s", err)
+	}
+	testAllocIDs(t, m, m2)
+}
+
+func TestSQLSessions(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-sessions.db")
+	testSessions(t, m)
+}
+
+func TestSQLCheckMeta(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-fsck.db")
+	testCheckMeta(t, m)
+	other, err := newSQLMeta("sqlite3", "/tmp/jfs-unit-test-fsck.db", &Config{})
+	if err != nil {
+		t.Fatalf("create another client: %s", err)
+	}
+	testRepairWithClients(t, m, other)
+}
+
+func TestSQLUpdateFormat(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-config.db")
+	testUpdateFormat(t, m)
+}
+
+func TestSQLEvents(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-events.db")
+	testEvents(t, m)
+}
+
+func TestSQLAtime(t *testing.T) {
+	_ = os.Remove("/tmp/jfs-unit-test-atime.db")
+	var conf Config
+	m, err := newSQLMeta("sqlite3", "/tmp/jfs-unit-test-atime.db", &conf)
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	testAtime(t, m, &conf)
+}
+
+func TestSQLFlags(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-flags.db")
+	testFlags(t, m)
+}
+
+func TestSQLRetention(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-retention.db")
+	testRetention(t, m)
+}
+
+func TestSQLGetPaths(t *testing.T) {
+	m := newSQLiteMeta(t, "/tmp/jfs-unit-test-paths.db")
+	testGetPaths(t, m)
+}
+
+func TestSQLVolumePrefix(t *testing.T) {
+	path := "/tmp/jfs-unit-test-prefix.db"
+	m := newSQLiteMeta(t, path)
+	pm, err := newSQLMeta("sqlite3", path+"?prefix=team", &Config{})
+	if err != nil {
+		t.Fatalf("create meta with prefix: %s", err)
+	}
+	testVolumePrefix(t, m, pm)
+}
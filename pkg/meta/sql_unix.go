@@ -0,0 +1,192 @@
+// +build !windows
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"database/sql"
+	"syscall"
+	"time"
+)
+
+type lockOwner struct {
+	sid   int64
+	owner uint64
+}
+
+func (m *dbMeta) Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno {
+	if ltype == syscall.F_UNLCK {
+		_, err := m.db.Exec(m.q("DELETE FROM jfs_flock WHERE inode=? AND sid=? AND owner=?"), uint64(inode), m.sid, owner)
+		return errno(err)
+	}
+	var err syscall.Errno
+	for {
+		err = m.txn(func(tx *sql.Tx) error {
+			rows, err := tx.Query(m.q("SELECT sid, owner, ltype FROM jfs_flock WHERE inode=?"+m.forUpdate(true)), uint64(inode))
+			if err != nil {
+				return err
+			}
+			owners := make(map[lockOwner]string)
+			for rows.Next() {
+				var o lockOwner
+				var t string
+				if err = rows.Scan(&o.sid, &o.owner, &t); err != nil {
+					_ = rows.Close()
+					return err
+				}
+				owners[o] = t
+			}
+			_ = rows.Close()
+			me := lockOwner{m.sid, owner}
+			t := "W"
+			if ltype == syscall.F_RDLCK {
+				for _, v := range owners {
+					if v == "W" {
+						return syscall.EAGAIN
+					}
+				}
+				t = "R"
+			} else {
+				delete(owners, me)
+				if len(owners) > 0 {
+					return syscall.EAGAIN
+				}
+			}
+			return m.upsert(tx, "UPDATE jfs_flock SET ltype=? WHERE inode=? AND sid=? AND owner=?",
+				"INSERT INTO jfs_flock(ltype, inode, sid, owner) VALUES(?, ?, ?, ?)", t, uint64(inode), m.sid, owner)
+		}, inode)
+
+		if !block || err != syscall.EAGAIN {
+			break
+		}
+		if ltype == syscall.F_WRLCK {
+			time.Sleep(time.Millisecond * 1)
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return err
+}
+
+func (m *dbMeta) loadPlocks(q querier, inode Ino, lock bool) (map[lockOwner][]byte, error) {
+	rows, err := q.Query(m.q("SELECT sid, owner, records FROM jfs_plock WHERE inode=?"+m.forUpdate(lock)), uint64(inode))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	owners := make(map[lockOwner][]byte)
+	for rows.Next() {
+		var o lockOwner
+		var records []byte
+		if err = rows.Scan(&o.sid, &o.owner, &records); err != nil {
+			return nil, err
+		}
+		owners[o] = records
+	}
+	return owners, rows.Err()
+}
+
+func (m *dbMeta) Getlk(ctx Context, inode Ino, owner uint64, ltype *uint32, start, end *uint64, pid *uint32) syscall.Errno {
+	if *ltype == syscall.F_UNLCK {
+		*start = 0
+		*end = 0
+		*pid = 0
+		return 0
+	}
+	owners, err := m.loadPlocks(m.db, inode, false)
+	if err != nil {
+		return errno(err)
+	}
+	delete(owners, lockOwner{m.sid, owner}) // exclude itself
+	for o, d := range owners {
+		ls := loadLocks(d)
+		for _, l := range ls {
+			// find conflicted locks
+			if (*ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && *end > l.start && *start < l.end {
+				*ltype = l.ltype
+				*start = l.start
+				*end = l.end
+				if o.sid == m.sid {
+					*pid = l.pid
+				} else {
+					*pid = 0
+				}
+				return 0
+			}
+		}
+	}
+	*ltype = syscall.F_UNLCK
+	*start = 0
+	*end = 0
+	*pid = 0
+	return 0
+}
+
+func (m *dbMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno {
+	var err syscall.Errno
+	lock := plock{ltype, pid, start, end}
+	me := lockOwner{m.sid, owner}
+	for {
+		err = m.txn(func(tx *sql.Tx) error {
+			owners, err := m.loadPlocks(tx, inode, true)
+			if err != nil {
+				return err
+			}
+			ls := loadLocks(owners[me])
+			if ltype == syscall.F_UNLCK {
+				if len(ls) == 0 {
+					return nil
+				}
+				ls = updateLocks(ls, lock)
+				if len(ls) == 0 {
+					_, err = tx.Exec(m.q("DELETE FROM jfs_plock WHERE inode=? AND sid=? AND owner=?"), uint64(inode), m.sid, owner)
+					return err
+				}
+			} else {
+				delete(owners, me)
+				for _, d := range owners {
+					ls := loadLocks(d)
+					for _, l := range ls {
+						// find conflicted locks
+						if (ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && end > l.start && start < l.end {
+							return syscall.EAGAIN
+						}
+					}
+				}
+				ls = updateLocks(ls, lock)
+			}
+			return m.upsert(tx, "UPDATE jfs_plock SET records=? WHERE inode=? AND sid=? AND owner=?",
+				"INSERT INTO jfs_plock(records, inode, sid, owner) VALUES(?, ?, ?, ?)", dumpLocks(ls), uint64(inode), m.sid, owner)
+		}, inode)
+
+		if !block || err != syscall.EAGAIN {
+			break
+		}
+		if ltype == syscall.F_WRLCK {
+			time.Sleep(time.Millisecond * 1)
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return err
+}
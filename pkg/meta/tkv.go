@@ -0,0 +1,2437 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/*
+	Node: A$inode I -> Attribute{type,mode,uid,gid,atime,mtime,ctime,nlink,length,rdev}
+	Dir:  A$inode D$name -> {type,inode}
+	File: A$inode C$indx -> [Slice{pos,id,length,off,len}]
+	Symlink: A$inode S -> target
+	Xattr: A$inode X$name -> value
+	Parents: A$inode P$parent -> count (for the files with hardlinks)
+	Flock: F$inode $sid $owner -> ltype
+	POSIX lock: P$inode $sid $owner -> [Plock(pid,ltype,start,end)]
+	Sessions: SH$sid -> heartbeat
+	Session info: SS$sid -> {JSON}
+	Sustained: SI$sid $inode -> 1
+	Removed files: D$inode $length -> seconds
+	Slices refs: K$chunkid $size -> refcount
+	Counters: C$name -> value
+	Change log: E$id -> {JSON}
+	Dir stats: U$inode -> {length,space,files,dirs}
+	Dir deltas: W$inode -> {length,space,files,dirs}
+	Setting: setting -> json
+
+	All the keys above are prefixed by 0xFD $prefix 0xFD if the prefix of volume is given in the URL.
+
+	All the integers in keys are encoded in big endian, so the keys of one inode are stored together.
+*/
+
+// kvTxn is a transaction of a key-value store, it panics on any error,
+// which will be recovered and returned by tkvClient.txn().
+type kvTxn interface {
+	get(key []byte) []byte
+	// scan calls handler for all the keys with given prefix in order, until it returns false.
+	scan(prefix []byte, handler func(key, value []byte) bool)
+	// scanRange calls handler for the keys in [begin, end) in order, until it returns false.
+	scanRange(begin, end []byte, handler func(key, value []byte) bool)
+	set(key, value []byte)
+	dels(keys ...[]byte)
+}
+
+type tkvClient interface {
+	name() string
+	txn(f func(kvTxn) error) error
+	close() error
+}
+
+var kvClients = make(map[string]func(addr string) (tkvClient, error))
+
+// prefixMark starts and ends the prefix of keys, which is never the first byte of any key without prefix.
+const prefixMark = 0xFD
+
+// prefixTxn adds the prefix to the keys of a volume, and removes it from the scanned ones.
+type prefixTxn struct {
+	kvTxn
+	prefix []byte
+}
+
+func (tx *prefixTxn) realKey(key []byte) []byte {
+	return append(append([]byte{}, tx.prefix...), key...)
+}
+
+func (tx *prefixTxn) get(key []byte) []byte {
+	return tx.kvTxn.get(tx.realKey(key))
+}
+
+func (tx *prefixTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	tx.kvTxn.scan(tx.realKey(prefix), func(key, value []byte) bool {
+		return handler(key[len(tx.prefix):], value)
+	})
+}
+
+func (tx *prefixTxn) scanRange(begin, end []byte, handler func(key, value []byte) bool) {
+	tx.kvTxn.scanRange(tx.realKey(begin), tx.realKey(end), func(key, value []byte) bool {
+		return handler(key[len(tx.prefix):], value)
+	})
+}
+
+func (tx *prefixTxn) set(key, value []byte) {
+	tx.kvTxn.set(tx.realKey(key), value)
+}
+
+func (tx *prefixTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.kvTxn.dels(tx.realKey(key))
+	}
+}
+
+type prefixClient struct {
+	tkvClient
+	prefix []byte
+}
+
+func (c *prefixClient) txn(f func(kvTxn) error) error {
+	return c.tkvClient.txn(func(tx kvTxn) error {
+		return f(&prefixTxn{tx, c.prefix})
+	})
+}
+
+func registerKV(name string, creator func(addr string) (tkvClient, error)) {
+	kvClients[name] = creator
+}
+
+type kvMeta struct {
+	*baseMeta
+	client tkvClient
+}
+
+var _ Meta = &kvMeta{}
+var _ engine = &kvMeta{}
+
+func init() {
+	Register("bolt", newKVMeta)
+	Register("memkv", newKVMeta)
+}
+
+// newKVMeta return a meta store using a transactional key-value store, the driver could be bolt or memkv.
+func newKVMeta(driver, addr string, conf *Config) (Meta, error) {
+	creator, ok := kvClients[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key-value store: %s", driver)
+	}
+	addr, name, err := splitPrefix(addr)
+	if err != nil {
+		return nil, err
+	}
+	client, err := creator(addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %s", driver, err)
+	}
+	if name != "" {
+		client = &prefixClient{client, append(append([]byte{prefixMark}, name...), prefixMark)}
+	}
+	m := &kvMeta{
+		baseMeta: newBaseMeta(conf),
+		client:   client,
+	}
+	m.en = m
+	return m, nil
+}
+
+func (m *kvMeta) Name() string {
+	return m.client.name()
+}
+
+func (m *kvMeta) serverVersion() string {
+	return ""
+}
+
+func (m *kvMeta) fmtKey(args ...interface{}) []byte {
+	b := bytes.NewBuffer(nil)
+	for _, a := range args {
+		switch a := a.(type) {
+		case byte:
+			b.WriteByte(a)
+		case uint32:
+			_ = binary.Write(b, binary.BigEndian, a)
+		case uint64:
+			_ = binary.Write(b, binary.BigEndian, a)
+		case Ino:
+			_ = binary.Write(b, binary.BigEndian, uint64(a))
+		case string:
+			b.WriteString(a)
+		default:
+			panic(fmt.Sprintf("invalid type %T, value %v", a, a))
+		}
+	}
+	return b.Bytes()
+}
+
+func (m *kvMeta) inodeKey(inode Ino) []byte {
+	return m.fmtKey("A", inode, "I")
+}
+
+func (m *kvMeta) entryKey(parent Ino, name string) []byte {
+	return m.fmtKey("A", parent, "D", name)
+}
+
+func (m *kvMeta) chunkKey(inode Ino, indx uint32) []byte {
+	return m.fmtKey("A", inode, "C", indx)
+}
+
+func (m *kvMeta) symKey(inode Ino) []byte {
+	return m.fmtKey("A", inode, "S")
+}
+
+func (m *kvMeta) xattrKey(inode Ino, name string) []byte {
+	return m.fmtKey("A", inode, "X", name)
+}
+
+func (m *kvMeta) parentKey(inode, parent Ino) []byte {
+	return m.fmtKey("A", inode, "P", parent)
+}
+
+func (m *kvMeta) sliceKey(chunkid uint64, size uint32) []byte {
+	return m.fmtKey("K", chunkid, size)
+}
+
+func (m *kvMeta) flockKey(inode Ino, sid int64, owner uint64) []byte {
+	return m.fmtKey("F", inode, uint64(sid), owner)
+}
+
+func (m *kvMeta) plockKey(inode Ino, sid int64, owner uint64) []byte {
+	return m.fmtKey("P", inode, uint64(sid), owner)
+}
+
+func (m *kvMeta) sessionKey(sid int64) []byte {
+	return m.fmtKey("SH", uint64(sid))
+}
+
+func (m *kvMeta) sessionInfoKey(sid int64) []byte {
+	return m.fmtKey("SS", uint64(sid))
+}
+
+func (m *kvMeta) sustainedKey(sid int64, inode Ino) []byte {
+	return m.fmtKey("SI", uint64(sid), inode)
+}
+
+func (m *kvMeta) delfileKey(inode Ino, length uint64) []byte {
+	return m.fmtKey("D", inode, length)
+}
+
+func (m *kvMeta) dirQuotaKey(inode Ino) []byte {
+	return m.fmtKey("QD", inode)
+}
+
+func (m *kvMeta) dirStatKey(inode Ino) []byte {
+	return m.fmtKey("U", inode)
+}
+
+func (m *kvMeta) dirDeltaKey(inode Ino) []byte {
+	return m.fmtKey("W", inode)
+}
+
+func (m *kvMeta) counterKey(name string) []byte {
+	return m.fmtKey("C", name)
+}
+
+func (m *kvMeta) encodeInt(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func (m *kvMeta) parseInt(buf []byte) int64 {
+	if len(buf) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func (m *kvMeta) incrBy(tx kvTxn, key []byte, delta int64) int64 {
+	v := m.parseInt(tx.get(key)) + delta
+	tx.set(key, m.encodeInt(v))
+	return v
+}
+
+// updateParent adds delta to the number of entries of a file with hardlinks in the parent.
+func (m *kvMeta) updateParent(tx kvTxn, inode, parent Ino, delta int64) {
+	key := m.parentKey(inode, parent)
+	if m.incrBy(tx, key, delta) <= 0 {
+		tx.dels(key)
+	}
+}
+
+func (m *kvMeta) exist(tx kvTxn, prefix []byte) bool {
+	var found bool
+	tx.scan(prefix, func(_, _ []byte) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+func (m *kvMeta) scanValues(tx kvTxn, prefix []byte) map[string][]byte {
+	values := make(map[string][]byte)
+	tx.scan(prefix, func(k, v []byte) bool {
+		values[string(k)] = v
+		return true
+	})
+	return values
+}
+
+func (m *kvMeta) txn(f func(tx kvTxn) error) syscall.Errno {
+	return errno(m.client.txn(f))
+}
+
+func (m *kvMeta) get(key []byte) ([]byte, error) {
+	var value []byte
+	err := m.client.txn(func(tx kvTxn) error {
+		value = tx.get(key)
+		return nil
+	})
+	return value, err
+}
+
+func (m *kvMeta) scanValuesOf(prefix []byte) (map[string][]byte, error) {
+	var values map[string][]byte
+	err := m.client.txn(func(tx kvTxn) error {
+		values = m.scanValues(tx, prefix)
+		return nil
+	})
+	return values, err
+}
+
+func (m *kvMeta) Reset() error {
+	return m.client.txn(func(tx kvTxn) error {
+		var keys [][]byte
+		tx.scan(nil, func(key, _ []byte) bool {
+			// the keys of the volumes with prefix are left
+			if _, ok := m.client.(*prefixClient); ok || key[0] != prefixMark {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		tx.dels(keys...)
+		return nil
+	})
+}
+
+func (m *kvMeta) Init(format Format, force bool) error {
+	body, err := m.get([]byte("setting"))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		var old Format
+		err = json.Unmarshal(body, &old)
+		if err != nil {
+			logger.Fatalf("existing format is broken: %s", err)
+		}
+		if force {
+			old.SecretKey = "removed"
+			logger.Warnf("Existing volume will be overwrited: %+v", old)
+		} else {
+			// only AccessKey, SecretKey, the limits, TrashDays and EnableACL can be safely updated.
+			format.UUID = old.UUID
+			old.AccessKey = format.AccessKey
+			old.SecretKey = format.SecretKey
+			old.Capacity = format.Capacity
+			old.Inodes = format.Inodes
+			old.TrashDays = format.TrashDays
+			if !old.EnableACL {
+				// ACL can be enabled for an existing volume, but not disabled
+				old.EnableACL = format.EnableACL
+			}
+			if format != old {
+				old.SecretKey = ""
+				format.SecretKey = ""
+				return fmt.Errorf("cannot update format from %+v to %+v", old, format)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(format, "", "")
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+	m.setFormat(&format)
+
+	// root inode
+	var attr Attr
+	attr.Typ = TypeDirectory
+	attr.Mode = 0777
+	ts := time.Now().Unix()
+	attr.Atime = ts
+	attr.Mtime = ts
+	attr.Ctime = ts
+	attr.Nlink = 2
+	attr.Length = 4 << 10
+	attr.Parent = 1
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set([]byte("setting"), data)
+		tx.set(m.inodeKey(1), m.marshal(&attr))
+		if body == nil {
+			tx.set(m.dirStatKey(1), m.packDirStat(&dirStat{}))
+		}
+		if format.TrashDays > 0 && tx.get(m.inodeKey(TrashInode)) == nil {
+			tx.set(m.inodeKey(TrashInode), m.marshal(specialRootAttr()))
+			tx.set(m.dirStatKey(TrashInode), m.packDirStat(&dirStat{}))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) Load() (*Format, error) {
+	body, err := m.get([]byte("setting"))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, fmt.Errorf("no volume found")
+	}
+	var format Format
+	err = json.Unmarshal(body, &format)
+	if err != nil {
+		return nil, fmt.Errorf("json: %s", err)
+	}
+	m.setFormat(&format)
+	return &format, nil
+}
+
+func (m *kvMeta) NewSession() error {
+	m.loadQuotas()
+	go m.flushQuotas()
+	go m.refreshFormat()
+	if m.conf.ReadOnly {
+		return nil
+	}
+	sid, err := m.incrCounter("nextsession", 1)
+	if err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+	m.sid = sid
+	if err = m.client.txn(func(tx kvTxn) error {
+		tx.set(m.sessionKey(m.sid), m.encodeInt(time.Now().Unix()))
+		tx.set(m.sessionInfoKey(m.sid), m.newSessionInfo())
+		return nil
+	}); err != nil {
+		return fmt.Errorf("set session: %s", err)
+	}
+	logger.Debugf("session is %d", m.sid)
+
+	go m.refreshSession()
+	go m.cleanupDeletedFiles()
+	go m.cleanupSlices()
+	go m.cleanupLeakedChunks()
+	go m.cleanupTrash()
+	go m.cleanupEvents()
+	go m.flushDirStats()
+	go m.flushAtimes()
+	return nil
+}
+
+func (m *kvMeta) incrCounter(name string, delta int64) (int64, error) {
+	var v int64
+	err := m.client.txn(func(tx kvTxn) error {
+		v = m.incrBy(tx, m.counterKey(name), delta)
+		return nil
+	})
+	return v, err
+}
+
+func (m *kvMeta) getCounter(name string) (int64, error) {
+	buf, err := m.get(m.counterKey(name))
+	return m.parseInt(buf), err
+}
+
+// counterOf returns a function to read counters within the transaction.
+func (m *kvMeta) counterOf(tx kvTxn) func(name string) (int64, error) {
+	return func(name string) (int64, error) {
+		return m.parseInt(tx.get(m.counterKey(name))), nil
+	}
+}
+
+func (m *kvMeta) getAttr(tx kvTxn, inode Ino, attr *Attr) error {
+	a := tx.get(m.inodeKey(inode))
+	if a == nil {
+		return syscall.ENOENT
+	}
+	m.parseAttr(a, attr)
+	return nil
+}
+
+func (m *kvMeta) getEntry(tx kvTxn, parent Ino, name string) (uint8, Ino, error) {
+	buf := tx.get(m.entryKey(parent, name))
+	if buf == nil {
+		return 0, 0, syscall.ENOENT
+	}
+	typ, inode := m.parseEntry(buf)
+	return typ, inode, nil
+}
+
+func (m *kvMeta) appendSlice(tx kvTxn, inode Ino, indx uint32, buf []byte) int {
+	key := m.chunkKey(inode, indx)
+	val := append(tx.get(key), buf...)
+	tx.set(key, val)
+	return len(val) / sliceBytes
+}
+
+func (m *kvMeta) doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	return m.txn(func(tx kvTxn) error {
+		_, ino, err := m.getEntry(tx, parent, name)
+		if err == nil && attr != nil {
+			err = m.getAttr(tx, ino, attr)
+		}
+		if err == nil && inode != nil {
+			*inode = ino
+		}
+		return err
+	})
+}
+
+func (m *kvMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	return m.txn(func(tx kvTxn) error {
+		return m.getAttr(tx, inode, attr)
+	})
+}
+
+func (m *kvMeta) doReadlink(ctx Context, inode Ino) ([]byte, error) {
+	target, err := m.get(m.symKey(inode))
+	if err == nil && target == nil {
+		err = syscall.ENOENT
+	}
+	return target, err
+}
+
+func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, inode)
+	var delta int64
+	st := m.txn(func(tx kvTxn) error {
+		var t Attr
+		if err := m.getAttr(tx, inode, &t); err != nil {
+			return err
+		}
+		if t.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if t.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		old := t.Length
+		var zeroChunks []uint32
+		if length > old {
+			prefix := m.fmtKey("A", inode, "C")
+			tx.scan(prefix, func(k, _ []byte) bool {
+				indx := binary.BigEndian.Uint32(k[len(prefix):])
+				if uint64(indx) > old/ChunkSize && uint64(indx) < length/ChunkSize {
+					zeroChunks = append(zeroChunks, indx)
+				}
+				return true
+			})
+		}
+		if err := m.checkQuota(align4K(length)-align4K(old), 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, align4K(length)-align4K(old), 0); err != nil {
+			return err
+		}
+		delta = align4K(length) - align4K(old)
+		if err := m.updateFileStats(tx, inode, t.Parent, int64(length)-int64(old), delta); err != nil {
+			return err
+		}
+		t.Length = length
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&t))
+		if length > old {
+			// zero out from old to length
+			var l = uint32(length - old)
+			if length > (old/ChunkSize+1)*ChunkSize {
+				l = ChunkSize - uint32(old%ChunkSize)
+			}
+			m.appendSlice(tx, inode, uint32(old/ChunkSize), marshalSlice(uint32(old%ChunkSize), 0, 0, 0, l))
+			buf := marshalSlice(0, 0, 0, 0, ChunkSize)
+			for _, indx := range zeroChunks {
+				m.appendSlice(tx, inode, indx, buf)
+			}
+			if length > (old/ChunkSize+1)*ChunkSize && length%ChunkSize > 0 {
+				m.appendSlice(tx, inode, uint32(length/ChunkSize), marshalSlice(0, 0, 0, 0, uint32(length%ChunkSize)))
+			}
+		}
+		m.incrBy(tx, m.counterKey(usedSpace), align4K(length)-align4K(old))
+		if attr != nil {
+			*attr = t
+		}
+		return nil
+	})
+	if st == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, inode)
+	var delta int64
+	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
+		return syscall.EINVAL
+	}
+	if mode&fallocInsertRange != 0 && mode != fallocInsertRange {
+		return syscall.EINVAL
+	}
+	if mode == fallocInsertRange || mode == fallocCollapesRange {
+		return syscall.ENOTSUP
+	}
+	if mode&fallocPunchHole != 0 && mode&fallocKeepSize == 0 {
+		return syscall.EINVAL
+	}
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	st := m.txn(func(tx kvTxn) error {
+		var t Attr
+		if err := m.getAttr(tx, inode, &t); err != nil {
+			return err
+		}
+		if t.Typ == TypeFIFO {
+			return syscall.EPIPE
+		}
+		if t.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if t.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		length := t.Length
+		if off+size > t.Length {
+			if mode&fallocKeepSize == 0 {
+				length = off + size
+			}
+		}
+
+		old := t.Length
+		if err := m.checkQuota(align4K(length)-align4K(old), 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, align4K(length)-align4K(old), 0); err != nil {
+			return err
+		}
+		delta = align4K(length) - align4K(old)
+		if err := m.updateFileStats(tx, inode, t.Parent, int64(length)-int64(old), delta); err != nil {
+			return err
+		}
+		t.Length = length
+		now := time.Now()
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&t))
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			if off+size > old {
+				size = old - off
+			}
+			for size > 0 {
+				indx := uint32(off / ChunkSize)
+				coff := off % ChunkSize
+				l := size
+				if coff+size > ChunkSize {
+					l = ChunkSize - coff
+				}
+				m.appendSlice(tx, inode, indx, marshalSlice(uint32(coff), 0, 0, 0, uint32(l)))
+				off += l
+				size -= l
+			}
+		}
+		m.incrBy(tx, m.counterKey(usedSpace), align4K(length)-align4K(old))
+		return nil
+	})
+	if st == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var cur Attr
+		if err := m.getAttr(tx, inode, &cur); err != nil {
+			return err
+		}
+		if cur.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if cur.Flags&(FlagImmutable|FlagAppend) != 0 && set&^SetAttrFlag != 0 {
+			return syscall.EPERM
+		}
+		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
+			attr.Mode |= (cur.Mode & 06000)
+		}
+		if (cur.Mode&06000) != 0 && (set&(SetAttrUID|SetAttrGID)) != 0 {
+			cur.Mode &= 01777
+			attr.Mode &= 01777
+		}
+		if set&SetAttrUID != 0 {
+			cur.Uid = attr.Uid
+		}
+		if set&SetAttrGID != 0 {
+			cur.Gid = attr.Gid
+		}
+		if set&SetAttrMode != 0 {
+			if ctx.Uid() != 0 && (attr.Mode&02000) != 0 {
+				if ctx.Gid() != cur.Gid {
+					attr.Mode &= 05777
+				}
+			}
+			cur.Mode = attr.Mode
+		}
+		if set&SetAttrFlag != 0 {
+			cur.Flags = attr.Flags
+		}
+		now := time.Now()
+		if set&SetAttrAtime != 0 {
+			cur.Atime = attr.Atime
+			cur.Atimensec = attr.Atimensec
+		}
+		if set&SetAttrAtimeNow != 0 {
+			cur.Atime = now.Unix()
+			cur.Atimensec = uint32(now.Nanosecond())
+		}
+		if set&SetAttrMtime != 0 {
+			cur.Mtime = attr.Mtime
+			cur.Mtimensec = attr.Mtimensec
+		}
+		if set&SetAttrMtimeNow != 0 {
+			cur.Mtime = now.Unix()
+			cur.Mtimensec = uint32(now.Nanosecond())
+		}
+		cur.Ctime = now.Unix()
+		cur.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&cur))
+		*attr = cur
+		return nil
+	}))
+}
+
+func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	ino, err := m.nextInode()
+	if err != nil {
+		return errno(err)
+	}
+	if attr == nil {
+		attr = &Attr{}
+	}
+	attr.Flags = 0
+	attr.Typ = _type
+	attr.Mode = mode & ^cumask
+	attr.Uid = ctx.Uid()
+	attr.Gid = ctx.Gid()
+	if _type == TypeDirectory {
+		attr.Nlink = 2
+		attr.Length = 4 << 10
+	} else {
+		attr.Nlink = 1
+		if _type == TypeSymlink {
+			attr.Length = uint64(len(path))
+		} else {
+			attr.Length = 0
+			attr.Rdev = rdev
+		}
+	}
+	attr.Parent = parent
+	attr.Full = true
+	if inode != nil {
+		*inode = ino
+	}
+
+	return m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var pattr Attr
+		if err := m.getAttr(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if pattr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		if tx.get(m.entryKey(parent, name)) != nil {
+			return syscall.EEXIST
+		}
+
+		if err := m.checkQuota(0, 1, m.counterOf(tx)); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if _type == TypeDirectory {
+			pattr.Nlink++
+		}
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		if ctx.Value(CtxKey("behavior")) == "Hadoop" {
+			attr.Gid = pattr.Gid
+		}
+
+		tx.set(m.entryKey(parent, name), m.packEntry(_type, ino))
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		tx.set(m.inodeKey(ino), m.marshal(attr))
+		if _type == TypeSymlink {
+			tx.set(m.symKey(ino), []byte(path))
+		} else if _type == TypeDirectory {
+			tx.set(m.dirStatKey(ino), m.packDirStat(&dirStat{}))
+		}
+		m.incrBy(tx, m.counterKey(totalInodes), 1)
+		m.updateDirStat(tx, parent, entryStat(_type, attr.Length, nil))
+		return nil
+	}))
+}
+
+// removeInode drops a node that has no more links, a file is kept until closed if it's still opened.
+func (m *kvMeta) removeInode(tx kvTxn, inode Ino, attr *Attr, opened bool) {
+	switch attr.Typ {
+	case TypeFile:
+		if opened {
+			tx.set(m.inodeKey(inode), m.marshal(attr))
+			tx.set(m.sustainedKey(m.sid, inode), []byte{1})
+		} else {
+			tx.set(m.delfileKey(inode, attr.Length), m.encodeInt(time.Now().Unix()))
+			tx.dels(m.inodeKey(inode))
+			m.incrBy(tx, m.counterKey(usedSpace), -align4K(attr.Length))
+		}
+	case TypeSymlink:
+		tx.dels(m.symKey(inode), m.inodeKey(inode))
+	case TypeDirectory:
+		tx.dels(m.inodeKey(inode))
+		m.delDirStat(tx, inode)
+	default:
+		tx.dels(m.inodeKey(inode))
+	}
+	var keys [][]byte
+	tx.scan(m.fmtKey("A", inode, "X"), func(k, _ []byte) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if attr.Parent == 0 {
+		tx.scan(m.fmtKey("A", inode, "P"), func(k, _ []byte) bool {
+			keys = append(keys, k)
+			return true
+		})
+	}
+	tx.dels(keys...)
+	m.incrBy(tx, m.counterKey(totalInodes), -1)
+}
+
+func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
+	var _type uint8
+	var inode Ino
+	var attr Attr
+	var opened bool
+	err := m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var pattr Attr
+		if err := m.getAttr(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		var err error
+		_type, inode, err = m.getEntry(tx, parent, name)
+		if err != nil {
+			return err
+		}
+		if _type == TypeDirectory {
+			return syscall.EPERM
+		}
+		if err = m.getAttr(tx, inode, &attr); err != nil {
+			return err
+		}
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Nlink--
+		opened = false
+		if _type == TypeFile && attr.Nlink == 0 {
+			m.Lock()
+			opened = m.isOpen(inode)
+			m.Unlock()
+		}
+
+		tx.dels(m.entryKey(parent, name))
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		m.updateDirStat(tx, parent, entryStat(_type, attr.Length, nil).neg())
+		if attr.Nlink > 0 {
+			tx.set(m.inodeKey(inode), m.marshal(&attr))
+			if attr.Parent == 0 {
+				m.updateParent(tx, inode, parent, -1)
+			}
+		} else {
+			m.removeInode(tx, inode, &attr, opened)
+		}
+		return nil
+	}))
+	if err == 0 && _type == TypeFile && attr.Nlink == 0 {
+		if opened {
+			m.Lock()
+			m.removedFiles[inode] = true
+			m.Unlock()
+		} else {
+			go m.deleteFile(inode, attr.Length)
+		}
+	}
+	return err
+}
+
+func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var pattr Attr
+		if err := m.getAttr(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		typ, inode, err := m.getEntry(tx, parent, name)
+		if err != nil {
+			return err
+		}
+		if typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if m.exist(tx, m.fmtKey("A", inode, "D")) {
+			return syscall.ENOTEMPTY
+		}
+		now := time.Now()
+		pattr.Nlink--
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+
+		tx.dels(m.entryKey(parent, name))
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		m.updateDirStat(tx, parent, entryStat(TypeDirectory, 0, m.getDirStat(tx, inode)).neg())
+		m.removeInode(tx, inode, &Attr{Typ: TypeDirectory}, false)
+		return nil
+	}))
+}
+
+func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno {
+	var dino Ino
+	var dtyp uint8
+	var tattr Attr
+	var opened bool
+	err := m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var sattr, iattr Attr
+		if err := m.getAttr(tx, parentSrc, &sattr); err != nil {
+			return err
+		}
+		if sattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		typ, ino, err := m.getEntry(tx, parentSrc, nameSrc)
+		if err != nil {
+			return err
+		}
+		if inode != nil {
+			*inode = ino
+		}
+		if parentSrc == parentDst && nameSrc == nameDst {
+			return nil
+		}
+		var dattr = &sattr
+		if parentDst != parentSrc {
+			dattr = &Attr{}
+			if err = m.getAttr(tx, parentDst, dattr); err != nil {
+				return err
+			}
+			if dattr.Typ != TypeDirectory {
+				return syscall.ENOTDIR
+			}
+			// a directory is moved into the trash only when it's removed
+			if typ == TypeDirectory && dattr.Parent == TrashInode && m.exist(tx, m.fmtKey("A", ino, "D")) {
+				return syscall.ENOTEMPTY
+			}
+		}
+		now := time.Now()
+		opened = false
+		tattr = Attr{}
+		dtyp, dino, err = m.getEntry(tx, parentDst, nameDst)
+		if err == syscall.ENOENT {
+			dino = 0
+		} else if err != nil {
+			return err
+		} else {
+			if ctx.Value(CtxKey("behavior")) == "Hadoop" {
+				return syscall.EEXIST
+			}
+			if err = m.getAttr(tx, dino, &tattr); err != nil {
+				return err
+			}
+			if dtyp == TypeDirectory {
+				if m.exist(tx, m.fmtKey("A", dino, "D")) {
+					return syscall.ENOTEMPTY
+				}
+			} else {
+				tattr.Nlink--
+				if tattr.Nlink > 0 {
+					tattr.Ctime = now.Unix()
+					tattr.Ctimensec = uint32(now.Nanosecond())
+				} else if dtyp == TypeFile {
+					m.Lock()
+					opened = m.isOpen(dino)
+					m.Unlock()
+				}
+			}
+		}
+
+		if err = m.getAttr(tx, ino, &iattr); err != nil {
+			return err
+		}
+		sattr.Mtime = now.Unix()
+		sattr.Mtimensec = uint32(now.Nanosecond())
+		sattr.Ctime = now.Unix()
+		sattr.Ctimensec = uint32(now.Nanosecond())
+		dattr.Mtime = now.Unix()
+		dattr.Mtimensec = uint32(now.Nanosecond())
+		dattr.Ctime = now.Unix()
+		dattr.Ctimensec = uint32(now.Nanosecond())
+		// the parents of a file with hardlinks are counted separately
+		if iattr.Parent > 0 {
+			iattr.Parent = parentDst
+		} else if parentSrc != parentDst {
+			m.updateParent(tx, ino, parentSrc, -1)
+			m.updateParent(tx, ino, parentDst, 1)
+		}
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		if typ == TypeDirectory && parentSrc != parentDst {
+			sattr.Nlink--
+			dattr.Nlink++
+		}
+		if attr != nil {
+			*attr = iattr
+		}
+
+		tx.dels(m.entryKey(parentSrc, nameSrc))
+		if parentSrc != parentDst {
+			var sub *dirStat
+			if typ == TypeDirectory {
+				sub = m.getDirStat(tx, ino)
+			}
+			moved := entryStat(typ, iattr.Length, sub)
+			m.updateDirStat(tx, parentSrc, moved.neg())
+			m.updateDirStat(tx, parentDst, moved)
+		}
+		if dino > 0 {
+			var tsub *dirStat
+			if dtyp == TypeDirectory {
+				tsub = m.getDirStat(tx, dino)
+			}
+			m.updateDirStat(tx, parentDst, entryStat(dtyp, tattr.Length, tsub).neg())
+			if dtyp != TypeDirectory && tattr.Nlink > 0 {
+				tx.set(m.inodeKey(dino), m.marshal(&tattr))
+				if tattr.Parent == 0 {
+					m.updateParent(tx, dino, parentDst, -1)
+				}
+			} else {
+				if dtyp == TypeDirectory {
+					dattr.Nlink--
+				}
+				m.removeInode(tx, dino, &tattr, opened)
+			}
+		}
+		tx.set(m.entryKey(parentDst, nameDst), m.packEntry(typ, ino))
+		tx.set(m.inodeKey(parentSrc), m.marshal(&sattr))
+		if parentDst != parentSrc {
+			tx.set(m.inodeKey(parentDst), m.marshal(dattr))
+		}
+		tx.set(m.inodeKey(ino), m.marshal(&iattr))
+		return nil
+	}))
+	if err == 0 && dino > 0 && dtyp == TypeFile && tattr.Nlink == 0 {
+		if opened {
+			m.Lock()
+			m.removedFiles[dino] = true
+			m.Unlock()
+		} else {
+			go m.deleteFile(dino, tattr.Length)
+		}
+	}
+	return err
+}
+
+func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var pattr, iattr Attr
+		if err := m.getAttr(tx, parent, &pattr); err != nil {
+			return err
+		}
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if err := m.getAttr(tx, inode, &iattr); err != nil {
+			return err
+		}
+		if iattr.Typ == TypeDirectory {
+			return syscall.EPERM
+		}
+		if tx.get(m.entryKey(parent, name)) != nil {
+			return syscall.EEXIST
+		}
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Nlink++
+		// the parents are counted separately once a file has more than one link
+		if iattr.Parent > 0 {
+			m.updateParent(tx, inode, iattr.Parent, 1)
+			iattr.Parent = 0
+		}
+		m.updateParent(tx, inode, parent, 1)
+		m.updateDirStat(tx, parent, entryStat(iattr.Typ, iattr.Length, nil))
+
+		tx.set(m.entryKey(parent, name), m.packEntry(iattr.Typ, inode))
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		tx.set(m.inodeKey(inode), m.marshal(&iattr))
+		if attr != nil {
+			*attr = iattr
+		}
+		return nil
+	}))
+}
+
+func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
+	return m.txn(func(tx kvTxn) error {
+		prefix := m.fmtKey("A", inode, "D")
+		tx.scan(prefix, func(k, v []byte) bool {
+			typ, ino := m.parseEntry(v)
+			e := &Entry{
+				Inode: ino,
+				Name:  append([]byte{}, k[len(prefix):]...),
+				Attr:  &Attr{Typ: typ},
+			}
+			*entries = append(*entries, e)
+			return true
+		})
+		if plus != 0 {
+			for _, e := range *entries {
+				if e.Name[0] == '.' && (len(e.Name) == 1 || len(e.Name) == 2 && e.Name[1] == '.') {
+					continue
+				}
+				if a := tx.get(m.inodeKey(e.Inode)); a != nil {
+					m.parseAttr(a, e.Attr)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno {
+	prefix := m.fmtKey("A", inode, "D")
+	begin := append(append([]byte{}, prefix...), *cursor...)
+	if *cursor != "" {
+		begin = append(begin, 0) // right after the last entry of the previous page
+	}
+	var es []*Entry
+	st := m.txn(func(tx kvTxn) error {
+		es = es[:0]
+		tx.scanRange(begin, m.fmtKey("A", inode, "E"), func(k, v []byte) bool {
+			typ, ino := m.parseEntry(v)
+			es = append(es, &Entry{
+				Inode: ino,
+				Name:  append([]byte{}, k[len(prefix):]...),
+				Attr:  &Attr{Typ: typ},
+			})
+			return len(es) < limit
+		})
+		if plus != 0 {
+			for _, e := range es {
+				if a := tx.get(m.inodeKey(e.Inode)); a != nil {
+					m.parseAttr(a, e.Attr)
+				}
+			}
+		}
+		return nil
+	})
+	if st != 0 {
+		return st
+	}
+	if len(es) < limit {
+		*cursor = ""
+	} else {
+		*cursor = string(es[len(es)-1].Name)
+	}
+	*entries = append(*entries, es...)
+	return 0
+}
+
+func (m *kvMeta) doDeleteSustainedInode(sid int64, inode Ino) error {
+	err := m.deleteInode(inode)
+	if err == nil {
+		err = m.client.txn(func(tx kvTxn) error {
+			tx.dels(m.sustainedKey(sid, inode))
+			return nil
+		})
+	}
+	return err
+}
+
+func (m *kvMeta) deleteInode(inode Ino) error {
+	var attr Attr
+	var found bool
+	err := m.client.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if found = a != nil; !found {
+			return nil
+		}
+		m.parseAttr(a, &attr)
+		tx.set(m.delfileKey(inode, attr.Length), m.encodeInt(time.Now().Unix()))
+		tx.dels(m.inodeKey(inode))
+		m.incrBy(tx, m.counterKey(usedSpace), -align4K(attr.Length))
+		return nil
+	})
+	if err == nil && found {
+		go m.deleteFile(inode, attr.Length)
+	}
+	return err
+}
+
+func (m *kvMeta) cleanStaleSession(sid int64) error {
+	vals, err := m.scanValuesOf(m.fmtKey("SI", uint64(sid)))
+	if err != nil {
+		return err
+	}
+	for k := range vals {
+		inode := Ino(binary.BigEndian.Uint64([]byte(k)[10:]))
+		if err = m.doDeleteSustainedInode(sid, inode); err != nil {
+			logger.Errorf("Failed to delete inode %d: %s", inode, err)
+			return err
+		}
+	}
+	return m.client.txn(func(tx kvTxn) error {
+		tx.dels(m.sessionKey(sid), m.sessionInfoKey(sid))
+		return nil
+	})
+}
+
+// cleanLocks removes all the flocks and plocks owned by the sessions.
+func (m *kvMeta) cleanLocks(sids map[int64]bool) error {
+	for _, prefix := range []string{"F", "P"} {
+		err := m.client.txn(func(tx kvTxn) error {
+			var keys [][]byte
+			tx.scan([]byte(prefix), func(k, _ []byte) bool {
+				if len(k) == 25 && sids[int64(binary.BigEndian.Uint64(k[9:17]))] {
+					keys = append(keys, k)
+				}
+				return true
+			})
+			tx.dels(keys...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) cleanStaleSessions() {
+	vals, err := m.scanValuesOf([]byte("SH"))
+	if err != nil {
+		return
+	}
+	stale := make(map[int64]bool)
+	for k, v := range vals {
+		if m.parseInt(v) < time.Now().Add(-staleAfter).Unix() {
+			stale[int64(binary.BigEndian.Uint64([]byte(k)[2:]))] = true
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	if err = m.cleanLocks(stale); err != nil {
+		logger.Warnf("cleanup locks from stale sessions: %s", err)
+	}
+	for sid := range stale {
+		if err = m.cleanStaleSession(sid); err != nil {
+			logger.Warnf("clean stale session %d: %s", sid, err)
+		}
+	}
+}
+
+func (m *kvMeta) ListSessions() ([]*Session, error) {
+	var sessions []*Session
+	err := m.client.txn(func(tx kvTxn) error {
+		sessions = nil
+		sessionOf := make(map[uint64]*Session)
+		infos := m.scanValues(tx, []byte("SS"))
+		for k, v := range m.scanValues(tx, []byte("SH")) {
+			info := infos["SS"+k[2:]]
+			s := newSession(binary.BigEndian.Uint64([]byte(k)[2:]), m.parseInt(v), info)
+			sessions = append(sessions, s)
+			sessionOf[s.Sid] = s
+		}
+		tx.scan([]byte("SI"), func(k, _ []byte) bool {
+			if s := sessionOf[binary.BigEndian.Uint64(k[2:10])]; s != nil && len(k) == 18 {
+				s.Sustained = append(s.Sustained, Ino(binary.BigEndian.Uint64(k[10:])))
+			}
+			return true
+		})
+		for _, prefix := range []string{"F", "P"} {
+			tx.scan([]byte(prefix), func(k, v []byte) bool {
+				if len(k) != 25 {
+					return true
+				}
+				s := sessionOf[binary.BigEndian.Uint64(k[9:17])]
+				if s == nil {
+					return true
+				}
+				inode := Ino(binary.BigEndian.Uint64(k[1:9]))
+				owner := binary.BigEndian.Uint64(k[17:])
+				if prefix == "F" {
+					s.Flocks = append(s.Flocks, Flock{inode, owner, string(v)})
+				} else {
+					s.Plocks = append(s.Plocks, Plock{inode, owner, parsePlockRecords(v)})
+				}
+				return true
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (m *kvMeta) CleanSession(sid uint64) error {
+	if err := m.cleanLocks(map[int64]bool{int64(sid): true}); err != nil {
+		return err
+	}
+	return m.cleanStaleSession(int64(sid))
+}
+
+func (m *kvMeta) refreshSession() {
+	for {
+		time.Sleep(time.Minute)
+		err := m.client.txn(func(tx kvTxn) error {
+			tx.set(m.sessionKey(m.sid), m.encodeInt(time.Now().Unix()))
+			return nil
+		})
+		if err != nil {
+			logger.Warnf("refresh session %d: %s", m.sid, err)
+		}
+		go m.cleanStaleSessions()
+	}
+}
+
+func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
+	buf, err := m.get(m.chunkKey(inode, indx))
+	if err != nil {
+		return errno(err)
+	}
+	ss := readSliceBuf(buf)
+	*chunks = buildSlice(ss)
+	if len(ss) >= 5 {
+		go m.compactChunk(inode, indx)
+	}
+	return 0
+}
+
+func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, inode)
+	var delta int64
+	var slices int
+	err := m.txn(func(tx kvTxn) error {
+		var attr Attr
+		if err := m.getAttr(tx, inode, &attr); err != nil {
+			return err
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if attr.Flags&(FlagImmutable|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+		// an append-only file could have been flagged after it's opened
+		if attr.Flags&FlagAppend != 0 && uint64(indx)*ChunkSize+uint64(off) < attr.Length {
+			return syscall.EPERM
+		}
+		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
+		var added, grown int64
+		if newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			grown = int64(newleng - attr.Length)
+			attr.Length = newleng
+		}
+		if err := m.checkQuota(added, 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, added, 0); err != nil {
+			return err
+		}
+		delta = added
+		if err := m.updateFileStats(tx, inode, attr.Parent, grown, delta); err != nil {
+			return err
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+
+		// most of chunk are used by single inode, so use that as the default (1 == not exists)
+		slices = m.appendSlice(tx, inode, indx, marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		if added > 0 {
+			m.incrBy(tx, m.counterKey(usedSpace), added)
+		}
+		return nil
+	})
+	if err == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+		m.markWritten(inode)
+	}
+	if err == 0 && slices%20 == 0 {
+		go m.compactChunk(inode, indx)
+	}
+	return err
+}
+
+func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	qs := m.fileQuotas(ctx, fout)
+	var delta int64
+	st := m.txn(func(tx kvTxn) error {
+		var sattr, attr Attr
+		if err := m.getAttr(tx, fin, &sattr); err != nil {
+			return err
+		}
+		if sattr.Typ != TypeFile {
+			return syscall.EINVAL
+		}
+		if offIn >= sattr.Length {
+			*copied = 0
+			return nil
+		}
+		if offIn+size > sattr.Length {
+			size = sattr.Length - offIn
+		}
+		if err := m.getAttr(tx, fout, &attr); err != nil {
+			return err
+		}
+		if attr.Typ != TypeFile {
+			return syscall.EINVAL
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		if attr.Flags&(FlagImmutable|FlagAppend|FlagRetention) != 0 {
+			return syscall.EPERM
+		}
+
+		newleng := offOut + size
+		var added, grown int64
+		if newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			grown = int64(newleng - attr.Length)
+			attr.Length = newleng
+		}
+		if err := m.checkQuota(added, 0, m.counterOf(tx)); err != nil {
+			return err
+		}
+		if err := m.checkDirQuotas(qs, added, 0); err != nil {
+			return err
+		}
+		delta = added
+		if err := m.updateFileStats(tx, fout, attr.Parent, grown, delta); err != nil {
+			return err
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+
+		coff := offIn / ChunkSize * ChunkSize
+		for i := offIn / ChunkSize; i <= (offIn+size)/ChunkSize; i++ {
+			// Add a zero chunk for hole
+			ss := append([]*slice{{len: ChunkSize}}, readSliceBuf(tx.get(m.chunkKey(fin, uint32(i))))...)
+			cs := buildSlice(ss)
+			var tpos uint32
+			for _, s := range cs {
+				pos := tpos
+				tpos += s.Len
+				if coff+uint64(pos) < offIn+size && coff+uint64(pos)+uint64(s.Len) > offIn {
+					if coff+uint64(pos) < offIn {
+						dec := uint32(offIn - coff - uint64(pos))
+						s.Off += dec
+						pos += dec
+						s.Len -= dec
+					}
+					if coff+uint64(pos)+uint64(s.Len) > offIn+size {
+						dec := uint32(offIn + size - (coff + uint64(pos) + uint64(s.Len)))
+						s.Len -= dec
+					}
+					doff := coff + uint64(pos) - offIn + offOut
+					indx := uint32(doff / ChunkSize)
+					dpos := uint32(doff % ChunkSize)
+					if dpos+s.Len > ChunkSize {
+						m.appendSlice(tx, fout, indx, marshalSlice(dpos, s.Chunkid, s.Size, s.Off, ChunkSize-dpos))
+						skip := ChunkSize - dpos
+						m.appendSlice(tx, fout, indx+1, marshalSlice(0, s.Chunkid, s.Size, s.Off+skip, s.Len-skip))
+						if s.Chunkid > 0 {
+							m.incrBy(tx, m.sliceKey(s.Chunkid, s.Size), 2)
+						}
+					} else {
+						m.appendSlice(tx, fout, indx, marshalSlice(dpos, s.Chunkid, s.Size, s.Off, s.Len))
+						if s.Chunkid > 0 {
+							m.incrBy(tx, m.sliceKey(s.Chunkid, s.Size), 1)
+						}
+					}
+				}
+			}
+			coff += ChunkSize
+		}
+		tx.set(m.inodeKey(fout), m.marshal(&attr))
+		if added > 0 {
+			m.incrBy(tx, m.counterKey(usedSpace), added)
+		}
+		*copied = size
+		return nil
+	})
+	if st == 0 {
+		m.updateDirQuotas(qs, delta, 0)
+		m.markWritten(fout)
+	}
+	return st
+}
+
+func (m *kvMeta) cleanupDeletedFiles() {
+	for {
+		time.Sleep(time.Minute)
+		vals, err := m.scanValuesOf([]byte("D"))
+		if err != nil {
+			continue
+		}
+		for k, v := range vals {
+			if len(k) != 17 || m.parseInt(v) > time.Now().Add(-time.Hour).Unix() {
+				continue
+			}
+			inode := Ino(binary.BigEndian.Uint64([]byte(k)[1:9]))
+			length := binary.BigEndian.Uint64([]byte(k)[9:])
+			logger.Debugf("cleanup chunks of inode %d with %d bytes", inode, length)
+			m.deleteFile(inode, length)
+		}
+	}
+}
+
+func (m *kvMeta) cleanupSlices() {
+	for {
+		time.Sleep(time.Hour)
+		vals, err := m.scanValuesOf([]byte("K"))
+		if err != nil {
+			logger.Errorf("scan slices: %s", err)
+			continue
+		}
+		for k, v := range vals {
+			if len(k) == 13 && m.parseInt(v) < 0 {
+				chunkid := binary.BigEndian.Uint64([]byte(k)[1:9])
+				size := binary.BigEndian.Uint32([]byte(k)[9:])
+				m.deleteSlice(chunkid, size)
+			}
+		}
+	}
+}
+
+func (m *kvMeta) cleanupLeakedChunks() {
+	time.Sleep(time.Second * 10)
+	type chunk struct {
+		inode Ino
+		indx  uint32
+	}
+	var leaked []chunk
+	err := m.client.txn(func(tx kvTxn) error {
+		leaked = nil
+		tx.scan([]byte("A"), func(k, _ []byte) bool {
+			if len(k) == 14 && k[9] == 'C' {
+				inode := Ino(binary.BigEndian.Uint64(k[1:9]))
+				if tx.get(m.inodeKey(inode)) == nil {
+					leaked = append(leaked, chunk{inode, binary.BigEndian.Uint32(k[10:])})
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("scan all chunks: %s", err)
+		return
+	}
+	for _, c := range leaked {
+		logger.Debugf("found leaked chunk %d_%d", c.inode, c.indx)
+		_ = m.deleteChunk(c.inode, c.indx)
+	}
+}
+
+func (m *kvMeta) deleteSlice(chunkid uint64, size uint32) {
+	err := m.newMsg(DeleteChunk, chunkid, size)
+	if err != nil {
+		logger.Warnf("delete chunk %d (%d bytes): %s", chunkid, size, err)
+	} else {
+		err = m.client.txn(func(tx kvTxn) error {
+			tx.dels(m.sliceKey(chunkid, size))
+			return nil
+		})
+		if err != nil {
+			logger.Errorf("delete slice %d: %s", chunkid, err)
+		}
+	}
+}
+
+func (m *kvMeta) deleteChunk(inode Ino, indx uint32) error {
+	var unused []*slice
+	err := m.client.txn(func(tx kvTxn) error {
+		unused = nil
+		key := m.chunkKey(inode, indx)
+		buf := tx.get(key)
+		if buf == nil {
+			return nil
+		}
+		tx.dels(key)
+		for _, s := range readSliceBuf(buf) {
+			if s.chunkid > 0 && m.incrBy(tx, m.sliceKey(s.chunkid, s.size), -1) < 0 {
+				unused = append(unused, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("delete slice from chunk %d_%d fail: %s, retry later", inode, indx, err)
+	}
+	for _, s := range unused {
+		m.deleteSlice(s.chunkid, s.size)
+	}
+	return nil
+}
+
+func (m *kvMeta) deleteFile(inode Ino, length uint64) {
+	var indexes []uint32
+	prefix := m.fmtKey("A", inode, "C")
+	err := m.client.txn(func(tx kvTxn) error {
+		indexes = nil
+		tx.scan(prefix, func(k, _ []byte) bool {
+			indexes = append(indexes, binary.BigEndian.Uint32(k[len(prefix):]))
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("delete chunks of inode %d: %s", inode, err)
+		return
+	}
+	for _, indx := range indexes {
+		if err = m.deleteChunk(inode, indx); err != nil {
+			logger.Warnf("delete chunk %d_%d: %s", inode, indx, err)
+			return
+		}
+	}
+	_ = m.client.txn(func(tx kvTxn) error {
+		tx.dels(m.delfileKey(inode, length))
+		return nil
+	})
+}
+
+func (m *kvMeta) compactChunk(inode Ino, indx uint32) {
+	// avoid too many or duplicated compaction
+	m.Lock()
+	k := uint64(inode) + (uint64(indx) << 32)
+	if len(m.compacting) > 10 || m.compacting[k] {
+		m.Unlock()
+		return
+	}
+	m.compacting[k] = true
+	m.Unlock()
+	defer func() {
+		m.Lock()
+		delete(m.compacting, k)
+		m.Unlock()
+	}()
+
+	buf, err := m.get(m.chunkKey(inode, indx))
+	if err != nil {
+		return
+	}
+	if len(buf) > sliceBytes*200 {
+		buf = buf[:sliceBytes*200]
+	}
+	chunkid, err := m.nextChunkID()
+	if err != nil {
+		return
+	}
+
+	ss := readSliceBuf(buf)
+	chunks := buildSlice(ss)
+	var size uint32
+	for _, s := range chunks {
+		size += s.Len
+	}
+	logger.Debugf("compact %d %d %d %d", inode, indx, len(ss), len(chunks))
+	err = m.newMsg(CompactChunk, chunks, chunkid)
+	if err != nil {
+		logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+		return
+	}
+	var unused []*slice
+	var left int
+	st := m.txn(func(tx kvTxn) error {
+		unused = nil
+		buf2 := tx.get(m.chunkKey(inode, indx))
+		if len(buf2) < len(buf) || !bytes.Equal(buf, buf2[:len(buf)]) {
+			return syscall.EINVAL
+		}
+		buf2 = append(marshalSlice(0, chunkid, size, 0, size), buf2[len(buf):]...)
+		left = len(buf2) / sliceBytes
+		tx.set(m.chunkKey(inode, indx), buf2)
+		// create the key to tracking it
+		tx.set(m.sliceKey(chunkid, size), m.encodeInt(0))
+		for _, s := range ss {
+			if s.chunkid > 0 && m.incrBy(tx, m.sliceKey(s.chunkid, s.size), -1) < 0 {
+				unused = append(unused, s)
+			}
+		}
+		return nil
+	})
+
+	if st == syscall.EINVAL {
+		m.deleteSlice(chunkid, size)
+	} else if st == 0 {
+		for _, s := range unused {
+			m.deleteSlice(s.chunkid, s.size)
+		}
+		if left > 5 {
+			go func() {
+				// wait for the current compaction to finish
+				time.Sleep(time.Millisecond * 10)
+				m.compactChunk(inode, indx)
+			}()
+		}
+	} else {
+		logger.Warnf("compact %d_%d: %s", inode, indx, st)
+	}
+}
+
+func (m *kvMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
+	*slices = nil
+	return m.txn(func(tx kvTxn) error {
+		tx.scan([]byte("A"), func(k, v []byte) bool {
+			if len(k) == 14 && k[9] == 'C' {
+				for _, s := range readSliceBuf(v) {
+					if s.chunkid > 0 {
+						*slices = append(*slices, Slice{Chunkid: s.chunkid, Size: s.size})
+					}
+				}
+			}
+			return true
+		})
+		return nil
+	})
+}
+
+func (m *kvMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	buf, err := m.get(m.xattrKey(inode, name))
+	if err == nil && buf == nil {
+		err = ENOATTR
+	}
+	*vbuff = buf
+	return errno(err)
+}
+
+func (m *kvMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno {
+	*names = nil
+	prefix := m.fmtKey("A", inode, "X")
+	return m.txn(func(tx kvTxn) error {
+		tx.scan(prefix, func(k, _ []byte) bool {
+			*names = append(*names, k[len(prefix):]...)
+			*names = append(*names, 0)
+			return true
+		})
+		return nil
+	})
+}
+
+func (m *kvMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var attr Attr
+		if err := m.getAttr(tx, inode, &attr); err != nil {
+			return err
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		tx.set(m.xattrKey(inode, name), value)
+		return nil
+	}))
+}
+
+func (m *kvMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	return m.txn(m.logged(ctx, func(tx kvTxn) error {
+		var attr Attr
+		if err := m.getAttr(tx, inode, &attr); err != nil {
+			return err
+		}
+		if attr.Flags&FlagSnapshot != 0 {
+			return syscall.EROFS
+		}
+		key := m.xattrKey(inode, name)
+		if tx.get(key) == nil {
+			return ENOATTR
+		}
+		tx.dels(key)
+		return nil
+	}))
+}
+
+func (m *kvMeta) doReadChunk(inode Ino, indx uint32) ([]byte, error) {
+	return m.get(m.chunkKey(inode, indx))
+}
+
+func (m *kvMeta) setCounter(name string, value int64) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set(m.counterKey(name), m.encodeInt(value))
+		return nil
+	})
+}
+
+func (m *kvMeta) setIfSmall(name string, value, diff int64) (bool, error) {
+	var updated bool
+	err := m.txn(func(tx kvTxn) error {
+		updated = false
+		if m.parseInt(tx.get(m.counterKey(name))) > value-diff {
+			return nil
+		}
+		tx.set(m.counterKey(name), m.encodeInt(value))
+		updated = true
+		return nil
+	})
+	return updated, errnoErr(err)
+}
+
+func (m *kvMeta) doLoadNode(n *loadedNode) error {
+	return m.client.txn(func(tx kvTxn) error {
+		if n.source > 0 && n.attr.Typ == TypeFile {
+			// the chunks of the source are read in the same transaction that increases the references of the slices
+			var sattr Attr
+			if err := m.getAttr(tx, n.source, &sattr); err != nil {
+				return err
+			}
+			n.attr.Length = sattr.Length
+			n.chunks = make(map[uint32][]byte)
+			prefix := m.fmtKey("A", n.source, "C")
+			tx.scan(prefix, func(k, v []byte) bool {
+				if indx := binary.BigEndian.Uint32(k[len(prefix):]); uint64(indx)*ChunkSize < sattr.Length && len(v) > 0 {
+					n.chunks[indx] = v
+				}
+				return true
+			})
+			m.incrBy(tx, m.counterKey(usedSpace), align4K(sattr.Length))
+		}
+		tx.set(m.inodeKey(n.inode), m.marshal(&n.attr))
+		if n.attr.Typ == TypeSymlink {
+			tx.set(m.symKey(n.inode), n.target)
+		}
+		for name, value := range n.xattrs {
+			tx.set(m.xattrKey(n.inode, name), value)
+		}
+		for indx, buf := range n.chunks {
+			tx.set(m.chunkKey(n.inode, indx), buf)
+			for _, s := range readSliceBuf(buf) {
+				if s.chunkid == 0 {
+					continue
+				}
+				// a missing key means one reference, so the first one is saved as 0
+				key := m.sliceKey(s.chunkid, s.size)
+				if n.source == 0 && tx.get(key) == nil {
+					tx.set(key, m.encodeInt(0))
+				} else {
+					m.incrBy(tx, key, 1)
+				}
+			}
+		}
+		if n.source > 0 && n.attr.Typ == TypeFile {
+			// a clone is created as an empty file
+			m.updateDirStat(tx, n.attr.Parent, &dirStat{length: int64(n.attr.Length), space: align4K(n.attr.Length)})
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doLoadEdge(parent Ino, name string, _type uint8, inode Ino) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set(m.entryKey(parent, name), m.packEntry(_type, inode))
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetParents(ctx Context, inode Ino) (map[Ino]int, error) {
+	var ps map[Ino]int
+	err := m.client.txn(func(tx kvTxn) error {
+		ps = m.getParents(tx, inode)
+		return nil
+	})
+	return ps, err
+}
+
+func (m *kvMeta) getParents(tx kvTxn, inode Ino) map[Ino]int {
+	ps := make(map[Ino]int)
+	prefix := m.fmtKey("A", inode, "P")
+	tx.scan(prefix, func(k, v []byte) bool {
+		if n := m.parseInt(v); len(k) == len(prefix)+8 && n > 0 {
+			ps[Ino(binary.BigEndian.Uint64(k[len(prefix):]))] = int(n)
+		}
+		return true
+	})
+	return ps
+}
+
+func (m *kvMeta) doSetParents(inode Ino, parents map[Ino]int) error {
+	return m.client.txn(func(tx kvTxn) error {
+		var keys [][]byte
+		tx.scan(m.fmtKey("A", inode, "P"), func(k, _ []byte) bool {
+			keys = append(keys, k)
+			return true
+		})
+		tx.dels(keys...)
+		for p, n := range parents {
+			tx.set(m.parentKey(inode, p), m.encodeInt(int64(n)))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) packQuota(q *Quota) []byte {
+	b := make([]byte, 32)
+	binary.BigEndian.PutUint64(b, uint64(q.MaxSpace))
+	binary.BigEndian.PutUint64(b[8:], uint64(q.MaxInodes))
+	binary.BigEndian.PutUint64(b[16:], uint64(q.UsedSpace))
+	binary.BigEndian.PutUint64(b[24:], uint64(q.UsedInodes))
+	return b
+}
+
+func (m *kvMeta) parseQuota(buf []byte) *Quota {
+	if len(buf) != 32 {
+		logger.Errorf("invalid quota: %v", buf)
+		return nil
+	}
+	return &Quota{
+		MaxSpace:   int64(binary.BigEndian.Uint64(buf)),
+		MaxInodes:  int64(binary.BigEndian.Uint64(buf[8:])),
+		UsedSpace:  int64(binary.BigEndian.Uint64(buf[16:])),
+		UsedInodes: int64(binary.BigEndian.Uint64(buf[24:])),
+	}
+}
+
+func (m *kvMeta) doLoadQuotas() (map[Ino]*Quota, error) {
+	prefix := m.fmtKey("QD")
+	values, err := m.scanValuesOf(prefix)
+	if err != nil {
+		return nil, err
+	}
+	quotas := make(map[Ino]*Quota)
+	for k, v := range values {
+		if q := m.parseQuota(v); q != nil && len(k) == len(prefix)+8 {
+			quotas[Ino(binary.BigEndian.Uint64([]byte(k[len(prefix):])))] = q
+		}
+	}
+	return quotas, nil
+}
+
+func (m *kvMeta) doGetQuota(inode Ino) (*Quota, error) {
+	buf, err := m.get(m.dirQuotaKey(inode))
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return m.parseQuota(buf), nil
+}
+
+func (m *kvMeta) doSetQuota(inode Ino, quota *Quota) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set(m.dirQuotaKey(inode), m.packQuota(quota))
+		return nil
+	})
+}
+
+func (m *kvMeta) doDelQuota(inode Ino) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.dels(m.dirQuotaKey(inode))
+		return nil
+	})
+}
+
+func (m *kvMeta) doFlushQuotas(deltas map[Ino]*Quota) error {
+	return m.client.txn(func(tx kvTxn) error {
+		for inode, d := range deltas {
+			buf := tx.get(m.dirQuotaKey(inode))
+			if buf == nil {
+				continue // removed
+			}
+			q := m.parseQuota(buf)
+			if q == nil {
+				continue
+			}
+			q.UsedSpace += d.UsedSpace
+			q.UsedInodes += d.UsedInodes
+			tx.set(m.dirQuotaKey(inode), m.packQuota(q))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) packDirStat(s *dirStat) []byte {
+	b := make([]byte, 32)
+	binary.BigEndian.PutUint64(b, uint64(s.length))
+	binary.BigEndian.PutUint64(b[8:], uint64(s.space))
+	binary.BigEndian.PutUint64(b[16:], uint64(s.files))
+	binary.BigEndian.PutUint64(b[24:], uint64(s.dirs))
+	return b
+}
+
+func (m *kvMeta) parseDirStat(buf []byte) *dirStat {
+	if len(buf) != 32 {
+		logger.Errorf("invalid stats of directory: %v", buf)
+		return nil
+	}
+	return &dirStat{
+		length: int64(binary.BigEndian.Uint64(buf)),
+		space:  int64(binary.BigEndian.Uint64(buf[8:])),
+		files:  int64(binary.BigEndian.Uint64(buf[16:])),
+		dirs:   int64(binary.BigEndian.Uint64(buf[24:])),
+	}
+}
+
+func (m *kvMeta) getDirStat(tx kvTxn, inode Ino) *dirStat {
+	if buf := tx.get(m.dirStatKey(inode)); buf != nil {
+		return m.parseDirStat(buf)
+	}
+	return nil
+}
+
+func (m *kvMeta) doGetDirStat(inode Ino) (*dirStat, error) {
+	buf, err := m.get(m.dirStatKey(inode))
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return m.parseDirStat(buf), nil
+}
+
+func (m *kvMeta) doSetDirStat(inode Ino, stat *dirStat) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set(m.dirStatKey(inode), m.packDirStat(stat))
+		return nil
+	})
+}
+
+// delDirStat removes the stats and the delta of a directory.
+func (m *kvMeta) delDirStat(tx kvTxn, inode Ino) {
+	tx.dels(m.dirStatKey(inode), m.dirDeltaKey(inode))
+}
+
+func (m *kvMeta) doDelDirStat(inode Ino) error {
+	return m.client.txn(func(tx kvTxn) error {
+		m.delDirStat(tx, inode)
+		return nil
+	})
+}
+
+// updateDirStat records a change under the directory within the transaction.
+func (m *kvMeta) updateDirStat(tx kvTxn, parent Ino, d *dirStat) {
+	if parent == 0 || d.isZero() {
+		return
+	}
+	s := &dirStat{}
+	if buf := tx.get(m.dirDeltaKey(parent)); buf != nil {
+		if s = m.parseDirStat(buf); s == nil {
+			s = &dirStat{}
+		}
+	}
+	s.add(d)
+	tx.set(m.dirDeltaKey(parent), m.packDirStat(s))
+}
+
+// updateFileStats records the change of length of a file in its parents within the transaction.
+func (m *kvMeta) updateFileStats(tx kvTxn, inode, parent Ino, length, space int64) error {
+	stats, err := fileStats(parent, length, space, func() (map[Ino]int, error) {
+		return m.getParents(tx, inode), nil
+	})
+	for p, d := range stats {
+		m.updateDirStat(tx, p, d)
+	}
+	return err
+}
+
+func (m *kvMeta) doGetDirDeltas() (map[Ino]*dirStat, error) {
+	prefix := m.fmtKey("W")
+	values, err := m.scanValuesOf(prefix)
+	if err != nil {
+		return nil, err
+	}
+	deltas := make(map[Ino]*dirStat, len(values))
+	for k, v := range values {
+		if d := m.parseDirStat(v); d != nil && len(k) == len(prefix)+8 {
+			deltas[Ino(binary.BigEndian.Uint64([]byte(k[len(prefix):])))] = d
+		}
+	}
+	return deltas, nil
+}
+
+func (m *kvMeta) doFlushDirStat(inode Ino) error {
+	return m.client.txn(func(tx kvTxn) error {
+		buf := tx.get(m.dirDeltaKey(inode))
+		if buf == nil {
+			return nil
+		}
+		tx.dels(m.dirDeltaKey(inode))
+		d := m.parseDirStat(buf)
+		// the ancestors are read in the transaction, so it's retried if any of them is moved in the meantime
+		for p, depth := inode, 0; d != nil && p > 0 && depth < 1000 && !d.isZero(); depth++ {
+			if buf := tx.get(m.dirStatKey(p)); buf != nil {
+				if s := m.parseDirStat(buf); s != nil {
+					s.add(d)
+					tx.set(m.dirStatKey(p), m.packDirStat(s))
+				}
+			}
+			if p == 1 || p == TrashInode || p == SnapshotInode {
+				break
+			}
+			a := tx.get(m.inodeKey(p))
+			if a == nil {
+				break
+			}
+			var attr Attr
+			m.parseAttr(a, &attr)
+			p = attr.Parent
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doScanNodes(ctx Context, fn func(inode Ino, attr *Attr) error) error {
+	var inodes []Ino
+	var attrs []*Attr
+	err := m.client.txn(func(tx kvTxn) error {
+		inodes, attrs = nil, nil
+		tx.scan([]byte("A"), func(k, v []byte) bool {
+			if len(k) == 10 && k[9] == 'I' {
+				var attr Attr
+				m.parseAttr(v, &attr)
+				inodes = append(inodes, Ino(binary.BigEndian.Uint64(k[1:9])))
+				attrs = append(attrs, &attr)
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, inode := range inodes {
+		if err = fn(inode, attrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) doScanEdges(ctx Context, fn func(parent Ino, name string, _type uint8, inode Ino) error) error {
+	type edge struct {
+		parent Ino
+		name   string
+		typ    uint8
+		inode  Ino
+	}
+	var edges []edge
+	err := m.client.txn(func(tx kvTxn) error {
+		edges = nil
+		tx.scan([]byte("A"), func(k, v []byte) bool {
+			if len(k) > 10 && k[9] == 'D' {
+				typ, inode := m.parseEntry(v)
+				edges = append(edges, edge{Ino(binary.BigEndian.Uint64(k[1:9])), string(k[10:]), typ, inode})
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range edges {
+		if err = fn(e.parent, e.name, e.typ, e.inode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) doSaveAttr(inode Ino, attr *Attr) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set(m.inodeKey(inode), m.marshal(attr))
+		return nil
+	})
+}
+
+func (m *kvMeta) doDeleteEdge(parent Ino, name string) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.dels(m.entryKey(parent, name))
+		return nil
+	})
+}
+
+func (m *kvMeta) doRemoveNode(inode Ino, attr *Attr) error {
+	return m.client.txn(func(tx kvTxn) error {
+		keys := [][]byte{m.inodeKey(inode)}
+		prefixes := [][]byte{m.fmtKey("A", inode, "X"), m.fmtKey("A", inode, "P")}
+		switch attr.Typ {
+		case TypeDirectory:
+			prefixes = append(prefixes, m.fmtKey("A", inode, "D"))
+		case TypeSymlink:
+			keys = append(keys, m.symKey(inode))
+		case TypeFile:
+			tx.set(m.delfileKey(inode, attr.Length), m.encodeInt(time.Now().Unix()))
+		}
+		for _, prefix := range prefixes {
+			tx.scan(prefix, func(k, _ []byte) bool {
+				keys = append(keys, k)
+				return true
+			})
+		}
+		tx.dels(keys...)
+		return nil
+	})
+}
+
+func (m *kvMeta) doListSliceRefs() (map[Slice]int64, error) {
+	vals, err := m.scanValuesOf([]byte("K"))
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[Slice]int64)
+	for k, v := range vals {
+		if len(k) != 13 {
+			continue
+		}
+		s := Slice{Chunkid: binary.BigEndian.Uint64([]byte(k)[1:9]), Size: binary.BigEndian.Uint32([]byte(k)[9:])}
+		// a slice is referenced once without the key, so the value is one less than the references
+		refs[s] = m.parseInt(v) + 1
+	}
+	return refs, nil
+}
+
+func (m *kvMeta) doSetSliceRef(chunkid uint64, size uint32, refs int64) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set(m.sliceKey(chunkid, size), m.encodeInt(refs-1))
+		return nil
+	})
+}
+
+func (m *kvMeta) doListDelFiles() (map[Ino]uint64, error) {
+	vals, err := m.scanValuesOf([]byte("D"))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[Ino]uint64)
+	for k := range vals {
+		if len(k) == 17 {
+			files[Ino(binary.BigEndian.Uint64([]byte(k)[1:9]))] = binary.BigEndian.Uint64([]byte(k)[9:])
+		}
+	}
+	return files, nil
+}
+
+func (m *kvMeta) doRemoveDelFile(inode Ino, length uint64) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.dels(m.delfileKey(inode, length))
+		return nil
+	})
+}
+
+func (m *kvMeta) doSaveFormat(format *Format, data []byte) error {
+	return m.client.txn(func(tx kvTxn) error {
+		tx.set([]byte("setting"), data)
+		if format.TrashDays > 0 && tx.get(m.inodeKey(TrashInode)) == nil {
+			tx.set(m.inodeKey(TrashInode), m.marshal(specialRootAttr()))
+			tx.set(m.dirStatKey(TrashInode), m.packDirStat(&dirStat{}))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) eventKey(id uint64) []byte {
+	return m.fmtKey("E", id)
+}
+
+func (m *kvMeta) doAppendEvent(e *Event) error {
+	return m.client.txn(func(tx kvTxn) error {
+		return m.insertEvent(tx, e)
+	})
+}
+
+// insertEvent inserts the event in the transaction, which are serialized by the counter, so the events
+// are committed in order.
+func (m *kvMeta) insertEvent(tx kvTxn, e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	id := m.incrBy(tx, m.counterKey("nextEvent"), 1)
+	tx.set(m.eventKey(uint64(id)), data)
+	return nil
+}
+
+// logged returns the transaction of the change made with the context, which inserts the event of it.
+func (m *kvMeta) logged(ctx Context, f func(tx kvTxn) error) func(tx kvTxn) error {
+	if eventOf(ctx) == nil {
+		return f
+	}
+	return func(tx kvTxn) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		return m.insertEvent(tx, eventOf(ctx))
+	}
+}
+
+func (m *kvMeta) doReadEvents(offset string, limit int) ([]*Event, error) {
+	var last uint64
+	if offset != "" {
+		var err error
+		if last, err = strconv.ParseUint(offset, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid offset: %s", offset)
+		}
+	}
+	var events []*Event
+	err := m.client.txn(func(tx kvTxn) error {
+		events = events[:0]
+		tx.scanRange(m.eventKey(last+1), m.fmtKey("F"), func(k, v []byte) bool {
+			var e Event
+			id := binary.BigEndian.Uint64(k[1:])
+			if err := json.Unmarshal(v, &e); err != nil {
+				logger.Warnf("corrupted event %d: %s", id, err)
+				return true
+			}
+			e.Offset = strconv.FormatUint(id, 10)
+			events = append(events, &e)
+			return len(events) < limit
+		})
+		return nil
+	})
+	return events, err
+}
+
+func (m *kvMeta) doTrimEvents(before int64) error {
+	for {
+		var keys [][]byte
+		err := m.client.txn(func(tx kvTxn) error {
+			keys = keys[:0]
+			tx.scan(m.fmtKey("E"), func(k, v []byte) bool {
+				var e Event
+				if json.Unmarshal(v, &e) == nil && e.Time >= before {
+					return false
+				}
+				keys = append(keys, k)
+				return len(keys) < 1000
+			})
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		err = m.client.txn(func(tx kvTxn) error {
+			tx.dels(keys...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *kvMeta) doTouchAtime(inode Ino, atime time.Time) error {
+	return m.client.txn(func(tx kvTxn) error {
+		var attr Attr
+		if err := m.getAttr(tx, inode, &attr); err != nil {
+			return err
+		}
+		if !atime.After(time.Unix(attr.Atime, int64(attr.Atimensec))) {
+			return nil
+		}
+		attr.Atime = atime.Unix()
+		attr.Atimensec = uint32(atime.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		return nil
+	})
+}
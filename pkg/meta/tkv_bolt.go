@@ -0,0 +1,111 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	registerKV("bolt", newBoltClient)
+}
+
+var boltBucket = []byte("jfs")
+
+type boltClient struct {
+	db *bolt.DB
+}
+
+func newBoltClient(path string) (tkvClient, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &boltClient{db}, nil
+}
+
+type boltTxn struct {
+	b *bolt.Bucket
+}
+
+func (tx *boltTxn) get(key []byte) []byte {
+	if v := tx.b.Get(key); v != nil {
+		return append([]byte{}, v...)
+	}
+	return nil
+}
+
+func (tx *boltTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	c := tx.b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if !handler(append([]byte{}, k...), append([]byte{}, v...)) {
+			break
+		}
+	}
+}
+
+func (tx *boltTxn) scanRange(begin, end []byte, handler func(key, value []byte) bool) {
+	c := tx.b.Cursor()
+	for k, v := c.Seek(begin); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+		if !handler(append([]byte{}, k...), append([]byte{}, v...)) {
+			break
+		}
+	}
+}
+
+func (tx *boltTxn) set(key, value []byte) {
+	if err := tx.b.Put(key, value); err != nil {
+		panic(err)
+	}
+}
+
+func (tx *boltTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		if err := tx.b.Delete(key); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (c *boltClient) name() string {
+	return "bolt"
+}
+
+func (c *boltClient) txn(f func(kvTxn) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return f(&boltTxn{tx.Bucket(boltBucket)})
+	})
+}
+
+func (c *boltClient) close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,170 @@
+// +build !windows
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+)
+
+func (m *kvMeta) Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno {
+	if ltype == syscall.F_UNLCK {
+		return m.txn(func(tx kvTxn) error {
+			tx.dels(m.flockKey(inode, m.sid, owner))
+			return nil
+		})
+	}
+	var err syscall.Errno
+	for {
+		err = m.txn(func(tx kvTxn) error {
+			owners := make(map[lockOwner]byte)
+			tx.scan(m.fmtKey("F", inode), func(k, v []byte) bool {
+				o := lockOwner{int64(binary.BigEndian.Uint64(k[9:17])), binary.BigEndian.Uint64(k[17:])}
+				owners[o] = v[0]
+				return true
+			})
+			t := byte('W')
+			if ltype == syscall.F_RDLCK {
+				for _, v := range owners {
+					if v == 'W' {
+						return syscall.EAGAIN
+					}
+				}
+				t = 'R'
+			} else {
+				delete(owners, lockOwner{m.sid, owner})
+				if len(owners) > 0 {
+					return syscall.EAGAIN
+				}
+			}
+			tx.set(m.flockKey(inode, m.sid, owner), []byte{t})
+			return nil
+		})
+
+		if !block || err != syscall.EAGAIN {
+			break
+		}
+		if ltype == syscall.F_WRLCK {
+			time.Sleep(time.Millisecond * 1)
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return err
+}
+
+func (m *kvMeta) loadPlocks(tx kvTxn, inode Ino) map[lockOwner][]byte {
+	owners := make(map[lockOwner][]byte)
+	tx.scan(m.fmtKey("P", inode), func(k, v []byte) bool {
+		owners[lockOwner{int64(binary.BigEndian.Uint64(k[9:17])), binary.BigEndian.Uint64(k[17:])}] = v
+		return true
+	})
+	return owners
+}
+
+func (m *kvMeta) Getlk(ctx Context, inode Ino, owner uint64, ltype *uint32, start, end *uint64, pid *uint32) syscall.Errno {
+	if *ltype == syscall.F_UNLCK {
+		*start = 0
+		*end = 0
+		*pid = 0
+		return 0
+	}
+	var owners map[lockOwner][]byte
+	if err := m.txn(func(tx kvTxn) error {
+		owners = m.loadPlocks(tx, inode)
+		return nil
+	}); err != 0 {
+		return err
+	}
+	delete(owners, lockOwner{m.sid, owner}) // exclude itself
+	for o, d := range owners {
+		ls := loadLocks(d)
+		for _, l := range ls {
+			// find conflicted locks
+			if (*ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && *end > l.start && *start < l.end {
+				*ltype = l.ltype
+				*start = l.start
+				*end = l.end
+				if o.sid == m.sid {
+					*pid = l.pid
+				} else {
+					*pid = 0
+				}
+				return 0
+			}
+		}
+	}
+	*ltype = syscall.F_UNLCK
+	*start = 0
+	*end = 0
+	*pid = 0
+	return 0
+}
+
+func (m *kvMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno {
+	var err syscall.Errno
+	lock := plock{ltype, pid, start, end}
+	me := lockOwner{m.sid, owner}
+	for {
+		err = m.txn(func(tx kvTxn) error {
+			owners := m.loadPlocks(tx, inode)
+			ls := loadLocks(owners[me])
+			if ltype == syscall.F_UNLCK {
+				if len(ls) == 0 {
+					return nil
+				}
+				ls = updateLocks(ls, lock)
+				if len(ls) == 0 {
+					tx.dels(m.plockKey(inode, m.sid, owner))
+					return nil
+				}
+			} else {
+				delete(owners, me)
+				for _, d := range owners {
+					ls := loadLocks(d)
+					for _, l := range ls {
+						// find conflicted locks
+						if (ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && end > l.start && start < l.end {
+							return syscall.EAGAIN
+						}
+					}
+				}
+				ls = updateLocks(ls, lock)
+			}
+			tx.set(m.plockKey(inode, m.sid, owner), dumpLocks(ls))
+			return nil
+		})
+
+		if !block || err != syscall.EAGAIN {
+			break
+		}
+		if ltype == syscall.F_WRLCK {
+			time.Sleep(time.Millisecond * 1)
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+func init() {
+	registerKV("memkv", func(addr string) (tkvClient, error) {
+		return newMemKV(), nil
+	})
+}
+
+type kvItem struct {
+	key   string
+	value []byte
+}
+
+func (it *kvItem) Less(o btree.Item) bool {
+	return it.key < o.(*kvItem).key
+}
+
+// memKV is an in-memory key-value store, which is used for tests only.
+type memKV struct {
+	sync.Mutex
+	items *btree.BTree
+}
+
+func newMemKV() *memKV {
+	return &memKV{items: btree.New(2)}
+}
+
+type memTxn struct {
+	store *memKV
+	undo  map[string][]byte
+}
+
+func (tx *memTxn) get(key []byte) []byte {
+	if it := tx.store.items.Get(&kvItem{key: string(key)}); it != nil {
+		return append([]byte{}, it.(*kvItem).value...)
+	}
+	return nil
+}
+
+func (tx *memTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	tx.store.items.AscendGreaterOrEqual(&kvItem{key: string(prefix)}, func(i btree.Item) bool {
+		it := i.(*kvItem)
+		if !bytes.HasPrefix([]byte(it.key), prefix) {
+			return false
+		}
+		return handler([]byte(it.key), append([]byte{}, it.value...))
+	})
+}
+
+func (tx *memTxn) scanRange(begin, end []byte, handler func(key, value []byte) bool) {
+	tx.store.items.AscendRange(&kvItem{key: string(begin)}, &kvItem{key: string(end)}, func(i btree.Item) bool {
+		it := i.(*kvItem)
+		return handler([]byte(it.key), append([]byte{}, it.value...))
+	})
+}
+
+func (tx *memTxn) save(key string) {
+	if _, ok := tx.undo[key]; ok {
+		return
+	}
+	if it := tx.store.items.Get(&kvItem{key: key}); it != nil {
+		tx.undo[key] = it.(*kvItem).value
+	} else {
+		tx.undo[key] = nil
+	}
+}
+
+func (tx *memTxn) set(key, value []byte) {
+	tx.save(string(key))
+	tx.store.items.ReplaceOrInsert(&kvItem{string(key), append([]byte{}, value...)})
+}
+
+func (tx *memTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.save(string(key))
+		tx.store.items.Delete(&kvItem{key: string(key)})
+	}
+}
+
+func (tx *memTxn) rollback() {
+	for k, v := range tx.undo {
+		if v == nil {
+			tx.store.items.Delete(&kvItem{key: k})
+		} else {
+			tx.store.items.ReplaceOrInsert(&kvItem{k, v})
+		}
+	}
+}
+
+func (c *memKV) name() string {
+	return "memkv"
+}
+
+func (c *memKV) txn(f func(kvTxn) error) (err error) {
+	c.Lock()
+	defer c.Unlock()
+	tx := &memTxn{store: c, undo: make(map[string][]byte)}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+	return f(tx)
+}
+
+func (c *memKV) close() error {
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"os"
+	"testing"
+)
+
+func newKVClient(t *testing.T, driver, addr string) Meta {
+	if driver == "bolt" {
+		_ = os.Remove(addr)
+	}
+	m, err := newKVMeta(driver, addr, &Config{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	return m
+}
+
+func TestMemKVClient(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testMetaClient(t, m)
+}
+
+func TestBoltClient(t *testing.T) {
+	m := newKVClient(t, "bolt", "/tmp/jfs-unit-test.bolt")
+	testMetaClient(t, m)
+}
+
+func TestKVCompaction(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testCompaction(t, m)
+}
+
+func TestKVConcurrentWrite(t *testing.T) {
+	m := newKVClient(t, "bolt", "/tmp/jfs-unit-test-write.bolt")
+	testConcurrentWrite(t, m)
+}
+
+func TestKVCopyFileRange(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testCopyFileRange(t, m)
+}
+
+func TestKVVolumeLimits(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testVolumeLimits(t, m)
+}
+
+func TestKVDirQuota(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testDirQuota(t, m)
+}
+
+func TestKVTrash(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testTrash(t, m)
+}
+
+func TestKVDirStats(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testDirStats(t, m)
+}
+
+func TestKVClone(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testClone(t, m)
+}
+
+func TestKVSnapshot(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testSnapshot(t, m)
+}
+
+func TestKVACL(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testACL(t, m)
+}
+
+func TestKVReaddirPage(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testReaddirPage(t, m)
+}
+
+func TestKVAllocIDs(t *testing.T) {
+	c := newMemKV()
+	m := &kvMeta{baseMeta: newBaseMeta(&Config{}), client: c}
+	m.en = m
+	m2 := &kvMeta{baseMeta: newBaseMeta(&Config{}), client: c}
+	m2.en = m2
+	testAllocIDs(t, m, m2)
+}
+
+func TestKVSessions(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testSessions(t, m)
+}
+
+func TestKVCheckMeta(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testCheckMeta(t, m)
+	other := &kvMeta{baseMeta: newBaseMeta(&Config{}), client: m.(*kvMeta).client}
+	other.en = other
+	testRepairWithClients(t, m, other)
+}
+
+func TestKVUpdateFormat(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testUpdateFormat(t, m)
+}
+
+func TestKVEvents(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testEvents(t, m)
+}
+
+func TestKVAtime(t *testing.T) {
+	var conf Config
+	m, err := newKVMeta("memkv", "", &conf)
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	testAtime(t, m, &conf)
+}
+
+func TestKVFlags(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testFlags(t, m)
+}
+
+func TestKVRetention(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testRetention(t, m)
+}
+
+func TestKVGetPaths(t *testing.T) {
+	m := newKVClient(t, "memkv", "")
+	testGetPaths(t, m)
+}
+
+func TestKVVolumePrefix(t *testing.T) {
+	c := newMemKV()
+	m := &kvMeta{baseMeta: newBaseMeta(&Config{}), client: c}
+	m.en = m
+	pm := &kvMeta{baseMeta: newBaseMeta(&Config{}), client: &prefixClient{c, []byte("\xFDteam\xFD")}}
+	pm.en = pm
+	testVolumePrefix(t, m, pm)
+}
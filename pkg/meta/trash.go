@@ -0,0 +1,184 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	// TrashInode is the inode of the trash directory, it's not an entry of the root
+	// but can be looked up from the root with TrashName.
+	TrashInode Ino = 0x7FFFFFFFFFF000
+	TrashName      = ".trash"
+
+	// removed entries are put into a sub-directory of the trash for every hour
+	trashBucketFormat = "2006-01-02-15"
+)
+
+// specialRootAttr returns the attributes of a special directory in the root, like the trash.
+func specialRootAttr() *Attr {
+	now := time.Now().Unix()
+	return &Attr{
+		Typ:    TypeDirectory,
+		Mode:   0555,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Nlink:  2,
+		Length: 4 << 10,
+		Parent: 1,
+	}
+}
+
+func (m *baseMeta) trashDays() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.format.TrashDays
+}
+
+// inTrash tells whether the directory is the trash or a bucket in it, anything removed from there is gone for good.
+func (m *baseMeta) inTrash(ctx Context, parent Ino) bool {
+	if parent == TrashInode {
+		return true
+	}
+	var attr Attr
+	return m.en.doGetAttr(ctx, parent, &attr) == 0 && attr.Parent == TrashInode
+}
+
+// trashBucket returns the bucket for the current hour, it's created when needed.
+func (m *baseMeta) trashBucket() (Ino, syscall.Errno) {
+	name := time.Now().UTC().Format(trashBucketFormat)
+	m.Lock()
+	if m.trashBucketName == name {
+		inode := m.trashBucketInode
+		m.Unlock()
+		return inode, 0
+	}
+	m.Unlock()
+
+	var inode Ino
+	var attr Attr
+	st := m.en.doLookup(Background, TrashInode, name, &inode, &attr)
+	if st == syscall.ENOENT {
+		// the bucket is writable by everyone like /tmp, so an owner can move an entry back out
+		st = m.en.doMknod(Background, TrashInode, name, TypeDirectory, 01777, 0, 0, "", &inode, &attr)
+		if st == syscall.EEXIST {
+			st = m.en.doLookup(Background, TrashInode, name, &inode, &attr)
+		}
+	}
+	if st != 0 {
+		return 0, st
+	}
+	m.Lock()
+	m.trashBucketName, m.trashBucketInode = name, inode
+	m.Unlock()
+	return inode, 0
+}
+
+// trashEntryName keeps the parent and the inode in the name, so the origin of an entry can be
+// figured out when restoring it.
+func trashEntryName(parent, inode Ino, name string) string {
+	s := fmt.Sprintf("%d-%d-%s", parent, inode, name)
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return s
+}
+
+// moveToTrash moves an entry into the current bucket of the trash instead of removing it.
+func (m *baseMeta) moveToTrash(ctx Context, parent Ino, name string, inode Ino) syscall.Errno {
+	bucket, st := m.trashBucket()
+	if st != 0 {
+		return st
+	}
+	st = m.rename(ctx, parent, name, bucket, trashEntryName(parent, inode, name), nil, nil, false)
+	if st == syscall.ENOENT {
+		// the bucket may be removed by someone else, try again with a new one
+		m.Lock()
+		m.trashBucketName = ""
+		m.Unlock()
+		if bucket, st = m.trashBucket(); st != 0 {
+			return st
+		}
+		st = m.rename(ctx, parent, name, bucket, trashEntryName(parent, inode, name), nil, nil, false)
+	}
+	return st
+}
+
+func (m *baseMeta) cleanupTrash() {
+	for {
+		time.Sleep(time.Hour)
+		if ok, err := m.ClaimJob("CleanupTrash", time.Hour); err != nil {
+			logger.Warnf("claim job to cleanup trash: %s", err)
+		} else if ok {
+			m.doCleanupTrash(time.Now())
+		}
+	}
+}
+
+// doCleanupTrash purges the buckets that are older than the retention, or all of them
+// when the trash is disabled.
+func (m *baseMeta) doCleanupTrash(now time.Time) {
+	ctx := Background
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, TrashInode, &attr); st != 0 {
+		if st != syscall.ENOENT {
+			logger.Warnf("get attribute of trash: %s", st)
+		}
+		return
+	}
+	var buckets []*Entry
+	if st := m.en.doReaddir(ctx, TrashInode, 0, &buckets); st != 0 {
+		logger.Warnf("readdir trash: %s", st)
+		return
+	}
+	edge := now.Add(-time.Duration(24*m.trashDays()) * time.Hour)
+	for _, b := range buckets {
+		t, err := time.Parse(trashBucketFormat, string(b.Name))
+		if err != nil {
+			logger.Warnf("bad bucket name in trash: %s", b.Name)
+			continue
+		}
+		if !t.Add(time.Hour).Before(edge) {
+			continue
+		}
+		if st := m.purgeEntry(ctx, TrashInode, string(b.Name), b.Inode, TypeDirectory); st != 0 {
+			logger.Warnf("purge bucket %s in trash: %s", b.Name, st)
+		} else {
+			logger.Infof("bucket %s in trash is purged", b.Name)
+		}
+	}
+}
+
+// purgeEntry removes an entry in the trash and everything under it.
+func (m *baseMeta) purgeEntry(ctx Context, parent Ino, name string, inode Ino, typ uint8) syscall.Errno {
+	if typ != TypeDirectory {
+		return m.en.doUnlink(ctx, parent, name)
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 0, &entries); st != 0 {
+		return st
+	}
+	for _, e := range entries {
+		if st := m.purgeEntry(ctx, inode, string(e.Name), e.Inode, e.Attr.Typ); st != 0 {
+			return st
+		}
+	}
+	return m.en.doRmdir(ctx, parent, name)
+}
@@ -0,0 +1,100 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"io"
+	"sync"
+)
+
+// Switchable is an object storage that forwards all the requests to another one, which can be
+// switched to a new one (with different credentials or endpoint) on the fly.
+type Switchable struct {
+	sync.RWMutex
+	os ObjectStorage
+}
+
+// NewSwitchable returns an object storage that forwards the requests to os until it's switched.
+func NewSwitchable(os ObjectStorage) *Switchable {
+	return &Switchable{os: os}
+}
+
+// Switch forwards the following requests to os.
+func (s *Switchable) Switch(os ObjectStorage) {
+	s.Lock()
+	s.os = os
+	s.Unlock()
+}
+
+func (s *Switchable) current() ObjectStorage {
+	s.RLock()
+	defer s.RUnlock()
+	return s.os
+}
+
+func (s *Switchable) String() string {
+	return s.current().String()
+}
+
+func (s *Switchable) Create() error {
+	return s.current().Create()
+}
+
+func (s *Switchable) Head(key string) (*Object, error) {
+	return s.current().Head(key)
+}
+
+func (s *Switchable) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.current().Get(key, off, limit)
+}
+
+func (s *Switchable) Put(key string, in io.Reader) error {
+	return s.current().Put(key, in)
+}
+
+func (s *Switchable) Delete(key string) error {
+	return s.current().Delete(key)
+}
+
+func (s *Switchable) List(prefix, marker string, limit int64) ([]*Object, error) {
+	return s.current().List(prefix, marker, limit)
+}
+
+func (s *Switchable) ListAll(prefix, marker string) (<-chan *Object, error) {
+	return s.current().ListAll(prefix, marker)
+}
+
+func (s *Switchable) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return s.current().CreateMultipartUpload(key)
+}
+
+func (s *Switchable) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	return s.current().UploadPart(key, uploadID, num, body)
+}
+
+func (s *Switchable) AbortUpload(key string, uploadID string) {
+	s.current().AbortUpload(key, uploadID)
+}
+
+func (s *Switchable) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return s.current().CompleteUpload(key, uploadID, parts)
+}
+
+func (s *Switchable) ListUploads(marker string) ([]*PendingPart, string, error) {
+	return s.current().ListUploads(marker)
+}
+
+var _ ObjectStorage = &Switchable{}
@@ -41,8 +41,11 @@ type handle struct {
 	inode Ino
 	fh    uint64
 
-	// for dir
+	// for dir, only the page being read is kept
 	children []*meta.Entry
+	childOff int    // offset of the first entry in children
+	cursor   string // cursor of the next page
+	lastPage bool
 
 	// for file
 	locks      uint8
@@ -16,6 +16,7 @@
 package vfs
 
 import (
+	"encoding/json"
 	"os"
 	"syscall"
 	"time"
@@ -41,6 +42,16 @@ var internalNodes = []*internalNode{
 	{controlInode, ".control", &Attr{Mode: 0666}},
 }
 
+// metaRoots are the special directories kept by the meta engine, they are listed in the root
+// if they exist, and served by the meta engine like any other directory.
+var metaRoots = []struct {
+	inode Ino
+	name  string
+}{
+	{meta.TrashInode, meta.TrashName},
+	{meta.SnapshotInode, meta.SnapshotName},
+}
+
 func init() {
 	uid := uint32(os.Getuid())
 	gid := uint32(os.Getgid())
@@ -93,6 +104,70 @@ func getInternalNodeByName(name string) *internalNode {
 	return nil
 }
 
+// InodeInfo is the reply of the Info message.
+type InodeInfo struct {
+	Inode Ino
+	Attr  *Attr
+	Paths []string
+	// RetainUntil is the time until which the node can't be removed or changed, see meta.RetentionXattr.
+	RetainUntil *time.Time   `json:",omitempty"`
+	Chunks      []*ChunkInfo `json:",omitempty"`
+}
+
+// ChunkInfo is the layout of the data in a chunk of a file.
+type ChunkInfo struct {
+	Index  uint32
+	Slices []*SliceInfo
+}
+
+// SliceInfo is a part of a chunk, which is a hole if Chunkid is 0. The data between Off and Off+Len
+// of the slice is stored in the blocks of Keys, which are relative to the root of the volume.
+type SliceInfo struct {
+	Pos     uint32 // the position in the chunk
+	Chunkid uint64
+	Size    uint32
+	Off     uint32
+	Len     uint32
+	Keys    []string `json:",omitempty"`
+}
+
+func getInfo(ctx Context, inode Ino) (*InodeInfo, syscall.Errno) {
+	info := &InodeInfo{Inode: inode, Attr: &Attr{}}
+	if st := m.GetAttr(ctx, inode, info.Attr); st != 0 {
+		return nil, st
+	}
+	info.Paths = m.GetPaths(ctx, inode)
+	if info.Attr.Flags&meta.FlagRetention != 0 {
+		var value []byte
+		if st := m.GetXattr(ctx, inode, meta.RetentionXattr, &value); st == 0 {
+			if until, err := meta.ParseRetention(value); err == nil {
+				info.RetainUntil = &until
+			}
+		}
+	}
+	if info.Attr.Typ != meta.TypeFile {
+		return info, 0
+	}
+	for indx := uint32(0); uint64(indx)*meta.ChunkSize < info.Attr.Length; indx++ {
+		var slices []meta.Slice
+		if st := m.Read(ctx, inode, indx, &slices); st != 0 {
+			return nil, st
+		}
+		c := &ChunkInfo{Index: indx}
+		var pos uint32
+		for _, s := range slices {
+			si := &SliceInfo{Pos: pos, Chunkid: s.Chunkid, Size: s.Size, Off: s.Off, Len: s.Len}
+			if s.Chunkid > 0 {
+				si.Keys = store.BlockKeys(s.Chunkid, int(s.Size), int(s.Off), int(s.Len))
+			}
+			c.Slices = append(c.Slices, si)
+			pos += s.Len
+		}
+		info.Chunks = append(info.Chunks, c)
+	}
+	return info, 0
+}
+
 func handleInternalMsg(ctx Context, msg []byte) []byte {
 	r := utils.ReadBuffer(msg)
 	cmd := r.Get32()
@@ -107,6 +182,28 @@ func handleInternalMsg(ctx Context, msg []byte) []byte {
 		name := string(r.Get(int(r.Get8())))
 		r := m.Rmr(ctx, inode, name)
 		return []byte{uint8(r)}
+	case meta.Clone:
+		srcIno := Ino(r.Get64())
+		parent := Ino(r.Get64())
+		name := string(r.Get(int(r.Get8())))
+		r := m.Clone(ctx, srcIno, parent, name)
+		return []byte{uint8(r)}
+	case meta.Info:
+		info, st := getInfo(ctx, Ino(r.Get64()))
+		if st != 0 {
+			return []byte{uint8(st)}
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			logger.Warnf("json: %s", err)
+			return []byte{uint8(syscall.EIO & 0xff)}
+		}
+		// the length of the JSON follows the status
+		w := utils.NewBuffer(1 + 4 + uint32(len(data)))
+		w.Put8(0)
+		w.Put32(uint32(len(data)))
+		w.Put(data)
+		return w.Bytes()
 	default:
 		logger.Warnf("unknown message type: %d", cmd)
 		return []byte{uint8(syscall.EINVAL & 0xff)}
@@ -48,8 +48,13 @@ type Config struct {
 
 var (
 	m      meta.Meta
+	store  chunk.ChunkStore
 	reader DataReader
 	writer DataWriter
+
+	// checkPermission is set when the permissions are checked by JuiceFS instead of the kernel,
+	// which can't evaluate the POSIX ACLs of the volume.
+	checkPermission bool
 )
 
 var (
@@ -76,6 +81,9 @@ func Lookup(ctx Context, parent Ino, name string) (entry *meta.Entry, err syscal
 	}
 	var inode Ino
 	var attr = &Attr{}
+	if err = checkAccess(ctx, parent, MODE_MASK_X, nil); err != 0 {
+		return
+	}
 	if parent == rootID {
 		if nleng == 2 && name[0] == '.' && name[1] == '.' {
 			name = name[:1]
@@ -152,6 +160,9 @@ func Mknod(ctx Context, parent Ino, name string, mode uint16, cumask uint16, rde
 		return
 	}
 
+	if err = checkAccess(ctx, parent, MODE_MASK_W|MODE_MASK_X, nil); err != 0 {
+		return
+	}
 	var inode Ino
 	var attr = &Attr{}
 	err = m.Mknod(ctx, parent, name, _type, mode&07777, cumask, uint32(rdev), &inode, attr)
@@ -172,6 +183,9 @@ func Unlink(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = checkRemove(ctx, parent, name); err != 0 {
+		return
+	}
 	err = m.Unlink(ctx, parent, name)
 	return
 }
@@ -190,6 +204,9 @@ func Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16) (en
 		return
 	}
 
+	if err = checkAccess(ctx, parent, MODE_MASK_W|MODE_MASK_X, nil); err != 0 {
+		return
+	}
 	var inode Ino
 	var attr = &Attr{}
 	err = m.Mkdir(ctx, parent, name, mode, cumask, 0, &inode, attr)
@@ -210,6 +227,9 @@ func Rmdir(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = checkRemove(ctx, parent, name); err != 0 {
+		return
+	}
 	err = m.Rmdir(ctx, parent, name)
 	return
 }
@@ -228,6 +248,9 @@ func Symlink(ctx Context, path string, parent Ino, name string) (entry *meta.Ent
 		return
 	}
 
+	if err = checkAccess(ctx, parent, MODE_MASK_W|MODE_MASK_X, nil); err != 0 {
+		return
+	}
 	var inode Ino
 	var attr = &Attr{}
 	err = m.Symlink(ctx, parent, name, path, &inode, attr)
@@ -239,6 +262,9 @@ func Symlink(ctx Context, path string, parent Ino, name string) (entry *meta.Ent
 
 func Readlink(ctx Context, ino Ino) (path []byte, err syscall.Errno) {
 	defer func() { logit(ctx, "readlink (%d): %s (%s)", ino, strerr(err), string(path)) }()
+	if err = checkAccess(ctx, ino, MODE_MASK_R, nil); err != 0 {
+		return
+	}
 	err = m.ReadLink(ctx, ino, &path)
 	return
 }
@@ -257,6 +283,15 @@ func Rename(ctx Context, parent Ino, name string, newparent Ino, newname string)
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = checkRemove(ctx, parent, name); err != 0 {
+		return
+	}
+	if err = checkRemove(ctx, newparent, newname); err != 0 {
+		return
+	}
+	if err = checkMove(ctx, parent, name, newparent); err != 0 {
+		return
+	}
 
 	err = m.Rename(ctx, parent, name, newparent, newname, nil, nil)
 	return
@@ -278,6 +313,9 @@ func Link(ctx Context, ino Ino, newparent Ino, newname string) (entry *meta.Entr
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = checkAccess(ctx, newparent, MODE_MASK_W|MODE_MASK_X, nil); err != 0 {
+		return
+	}
 
 	var attr = &Attr{}
 	err = m.Link(ctx, ino, newparent, newname, attr)
@@ -294,6 +332,9 @@ func Opendir(ctx Context, ino Ino) (fh uint64, err syscall.Errno) {
 		err = syscall.ENOTDIR
 		return
 	}
+	if err = checkAccess(ctx, ino, MODE_MASK_R, nil); err != 0 {
+		return
+	}
 	fh = newHandle(ino).fh
 	return
 }
@@ -308,6 +349,21 @@ func UpdateLength(inode Ino, attr *meta.Attr) {
 	}
 }
 
+// readdirPage loads the next page of entries into the handle, with the attributes if they are accessible.
+func (h *handle) readdirPage(ctx Context, ino Ino) syscall.Errno {
+	cursor := h.cursor
+	err := m.ReaddirPage(ctx, ino, 1, &cursor, 0, &h.children)
+	if err == syscall.EACCES {
+		cursor = h.cursor
+		err = m.ReaddirPage(ctx, ino, 0, &cursor, 0, &h.children)
+	}
+	if err == 0 {
+		h.cursor = cursor
+		h.lastPage = cursor == ""
+	}
+	return err
+}
+
 func Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plus bool) (entries []*meta.Entry, err syscall.Errno) {
 	defer func() { logit(ctx, "readdir (%d,%d,%d): %s (%d)", ino, size, off, strerr(err), len(entries)) }()
 	h := findHandle(ino, fh)
@@ -318,17 +374,27 @@ func Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plus bool) (
 	h.Lock()
 	defer h.Unlock()
 
-	if h.children == nil || off == 0 {
-		var inodes []*meta.Entry
-		err = m.Readdir(ctx, ino, 1, &inodes)
-		if err == syscall.EACCES {
-			err = m.Readdir(ctx, ino, 0, &inodes)
-		}
-		if err != 0 {
+	if h.children == nil || off == 0 || off < h.childOff {
+		// read from the beginning again
+		var attr Attr
+		if err = m.GetAttr(ctx, ino, &attr); err != 0 {
 			return
 		}
-		h.children = inodes
+		h.children = []*meta.Entry{{Inode: ino, Name: []byte("."), Attr: &Attr{Typ: meta.TypeDirectory}}}
+		if attr.Parent > 0 {
+			h.children = append(h.children, &meta.Entry{Inode: attr.Parent, Name: []byte(".."), Attr: &Attr{Typ: meta.TypeDirectory}})
+		}
 		if ino == rootID {
+			for _, r := range metaRoots {
+				var attr Attr
+				if m.GetAttr(ctx, r.inode, &attr) == 0 {
+					h.children = append(h.children, &meta.Entry{
+						Inode: r.inode,
+						Name:  []byte(r.name),
+						Attr:  &attr,
+					})
+				}
+			}
 			// add internal nodes
 			for _, node := range internalNodes {
 				h.children = append(h.children, &meta.Entry{
@@ -338,9 +404,23 @@ func Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plus bool) (
 				})
 			}
 		}
+		h.childOff = 0
+		h.cursor = ""
+		if err = h.readdirPage(ctx, ino); err != 0 {
+			h.children = nil
+			return
+		}
+	}
+	for off >= h.childOff+len(h.children) && !h.lastPage {
+		h.childOff += len(h.children)
+		h.children = []*meta.Entry{}
+		if err = h.readdirPage(ctx, ino); err != 0 {
+			h.children = nil
+			return
+		}
 	}
-	if off < len(h.children) {
-		entries = h.children[off:]
+	if off-h.childOff < len(h.children) {
+		entries = h.children[off-h.childOff:]
 	}
 	return
 }
@@ -367,6 +447,9 @@ func Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, fl
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = checkAccess(ctx, parent, MODE_MASK_W|MODE_MASK_X, nil); err != 0 {
+		return
+	}
 
 	var inode Ino
 	var attr = &Attr{}
@@ -397,6 +480,9 @@ func Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh uint64, err
 			err = syscall.EACCES
 			return
 		}
+		if err = checkAccess(ctx, ino, openMask(flags), nil); err != 0 {
+			return
+		}
 		h := newHandle(ino)
 		fh = h.fh
 		switch ino {
@@ -412,6 +498,22 @@ func Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh uint64, err
 	if err != 0 {
 		return
 	}
+	if attr.Flags&meta.FlagSnapshot != 0 && (flags&O_ACCMODE) != syscall.O_RDONLY {
+		_ = m.Close(ctx, ino)
+		err = syscall.EROFS
+		return
+	}
+	if (flags&O_ACCMODE) != syscall.O_RDONLY && attr.Flags&meta.FlagImmutable != 0 ||
+		attr.Flags&meta.FlagAppend != 0 && ((flags&O_ACCMODE) != syscall.O_RDONLY && flags&syscall.O_APPEND == 0 || flags&syscall.O_TRUNC != 0) {
+		// an append-only file can only be opened to append
+		_ = m.Close(ctx, ino)
+		err = syscall.EPERM
+		return
+	}
+	if err = checkAccess(ctx, ino, openMask(flags), attr); err != 0 {
+		_ = m.Close(ctx, ino)
+		return
+	}
 
 	UpdateLength(ino, attr)
 	fh = newFileHandle(ino, attr.Length, flags)
@@ -545,6 +647,8 @@ func Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n int, err s
 	n, err = h.reader.Read(ctx, off, buf)
 	if err == syscall.ENOENT {
 		err = syscall.EBADF
+	} else if err == 0 && n > 0 {
+		m.TouchAtime(ctx, ino, nil)
 	}
 	h.removeOp(ctx)
 	return
@@ -768,6 +872,10 @@ const (
 	xattrMaxSize = 65536
 )
 
+func isACL(name string) bool {
+	return name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
 func SetXattr(ctx Context, ino Ino, name string, value []byte, flags int) (err syscall.Errno) {
 	defer func() { logit(ctx, "setxattr (%d,%s,%d,%d): %s", ino, name, len(value), flags, strerr(err)) }()
 	if IsSpecialNode(ino) {
@@ -794,10 +902,13 @@ func SetXattr(ctx Context, ino Ino, name string, value []byte, flags int) (err s
 		err = syscall.EINVAL
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
+	if !checkPermission && isACL(name) {
 		err = syscall.ENOTSUP
 		return
 	}
+	if err = checkXattr(ctx, ino, name, MODE_MASK_W); err != 0 {
+		return
+	}
 	err = m.SetXattr(ctx, ino, name, value)
 	return
 }
@@ -821,10 +932,13 @@ func GetXattr(ctx Context, ino Ino, name string, size uint32) (value []byte, err
 		err = syscall.EINVAL
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
+	if !checkPermission && isACL(name) {
 		err = syscall.ENOTSUP
 		return
 	}
+	if err = checkXattr(ctx, ino, name, MODE_MASK_R); err != 0 {
+		return
+	}
 	err = m.GetXattr(ctx, ino, name, &value)
 	if size > 0 && len(value) > int(size) {
 		err = syscall.ERANGE
@@ -851,7 +965,7 @@ func RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno) {
 		err = syscall.EPERM
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
+	if !checkPermission && isACL(name) {
 		return syscall.ENOTSUP
 	}
 	if len(name) > xattrMaxName {
@@ -866,14 +980,19 @@ func RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno) {
 		err = syscall.EINVAL
 		return
 	}
+	if err = checkXattr(ctx, ino, name, MODE_MASK_W); err != 0 {
+		return
+	}
 	err = m.RemoveXattr(ctx, ino, name)
 	return
 }
 
 var logger = utils.GetLogger("juicefs")
 
-func Init(conf *Config, m_ meta.Meta, store chunk.ChunkStore) {
+func Init(conf *Config, m_ meta.Meta, store_ chunk.ChunkStore) {
 	m = m_
+	store = store_
+	checkPermission = conf.Format != nil && conf.Format.EnableACL
 	reader = NewDataReader(conf, m, store)
 	writer = NewDataWriter(conf, m, store)
 	handles = make(map[Ino][]*handle)
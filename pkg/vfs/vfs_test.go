@@ -0,0 +1,77 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// nolint:errcheck
+func TestPermissionsWithACL(t *testing.T) {
+	mm := meta.NewClient("memkv://", &meta.Config{})
+	format := meta.Format{Name: "test", BlockSize: 4096, EnableACL: true}
+	_ = mm.Init(format, true)
+	var conf = Config{
+		Meta:   &meta.Config{},
+		Format: &format,
+		Chunk: &chunk.Config{
+			BlockSize: 4096,
+		},
+	}
+	Init(&conf, mm, chunk.NewDiskStore("/tmp"))
+
+	root := NewLogContext(meta.Background)
+	a, _ := Mkdir(root, rootID, "a", 0777, 0)
+	b, _ := Mkdir(root, rootID, "b", 0777, 0)
+	if _, err := Mkdir(root, a.Inode, "d", 0755, 0); err != 0 {
+		t.Fatalf("mkdir d: %s", err)
+	}
+	l, err := Symlink(root, "/a/d", a.Inode, "l")
+	if err != 0 {
+		t.Fatalf("symlink l: %s", err)
+	}
+
+	// a user who doesn't own anything and has no ACL granted
+	ctx := NewLogContext(meta.NewContext(1, 1000, []uint32{1000}))
+	if _, err := Readlink(ctx, l.Inode); err != 0 {
+		t.Fatalf("readlink by others: %s", err)
+	}
+	if err := Rename(ctx, a.Inode, "d", b.Inode, "d"); err != syscall.EACCES {
+		t.Fatalf("move the directory of others into another parent should be denied: %s", err)
+	}
+	if err := Rename(ctx, a.Inode, "d", a.Inode, "e"); err != 0 {
+		t.Fatalf("rename the directory of others in the same parent: %s", err)
+	}
+	getInternalNode(logInode).attr.Uid = 0
+	if _, _, err := Open(ctx, logInode, syscall.O_RDONLY); err != syscall.EACCES {
+		t.Fatalf("open .accesslog of others should be denied: %s", err)
+	}
+	if _, fh, err := Open(ctx, controlInode, syscall.O_RDWR); err != 0 {
+		t.Fatalf("open .control: %s", err)
+	} else {
+		Release(ctx, controlInode, fh)
+	}
+	if _, err := SetAttr(root, rootID, meta.SetAttrMode, 0, 0700, 0, 0, 0, 0, 0, 0, 0); err != 0 {
+		t.Fatalf("chmod root: %s", err)
+	}
+	if _, err := Lookup(ctx, rootID, ".control"); err != syscall.EACCES {
+		t.Fatalf("lookup in a directory without search permission should be denied: %s", err)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"syscall"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
 
 	"golang.org/x/sys/unix"
 )
@@ -31,6 +32,16 @@ import (
 const O_ACCMODE = syscall.O_ACCMODE
 const F_UNLCK = syscall.F_UNLCK
 
+// the ioctls used by lsattr and chattr, and the inode flags supported
+const (
+	FS_IOC_GETFLAGS   = 0x80086601
+	FS_IOC_SETFLAGS   = 0x40086602
+	FS_IOC32_GETFLAGS = 0x80046601
+	FS_IOC32_SETFLAGS = 0x40046602
+	FS_IMMUTABLE_FL   = 0x10
+	FS_APPEND_FL      = 0x20
+)
+
 const (
 	MODE_MASK_R = 4
 	MODE_MASK_W = 2
@@ -47,7 +58,10 @@ type Statfs struct {
 
 func StatFS(ctx Context, ino Ino) (st *Statfs, err int) {
 	var totalspace, availspace, iused, iavail uint64
-	_ = m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail)
+	if IsSpecialNode(ino) {
+		ino = 1
+	}
+	_ = m.StatFS(ctx, ino, &totalspace, &availspace, &iused, &iavail)
 	var bsize uint64 = 0x10000
 	blocks := totalspace / bsize
 	bavail := blocks - (totalspace-availspace+bsize-1)/bsize
@@ -104,6 +118,123 @@ func Access(ctx Context, ino Ino, mask int) (err syscall.Errno) {
 	return
 }
 
+// checkAccess checks the permissions of a node if it's not done by the kernel.
+func checkAccess(ctx Context, ino Ino, mmask uint16, attr *Attr) syscall.Errno {
+	if !checkPermission || ctx.Uid() == 0 {
+		return 0
+	}
+	if n := getInternalNode(ino); n != nil {
+		return accessTest(n.attr, mmask, ctx.Uid(), ctx.Gid())
+	}
+	return m.Access(ctx, ino, uint8(mmask), attr)
+}
+
+// checkMove checks whether a directory can be moved into another parent, which changes its ".."
+// and needs the permission to write the directory itself.
+func checkMove(ctx Context, parent Ino, name string, newparent Ino) syscall.Errno {
+	if !checkPermission || ctx.Uid() == 0 || parent == newparent {
+		return 0
+	}
+	var inode Ino
+	var attr Attr
+	if m.Lookup(ctx, parent, name, &inode, &attr) != 0 || attr.Typ != meta.TypeDirectory {
+		return 0
+	}
+	return m.Access(ctx, inode, MODE_MASK_W, &attr)
+}
+
+// checkRemove checks whether the entry can be removed or replaced, which needs the permission
+// to change the parent, and to own the entry or the parent if the sticky bit of the parent is set.
+func checkRemove(ctx Context, parent Ino, name string) syscall.Errno {
+	if !checkPermission || ctx.Uid() == 0 {
+		return 0
+	}
+	var pattr Attr
+	if st := m.GetAttr(ctx, parent, &pattr); st != 0 {
+		return st
+	}
+	if st := m.Access(ctx, parent, MODE_MASK_W|MODE_MASK_X, &pattr); st != 0 {
+		return st
+	}
+	if pattr.Mode&01000 != 0 && pattr.Uid != ctx.Uid() {
+		var inode Ino
+		var attr Attr
+		if m.Lookup(ctx, parent, name, &inode, &attr) == 0 && attr.Uid != ctx.Uid() {
+			return syscall.EACCES
+		}
+	}
+	return 0
+}
+
+// checkXattr checks the permission to read (MODE_MASK_R) or change (MODE_MASK_W) an extended attribute.
+func checkXattr(ctx Context, ino Ino, name string, mmask uint16) syscall.Errno {
+	if !checkPermission || ctx.Uid() == 0 {
+		return 0
+	}
+	if strings.HasPrefix(name, "trusted.") {
+		return syscall.EPERM
+	}
+	if strings.HasPrefix(name, "user.") {
+		return m.Access(ctx, ino, uint8(mmask), nil)
+	}
+	return 0
+}
+
+func openMask(flags uint32) uint16 {
+	var mmask uint16
+	switch flags & O_ACCMODE {
+	case syscall.O_RDONLY:
+		mmask = MODE_MASK_R
+	case syscall.O_WRONLY:
+		mmask = MODE_MASK_W
+	case syscall.O_RDWR:
+		mmask = MODE_MASK_R | MODE_MASK_W
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mmask |= MODE_MASK_W
+	}
+	return mmask
+}
+
+// checkSetAttr checks whether the attributes of a node can be changed, like the kernel does.
+func checkSetAttr(ctx Context, ino Ino, set int, opened uint8, uid, gid uint32) syscall.Errno {
+	if !checkPermission || ctx.Uid() == 0 {
+		return 0
+	}
+	var attr Attr
+	if st := m.GetAttr(ctx, ino, &attr); st != 0 {
+		return st
+	}
+	owner := attr.Uid == ctx.Uid()
+	if set&meta.SetAttrUID != 0 && uid != attr.Uid {
+		return syscall.EPERM
+	}
+	if set&meta.SetAttrGID != 0 && gid != attr.Gid {
+		var member bool
+		for _, g := range ctx.Gids() {
+			if g == gid {
+				member = true
+				break
+			}
+		}
+		if !owner || !member {
+			return syscall.EPERM
+		}
+	}
+	if set&(meta.SetAttrMode|meta.SetAttrAtime|meta.SetAttrMtime) != 0 && !owner {
+		return syscall.EPERM
+	}
+	if set&(meta.SetAttrAtimeNow|meta.SetAttrMtimeNow) != 0 && !owner {
+		if st := m.Access(ctx, ino, MODE_MASK_W, &attr); st != 0 {
+			return st
+		}
+	}
+	if set&meta.SetAttrSize != 0 && opened == 0 {
+		return m.Access(ctx, ino, MODE_MASK_W, &attr)
+	}
+	return 0
+}
+
 func setattrStr(set int, mode, uid, gid uint32, atime, mtime int64, size uint64) string {
 	var sb strings.Builder
 	if set&meta.SetAttrMode != 0 {
@@ -149,6 +280,9 @@ func SetAttr(ctx Context, ino Ino, set int, opened uint8, mode, uid, gid uint32,
 		entry = &meta.Entry{Inode: ino, Attr: n.attr}
 		return
 	}
+	if err = checkSetAttr(ctx, ino, set, opened, uid, gid); err != 0 {
+		return
+	}
 	err = syscall.EINVAL
 	var attr = &Attr{}
 	if (set & (meta.SetAttrMode | meta.SetAttrUID | meta.SetAttrGID | meta.SetAttrAtime | meta.SetAttrMtime | meta.SetAttrSize)) == 0 {
@@ -290,3 +424,59 @@ func Flock(ctx Context, ino Ino, fh uint64, owner uint64, typ uint32, block bool
 	}
 	return
 }
+
+// Ioctl gets or sets the immutable and append-only flags of a node with FS_IOC_GETFLAGS and FS_IOC_SETFLAGS,
+// the flags are passed as an int or a long in native byte order. The go-fuse pinned in go.mod doesn't pass
+// FUSE_IOCTL to the file system, so it's not served by the FUSE mount until go-fuse is upgraded.
+func Ioctl(ctx Context, ino Ino, cmd uint32, in []byte, out []byte) (err syscall.Errno) {
+	defer func() { logit(ctx, "ioctl (%d,0x%X): %s", ino, cmd, strerr(err)) }()
+	if IsSpecialNode(ino) {
+		return syscall.ENOTTY
+	}
+	switch cmd {
+	case FS_IOC_GETFLAGS, FS_IOC32_GETFLAGS:
+		var attr Attr
+		if err = m.GetAttr(ctx, ino, &attr); err != 0 {
+			return
+		}
+		var flags uint32
+		if attr.Flags&meta.FlagImmutable != 0 {
+			flags |= FS_IMMUTABLE_FL
+		}
+		if attr.Flags&meta.FlagAppend != 0 {
+			flags |= FS_APPEND_FL
+		}
+		w := utils.NewNativeBuffer(out)
+		if len(out) >= 8 {
+			w.Put64(uint64(flags))
+		} else if len(out) >= 4 {
+			w.Put32(flags)
+		} else {
+			err = syscall.EINVAL
+		}
+	case FS_IOC_SETFLAGS, FS_IOC32_SETFLAGS:
+		var flags uint64
+		r := utils.NewNativeBuffer(in)
+		if len(in) >= 8 {
+			flags = r.Get64()
+		} else if len(in) >= 4 {
+			flags = uint64(r.Get32())
+		} else {
+			return syscall.EINVAL
+		}
+		if flags&^(FS_IMMUTABLE_FL|FS_APPEND_FL) != 0 {
+			return syscall.EOPNOTSUPP
+		}
+		var iflags uint8
+		if flags&FS_IMMUTABLE_FL != 0 {
+			iflags |= meta.FlagImmutable
+		}
+		if flags&FS_APPEND_FL != 0 {
+			iflags |= meta.FlagAppend
+		}
+		err = m.SetFlags(ctx, ino, iflags)
+	default:
+		err = syscall.ENOTTY
+	}
+	return
+}
@@ -86,7 +86,7 @@ func (j *juice) Statfs(path string, stat *fuse.Statfs_t) int {
 	ctx := j.newContext()
 	// defer trace(path)(stat)
 	var totalspace, availspace, iused, iavail uint64
-	j.fs.Meta().StatFS(ctx, &totalspace, &availspace, &iused, &iavail)
+	j.fs.Meta().StatFS(ctx, 1, &totalspace, &availspace, &iused, &iavail)
 	var bsize uint64 = 0x10000
 	blocks := totalspace / bsize
 	bavail := availspace / bsize
@@ -520,27 +520,36 @@ func (j *juice) Readdir(path string,
 		return
 	}
 	ctx := j.newContext()
-	entries, err := vfs.Readdir(ctx, ino, 100000, int(ofst), fh, true)
-	if err != 0 {
-		e = -int(err)
-		return
-	}
 	var st fuse.Stat_t
-	var ok bool
-	// remove the virtual accesslog
-	for _, e := range entries[:len(entries)-1] {
-		if e.Attr.Full {
-			vfs.UpdateLength(e.Inode, e.Attr)
-			attrToStat(e.Inode, e.Attr, &st)
-			ok = fill(string(e.Name), &st, 0)
-		} else {
-			ok = fill(string(e.Name), nil, 0)
+	// the entries are filled in one call, page by page
+	for off := int(ofst); ; {
+		entries, err := vfs.Readdir(ctx, ino, 100000, off, fh, true)
+		if err != 0 {
+			e = -int(err)
+			return
 		}
-		if !ok {
-			break
+		if len(entries) == 0 {
+			return
+		}
+		off += len(entries)
+		for _, e := range entries {
+			// hide the internal files
+			if vfs.IsSpecialNode(e.Inode) {
+				continue
+			}
+			var ok bool
+			if e.Attr.Full {
+				vfs.UpdateLength(e.Inode, e.Attr)
+				attrToStat(e.Inode, e.Attr, &st)
+				ok = fill(string(e.Name), &st, 0)
+			} else {
+				ok = fill(string(e.Name), nil, 0)
+			}
+			if !ok {
+				return
+			}
 		}
 	}
-	return
 }
 
 // Releasedir closes an open directory.
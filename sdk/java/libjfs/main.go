@@ -246,16 +246,8 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		}
 		utils.InitLoggers(false)
 
-		addr := jConf.MetaURL
-		if !strings.Contains(addr, "://") {
-			addr = "redis://" + addr
-		}
-		logger.Infof("Meta address: %s", addr)
-		var rc = meta.RedisConfig{Retries: 10, Strict: true}
-		m, err := meta.NewRedisMeta(addr, &rc)
-		if err != nil {
-			logger.Fatalf("Meta: %s", err)
-		}
+		metaConf := &meta.Config{Retries: 10, Strict: true, IORetries: 10}
+		m := meta.NewClient(jConf.MetaURL, metaConf)
 		format, err := m.Load()
 		if err != nil {
 			logger.Fatalf("load setting: %s", err)
@@ -309,9 +301,7 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		}
 
 		conf := &vfs.Config{
-			Meta: &meta.Config{
-				IORetries: 10,
-			},
+			Meta:      metaConf,
 			Format:    format,
 			Chunk:     &chunkConf,
 			AccessLog: jConf.AccessLog,
@@ -664,6 +654,19 @@ func jfs_utime(pid int, h uintptr, cpath *C.char, mtime, atime int64) int {
 	return errno(f.Utime(w.withPid(pid), atime, mtime))
 }
 
+//export jfs_setFlags
+func jfs_setFlags(pid int, h uintptr, cpath *C.char, flags uint8) int {
+	w := F(h)
+	if w == nil {
+		return -int(syscall.EINVAL)
+	}
+	f, err := w.Open(w.withPid(pid), C.GoString(cpath), 0)
+	if err != 0 {
+		return errno(err)
+	}
+	return errno(f.SetFlags(w.withPid(pid), flags))
+}
+
 //export jfs_setOwner
 func jfs_setOwner(pid int, h uintptr, cpath *C.char, owner *C.char, group *C.char) int {
 	w := F(h)
@@ -719,22 +722,29 @@ func jfs_listdir(pid int, h uintptr, cpath *C.char, offset int, buf uintptr, buf
 		}
 	}
 
-	es, err := f.ReaddirPlus(ctx, offset)
-	if err != 0 {
-		return errno(err)
-	}
-
 	wb := utils.NewNativeBuffer(toBuf(buf, bufsize))
-	for i, d := range es {
-		if wb.Left() < 1+len(d.Name)+1+130+8 {
-			wb.Put32(uint32(len(es) - i))
-			wb.Put32(uint32(nextFileHandle(f, w)))
-			return bufsize - wb.Left() - 8
+	// fill the buffer page by page, it's followed by a flag of more entries (the rest of the directory
+	// is not counted) and the handle to continue with, or zero when all the entries are filled
+	for {
+		es, err := f.ReaddirPlus(ctx, offset)
+		if err != 0 {
+			return errno(err)
+		}
+		if len(es) == 0 {
+			break
+		}
+		for _, d := range es {
+			if wb.Left() < 1+len(d.Name)+1+130+8 {
+				wb.Put32(1)
+				wb.Put32(uint32(nextFileHandle(f, w)))
+				return bufsize - wb.Left() - 8
+			}
+			wb.Put8(byte(len(d.Name)))
+			wb.Put(d.Name)
+			header := wb.Get(1)
+			header[0] = uint8(fill_stat(w, wb, fs.AttrToFileInfo(d.Inode, d.Attr)))
 		}
-		wb.Put8(byte(len(d.Name)))
-		wb.Put(d.Name)
-		header := wb.Get(1)
-		header[0] = uint8(fill_stat(w, wb, fs.AttrToFileInfo(d.Inode, d.Attr)))
+		offset += len(es)
 	}
 	wb.Put32(0)
 	return bufsize - wb.Left() - 4
@@ -26,6 +26,7 @@ import org.xeustechnologies.jcl.JclObjectFactory;
 import org.xeustechnologies.jcl.JclUtils;
 
 import java.io.IOException;
+import java.lang.reflect.InvocationTargetException;
 import java.net.URI;
 
 /****************************************************************
@@ -111,6 +112,22 @@ public class JuiceFileSystem extends FilterFileSystem {
     return st.getLen() > 0;
   }
 
+  /**
+   * Set the immutable and append-only flags of a file or directory, which can only be changed by the superuser.
+   */
+  public void setFlags(Path p, boolean immutable, boolean appendOnly) throws IOException {
+    // the implementation is loaded by another class loader
+    try {
+      fs.getClass().getMethod("setFlags", Path.class, boolean.class, boolean.class).invoke(fs, p, immutable, appendOnly);
+    } catch (InvocationTargetException e) {
+      if (e.getCause() instanceof IOException)
+        throw (IOException) e.getCause();
+      throw new IOException(e.getCause());
+    } catch (ReflectiveOperationException e) {
+      throw new IOException(e);
+    }
+  }
+
   @Override
   public FileChecksum getFileChecksum(Path f, long length) throws IOException {
     if (!fileChecksumEnabled)
@@ -153,6 +153,8 @@ public class JuiceFileSystemImpl extends FileSystem {
 
     int jfs_utime(long pid, long h, String path, long mtime, long atime);
 
+    int jfs_setFlags(long pid, long h, String path, byte flags);
+
     int jfs_chown(long pid, long h, String path);
 
     int jfs_listdir(long pid, long h, String path, int offset, Pointer buf, int size);
@@ -168,6 +170,10 @@ public class JuiceFileSystemImpl extends FileSystem {
     int jfs_removeXattr(long pid, long h, String path, String name);
   }
 
+  // the same as meta.FlagImmutable and meta.FlagAppend
+  static final byte FLAG_IMMUTABLE = 4;
+  static final byte FLAG_APPEND = 8;
+
   static int EPERM = -1;
   static int ENOENT = -2;
   static int EINTR = -0x4;
@@ -1358,8 +1364,9 @@ public class JuiceFileSystemImpl extends FileSystem {
         offset += 1 + size;
         j++;
       }
-      int left = buf.getInt(offset);
-      if (left == 0)
+      // non-zero if there are more entries to list with the handle following it
+      int more = buf.getInt(offset);
+      if (more == 0)
         break;
       int fd = buf.getInt(offset + 4);
       r = lib.jfs_listdir(Thread.currentThread().getId(), fd, path, j, buf, bufsize);
@@ -1527,6 +1534,22 @@ public class JuiceFileSystemImpl extends FileSystem {
       throw error(r, p);
   }
 
+  /**
+   * Set the immutable and append-only flags of a file or directory, which can only be changed by the superuser.
+   * An immutable file can't be changed, removed or renamed, and an append-only file can only be appended.
+   */
+  public void setFlags(Path p, boolean immutable, boolean appendOnly) throws IOException {
+    statistics.incrementWriteOps(1);
+    byte flags = 0;
+    if (immutable)
+      flags |= FLAG_IMMUTABLE;
+    if (appendOnly)
+      flags |= FLAG_APPEND;
+    int r = lib.jfs_setFlags(Thread.currentThread().getId(), handle, normalizePath(p), flags);
+    if (r != 0)
+      throw error(r, p);
+  }
+
   @Override
   public void close() throws IOException {
     super.close();